@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminHandler serves the local admin API.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/ca/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadCA(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		var ups []*upstreamStatus
+		for _, u := range upstreams {
+			ups = append(ups, u.status())
+		}
+		expiryLock.Lock()
+		status := struct {
+			Epoch      int64             `json:"config_epoch"`
+			Components []string          `json:"components"`
+			CA         *certExpiry       `json:"ca"`
+			Leaf       *certExpiry       `json:"soonest_leaf,omitempty"`
+			Upstreams  []*upstreamStatus `json:"upstreams"`
+			Warm       *warmStatus       `json:"warm_up,omitempty"`
+			Observe    interface{}       `json:"observe,omitempty"`
+			TLS        []tlsCount        `json:"tls"`
+			Families   []famStatus       `json:"families"`
+			Peer       *peerStatus       `json:"peer,omitempty"`
+			Clients    *clientsSummary   `json:"clients,omitempty"`
+			Caches     *cacheStatus      `json:"caches"`
+			Down       map[string]string `json:"components_down,omitempty"`
+			NeedsCA    []needsCA         `json:"needs_ca,omitempty"`
+		}{atomic.LoadInt64(&configEpoch), enabledComponents(), expiryCA, expiryLeaf, ups, warmProgress(), observeReport(), tlsReport(), famReport(), peer.status(), clientsStatus(), cacheReport(), sup.downReport(), needsCAReport()}
+		expiryLock.Unlock()
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("/debug/conns", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, liveConnInfos())
+	})
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/upgrade", upgradeHandler)
+	mux.HandleFunc("/shadow", shadowHandler)
+	mux.HandleFunc("/sticky", stickyHandler)
+	mux.HandleFunc("/breakers", breakersHandler)
+	mux.HandleFunc("/rules/export", exportHandler)
+	mux.HandleFunc("/rules/import", importHandler)
+	mux.HandleFunc("/rules/runtime", runtimeHandler)
+	mux.HandleFunc("/config", configHandler)
+	mux.HandleFunc("/peer/resolve", peerResolveHandler)
+	mux.HandleFunc("/peer/rules", peerRulesHandler)
+	mux.HandleFunc("/clients", clientsHandler)
+	mux.HandleFunc("/sightings", sightingsHandler)
+	mux.HandleFunc("/tls/needs-ca", needsCAHandler)
+	mux.HandleFunc("/zone", zoneHandler)
+	mux.HandleFunc("/certs/issued", issuedHandler)
+	mux.HandleFunc("/certs/", certsHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/shadow/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := promoteShadow(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	// what a view (default unless view= is given) does with name=, and the
+	// group the name belongs to
+	mux.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := normalizeHost(r.URL.Query().Get("name"))
+		if !ok {
+			http.Error(w, "name= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		vname := r.URL.Query().Get("view")
+		if vname == "" {
+			vname = "default"
+		}
+		v := viewByName(vname)
+		if v == nil {
+			http.Error(w, "no view "+vname, http.StatusNotFound)
+			return
+		}
+		res := struct {
+			Name  string    `json:"name"`
+			View  string    `json:"view"`
+			Group string    `json:"group,omitempty"`
+			Rule  *ruleInfo `json:"rule"`
+		}{Name: name, View: v.name, Group: groupFor(name)}
+		if ru := v.match(name); ru != nil {
+			res.Rule = ru.info()
+		}
+		writeJSON(w, res)
+	})
+	// all parsed rules of a view (default unless view= is given) in merge
+	// order, or with resolved=1 only the winning rule of every domain
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("view")
+		if name == "" {
+			name = "default"
+		}
+		v := viewByName(name)
+		if v == nil {
+			http.Error(w, "no view "+name, http.StatusNotFound)
+			return
+		}
+		var ret []*ruleInfo
+		if r.URL.Query().Get("resolved") == "1" {
+			for _, ru := range v.table {
+				ret = append(ret, ru.info())
+			}
+			sort.Slice(ret, func(i, j int) bool { return ret[i].Domain < ret[j].Domain })
+		} else {
+			for _, ru := range v.dump {
+				ret = append(ret, ru.info())
+			}
+		}
+		writeJSON(w, ret)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug(err)
+	}
+}
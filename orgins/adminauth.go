@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	adminPair     atomic.Value // *tls.Certificate from adminCert and adminKey, if set
+	adminClients  atomic.Value // *x509.CertPool from adminClientCA
+	adminRefusals = metricCounter("admin_auth_failures_total")
+)
+
+// adminRemote reports whether adminAddr is reachable beyond loopback, and
+// so needs TLS with client certificates.
+func adminRemote() bool {
+	host, _, err := net.SplitHostPort(currentSettings().adminAddr)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return host != "localhost" && (ip == nil || !ip.IsLoopback())
+}
+
+// loadAdminTLS reads the admin cert pair and client CA. Called at setup and
+// with every CA reload, so they rotate with it.
+func loadAdminTLS() error {
+	if !adminRemote() {
+		return nil
+	}
+	if adminClientCA == "" {
+		return errors.New("adminAddr " + currentSettings().adminAddr + " isn't loopback, adminClientCA is needed")
+	}
+	data, err := ioutil.ReadFile(adminClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New(adminClientCA + ": no certificates")
+	}
+	if adminCert != "" {
+		pair, err := tls.LoadX509KeyPair(adminCert, adminKey)
+		if err != nil {
+			return err
+		}
+		adminPair.Store(&pair)
+	}
+	adminClients.Store(pool)
+	return nil
+}
+
+// adminTLSConfig is what the admin listener serves with when adminRemote:
+// our cert, and a client certificate from adminClientCA required of everyone.
+func adminTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	c := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if pair, ok := adminPair.Load().(*tls.Certificate); ok {
+				return pair, nil
+			}
+			return cachedLeaf(adminName, atomic.LoadUint64(&suffixGen), false, "admin")
+		},
+		KeyLogWriter: keyLog,
+	}
+	requireAdminClient(c, hello.Conn.RemoteAddr())
+	return c, nil
+}
+
+// requireAdminClient makes c fail the handshake of peer unless it presents
+// a certificate from adminClientCA.
+func requireAdminClient(c *tls.Config, peer net.Addr) {
+	// verified here rather than by crypto/tls, so refusals can be logged
+	c.ClientAuth = tls.RequestClientCert
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := verifyAdminClient(cs.PeerCertificates)
+		if err != nil {
+			atomic.AddInt64(adminRefusals, 1)
+			logThrottled.Warnf("admin "+peer.String(), "admin: %s refused: %s", peer, err)
+		}
+		return err
+	}
+}
+
+func verifyAdminClient(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         adminClients.Load().(*x509.CertPool),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// adminListener wraps l in TLS with client authentication when adminRemote.
+func adminListener(l net.Listener) net.Listener {
+	if !adminRemote() {
+		return l
+	}
+	log.Infof("admin API on %s over TLS, clients need a certificate from %s", currentSettings().adminAddr, adminClientCA)
+	return tls.NewListener(l, &tls.Config{GetConfigForClient: adminTLSConfig})
+}
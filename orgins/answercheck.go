@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// poisonAddrs lists IPs and CIDRs known to be injected for censored names;
+// answers made of nothing else are discarded like bogons.
+var poisonAddrs = []string{}
+
+var poisonNets []*net.IPNet // parsed poisonAddrs, no async r & w so ok
+
+var (
+	errPoisoned = errors.New("only known poison addresses")
+	errDisagree = errors.New("upstreams disagree")
+)
+
+// insaneAnswer is why an upstream answer was discarded.
+type insaneAnswer string
+
+func (e insaneAnswer) Error() string { return "insane answer: " + string(e) }
+
+func parsePoisonAddrs() error {
+	for _, a := range poisonAddrs {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return errors.New("poisonAddrs: " + err.Error())
+		}
+		poisonNets = append(poisonNets, n)
+	}
+	return nil
+}
+
+// saneAddrs returns the addresses r answers q with, once it's sure r is
+// the answer to q: same ID and question. Records owned by a name that isn't
+// q's or reached from it by a CNAME of the answer, or not of q's type, are
+// discarded; injectors don't always get those right.
+func saneAddrs(q, r *dns.Msg) ([]net.IP, error) {
+	want := q.Question[0]
+	switch {
+	case r.Id != q.Id:
+		return nil, countInsane("id-mismatch")
+	case len(r.Question) != 1, !strings.EqualFold(r.Question[0].Name, want.Name),
+		r.Question[0].Qtype != want.Qtype, r.Question[0].Qclass != want.Qclass:
+		return nil, countInsane("question-mismatch")
+	}
+
+	names := map[string]bool{strings.ToLower(want.Name): true}
+	for grew := true; grew; {
+		grew = false
+		for _, rr := range r.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && names[strings.ToLower(c.Hdr.Name)] && !names[strings.ToLower(c.Target)] {
+				names[strings.ToLower(c.Target)] = true
+				grew = true
+			}
+		}
+	}
+	var ret []net.IP
+	foreign := 0
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		if rr.Header().Rrtype != want.Qtype || !names[strings.ToLower(rr.Header().Name)] {
+			foreign++
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	if foreign > 0 {
+		metricAdd(metricName("dns_insane_answers_total", "reason", "foreign-record"), int64(foreign))
+	}
+	return ret, nil
+}
+
+func countInsane(reason string) error {
+	metricAdd(metricName("dns_insane_answers_total", "reason", reason), 1)
+	return insaneAnswer(reason)
+}
+
+// dropPoisoned filters out poisonAddrs, returning errPoisoned if nothing
+// is left.
+func dropPoisoned(host string, addrs []*Resolv) ([]*Resolv, error) {
+	if len(poisonNets) == 0 {
+		return addrs, nil
+	}
+	var ret []*Resolv
+	for _, a := range addrs {
+		h, _, _ := net.SplitHostPort(a.addr)
+		if ip := net.ParseIP(h); ip != nil && inNets(ip, poisonNets) {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	if len(ret) == 0 {
+		logThrottled.Warnf(host, "%s: answered only known poison addresses, e.g. %s", host, addrs[0].addr)
+		metricAdd(metricName("dial_failures_total", "kind", "poisoned"), 1)
+		return nil, errPoisoned
+	}
+	return ret, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// agreed keeps the addrs of a that b has too, for paranoid rules: two
+// independent resolvers naming the same address are unlikely to both be
+// poisoned. errDisagree if there are none.
+func agreed(host string, a, b []*Resolv) ([]*Resolv, error) {
+	seen := make(map[string]bool)
+	for _, r := range b {
+		seen[r.addr] = true
+	}
+	var ret []*Resolv
+	for _, r := range a {
+		if seen[r.addr] {
+			ret = append(ret, r)
+		}
+	}
+	if len(ret) == 0 {
+		logThrottled.Warnf(host, "%s: %s and %s share no address, not using either", host, gfwResolver, paranoidResolver)
+		metricAdd(metricName("dial_failures_total", "kind", "disagreed"), 1)
+		return nil, errDisagree
+	}
+	return ret, nil
+}
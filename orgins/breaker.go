@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// breaker states
+const (
+	breakerClosed   = "closed"    // connections go through, failures counted
+	breakerOpen     = "open"      // refused until the backoff ends
+	breakerHalfOpen = "half-open" // one probe let through, the rest refused
+)
+
+// breaker is the circuit breaker of one host: after breakerFailures failed
+// connections in a row, none more than breakerWindow after the first, new
+// ones are refused before anything is resolved or dialed. Each host has its
+// own, so one failing can't hold up another.
+type breaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int      // in a row
+	first    deadline // end of the window the failures count in
+	until    deadline // end of the backoff while open, of the probe while half-open
+	backoff  time.Duration
+	probing  bool
+	lastFail string // failure kind, for /breakers
+}
+
+var (
+	breakers       sync.Map // host -> *breaker
+	breakersOpen   int64
+	breakerSwept   int64 // deadline of the next sweep of stale breakers
+	breakerRefused = metricCounter("breaker_refused_total")
+)
+
+// breakerAllows reports whether a connection for host may be dialed: always
+// while its breaker is closed, never while open, and once the backoff ended
+// for a single probe, whose result decides whether it closes. A probe with
+// no result within breakerWindow, its client having given up, is replaced.
+func breakerAllows(host string) bool {
+	if breakerFailures <= 0 {
+		return true
+	}
+	val, ok := breakers.Load(host)
+	if !ok {
+		return true
+	}
+	b := val.(*breaker)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerClosed:
+		return true
+	case b.until.passed():
+		b.state, b.probing, b.until = breakerHalfOpen, true, expireIn(breakerWindow)
+		log.Infof("%s: circuit half-open, letting a probe through", host)
+		return true
+	}
+	atomic.AddInt64(breakerRefused, 1)
+	return false
+}
+
+// breakerRecord notes how a connection for host went, failed being its
+// failure kind or "" if the upstream was reached.
+func breakerRecord(host, failed string) {
+	if breakerFailures <= 0 {
+		return
+	}
+	if failed == "" {
+		if _, wasOpen := dropBreaker(host); wasOpen {
+			log.Infof("%s: circuit closed, the probe got through", host)
+			emit(evBreakerClosed, map[string]interface{}{"host": host})
+		}
+		return
+	}
+	sweepBreakers()
+	val, _ := breakers.LoadOrStore(host, &breaker{state: breakerClosed})
+	b := val.(*breaker)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastFail = failed
+	switch b.state {
+	case breakerHalfOpen:
+		if !b.probing {
+			return
+		}
+		b.probing = false
+		b.backoff *= 2
+		if b.backoff > breakerMaxOpen {
+			b.backoff = breakerMaxOpen
+		}
+		b.state, b.until = breakerOpen, expireIn(b.backoff)
+		log.Warnf("%s: probe failed with %s, circuit open for %s", host, failed, b.backoff)
+		return
+	case breakerOpen:
+		return // dialed before it opened
+	}
+	if b.failures == 0 || b.first.passed() {
+		b.failures, b.first = 0, expireIn(breakerWindow)
+	}
+	b.failures++
+	if b.failures < breakerFailures {
+		return
+	}
+	b.state, b.backoff = breakerOpen, breakerOpenFor
+	b.until = expireIn(b.backoff)
+	metricAdd("breaker_opened_total", 1)
+	metricSet("breakers_open", atomic.AddInt64(&breakersOpen, 1))
+	log.Warnf("%s: %d connections failed in a row, last with %s, circuit open for %s", host, b.failures, failed, b.backoff)
+	emit(evBreakerOpened, map[string]interface{}{"host": host, "failures": b.failures, "last_failure": failed})
+}
+
+// sweepBreakers drops closed breakers whose failures are too old to count,
+// at most once per breakerWindow, so hosts that failed once and were never
+// asked for again don't pile up.
+func sweepBreakers() {
+	next := atomic.LoadInt64(&breakerSwept)
+	if !deadline(next).passed() || !atomic.CompareAndSwapInt64(&breakerSwept, next, int64(expireIn(breakerWindow))) {
+		return
+	}
+	breakers.Range(func(key, val interface{}) bool {
+		b := val.(*breaker)
+		b.mu.Lock()
+		if b.state == breakerClosed && b.first.passed() {
+			breakers.CompareAndDelete(key, b)
+		}
+		b.mu.Unlock()
+		return true
+	})
+}
+
+// dropBreaker forgets the breaker of host, closing its circuit, and
+// reports whether it had one and whether it was open.
+func dropBreaker(host string) (had, wasOpen bool) {
+	val, ok := breakers.LoadAndDelete(host)
+	if !ok {
+		return false, false
+	}
+	b := val.(*breaker)
+	b.mu.Lock()
+	wasOpen = b.state != breakerClosed
+	b.mu.Unlock()
+	if wasOpen {
+		metricSet("breakers_open", atomic.AddInt64(&breakersOpen, -1))
+	}
+	return true, wasOpen
+}
+
+// breakerInfo is the /breakers view of a breaker.
+type breakerInfo struct {
+	Host        string     `json:"host"`
+	State       string     `json:"state"`
+	Failures    int        `json:"failures"`
+	LastFailure string     `json:"last_failure"`
+	OpenUntil   *time.Time `json:"open_until,omitempty"`
+	Backoff     string     `json:"backoff,omitempty"`
+}
+
+// breakersHandler serves /breakers: GET lists the hosts with failures or
+// an open circuit, DELETE host= closes the circuit of host.
+func breakersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ret := []breakerInfo{}
+		breakers.Range(func(key, val interface{}) bool {
+			b := val.(*breaker)
+			b.mu.Lock()
+			info := breakerInfo{Host: key.(string), State: b.state, Failures: b.failures, LastFailure: b.lastFail}
+			if b.state != breakerClosed {
+				until := b.until.wall()
+				info.OpenUntil, info.Backoff = &until, b.backoff.String()
+			}
+			b.mu.Unlock()
+			ret = append(ret, info)
+			return true
+		})
+		sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+		writeJSON(w, ret)
+	case http.MethodDelete:
+		host, ok := normalizeHost(r.URL.Query().Get("host"))
+		if !ok {
+			http.Error(w, "host= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		if had, _ := dropBreaker(host); !had {
+			http.Error(w, host+" has no breaker", http.StatusNotFound)
+			return
+		}
+		log.Infof("%s: circuit reset through the admin API", host)
+		_, _ = w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, "GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// caPair is the root CA the proxy forges certificates from. It is swapped as a
+// whole on reload, so a handshake always sees a matching cert and key.
+type caPair struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var (
+	caCur atomic.Value // *caPair
+	// caGen is bumped as a CA is reloaded, with the issuer reset under
+	// issuerLock, so a leaf minted from the CA before isn't cached after
+	caGen uint64
+)
+
+func currentCA() *caPair {
+	return caCur.Load().(*caPair)
+}
+
+func loadCA() (*caPair, error) {
+	certPEMBlock, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, err
+	}
+	certDERBlock, _ := pem.Decode(certPEMBlock)
+	if certDERBlock == nil {
+		return nil, errors.New("no PEM data in " + caCert)
+	}
+	cert, err := x509.ParseCertificate(certDERBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := caKeys.signer(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// a half-written pair must never replace a working one
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("CA key does not match CA cert")
+	}
+	if _, ok := caKeys.(*tokenKey); ok {
+		// its public half is the cert's, only a signature tells
+		if err := proveKey(cert, key); err != nil {
+			return nil, err
+		}
+	}
+	if !cert.IsCA {
+		return nil, errors.New("CA cert is not a CA")
+	}
+	return &caPair{cert: cert, key: key}, nil
+}
+
+// proveKey checks key makes signatures cert verifies.
+func proveKey(cert *x509.Certificate, key crypto.Signer) error {
+	digest := sha256.Sum256([]byte("sni proxy CA key check"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return errors.New("the token's key does not match CA cert, check object= or id=")
+	}
+	return nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+	return signer, nil
+}
+
+// reloadCA swaps in the CA files from disk if they are valid. Cached leaves
+// are dropped unless keepLeavesOnCaReload, then they live out their validity.
+func reloadCA() error {
+	ca, err := loadCA()
+	if err != nil {
+		return err
+	}
+	issuerLock.Lock()
+	caCur.Store(ca)
+	atomic.AddUint64(&caGen, 1)
+	curIssuer = nil
+	issuerLock.Unlock()
+	if !keepLeavesOnCaReload {
+		cacheCert.Range(func(k, _ interface{}) bool {
+			cacheCert.Delete(k)
+			return true
+		})
+	}
+	log.Infof("CA reloaded: %s, valid until %s", ca.cert.Subject.CommonName, ca.cert.NotAfter.Format(time.RFC3339))
+	if err := loadAdminTLS(); err != nil {
+		log.Errorf("admin TLS not reloaded: %s", err)
+	}
+	checkExpiry()
+	warmLeaves()
+	return nil
+}
+
+func pollingCAChange() {
+	files := append([]string{caCert}, caKeys.watched()...)
+	stat := func() []os.FileInfo {
+		ret := make([]os.FileInfo, len(files))
+		for i, f := range files {
+			ret[i], _ = os.Stat(f)
+		}
+		return ret
+	}
+	last := stat()
+	go func() {
+		for {
+			time.Sleep(pollInterval)
+
+			cur := stat()
+			changed := false
+			for i := range cur {
+				changed = changed || fileChanged(cur[i], last[i])
+			}
+			if !changed {
+				continue
+			}
+			last = cur
+			if err := reloadCA(); err != nil {
+				log.Errorf("CA files changed but not reloaded: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// caKeySource is where the CA private key comes from, picked by
+// caKeyBackend. Whatever it is, leaves are signed through the crypto.Signer
+// it hands out, which for a token never leaves it: cached leaves, warmUp
+// and useIntermediate keep it from being asked for every handshake.
+type caKeySource interface {
+	// signer unlocks the key of cert; what goes wrong is said with what to
+	// do about it
+	signer(cert *x509.Certificate) (crypto.Signer, error)
+	// watched are the files whose changing means the key is to be read again
+	watched() []string
+}
+
+var caKeys caKeySource
+
+// setupCAKey picks the caKeySource of caKeyBackend.
+func setupCAKey() error {
+	switch caKeyBackend {
+	case "file":
+		caKeys = fileKey(caKey)
+	case "encrypted":
+		caKeys = &encryptedKey{path: caKey, passphrase: caKeyPassphrase}
+	case "pkcs11":
+		u, err := parsePKCS11URI(caKey)
+		if err != nil {
+			return fmt.Errorf("caKey: %s", err)
+		}
+		if deterministicSerials && !useIntermediate {
+			return errors.New("deterministicSerials derives serials from the CA key, which the token won't hand out: set useIntermediate, whose key is in memory, or turn deterministicSerials off")
+		}
+		caKeys = &tokenKey{uri: u}
+	default:
+		return fmt.Errorf("unknown caKeyBackend %q, needs to be file, encrypted or pkcs11", caKeyBackend)
+	}
+	return nil
+}
+
+// readKeyPEM is the first PEM block of path.
+func readKeyPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	return block, nil
+}
+
+// fileKey is a plaintext PEM key file.
+type fileKey string
+
+func (k fileKey) signer(*x509.Certificate) (crypto.Signer, error) {
+	block, err := readKeyPEM(string(k))
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("%s is encrypted, set caKeyBackend to encrypted", k)
+	}
+	return parsePrivateKey(block.Bytes)
+}
+
+func (k fileKey) watched() []string { return []string{string(k)} }
+
+// encryptedKey is a PEM key file encrypted with a passphrase: PKCS#8 with
+// PBES2, as openssl pkcs8 -topk8 -v2 aes-256-cbc writes it, or the older
+// kind with Proc-Type and DEK-Info headers. The passphrase is read once,
+// from secretFrom(passphrase), and kept for when the file changes.
+type encryptedKey struct {
+	path, passphrase string
+
+	mu   sync.Mutex
+	pass []byte
+}
+
+func (k *encryptedKey) signer(*x509.Certificate) (crypto.Signer, error) {
+	block, err := readKeyPEM(k.path)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pass == nil {
+		pass, err := secretFrom(k.passphrase, "passphrase of "+k.path)
+		if err != nil {
+			return nil, err
+		}
+		k.pass = pass
+	}
+	var der []byte
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		der, err = decryptPKCS8(block.Bytes, k.pass)
+	case x509.IsEncryptedPEMBlock(block):
+		der, err = x509.DecryptPEMBlock(block, k.pass)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			err = errPassphrase
+		}
+	default:
+		return nil, fmt.Errorf("%s isn't encrypted, set caKeyBackend to file or encrypt it: openssl pkcs8 -topk8 -v2 aes-256-cbc -in %s", k.path, k.path)
+	}
+	if errors.Is(err, errPassphrase) {
+		k.pass = nil // asked for again on the next try
+		return nil, fmt.Errorf("%s: wrong passphrase from %s", k.path, k.passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", k.path, err)
+	}
+	return parsePrivateKey(der)
+}
+
+func (k *encryptedKey) watched() []string { return []string{k.path} }
+
+var errPassphrase = errors.New("wrong passphrase")
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	// AES-CBC by key size
+	aesCBC = map[string]int{"2.16.840.1.101.3.4.1.2": 16, "2.16.840.1.101.3.4.1.22": 24, "2.16.840.1.101.3.4.1.42": 32}
+)
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo, RFC 5958, encrypted
+// with PBES2 from PBKDF2 and AES-CBC, RFC 8018: what OpenSSL writes. A
+// wrong passphrase is errPassphrase, as the padding tells, almost always.
+func decryptPKCS8(der, pass []byte) ([]byte, error) {
+	var info struct {
+		Algo pkix.AlgorithmIdentifier
+		Data []byte
+	}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("encrypted with %s, only PBES2 is understood", info.Algo.Algorithm)
+	}
+	var params struct{ KDF, Cipher pkix.AlgorithmIdentifier }
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("key derived with %s, only PBKDF2 is understood", params.KDF.Algorithm)
+	}
+	var kdf struct {
+		Salt       []byte
+		Iterations int
+		KeyLength  int                      `asn1:"optional"`
+		PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	h := sha1.New
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		h = sha256.New
+	default:
+		return nil, fmt.Errorf("PBKDF2 with %s, only HMAC-SHA1 and HMAC-SHA256 are understood", kdf.PRF.Algorithm)
+	}
+	size, ok := aesCBC[params.Cipher.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("encrypted with %s, only AES-CBC is understood", params.Cipher.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("no AES IV")
+	}
+	if len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted key isn't whole AES blocks")
+	}
+	block, err := aes.NewCipher(pbkdf2Key(pass, kdf.Salt, kdf.Iterations, size, h))
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.Data)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errPassphrase
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// pbkdf2Key is PBKDF2 of RFC 8018 with the HMAC of h.
+func pbkdf2Key(pass, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, pass)
+	var out []byte
+	for n := uint32(1); len(out) < keyLen; n++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// secretFrom reads the passphrase or PIN src says, what being what it's
+// for in errors and the prompt:
+//
+//	env:NAME   the environment variable NAME, unset once read
+//	file:PATH  the first line of PATH
+//	cred:NAME  the systemd credential NAME, LoadCredential= in the unit
+//	prompt     asked for on the terminal
+func secretFrom(src, what string) ([]byte, error) {
+	kind, arg := src, ""
+	if i := strings.IndexByte(src, ':'); i >= 0 {
+		kind, arg = src[:i], src[i+1:]
+	}
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s is read from $%s, which isn't set", what, arg)
+		}
+		_ = os.Unsetenv(arg)
+		return []byte(v), nil
+	case "cred":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("%s is the systemd credential %s, but there's no $CREDENTIALS_DIRECTORY: add LoadCredential=%s:/path to the unit", what, arg, arg)
+		}
+		return firstLine(filepath.Join(dir, arg), what)
+	case "file":
+		return firstLine(arg, what)
+	case "prompt":
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return nil, fmt.Errorf("%s is to be prompted for, but there's no terminal: read it from env:, file: or cred: instead", what)
+		}
+		fmt.Fprintf(os.Stderr, "%s: ", what)
+		pass, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	}
+	return nil, fmt.Errorf("%s is read from %q, which needs to be env:NAME, file:PATH, cred:NAME or prompt", what, src)
+}
+
+func firstLine(path, what string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", what, err)
+	}
+	defer func() { _ = f.Close() }()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("%s: %s is empty", what, path)
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// pkcs11URI names a key in a token, RFC 7512:
+//
+//	pkcs11:token=YubiHSM;object=sni-ca?module-path=/usr/lib/pkcs11/yubihsm_pkcs11.so&pin-source=cred:hsm-pin
+//
+// token, object, id and slot-id pick the key, any left out matching all;
+// module-path is the module to load; pin-source is where the PIN is read,
+// as secretFrom takes it, or pin-value the PIN itself.
+type pkcs11URI struct {
+	module        string
+	token, object string
+	id            []byte
+	slot          int // -1 for any
+	pin           string
+}
+
+func parsePKCS11URI(s string) (*pkcs11URI, error) {
+	if !strings.HasPrefix(s, "pkcs11:") {
+		return nil, fmt.Errorf("%q isn't a pkcs11: URI", s)
+	}
+	path, query := strings.TrimPrefix(s, "pkcs11:"), ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	u := &pkcs11URI{slot: -1}
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		eq := strings.IndexByte(attr, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%q in %s isn't name=value", attr, s)
+		}
+		v, err := url.PathUnescape(attr[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		switch attr[:eq] {
+		case "token":
+			u.token = v
+		case "object":
+			u.object = v
+		case "id":
+			u.id = []byte(v)
+		case "slot-id":
+			if u.slot, err = strconv.Atoi(v); err != nil || u.slot < 0 {
+				return nil, fmt.Errorf("slot-id %q isn't a number", v)
+			}
+		case "type":
+			if v != "private" {
+				return nil, fmt.Errorf("type=%s, the CA key is a private one", v)
+			}
+		}
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	u.module = q.Get("module-path")
+	if u.module == "" {
+		return nil, errors.New("needs module-path=, the PKCS#11 module of the token, such as /usr/lib/pkcs11/yubihsm_pkcs11.so")
+	}
+	switch {
+	case q.Get("pin-value") != "":
+		u.pin = "value:" + q.Get("pin-value")
+	case q.Get("pin-source") != "":
+		u.pin = q.Get("pin-source")
+	default:
+		return nil, errors.New("needs pin-source= or pin-value=, the token's PIN")
+	}
+	return u, nil
+}
+
+// tokenPIN is the PIN of u.
+func (u *pkcs11URI) tokenPIN() ([]byte, error) {
+	if strings.HasPrefix(u.pin, "value:") {
+		return []byte(strings.TrimPrefix(u.pin, "value:")), nil
+	}
+	return secretFrom(u.pin, "PIN of token "+u.token)
+}
+
+// tokenKey is a key in a PKCS#11 token, logged in to once and kept open:
+// a token unplugged takes a restart.
+type tokenKey struct {
+	uri *pkcs11URI
+
+	mu   sync.Mutex
+	open crypto.Signer
+}
+
+func (k *tokenKey) signer(cert *x509.Certificate) (crypto.Signer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.open == nil {
+		s, err := openToken(k.uri, cert.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		k.open = s
+	}
+	return k.open, nil
+}
+
+func (k *tokenKey) watched() []string { return nil }
+
+// redactKeyURI is caKey for /config, a PIN in it masked.
+func redactKeyURI(s string) string {
+	i := strings.IndexByte(s, '?')
+	if !strings.HasPrefix(s, "pkcs11:") || i < 0 {
+		return s
+	}
+	q, err := url.ParseQuery(s[i+1:])
+	if err != nil {
+		return s[:i] + "?redacted"
+	}
+	if q.Get("pin-value") != "" {
+		q.Set("pin-value", "redacted")
+	}
+	return s[:i+1] + q.Encode()
+}
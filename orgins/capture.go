@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// capture tees the decrypted streams of one connection of a rule with the
+// capture option into files under captureDir:
+//
+//	<time>-<conn>-<host>.up    what the client sent
+//	<time>-<conn>-<host>.down  what the upstream sent
+//	<time>-<conn>-<host>.json  captureMeta
+//
+// conn being the connection's ID in the logs. The relay never waits for
+// the disk: each direction is written by a goroutine of its own from at
+// most captureQueue bytes, and what doesn't fit is left out of the file
+// and listed in Gaps.
+type capture struct {
+	base string
+	log  *log.Entry
+
+	mu       sync.Mutex // the relay may still be writing when it's closed
+	up, down *captureSink
+	meta     captureMeta
+}
+
+type captureMeta struct {
+	Conn        string       `json:"conn"`
+	SNI         string       `json:"sni"`
+	Upstream    string       `json:"upstream"`
+	ALPN        string       `json:"alpn,omitempty"`
+	Start       time.Time    `json:"start"`
+	End         time.Time    `json:"end"`
+	Up          int64        `json:"up"` // bytes in the file
+	Down        int64        `json:"down"`
+	UpDropped   int64        `json:"up_dropped,omitempty"`
+	DownDropped int64        `json:"down_dropped,omitempty"`
+	Gaps        []captureGap `json:"gaps,omitempty"` // the first captureMaxGaps
+	Closed      string       `json:"closed"`
+}
+
+// captureGap is a run of bytes relayed but not captured: Bytes of them at
+// offset At of the stream of direction Dir.
+type captureGap struct {
+	Dir   string `json:"dir"`
+	At    int64  `json:"at"`
+	Bytes int64  `json:"bytes"`
+}
+
+const captureMaxGaps = 100
+
+// captureSink writes one direction of a capture to its file.
+type captureSink struct {
+	dir     string
+	f       io.WriteCloser
+	ch      chan []byte
+	done    chan struct{}
+	queued  int64 // bytes in ch
+	written int64
+	failed  int32
+
+	// under capture.mu
+	offered int64 // bytes relayed so far, captured or not
+	dropped int64
+	gapEnd  int64 // where the last gap ended, to extend it
+	closed  bool
+}
+
+func newCaptureSink(dir string, f io.WriteCloser, clog *log.Entry) *captureSink {
+	s := &captureSink{dir: dir, f: f, ch: make(chan []byte, 1024), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for b := range s.ch {
+			if atomic.LoadInt32(&s.failed) == 0 {
+				if _, err := f.Write(b); err != nil {
+					clog.Errorf("capture: %s", err)
+					atomic.StoreInt32(&s.failed, 1)
+				} else {
+					atomic.AddInt64(&s.written, int64(len(b)))
+				}
+			}
+			atomic.AddInt64(&s.queued, -int64(len(b)))
+		}
+		if err := f.Close(); err != nil {
+			clog.Error(err)
+		}
+	}()
+	return s
+}
+
+// offer queues a copy of p for the file, or drops it if the queue is full.
+// Called with capture.mu held.
+func (s *captureSink) offer(c *capture, p []byte) {
+	at := s.offered
+	s.offered += int64(len(p))
+	if s.closed || atomic.LoadInt32(&s.failed) != 0 {
+		return // the capture of this direction is over
+	}
+	if atomic.LoadInt64(&s.queued)+int64(len(p)) <= captureQueue {
+		b := append([]byte(nil), p...)
+		select {
+		case s.ch <- b:
+			atomic.AddInt64(&s.queued, int64(len(b)))
+			return
+		default:
+		}
+	}
+	s.dropped += int64(len(p))
+	metricAdd("capture_dropped_bytes_total", int64(len(p)))
+	gaps := c.meta.Gaps
+	if last := len(gaps) - 1; last >= 0 && gaps[last].Dir == s.dir && s.gapEnd == at {
+		gaps[last].Bytes += int64(len(p))
+	} else if len(gaps) < captureMaxGaps {
+		c.meta.Gaps = append(gaps, captureGap{s.dir, at, int64(len(p))})
+		logThrottled.Warnf("capture "+c.base, "capture: %s: disk behind, dropping %s bytes from %d", c.base, s.dir, at)
+	}
+	s.gapEnd = at + int64(len(p))
+}
+
+// close waits for what's queued to be written, at most captureQueue bytes.
+func (s *captureSink) close() {
+	close(s.ch)
+	<-s.done
+}
+
+var pruneLock sync.Mutex
+
+// startCapture opens the files for a capture of host, nil if they can't be.
+func startCapture(id, host, alpn string) *capture {
+	clog := log.WithField("conn", id)
+	if err := os.MkdirAll(captureDir, 0700); err != nil {
+		clog.Errorf("capture: %s", err)
+		return nil
+	}
+	now := time.Now()
+	c := &capture{
+		base: filepath.Join(captureDir, fmt.Sprintf("%s-%s-%s", now.Format("20060102T150405.000000000"), id, host)),
+		log:  clog,
+		meta: captureMeta{Conn: id, SNI: host, ALPN: alpn, Start: now},
+	}
+	up, err := os.OpenFile(c.base+".up", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		clog.Errorf("capture: %s", err)
+		return nil
+	}
+	down, err := os.OpenFile(c.base+".down", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		clog.Errorf("capture: %s", err)
+		_ = up.Close()
+		return nil
+	}
+	c.up, c.down = newCaptureSink("up", up, clog), newCaptureSink("down", down, clog)
+	clog.Warnf("%s: CAPTURING decrypted traffic to %s.*", host, c.base)
+	return c
+}
+
+// teeWriter writes to w, then offers what was written to the capture.
+// Capture errors never affect the relay, they just end the capture of that
+// direction; a slow disk makes gaps rather than a slow relay.
+type teeWriter struct {
+	w io.Writer
+	c *capture
+	s *captureSink
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n == 0 {
+		return n, err
+	}
+	t.c.mu.Lock()
+	t.s.offer(t.c, p[:n])
+	t.c.mu.Unlock()
+	return n, err
+}
+
+func (c *capture) teeUp(w io.Writer) io.Writer {
+	return &teeWriter{w: w, c: c, s: c.up}
+}
+
+func (c *capture) teeDown(w io.Writer) io.Writer {
+	return &teeWriter{w: w, c: c, s: c.down}
+}
+
+// close writes the metadata, then prunes captureDir.
+func (c *capture) close(upstream, closed string) {
+	data, err := c.finish(upstream, closed)
+	if err == nil {
+		err = ioutil.WriteFile(c.base+".json", data, 0600)
+	}
+	if err != nil {
+		c.log.Errorf("capture: %s", err)
+	}
+	pruneCaptures()
+}
+
+// finish ends the capture once what's queued is written and returns the
+// metadata.
+func (c *capture) finish(upstream, closed string) ([]byte, error) {
+	c.mu.Lock()
+	c.up.closed, c.down.closed = true, true
+	c.mu.Unlock()
+	// no more offers now, the writers only drain their queues
+	c.up.close()
+	c.down.close()
+
+	c.mu.Lock()
+	c.meta.Up, c.meta.Down = atomic.LoadInt64(&c.up.written), atomic.LoadInt64(&c.down.written)
+	c.meta.UpDropped, c.meta.DownDropped = c.up.dropped, c.down.dropped
+	c.meta.Upstream, c.meta.Closed, c.meta.End = upstream, closed, time.Now()
+	defer c.mu.Unlock()
+	return json.MarshalIndent(&c.meta, "", "  ")
+}
+
+// pruneCaptures deletes the oldest captures until captureDir fits in
+// captureMaxBytes. Names start with the time, so they sort by age.
+func pruneCaptures() {
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+
+	files, err := ioutil.ReadDir(captureDir)
+	if err != nil {
+		log.Errorf("capture: %s", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		if total <= captureMaxBytes {
+			break
+		}
+		if !strings.HasSuffix(f.Name(), ".up") && !strings.HasSuffix(f.Name(), ".down") &&
+			!strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(captureDir, f.Name())); err != nil {
+			log.Error(err)
+			continue
+		}
+		total -= f.Size()
+	}
+}
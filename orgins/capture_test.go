@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// slowClientGrowth is how much more memory than at the start relaying to
+// a slow client may take before TestSlowClient fails.
+const slowClientGrowth = 64 << 20
+
+// TestSlowClient relays a GiB from a loopback origin sending as fast as it
+// can to a client reading at a hundredth of the speed copying manages,
+// through the copy engine and a capture tee whose disk is slower still.
+// The process mustn't grow by slowClientGrowth, and the capture has to
+// have gaps to show for the disk it couldn't keep up with.
+func TestSlowClient(t *testing.T) {
+	if testing.Short() {
+		t.Skip("relays a GiB at a crawl")
+	}
+	const size = 1 << 30
+	buf := make([]byte, 256<<10)
+
+	// how fast copying goes here, on a tenth of it
+	began := time.Now()
+	_, down, err := loopRelay(relayEngines()["copy"], func(c net.Conn) {
+		for sent := 0; sent < size/10; sent += len(buf) {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}, func(c net.Conn) error {
+		_, err := io.Copy(ioutil.Discard, c)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := float64(down) / time.Since(began).Seconds() / 100
+
+	c := &capture{base: "slow-client", log: log.WithField("conn", "slow-client")}
+	// the disk takes a tenth of what the client does
+	c.up = newCaptureSink("up", nopWriteCloser{ioutil.Discard}, c.log)
+	c.down = newCaptureSink("down", nopWriteCloser{slowWriter{ioutil.Discard, rate / 10}}, c.log)
+	picked := 0
+	pick := func(dst, src net.Conn) relayEngine {
+		// loopRelay asks for the engine up, then the one down
+		if picked++; picked == 1 {
+			return teeEngine{c.teeUp}
+		}
+		return teeEngine{c.teeDown}
+	}
+
+	start := rss()
+	var peak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if r := rss(); r > peak {
+				peak = r
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	began = time.Now()
+	_, down, err = loopRelay(pick, func(c net.Conn) {
+		for sent := int64(0); sent < size; sent += int64(len(buf)) {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}, func(c net.Conn) error {
+		_, err := io.Copy(ioutil.Discard, slowReader{c, rate})
+		return err
+	})
+	close(stop)
+	<-sampled
+	_, _ = c.finish("slow-client", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("relayed %d MiB at %.1f MiB/s in %.0fs, memory %d MiB at the start, %d MiB at the peak",
+		down>>20, rate/(1<<20), time.Since(began).Seconds(), start>>20, peak>>20)
+	t.Logf("captured %d MiB, dropped %d MiB in %d gaps", c.meta.Down>>20, c.meta.DownDropped>>20, len(c.meta.Gaps))
+	if down != size {
+		t.Errorf("relayed %d, want %d", down, size)
+	}
+	if peak-start > slowClientGrowth {
+		t.Errorf("grew by %d MiB, more than %d", (peak-start)>>20, slowClientGrowth>>20)
+	}
+	if c.meta.DownDropped == 0 || c.meta.Down+c.meta.DownDropped != size {
+		t.Errorf("capture of %d and %d dropped doesn't add up to %d", c.meta.Down, c.meta.DownDropped, size)
+	}
+}
+
+// teeEngine copies through the capture tees, as the MITM relay does for
+// rules with the capture option.
+type teeEngine struct{ tee func(io.Writer) io.Writer }
+
+func (teeEngine) name() string { return "copy+capture" }
+
+func (e teeEngine) copy(dst, src net.Conn, n *int64) error {
+	_, err := io.Copy(e.tee(countingWriter{dst, n}), src)
+	return err
+}
+
+// slowReader reads at most rate bytes a second from r.
+type slowReader struct {
+	r    io.Reader
+	rate float64
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	began := time.Now()
+	n, err := s.r.Read(p)
+	time.Sleep(time.Duration(float64(n)/s.rate*float64(time.Second)) - time.Since(began))
+	return n, err
+}
+
+// slowWriter writes at most rate bytes a second to w.
+type slowWriter struct {
+	w    io.Writer
+	rate float64
+}
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(float64(len(p)) / s.rate * float64(time.Second)))
+	return s.w.Write(p)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// rss is the resident set size of the process, from /proc where there is
+// one, else what the Go runtime got from the OS.
+func rss() int64 {
+	if data, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		var size, res int64
+		if _, err := fmt.Sscan(string(data), &size, &res); err == nil {
+			return res * int64(os.Getpagesize())
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.Sys)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// checkHost answers whether DNS, interception and CA trust work for the
+// client asking: over HTTPS with a cert from our CA, and over plain HTTP,
+// which works without trusting the CA.
+func checkHost() string {
+	if selfName == "" {
+		return ""
+	}
+	return "check." + selfName
+}
+
+type checkResult struct {
+	Client        string `json:"client"`
+	Intercepted   bool   `json:"intercepted"`
+	CAFingerprint string `json:"ca_sha256,omitempty"`
+	Note          string `json:"note,omitempty"`
+	Version       string `json:"version"`
+}
+
+// checkHandler serves the check page, TLS telling whether it came through
+// the 443 port.
+func checkHandler(tls bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := &checkResult{Intercepted: tls, Version: version}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			res.Client = host
+		}
+		if tls {
+			sum := sha256.Sum256(currentCA().cert.Raw)
+			res.CAFingerprint = hex.EncodeToString(sum[:])
+		} else {
+			res.Note = "CA not needed for this check, try https://" + checkHost() + "/"
+		}
+		writeJSON(w, res)
+	})
+}
+
+// isCheckHost reports whether the Host of a plain HTTP request is checkHost.
+func isCheckHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return checkHost() != "" && strings.EqualFold(strings.TrimSuffix(host, "."), checkHost())
+}
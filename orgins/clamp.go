@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// clamp is what a route line says about the size of what it sends, for
+// tunnels that blackhole packets over their MTU instead of saying so:
+//
+//	socks name=wg addr=10.8.0.1:1080 mss=1240 max-record=4096
+type clamp struct {
+	mss       int // TCP_MAXSEG of the sockets the route dials, 0 to leave it
+	maxRecord int // largest TLS record written upstream, 0 for crypto/tls's own
+}
+
+// parseClamp reads the mss and max-record options of a route, returning
+// what's wrong with them; a bad one is left unset.
+func parseClamp(opts map[string]string) (clamp, []string) {
+	var c clamp
+	var bad []string
+	if v, ok := opts["mss"]; ok {
+		n, err := strconv.Atoi(v)
+		switch {
+		case err != nil || n < 536 || n > 9000:
+			bad = append(bad, "mss needs to be between 536 and 9000, not "+v)
+		case !mssSupported:
+			bad = append(bad, "mss isn't supported here")
+		default:
+			c.mss = n
+		}
+	}
+	if v, ok := opts["max-record"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 512 || n > 16384 {
+			bad = append(bad, "max-record needs to be between 512 and 16384, not "+v)
+		} else {
+			c.maxRecord = n
+		}
+	}
+	return c, bad
+}
+
+// control sets the mss on sockets before they connect, nil if there's none.
+func (c clamp) control() func(network, address string, rc syscall.RawConn) error {
+	if c.mss == 0 {
+		return nil
+	}
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = setMSS(fd, c.mss)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// wrap returns i as a clampedConn if c clamps anything.
+func (c clamp) wrap(i net.Conn) net.Conn {
+	tc, ok := i.(*tls.Conn)
+	if !ok || c == (clamp{}) {
+		return i
+	}
+	return &clampedConn{Conn: tc, maxRecord: c.maxRecord}
+}
+
+// clampedConn is an upstream connection of a clamping route. It writes no
+// record over maxRecord, and counts the writes that stalled, which the
+// access log reports so the clamp can be tuned.
+type clampedConn struct {
+	*tls.Conn
+	maxRecord int
+	stalls    int64
+}
+
+func (c *clampedConn) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if c.maxRecord > 0 && len(chunk) > c.maxRecord {
+			chunk = chunk[:c.maxRecord] // crypto/tls makes a record of at most one Write
+		}
+		began := time.Now()
+		m, err := c.Conn.Write(chunk)
+		if time.Since(began) >= writeStall {
+			atomic.AddInt64(&c.stalls, 1)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// writeStalls is how many writes took writeStall or longer.
+func (c *clampedConn) writeStalls() int64 {
+	return atomic.LoadInt64(&c.stalls)
+}
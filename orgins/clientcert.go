@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// clientCerts caches the credentials of rules with client-cert and
+// client-key, certFile+"\n"+keyFile -> *tls.Certificate. Emptied on every
+// reload, which their files changing triggers, so they're read again on
+// next use.
+var clientCerts sync.Map
+
+// clientCertError is a client credential that couldn't be loaded.
+type clientCertError struct {
+	file string
+	err  error
+}
+
+func (e *clientCertError) Error() string { return "client credential " + e.file + ": " + e.err.Error() }
+func (e *clientCertError) Unwrap() error { return e.err }
+
+// clientCertFor loads the credential in certFile and keyFile, or returns
+// it from clientCerts. A key others may read is refused, it's as good as
+// leaked.
+func clientCertFor(certFile, keyFile string) (*tls.Certificate, error) {
+	k := certFile + "\n" + keyFile
+	if c, ok := clientCerts.Load(k); ok {
+		return c.(*tls.Certificate), nil
+	}
+	if err := checkKeyPerm(keyFile); err != nil {
+		return nil, &clientCertError{keyFile, err}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, &clientCertError{certFile, err}
+	}
+	clientCerts.Store(k, &pair)
+	metricAdd("client_certs_loaded_total", 1)
+	return &pair, nil
+}
+
+func checkKeyPerm(keyFile string) error {
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("mode %v lets others read it, chmod 600 it", fi.Mode().Perm())
+	}
+	return nil
+}
+
+// forgetClientCerts empties clientCerts, for a reload.
+func forgetClientCerts() {
+	clientCerts.Range(func(k, _ interface{}) bool {
+		clientCerts.Delete(k)
+		return true
+	})
+}
+
+// useClientCert has config, for dialing upstream for r, present the client
+// credential of r if it has one, and accept one renegotiation, which is how
+// TLS 1.2 origins ask for it per path. crypto/tls can't do TLS 1.3
+// post-handshake auth, so an origin asking for it that way fails.
+func useClientCert(config *tls.Config, r *rule) error {
+	if r.clientCert == "" {
+		return nil
+	}
+	pair, err := clientCertFor(r.clientCert, r.clientKey)
+	if err != nil {
+		return err
+	}
+	config.Certificates = []tls.Certificate{*pair}
+	config.Renegotiation = tls.RenegotiateOnceAsClient
+	return nil
+}
+
+// certRefusals are the alerts an origin sends when the client credential
+// it asked for is missing or no good to it.
+var certRefusals = []string{
+	"bad certificate", "certificate required", "unknown certificate authority",
+	"revoked certificate", "expired certificate", "unsupported certificate",
+}
+
+// clientCertFailed reports whether err is a client credential failing to
+// load or being refused by the origin.
+func clientCertFailed(err error) bool {
+	var cerr *clientCertError
+	if err == nil || errors.As(err, &cerr) {
+		return err != nil
+	}
+	s := err.Error()
+	if !strings.Contains(s, "remote error: tls: ") {
+		return false
+	}
+	for _, a := range certRefusals {
+		if strings.Contains(s, a) {
+			return true
+		}
+	}
+	return false
+}
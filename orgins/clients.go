@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientAllow lists the CIDRs whose clients the DNS, TLS and HTTP listeners
+// serve, everyone when empty. Worth setting once they listen beyond loopback.
+var clientAllow = []string{}
+
+var clientNets []*net.IPNet // parsed clientAllow, no async r & w so ok
+
+func parseClientAllow() error {
+	for _, c := range clientAllow {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return errors.New("clientAllow: " + err.Error())
+		}
+		clientNets = append(clientNets, n)
+	}
+	return nil
+}
+
+// clientAllowed reports whether addr may use the listeners, counting the
+// ones turned away by listener.
+func clientAllowed(addr net.Addr, listener string) bool {
+	if len(clientNets) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, n := range clientNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	metricAdd(metricName("clients_refused_total", "listener", listener), 1)
+	logThrottled.Infof("refused "+listener, "%s refused on %s, not in clientAllow", addr, listener)
+	return false
+}
+
+// requestAddr is the client of an HTTP request as a net.Addr.
+func requestAddr(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.ParseIP(host)}
+}
+
+// requestLocal is the address of ours r came in on, nil if unknown.
+func requestLocal(r *http.Request) net.Addr {
+	a, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return a
+}
+
+// proxiedHost returns the Host of a plain HTTP request if it's a valid name
+// the client's view has a rule for, so that nothing else a client sends is
+// ever reflected in a page or a URL.
+func proxiedHost(r *http.Request) (string, bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.ContainsAny(host, "/\\@") {
+		return "", false
+	}
+	name, ok := normalizeHost(host)
+	if !ok {
+		return "", false
+	}
+	if rq := requestAddr(r); rq != nil {
+		if ru := viewFor(rq, requestLocal(r)).match(name); ru != nil && !ru.block {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// plainServer serves the HTTP port, bounded so slow clients can't hold on
+// to connections, from a plainListener: one request a conn, its head
+// checked, its Host canonical and its hop-by-hop headers gone before any
+// rule is looked at.
+func plainServer(addr string) *http.Server {
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !clientAllowed(requestAddr(r), "http") {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			r.Host = canonicalHost(r.Host)
+			stripHopByHop(r.Header)
+			if isCheckHost(r.Host) {
+				checkHandler(false).ServeHTTP(w, r)
+				return
+			}
+			if host, ok := proxiedHost(r); ok {
+				serveError(w, r, http.StatusForbidden, host+" accessed with http")
+				return
+			}
+			serveError(w, r, http.StatusForbidden, "plain http is not served here")
+		}),
+		ReadHeaderTimeout: httpHeaderTimeout,
+		ReadTimeout:       2 * httpHeaderTimeout,
+		WriteTimeout:      2 * httpHeaderTimeout,
+		IdleTimeout:       time.Minute,
+		MaxHeaderBytes:    httpMaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if pc, ok := c.(*plainConn); ok {
+				return withConnLog(ctx, pc.log)
+			}
+			return ctx
+		},
+	}
+	srv.SetKeepAlivesEnabled(false)
+	return srv
+}
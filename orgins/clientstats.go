@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// clientStat is what one DNS and TLS client did, to tell which device keeps
+// resolving a name without a capture. Memory is bounded twice: at most
+// clientsMax clients, the least recently seen evicted, and clientTopSlots
+// names each, kept with the space-saving algorithm. A name in Top is counted
+// at most Error too high; one that isn't has fewer queries than any that is.
+type clientStat struct {
+	Queries int64       `json:"queries"`
+	Spoofed int64       `json:"spoofed"`
+	Blocked int64       `json:"blocked"`
+	TLS     int64       `json:"tls_connections"`
+	First   time.Time   `json:"first_seen"`
+	Last    time.Time   `json:"last_seen"`
+	Top     []nameCount `json:"top"`
+}
+
+type nameCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error,omitempty"`
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = make(map[string]*clientStat) // by IP
+)
+
+// clientFor returns the stats of addr's IP, making room for it if new.
+// Called with clientsLock held.
+func clientFor(addr net.Addr) *clientStat {
+	if addr == nil {
+		return nil
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	c, ok := clients[ip]
+	if !ok {
+		if len(clients) >= clientsMax {
+			evictClient()
+		}
+		c = &clientStat{First: now}
+		clients[ip] = c
+		atomic.AddInt64(&clientsBytes, clientCost(ip, c))
+	}
+	c.Last = now
+	return c
+}
+
+// evictClient drops the least recently seen client. A scan, but only when
+// a new client comes with the map full.
+func evictClient() {
+	var oldest string
+	var last time.Time
+	for ip, c := range clients {
+		if oldest == "" || c.Last.Before(last) {
+			oldest, last = ip, c.Last
+		}
+	}
+	atomic.AddInt64(&clientsBytes, -clientCost(oldest, clients[oldest]))
+	delete(clients, oldest)
+	metricAdd("clients_evicted_total", 1)
+}
+
+// saw counts name, taking the slot of the least counted one when all are
+// full, which it inherits the count of as its error.
+func (c *clientStat) saw(name string) {
+	low := -1
+	for i := range c.Top {
+		if c.Top[i].Name == name {
+			c.Top[i].Count++
+			return
+		}
+		if low < 0 || c.Top[i].Count < c.Top[low].Count {
+			low = i
+		}
+	}
+	if len(c.Top) < clientTopSlots {
+		c.Top = append(c.Top, nameCount{Name: name, Count: 1})
+		atomic.AddInt64(&clientsBytes, int64(len(name))+nameCountEntry)
+		return
+	}
+	atomic.AddInt64(&clientsBytes, int64(len(name)-len(c.Top[low].Name)))
+	c.Top[low] = nameCount{Name: name, Count: c.Top[low].Count + 1, Error: c.Top[low].Count}
+}
+
+// countClientQuery counts a query by its decision, from logQuery.
+func countClientQuery(addr net.Addr, name string, decision int) {
+	if !trackClients {
+		return
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	c := clientFor(addr)
+	if c == nil {
+		return
+	}
+	c.Queries++
+	switch decision {
+	case decisionSpoofed:
+		c.Spoofed++
+	case decisionBlocked:
+		c.Blocked++
+	}
+	c.saw(strings.TrimSuffix(strings.ToLower(name), "."))
+}
+
+// countClientTLS counts a TLS connection for host, from forwardTls.
+func countClientTLS(addr net.Addr, host string, blocked bool) {
+	if !trackClients {
+		return
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	c := clientFor(addr)
+	if c == nil {
+		return
+	}
+	c.TLS++
+	if blocked {
+		c.Blocked++
+	}
+	c.saw(host)
+}
+
+type clientReport struct {
+	Client string `json:"client"`
+	clientStat
+}
+
+// clientsReport is every client, or those with name among their top ones,
+// the busiest first, their names the most counted first.
+func clientsReport(name string) []clientReport {
+	clientsLock.Lock()
+	ret := []clientReport{}
+	for ip, c := range clients {
+		r := clientReport{ip, *c}
+		r.Top = append([]nameCount(nil), c.Top...)
+		ret = append(ret, r)
+	}
+	clientsLock.Unlock()
+
+	kept := ret[:0]
+	for _, r := range ret {
+		sort.Slice(r.Top, func(i, j int) bool { return r.Top[i].Count > r.Top[j].Count })
+		if name == "" || hasName(r.Top, name) {
+			kept = append(kept, r)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Queries+kept[i].TLS > kept[j].Queries+kept[j].TLS })
+	return kept
+}
+
+func hasName(top []nameCount, name string) bool {
+	for _, n := range top {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// clientsHandler is /clients: GET lists the clients, ?name= those among
+// whose top names it is; DELETE forgets them all, or ?client= one.
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	if !trackClients {
+		http.Error(w, "client tracking is off", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		name := ""
+		if v := q.Get("name"); v != "" {
+			host, ok := normalizeHost(v)
+			if !ok {
+				http.Error(w, "name= needs a valid hostname", http.StatusBadRequest)
+				return
+			}
+			name = host
+		}
+		writeJSON(w, clientsReport(name))
+	case http.MethodDelete:
+		clientsLock.Lock()
+		if ip := q.Get("client"); ip != "" {
+			delete(clients, ip)
+		} else {
+			clients = make(map[string]*clientStat)
+		}
+		recountClients()
+		clientsLock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// clientsSummary is the gist of /clients for /status.
+type clientsSummary struct {
+	Tracked int    `json:"tracked"`
+	Busiest string `json:"busiest,omitempty"`
+	Queries int64  `json:"busiest_queries,omitempty"`
+}
+
+func clientsStatus() *clientsSummary {
+	if !trackClients {
+		return nil
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	s := &clientsSummary{Tracked: len(clients)}
+	for ip, c := range clients {
+		if c.Queries > s.Queries {
+			s.Busiest, s.Queries = ip, c.Queries
+		}
+	}
+	return s
+}
+
+// copyClients is the stats as they are, for the snapshot and clientsFile.
+func copyClients() map[string]*clientStat {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	ret := make(map[string]*clientStat, len(clients))
+	for ip, c := range clients {
+		cp := *c
+		cp.Top = append([]nameCount(nil), c.Top...)
+		ret[ip] = &cp
+	}
+	return ret
+}
+
+func restoreClients(m map[string]*clientStat) {
+	if !trackClients || m == nil {
+		return
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	clients = m
+	recountClients()
+	for len(clients) > clientsMax {
+		evictClient()
+	}
+}
+
+// loadClients reads clientsFile if there's one, and saves to it every
+// clientsSave from then on.
+func loadClients() {
+	if !trackClients || clientsFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(clientsFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Error(err)
+	default:
+		var m map[string]*clientStat
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Errorf("%s: %s", clientsFile, err)
+		} else {
+			restoreClients(m)
+		}
+	}
+	go func() {
+		for range time.Tick(clientsSave) {
+			if err := saveClients(); err != nil {
+				logThrottled.Errorf("clients save", "%s: %s", clientsFile, err)
+			}
+		}
+	}()
+}
+
+// saveClients writes clientsFile through a rename, so a crash never leaves
+// it half written.
+func saveClients() error {
+	data, err := json.Marshal(copyClients())
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(clientsFile), ".clients-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), clientsFile)
+}
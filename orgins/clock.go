@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// clock is where expiry logic reads the time: the wall clock for what's
+// compared with certificates or shown, and a monotonic one for when cached
+// things expire. The wall clock stepping, as a router's does when NTP
+// syncs after boot, so neither expires nor revives them. The tests swap
+// in a clock they move by hand.
+type clock interface {
+	Now() time.Time
+	Mono() time.Duration // since some fixed point, never stepped
+}
+
+type systemClock struct{ start time.Time }
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Mono is read off the monotonic reading time.Now carries.
+func (c systemClock) Mono() time.Duration { return time.Since(c.start) }
+
+var clk clock = systemClock{time.Now()}
+
+// deadline is when something cached expires, on the monotonic clock.
+type deadline time.Duration
+
+// expireIn is the deadline d from now.
+func expireIn(d time.Duration) deadline {
+	return deadline(clk.Mono() + d)
+}
+
+// deadlineAt is the deadline of the wall clock time t, as handed over by
+// another process.
+func deadlineAt(t time.Time) deadline {
+	return expireIn(t.Sub(clk.Now()))
+}
+
+func (d deadline) passed() bool {
+	return clk.Mono() >= time.Duration(d)
+}
+
+// left is how long until d, negative once it passed.
+func (d deadline) left() time.Duration {
+	return time.Duration(d) - clk.Mono()
+}
+
+// wall is d on the wall clock as it reads now, to be shown or handed over.
+func (d deadline) wall() time.Time {
+	return clk.Now().Add(d.left())
+}
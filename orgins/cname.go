@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// maxCnameChain is how many CNAMEs are followed from a name, more than any
+// sane chain has.
+const maxCnameChain = 8
+
+// cnameAliases are names whose CNAME chain led to a name with a rule, with
+// matchCnames: they're matched as that name while the chain is valid, so
+// connections for them get the rule too
+var cnameAliases = newBudgetMap("cnames", aliasCost, aliasAge) // name -> *alias
+
+type alias struct {
+	target string
+	expire deadline
+}
+
+// aliasTarget returns the name domain is matched as, "" if none.
+func aliasTarget(domain string) string {
+	if a, ok := cnameAliases.Load(domain); ok {
+		if a := a.(*alias); !a.expire.passed() {
+			return a.target
+		}
+		cnameAliases.Delete(domain)
+	}
+	return ""
+}
+
+// cnameChain follows the CNAMEs in answer from name, returning the names
+// after it in order and the lowest TTL on the way. It stops after
+// maxCnameChain names or at one seen before, so a loop can't hold it.
+func cnameChain(name string, answer []dns.RR) ([]string, uint32) {
+	targets := make(map[string]*dns.CNAME)
+	for _, rr := range answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(c.Hdr.Name)] = c
+		}
+	}
+	var chain []string
+	var ttl uint32
+	seen := map[string]bool{strings.ToLower(dns.Fqdn(name)): true}
+	for cur := strings.ToLower(dns.Fqdn(name)); len(chain) < maxCnameChain; {
+		c, ok := targets[cur]
+		if !ok {
+			break
+		}
+		next := strings.ToLower(c.Target)
+		if seen[next] {
+			logThrottled.Warnf("cname "+name, "%s: CNAME loop at %s", name, next)
+			break
+		}
+		seen[next] = true
+		if len(chain) == 0 || c.Hdr.Ttl < ttl {
+			ttl = c.Hdr.Ttl
+		}
+		if host, ok := normalizeHost(next); ok {
+			chain = append(chain, host)
+		}
+		cur = next
+	}
+	return chain, ttl
+}
+
+// matchCnameChain returns the rule of the first name in the CNAME chain of
+// the forwarded answer r for domain that has one in v, remembering domain as
+// an alias of it; nil if none does.
+func matchCnameChain(v *view, domain string, r *dns.Msg) *rule {
+	if v.direct || r.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	chain, ttl := cnameChain(domain, r.Answer)
+	for _, name := range chain {
+		ru := matchRule(v.table, name)
+		if ru == nil || ru.forwarded() {
+			continue
+		}
+		// valid as long as the chain, and at least as the answer we give
+		valid := time.Duration(ttl) * time.Second
+		if min := spoofTTL(ru, time.Now()); valid < min {
+			valid = min
+		}
+		cnameAliases.Store(domain, &alias{target: name, expire: expireIn(valid)})
+		log.Debugf("%s: CNAME chain reaches %s, matched as it", domain, name)
+		return ru
+	}
+	return nil
+}
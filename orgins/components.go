@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// component is a part of what main serves that runs without the others:
+// open binds its listeners or takes them over, serve serves them till
+// they're closed, returning nil, or fail. The supervisor runs them.
+type component struct {
+	name      string
+	enabled   bool
+	mandatory bool // its failing stops the others; else it's only marked down
+	exit      int  // main's exit code when it fails
+	open      func() error
+	serve     func() error
+}
+
+var components []*component // in the order they're opened and started
+
+func init() {
+	components = []*component{
+		{"dns", enableDNS, true, exitDNS, openDNS, serveDNS},
+		{"http", enableHTTP, true, exitHTTP, openHTTP, servePlain},
+		{"admin", enableAdmin, false, exitFailure, openAdmin, serveAdmin},
+		{"tls", enableTLS, true, exitTLS, openTLS, serveTLS},
+		{"health", healthAddr != "", false, exitFailure, openHealth, serveHealth},
+	}
+}
+
+// enabledComponents names the components that run, for /status.
+func enabledComponents() []string {
+	var ret []string
+	for _, c := range components {
+		if c.enabled {
+			ret = append(ret, c.name)
+		}
+	}
+	return ret
+}
+
+// checkComponents refuses subsets that can't work, and warns about what
+// something else has to do for the ones that can.
+func checkComponents() error {
+	if !enableDNS && !enableHTTP && !enableTLS {
+		return errors.New("enableDNS, enableHTTP and enableTLS are all off, nothing to serve")
+	}
+	if enableDNS && !enableTLS && spoofTarget == "" {
+		return errors.New("enableTLS is off, spoofTarget must say where proxied names are spoofed to")
+	}
+	if enableTLS && !enableDNS {
+		log.Warnf("DNS is off: something else must resolve the proxied names to %s", *tlsListen)
+	}
+	return nil
+}
+
+// needCA reports whether the CA is used: for the TLS component, and for
+// the admin cert when it's minted rather than loaded.
+func needCA() bool {
+	return enableTLS || enableAdmin && adminRemote() && adminCert == ""
+}
+
+// listenerNames are what openListeners may take over from an old process.
+var listenerNames = []string{"dns-udp", "dns-tcp", "http", "admin", "tls", "health"}
+
+func openDNS() error {
+	closeAll(serving.dnsTCP) // those of a serve that failed
+	for _, udp := range serving.dnsUDP {
+		_ = udp.Close()
+	}
+	serving.dnsUDP, serving.dnsTCP = nil, nil
+	for _, addr := range dnsAddrs() {
+		var udp net.PacketConn
+		var err error
+		if f := inheritedFile("dns-udp"); f != nil {
+			udp, err = net.FilePacketConn(f)
+			_ = f.Close()
+		} else {
+			udp, err = net.ListenPacket("udp", addr)
+		}
+		if err != nil {
+			return err
+		}
+		serving.dnsUDP = append(serving.dnsUDP, udp)
+		tcp, err := listenInherited("dns-tcp", func() (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+		if err != nil {
+			return err
+		}
+		serving.dnsTCP = append(serving.dnsTCP, tcp)
+	}
+	return nil
+}
+
+// serveDNS serves UDP and TCP port 53 or the -dns-listen addresses.
+func serveDNS() error {
+	var srvs []*dns.Server
+	for i := range serving.dnsUDP {
+		srvs = append(srvs,
+			&dns.Server{PacketConn: serving.dnsUDP[i], Handler: dns.HandlerFunc(forwardDns)},
+			&dns.Server{Listener: serving.dnsTCP[i], Handler: dns.HandlerFunc(forwardDns)})
+	}
+	var loops []func() error
+	for _, srv := range srvs {
+		srv := srv
+		defer trackServer(dnsServer{srv})()
+		loops = append(loops, srv.ActivateAndServe)
+	}
+	return serveAll(func() {
+		for _, srv := range srvs {
+			_ = srv.Shutdown()
+		}
+	}, loops...)
+}
+
+func openHTTP() error {
+	var err error
+	serving.http, err = listenInherited("http", func() (net.Listener, error) {
+		return net.Listen("tcp", *httpListen)
+	})
+	return err
+}
+
+// servePlain serves TCP port 80 or -http-listen, so clients sent to us for
+// plain http get an answer rather than a refused connection.
+func servePlain() error {
+	plain := plainServer(*httpListen)
+	defer trackServer(plain)()
+	if err := plain.Serve(plainListener{serving.http}); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func openAdmin() error {
+	var err error
+	serving.admin, err = listenInherited("admin", func() (net.Listener, error) {
+		return net.Listen("tcp", currentSettings().adminAddr)
+	})
+	return err
+}
+
+// serveAdmin serves the admin API and metrics.
+func serveAdmin() error {
+	admin := &http.Server{Handler: adminHandler()}
+	defer trackServer(admin)()
+	if err := admin.Serve(adminListener(serving.admin)); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func openTLS() error {
+	closeAll(serving.tls)
+	serving.tls = nil
+	if len(inherited["tls"]) == 0 {
+		var err error
+		serving.tls, err = listenTLS(*tlsListen)
+		return err
+	}
+	for f := inheritedFile("tls"); f != nil; f = inheritedFile("tls") {
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		serving.tls = append(serving.tls, l)
+	}
+	log.Infof("took over %d TLS listeners on %s", len(serving.tls), *tlsListen)
+	return nil
+}
+
+// serveTLS accepts on port 443 or -tls-listen, the interception itself.
+func serveTLS() error {
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		KeyLogWriter:   keyLog,
+	}
+	ls := serving.tls
+	var loops []func() error
+	for i, l := range ls {
+		i, l := i, l
+		loops = append(loops, func() error { return acceptLoop(i, l, tlsConfig) })
+	}
+	return serveAll(func() { closeAll(ls) }, loops...)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var dumpConfig = flag.Bool("dump-config", false,
+	"print the effective configuration as JSON, as GET /config on the admin API does, and exit")
+
+// effectiveConfig is what the proxy runs with: the constants, flags and
+// what was loaded or derived from them, read from the same variables the
+// code uses. Secrets in URLs are redacted.
+type effectiveConfig struct {
+	Version    string            `json:"version"`
+	Components []string          `json:"components"`
+	Listeners  map[string]string `json:"listeners"` // bound addrs once serving
+	Flags      map[string]string `json:"flags"`
+	DNS        dnsConfig         `json:"dns"`
+	Timeouts   map[string]string `json:"timeouts"`
+	Caches     map[string]string `json:"caches"`
+	Limits     map[string]int64  `json:"limits"`
+	Features   map[string]bool   `json:"features"`
+	Files      map[string]string `json:"files"`
+	Webhooks   map[string]string `json:"webhooks"`
+	Peer       string            `json:"peer,omitempty"`
+	Sources    []sourceState     `json:"sources"`
+	Views      []viewState       `json:"views"`
+	Routes     map[string]string `json:"routes"` // name -> proxy addr, "" for the built-in ones
+}
+
+type dnsConfig struct {
+	Default          string            `json:"default"`
+	Secure           string            `json:"secure"`
+	Paranoid         string            `json:"paranoid,omitempty"`
+	DNSSEC           bool              `json:"dnssec"`
+	TrustAnchors     string            `json:"trust_anchors,omitempty"` // trustAnchorFile
+	Private          bool              `json:"private"`                 // everything forwarded to secure, see privateDNS
+	PoisonAddrs      []string          `json:"poison_addrs"`
+	AddrFamily       string            `json:"addr_family"`
+	EDNSSize         int               `json:"edns_udp_size"`
+	SpoofTarget      string            `json:"spoof_target"`
+	SpoofA           bool              `json:"spoof_a"`
+	SpoofAAAA        bool              `json:"spoof_aaaa"`
+	FlattenCnames    bool              `json:"flatten_cnames"`
+	MatchCnames      bool              `json:"match_cnames"`
+	ProvenanceOption uint16            `json:"provenance_option"`
+	InternalZone     string            `json:"internal_zone"`
+	LocalZone        string            `json:"local_zone"`
+	UnknownTLD       string            `json:"unknown_tld"`
+	SelfName         string            `json:"self_name"`
+	QueryLogSample   int64             `json:"query_log_sample"`
+	Upstreams        []*upstreamStatus `json:"upstreams"`
+}
+
+type sourceState struct {
+	Source   string     `json:"source"`
+	Lines    int        `json:"lines"`
+	Rules    int        `json:"rules"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	Error    string     `json:"error,omitempty"` // of the last load, the lines kept are from before
+}
+
+type viewState struct {
+	Name    string   `json:"name"`
+	Sources []string `json:"sources"`
+	Rules   int      `json:"rules"`
+	Epoch   int64    `json:"epoch"`
+	Direct  bool     `json:"direct,omitempty"`
+	Local   []string `json:"local,omitempty"`
+}
+
+// redact masks the credentials and query of a URL, leaving anything else
+// as it is.
+func redact(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if at := strings.LastIndexByte(s, '@'); at >= 0 {
+			return "redacted@" + s[at+1:] // user:pass@host:port
+		}
+		return s
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+func mapSize(m interface {
+	Range(func(key, val interface{}) bool)
+}) int64 {
+	var n int64
+	m.Range(func(key, val interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func currentConfig() *effectiveConfig {
+	s, sp := currentSettings(), spoofCur.Load().(spoofTypes)
+	c := &effectiveConfig{
+		Version:    version,
+		Components: enabledComponents(),
+		Listeners: map[string]string{
+			"dns":   *dnsListen,
+			"tls":   *tlsListen,
+			"http":  *httpListen,
+			"admin": s.adminAddr,
+		},
+		Flags: map[string]string{},
+		DNS: dnsConfig{
+			Default:          defResolver,
+			Secure:           gfwResolver,
+			Paranoid:         paranoidResolver,
+			DNSSEC:           validateDNSSEC,
+			TrustAnchors:     trustAnchorFile,
+			Private:          s.privateForward,
+			PoisonAddrs:      poisonAddrs,
+			AddrFamily:       defaultFamily.String(),
+			EDNSSize:         ednsUDPSize,
+			SpoofTarget:      spoofTarget,
+			SpoofA:           sp.a,
+			SpoofAAAA:        sp.aaaa,
+			FlattenCnames:    flattenCnames,
+			MatchCnames:      matchCnames,
+			ProvenanceOption: s.provenanceCode,
+			InternalZone:     internalZone,
+			LocalZone:        s.localZone,
+			UnknownTLD:       tldPolicy,
+			SelfName:         selfName,
+			QueryLogSample:   s.querySample,
+		},
+		Timeouts: map[string]string{
+			"dial":           dialTimeout.String(),
+			"rule_min":       minTimeout.String(),
+			"rule_max":       maxTimeout.String(),
+			"sniff":          sniffTimeout.String(),
+			"http_header":    httpHeaderTimeout.String(),
+			"dns":            dnsTimeout.String(),
+			"upgrade":        upgradeTimeout.String(),
+			"upgrade_drain":  upgradeDrain.String(),
+			"drain_grace":    drainGrace.String(),
+			"write_stall":    writeStall.String(),
+			"remote_reload":  remoteRefresh.String(),
+			"breaker_open":   breakerOpenFor.String(),
+			"breaker_max":    breakerMaxOpen.String(),
+			"relay_idle":     s.limits.idle.String(),
+			"relay_max_life": s.limits.maxLife.String(),
+			"relay_one_way":  s.limits.oneWay.String(),
+		},
+		Caches: map[string]string{
+			"addr_ttl":       cacheAddrTtl.String(),
+			"negative_ttl":   negativeTtl.String(),
+			"local_zone_ttl": localZoneTtl.String(),
+			"route_ttl":      cacheRouteTtl.String(),
+			"sticky_ttl":     stickyTtl.String(),
+			"spoof_ttl":      spoofTtl.String(),
+			"cert_expire":    certExpire.String(),
+			"summary":        summaryInterval.String(),
+		},
+		Limits: map[string]int64{
+			"conn_budget":      connBudget,
+			"tls_listeners":    int64(len(serving.tls)),
+			"dns_clients_idle": dnsClientsIdle,
+			"rsa_key_pool":     rsaKeyPool,
+			"min_client_tls":   int64(clientTLSMin),
+			"cached_addrs":     mapSize(cacheResolv),
+			"cached_negative":  mapSize(cacheNeg),
+			"cached_leaves":    mapSize(cacheCert),
+			"suffix_gen":       int64(atomic.LoadUint64(&suffixGen)),
+			"pins":             mapSize(&stickyPins),
+			"clients_max":      clientsMax,
+			"client_top_slots": clientTopSlots,
+			"breaker_failures": breakerFailures,
+			"breakers":         mapSize(&breakers),
+			"caches_max_bytes": s.cacheBudget,
+		},
+		Features: map[string]bool{
+			"use_intermediate":         useIntermediate,
+			"keep_leaves_on_ca_reload": keepLeavesOnCaReload,
+			"deterministic_serials":    deterministicSerials,
+			"grace_removed":            graceRemoved,
+			"adaptive_ttl":             adaptiveTtl,
+			"rebind_protect":           rebindProtect,
+			"drain_on_remove":          drainOnRemove,
+			"warm_up":                  warmUp,
+			"passthrough":              currentViews().passthrough,
+			"track_clients":            trackClients,
+			"verify_cn_fallback":       upstreamPolicy.cnFallback,
+			"verify_expired_interim":   upstreamPolicy.expiredIntermediate,
+		},
+		Files: map[string]string{
+			"config":         *configPath,
+			"ca_cert":        caCert,
+			"ca_key":         redactKeyURI(caKey),
+			"ca_key_backend": caKeyBackend,
+			"rules":          configFile,
+			"routes":         routesFile,
+			"views":          viewsFile,
+			"groups":         groupsFile,
+			"subject":        subjectFile,
+			"ip_rules":       ipRulesFile,
+			"shadow":         shadowFile,
+			"error_page":     errorPageFile,
+			"key_log":        keyLogFile,
+			"query_log":      queryLogFile,
+			"captures":       captureDir,
+			"clients":        clientsFile,
+			"local_zone":     localZoneFile,
+			"suffixes":       suffixFile,
+			"runtime":        runtimeFile,
+			"health":         healthFile,
+		},
+		Webhooks: map[string]string{
+			"events": redact(eventWebhook),
+			"expiry": redact(expiryWebhook),
+		},
+		Routes: map[string]string{},
+		Peer:   redact(peerURL),
+	}
+	if len(serving.dnsUDP) > 0 {
+		var addrs []string
+		for _, pc := range serving.dnsUDP {
+			addrs = append(addrs, pc.LocalAddr().String())
+		}
+		c.Listeners["dns"] = strings.Join(addrs, ",")
+	}
+	if serving.http != nil {
+		c.Listeners["http"] = serving.http.Addr().String()
+	}
+	if serving.admin != nil {
+		c.Listeners["admin"] = serving.admin.Addr().String()
+	}
+	if serving.health != nil {
+		c.Listeners["health"] = serving.health.Addr().String()
+	}
+	if len(serving.tls) > 0 {
+		c.Listeners["tls"] = serving.tls[0].Addr().String()
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		c.Flags[f.Name] = f.Value.String()
+	})
+	for _, u := range upstreams {
+		c.DNS.Upstreams = append(c.DNS.Upstreams, u.status())
+	}
+	for name, rt := range s.routes {
+		c.Routes[name] = ""
+		if p, ok := rt.(proxyRoute); ok {
+			c.Routes[name] = redact(p.addr)
+		}
+	}
+
+	// rules are counted as compiled into the first view using the source
+	counts := make(map[string]int)
+	for _, v := range currentViews().views {
+		var local []string
+		for _, ip := range v.locals {
+			local = append(local, ip.String())
+		}
+		c.Views = append(c.Views, viewState{v.name, v.sources, len(v.table), v.epoch, v.direct, local})
+		own := make(map[string]int)
+		for _, r := range v.dump {
+			own[r.source]++
+		}
+		for _, src := range v.sources {
+			if _, ok := counts[src]; !ok {
+				counts[src] = own[src]
+			}
+		}
+	}
+	var srcs []string
+	for src := range counts {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+	sourceLock.Lock()
+	for _, src := range srcs {
+		s := sourceState{Source: redact(src), Lines: len(sourceLines[src]), Rules: counts[src],
+			Error: strings.Replace(sourceErrors[src], src, redact(src), -1)}
+		if t, ok := sourceLoaded[src]; ok {
+			s.LoadedAt = &t
+		}
+		c.Sources = append(c.Sources, s)
+	}
+	sourceLock.Unlock()
+	return c
+}
+
+// configHandler is GET /config, the effective configuration.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentConfig())
+}
+
+// runDumpConfig is -dump-config, run after setup so sources are loaded,
+// but before anything is bound.
+func runDumpConfig() int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(currentConfig()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return 0
+}
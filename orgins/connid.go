@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// connIDPrefix tells this process's connection IDs from those of the one
+// before an upgrade, whose counter started over just the same.
+var connIDPrefix = func() string {
+	b := make([]byte, 2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+var connSeq uint64
+
+// newConnID names an accepted connection in the access log, the other log
+// lines on its path, /debug/conns and its capture files, e.g. 3fa9-2bq.
+func newConnID() string {
+	return connIDPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&connSeq, 1), 36)
+}
+
+// peekOf is the peekConn c is or wraps, nil for conns not accepted by us.
+func peekOf(c net.Conn) *peekConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	pc, _ := c.(*peekConn)
+	return pc
+}
+
+// connID is the ID of c, "" for conns not accepted by us.
+func connID(c net.Conn) string {
+	if pc := peekOf(c); pc != nil {
+		return pc.id
+	}
+	return ""
+}
+
+// connLog logs with the ID of c as the conn field, set once per connection.
+func connLog(c net.Conn) *log.Entry {
+	if pc := peekOf(c); pc != nil {
+		return pc.log
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// acceptedAt is when c was accepted, now for conns not accepted by us.
+func acceptedAt(c net.Conn) time.Time {
+	if pc := peekOf(c); pc != nil {
+		return pc.accepted
+	}
+	return time.Now()
+}
+
+type connLogKey struct{}
+
+// withConnLog hands the logger of a connection down to what it dials.
+func withConnLog(ctx context.Context, e *log.Entry) context.Context {
+	return context.WithValue(ctx, connLogKey{}, e)
+}
+
+func connLogFrom(ctx context.Context) *log.Entry {
+	if e, ok := ctx.Value(connLogKey{}).(*log.Entry); ok {
+		return e
+	}
+	return log.NewEntry(log.StandardLogger())
+}
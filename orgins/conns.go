@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configEpoch counts reloads; every view remembers the one it was built in,
+// and so every connection the rules generation it was matched against.
+var configEpoch int64
+
+// liveConn is a relayed client connection, listed at /debug/conns.
+type liveConn struct {
+	id     int64
+	cid    string // connID, as in the logs
+	conn   net.Conn
+	host   string
+	mode   string
+	view   string
+	epoch  int64
+	domain string // of the matched rule
+	began  time.Time
+
+	addr     atomic.Value // string, the upstream once dialed
+	draining int32        // 1 once its rule was removed, 2 once closed for it
+}
+
+var (
+	liveConns  sync.Map // id -> *liveConn
+	liveConnID int64
+)
+
+// trackConn lists a connection until the returned func is called.
+func trackConn(conn net.Conn, host, mode string, v *view, r *rule) (*liveConn, func()) {
+	lc := &liveConn{
+		id:     atomic.AddInt64(&liveConnID, 1),
+		cid:    connID(conn),
+		conn:   conn,
+		host:   host,
+		mode:   mode,
+		view:   v.name,
+		epoch:  v.epoch,
+		domain: r.domain,
+		began:  time.Now(),
+	}
+	lc.addr.Store("")
+	liveConns.Store(lc.id, lc)
+	cost := liveConnCost(lc)
+	atomic.AddInt64(&connsBytes, cost)
+	atomic.AddInt64(&connsCount, 1)
+	return lc, func() {
+		liveConns.Delete(lc.id)
+		atomic.AddInt64(&connsBytes, -cost)
+		atomic.AddInt64(&connsCount, -1)
+	}
+}
+
+// drained reports whether the connection was closed because its rule went away.
+func (lc *liveConn) drained() bool {
+	return atomic.LoadInt32(&lc.draining) == 2
+}
+
+// liveConnInfo is the /debug/conns view of a connection.
+type liveConnInfo struct {
+	ID       int64     `json:"id"`
+	Conn     string    `json:"conn,omitempty"`
+	Host     string    `json:"host"`
+	Mode     string    `json:"mode"`
+	Client   string    `json:"client"`
+	Addr     string    `json:"addr,omitempty"`
+	View     string    `json:"view"`
+	Epoch    int64     `json:"epoch"`
+	Rule     string    `json:"rule"`
+	Since    time.Time `json:"since"`
+	Draining bool      `json:"draining,omitempty"`
+}
+
+func liveConnInfos() []*liveConnInfo {
+	ret := []*liveConnInfo{}
+	liveConns.Range(func(_, val interface{}) bool {
+		lc := val.(*liveConn)
+		ret = append(ret, &liveConnInfo{
+			ID:       lc.id,
+			Conn:     lc.cid,
+			Host:     lc.host,
+			Mode:     lc.mode,
+			Client:   lc.conn.RemoteAddr().String(),
+			Addr:     lc.addr.Load().(string),
+			View:     lc.view,
+			Epoch:    lc.epoch,
+			Rule:     lc.domain,
+			Since:    lc.began,
+			Draining: atomic.LoadInt32(&lc.draining) != 0,
+		})
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// drainRemoved gives connections whose rule is gone from the current views,
+// or now blocks, drainGrace before closing them. Called after a reload.
+func drainRemoved() {
+	if !drainOnRemove {
+		return
+	}
+	liveConns.Range(func(_, val interface{}) bool {
+		lc := val.(*liveConn)
+		if atomic.LoadInt32(&lc.draining) != 0 || !ruleRemoved(lc) {
+			return true
+		}
+		atomic.StoreInt32(&lc.draining, 1)
+		connLog(lc.conn).Infof("%s: rule %s removed, closing in %s", lc.host, lc.domain, drainGrace)
+		time.AfterFunc(drainGrace, func() {
+			if !ruleRemoved(lc) { // put back in the meantime
+				atomic.StoreInt32(&lc.draining, 0)
+				return
+			}
+			atomic.StoreInt32(&lc.draining, 2)
+			metricAdd("conns_drained_total", 1)
+			closeConn(lc.conn)
+		})
+		return true
+	})
+}
+
+func ruleRemoved(lc *liveConn) bool {
+	v := viewByName(lc.view)
+	if v == nil {
+		v = defaultView()
+	}
+	r := decide("drain", lc.host, lc.conn.RemoteAddr(), v.match(lc.host))
+	return r == nil || r.block
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialer opens TLS connections to upstreams. addr is where the connection
+// goes, host the name it is for.
+type dialer interface {
+	DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error)
+}
+
+// rawDialer opens plain TCP connections the same way, for relays that don't
+// terminate TLS.
+type rawDialer interface {
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// dialTimeouts bound connecting and the TLS handshake of one dial, dialTimeout
+// for both unless the rule says otherwise.
+type dialTimeouts struct {
+	dial, handshake time.Duration
+}
+
+type timeoutsKey struct{}
+
+// withTimeouts makes dials under ctx use the timeouts of r.
+func withTimeouts(ctx context.Context, r *rule) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, r.timeouts())
+}
+
+func timeoutsFrom(ctx context.Context) dialTimeouts {
+	if t, ok := ctx.Value(timeoutsKey{}).(dialTimeouts); ok {
+		return t
+	}
+	return dialTimeouts{dialTimeout, dialTimeout}
+}
+
+// upstreamDialer is what every direct upstream connection goes through, set
+// up once from the config.
+var upstreamDialer dialer = newNetDialer()
+
+// netDialer connects straight to addr.
+type netDialer struct {
+	d *net.Dialer
+}
+
+func newNetDialer() *netDialer {
+	return &netDialer{d: bootstrapDialer}
+}
+
+func (d *netDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutsFrom(ctx).dial)
+	defer cancel()
+	return d.d.DialContext(ctx, "tcp", addr)
+}
+
+func (d *netDialer) DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClient(ctx, raw, config)
+}
+
+// socksDialer tunnels through a SOCKS5 proxy, e.g. one bound to a VPN interface.
+type socksDialer struct {
+	proxy   string
+	control func(network, address string, c syscall.RawConn) error // of the socket to proxy
+}
+
+func (d socksDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	pd, err := proxy.SOCKS5("tcp", d.proxy, nil, &net.Dialer{Timeout: timeoutsFrom(ctx).dial, Control: d.control, Resolver: bootstrapResolver})
+	if err != nil {
+		return nil, err
+	}
+	return pd.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+func (d socksDialer) DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClient(ctx, raw, config)
+}
+
+// httpDialer tunnels through an HTTP proxy with CONNECT.
+type httpDialer struct {
+	proxy   string
+	control func(network, address string, c syscall.RawConn) error // of the socket to proxy
+}
+
+func (d httpDialer) DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClient(ctx, raw, config)
+}
+
+func (d httpDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	timeout := timeoutsFrom(ctx).dial
+	raw, err := (&net.Dialer{Timeout: timeout, Control: d.control, Resolver: bootstrapResolver}).DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	_ = raw.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(raw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(raw), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = raw.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return raw, nil
+}
+
+// frontDialer sends front as the SNI instead of whatever config says.
+type frontDialer struct {
+	dialer
+	front string
+}
+
+func (d frontDialer) DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error) {
+	config = config.Clone()
+	config.ServerName = d.front
+	return d.dialer.DialTLSContext(ctx, host, addr, config)
+}
+
+func tlsClient(ctx context.Context, raw net.Conn, config *tls.Config) (net.Conn, error) {
+	stages := stagesFrom(ctx)
+	stages.mark(stageDialed)
+	ctx, cancel := context.WithTimeout(ctx, timeoutsFrom(ctx).handshake)
+	defer cancel()
+	i := tls.Client(raw, config)
+	if err := i.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	stages.mark(stageUpHandshake)
+	return i, nil
+}
+
+// fetchTransport makes remote rule sources go through upstreamDialer too.
+var fetchTransport = &http.Transport{
+	Proxy:       http.ProxyFromEnvironment,
+	DialContext: bootstrapDialer.DialContext,
+	DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return upstreamDialer.DialTLSContext(ctx, host, addr, &tls.Config{ServerName: host})
+	},
+}
+
+// dialFailure sorts why dialing an upstream failed into a failure kind.
+func dialFailure(err error) string {
+	var nerr net.Error
+	var rerr tls.RecordHeaderError
+	var cerr x509.UnknownAuthorityError
+	var herr x509.HostnameError
+	var ierr x509.CertificateInvalidError
+	var verr *tls.CertificateVerificationError
+	var cherr *chainError
+	switch {
+	case err == errResolve, err == errBogon, err == errPoisoned, err == errDisagree:
+		return failResolve
+	case clientCertFailed(err):
+		return failClientCert
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return failTimeout
+	case errors.As(err, &rerr), errors.As(err, &cerr), errors.As(err, &herr), errors.As(err, &ierr), errors.As(err, &verr), errors.As(err, &cherr):
+		return failVerify
+	default:
+		return failUnreachable
+	}
+}
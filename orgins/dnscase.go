@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errCaseMismatch is an answer whose question isn't in the case the qname
+// was sent in, as one forged by someone who didn't see the query would be.
+var errCaseMismatch = errors.New("answer doesn't echo the qname's case")
+
+var caseMismatches = metricCounter("dns_case_mismatch_total")
+
+// mixCase is name with each letter upper or lower case at random, the
+// dns0x20 trick: every letter is a bit more a spoofer has to guess.
+func mixCase(name string) string {
+	b := []byte(strings.ToLower(name))
+	bits := make([]byte, (len(b)+7)/8)
+	_, _ = rand.Read(bits)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' && bits[i/8]&(1<<(i%8)) != 0 {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// exchange asks u for m. With caseRandomize, a plain upstream is sent the
+// qname in mixCase, and an answer not echoing it counts as a failed
+// exchange, asked again once; names in the answer are then given back the
+// case m has.
+func exchange(u *upstream, m *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error) {
+	q := upstreamQuery(m)
+	mixed := currentSettings().caseCheck && u.clients.net != "tcp-tls"
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
+	for try := 0; try < 2; try++ {
+		sent := q.Question[0].Name
+		if mixed {
+			sent = mixCase(m.Question[0].Name)
+			q.Id, q.Question[0].Name = dns.Id(), sent
+		}
+		cli := u.client(tcp)
+		r, rtt, err = cli.Exchange(q, u.addr)
+		cli.put()
+		if err == nil && mixed && (len(r.Question) != 1 || r.Question[0].Name != sent) {
+			atomic.AddInt64(caseMismatches, 1)
+			logThrottled.Warnf("case "+u.addr, "%s: answer from %s doesn't echo the qname's case, possibly forged", m.Question[0].Name, u.addr)
+			r, err = nil, errCaseMismatch
+		}
+		u.record(r, rtt, err)
+		if err != errCaseMismatch {
+			break
+		}
+	}
+	if err == nil && mixed {
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			for _, rr := range section {
+				if h := rr.Header(); strings.EqualFold(h.Name, m.Question[0].Name) {
+					h.Name = m.Question[0].Name
+				}
+			}
+		}
+	}
+	return r, rtt, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsClient is a client handed out by an upstream, to be given back with put.
+type dnsClient struct {
+	*dns.Client
+	pool *clientPool
+	gen  int64
+}
+
+// clientPool keeps up to dnsClientsIdle clients of one upstream and
+// transport, all made for the same config epoch; a reload discards them, so
+// they always reflect the current config. A client is only its config:
+// each exchange dials its own socket, over UDP from a port of its own.
+type clientPool struct {
+	net       string // udp, tcp or tcp-tls
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	gen  int64
+	idle []*dns.Client
+
+	hits, made *int64
+}
+
+func newClientPool(addr, net string, tlsConfig *tls.Config) *clientPool {
+	return &clientPool{
+		net:       net,
+		tlsConfig: tlsConfig,
+		hits:      metricCounter(metricName("dns_clients_total", "upstream", addr, "net", net, "result", "hit")),
+		made:      metricCounter(metricName("dns_clients_total", "upstream", addr, "net", net, "result", "made")),
+	}
+}
+
+func (p *clientPool) get() *dnsClient {
+	gen := atomic.LoadInt64(&configEpoch)
+	p.mu.Lock()
+	if p.gen != gen {
+		p.gen, p.idle = gen, nil
+	}
+	if n := len(p.idle); n > 0 {
+		cli := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		atomic.AddInt64(p.hits, 1)
+		return &dnsClient{cli, p, gen}
+	}
+	p.mu.Unlock()
+	atomic.AddInt64(p.made, 1)
+	return &dnsClient{p.newClient(), p, gen}
+}
+
+// newClient makes a client from the current config.
+func (p *clientPool) newClient() *dns.Client {
+	cli := &dns.Client{Net: p.net, Timeout: dnsTimeout}
+	if p.net == "tcp-tls" {
+		cli.TLSConfig = p.tlsConfig
+	}
+	return cli
+}
+
+// Exchange sends m to addr marked with loopGuardOption.
+func (c *dnsClient) Exchange(m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return c.Client.Exchange(loopMark(m), addr)
+}
+
+// put gives c back, unless it's from an older config or enough are idle.
+func (c *dnsClient) put() {
+	p := c.pool
+	p.mu.Lock()
+	if c.gen == p.gen && len(p.idle) < dnsClientsIdle {
+		p.idle = append(p.idle, c.Client)
+	}
+	p.mu.Unlock()
+}
+
+func (p *clientPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// client returns a client for u, over TCP if tcp and u is asked over UDP.
+func (u *upstream) client(tcp bool) *dnsClient {
+	if tcp && u.tcp != nil {
+		return u.tcp.get()
+	}
+	return u.clients.get()
+}
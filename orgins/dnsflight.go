@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flight is an upstream exchange identical queries that come in while it
+// runs wait for, rather than asking again: a page load fires the same A
+// and AAAA queries from several places at once.
+type flight struct {
+	done chan struct{}
+	r    *dns.Msg
+	rtt  time.Duration
+	err  error
+}
+
+var (
+	flightLock sync.Mutex
+	flights    = make(map[string]*flight)
+	coalesced  = metricCounter("dns_coalesced_total")
+)
+
+// flightKey is what makes two queries the same upstream exchange: the
+// upstream, the question, whether DNSSEC records are wanted and the
+// transport, as a UDP answer may come truncated.
+func flightKey(u *upstream, m *dns.Msg, tcp bool) string {
+	q := m.Question[0]
+	key := u.addr + "/" + strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass))
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		key += "/do"
+	}
+	if tcp {
+		key += "/tcp"
+	}
+	return key
+}
+
+// exchangeShared asks u for m, or waits for the identical query in flight.
+// Each caller gets its own copy of the answer, with its ID and question.
+func exchangeShared(u *upstream, m *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error) {
+	key := flightKey(u, m, tcp)
+	flightLock.Lock()
+	f, ok := flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		flights[key] = f
+	}
+	flightLock.Unlock()
+
+	if !ok {
+		f.r, f.rtt, f.err = exchange(u, m, tcp)
+		flightLock.Lock()
+		delete(flights, key)
+		flightLock.Unlock()
+		close(f.done)
+	} else {
+		atomic.AddInt64(coalesced, 1)
+		<-f.done
+	}
+	if f.err != nil {
+		return nil, f.rtt, f.err
+	}
+	r := f.r.Copy()
+	r.Id = m.Id
+	r.Question = append([]dns.Question(nil), m.Question...)
+	return r, f.rtt, nil
+}
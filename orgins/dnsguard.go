@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// bogonAllow lists domains (and their subdomains) whose secure answers may
+// be private addresses, for internal names proxied on purpose.
+var bogonAllow = []string{}
+
+var (
+	errResolve = errors.New("resolve error")
+	errBogon   = errors.New("only bogon addresses")
+)
+
+// bogonNets are ranges never reachable on the internet that isPrivateIP
+// doesn't cover: this network, documentation and reserved.
+var bogonNets = func() (ret []*net.IPNet) {
+	for _, c := range []string{
+		"0.0.0.0/8", "192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "2001:db8::/32",
+	} {
+		_, n, _ := net.ParseCIDR(c)
+		ret = append(ret, n)
+	}
+	return
+}()
+
+// isBogon reports whether ip can't be a real answer for a public name.
+func isBogon(ip net.IP, allowPrivate bool) bool {
+	if ip.IsMulticast() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip.IsPrivate() {
+		return !allowPrivate
+	}
+	for _, n := range bogonNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropBogons filters the secure answers for host, returning errBogon if
+// nothing is left.
+func dropBogons(host string, addrs []*Resolv) ([]*Resolv, error) {
+	allowPrivate := false
+	for _, allowed := range bogonAllow {
+		allowPrivate = allowPrivate || underDomain(host, allowed)
+	}
+	var ret []*Resolv
+	for _, a := range addrs {
+		h, _, err := net.SplitHostPort(a.addr)
+		if ip := net.ParseIP(h); err == nil && ip != nil && isBogon(ip, allowPrivate) {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	if dropped := len(addrs) - len(ret); dropped > 0 {
+		metricAdd("bogon_answers_total", int64(dropped))
+	}
+	if len(ret) == 0 {
+		logThrottled.Warnf(host, "%s: secure resolver answered only bogons, e.g. %s", host, addrs[0].addr)
+		metricAdd(metricName("dial_failures_total", "kind", "bogon"), 1)
+		return nil, errBogon
+	}
+	return ret, nil
+}
+
+// rebindAllow lists domains (and their subdomains) allowed to resolve to
+// private addresses when rebindProtect is on, e.g. dynamic DNS names of the LAN.
+var rebindAllow = []string{}
+
+// underDomain reports whether name (without trailing dot) is domain or one of
+// its subdomains.
+func underDomain(name, domain string) bool {
+	name, domain = strings.ToLower(name), strings.ToLower(domain)
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// stripRebinding removes answers pointing into private address space from an
+// upstream reply for an external name and reports how many were dropped.
+func stripRebinding(name string, r *dns.Msg) int {
+	if !rebindProtect {
+		return 0
+	}
+	for _, allowed := range rebindAllow {
+		if underDomain(name, allowed) {
+			return 0
+		}
+	}
+	kept := r.Answer[:0]
+	dropped := 0
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		}
+		if ip != nil && isPrivateIP(ip) {
+			dropped++
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	r.Answer = kept
+	return dropped
+}
+
+// stripAAAA removes the AAAA records from an upstream reply, and the IPv6
+// hints from its HTTPS and SVCB records, reporting how many it removed.
+func stripAAAA(r *dns.Msg) int {
+	n := 0
+	for _, sec := range []*[]dns.RR{&r.Answer, &r.Extra} {
+		kept := (*sec)[:0]
+		for _, rr := range *sec {
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				n++
+				continue
+			case *dns.HTTPS:
+				n += dropIPv6Hints(&rr.SVCB)
+			case *dns.SVCB:
+				n += dropIPv6Hints(rr)
+			}
+			kept = append(kept, rr)
+		}
+		*sec = kept
+	}
+	return n
+}
+
+func dropIPv6Hints(rr *dns.SVCB) int {
+	n := 0
+	kept := rr.Value[:0]
+	for _, kv := range rr.Value {
+		if kv.Key() == dns.SVCB_IPV6HINT {
+			n++
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	rr.Value = kept
+	return n
+}
+
+// answerInternal answers authoritatively for internalZone, which is never
+// forwarded: the configured address for A/AAAA, NXDOMAIN when there is none.
+func answerInternal(m *dns.Msg) (*dns.Msg, bool) {
+	q := m.Question[0]
+	if internalZone == "" || !underDomain(strings.TrimSuffix(q.Name, "."), internalZone) {
+		return nil, false
+	}
+	msg := new(dns.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+
+	ip := net.ParseIP(internalZoneAddr)
+	if ip == nil {
+		msg.Rcode = dns.RcodeNameError
+		return msg, true
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch {
+	case q.Qtype == dns.TypeA && ip.To4() != nil:
+		msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip.To4()}}
+	case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+		msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return msg, true
+}
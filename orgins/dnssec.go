@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC status of the addresses of a host, as RFC 4035 has them
+const (
+	dnssecSecure   = "secure"   // a chain of signatures up to a trust anchor
+	dnssecInsecure = "insecure" // a proven unsigned delegation on the way
+	dnssecBogus    = "bogus"    // neither, so not to be trusted
+)
+
+var validateDNSSEC = dnssecValidate
+
+// rootAnchors are the DS records of the root KSKs, KSK-2017 and KSK-2024,
+// trusted unless trustAnchorFile has others.
+var rootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var trustAnchors atomic.Value // []dns.RR, all *dns.DS of the root
+
+// loadTrustAnchors reads trustAnchorFile, DS records of the root in zone
+// file format, or takes rootAnchors without one. Anchors other than the
+// ones before forget every chain validated with those.
+func loadTrustAnchors() error {
+	if !validateDNSSEC {
+		return nil
+	}
+	lines := rootAnchors
+	if trustAnchorFile != "" {
+		f, err := os.Open(trustAnchorFile)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		lines = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, ";") {
+				lines = append(lines, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	var anchors []dns.RR
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return fmt.Errorf("trust anchor %q: %s", line, err)
+		}
+		if ds, ok := rr.(*dns.DS); !ok || ds.Hdr.Name != "." {
+			return fmt.Errorf("trust anchor %q: not a DS of the root", line)
+		}
+		anchors = append(anchors, rr)
+	}
+	if len(anchors) == 0 {
+		return errors.New("no trust anchors")
+	}
+	if old, _ := trustAnchors.Load().([]dns.RR); fmt.Sprint(old) != fmt.Sprint(anchors) {
+		trustAnchors.Store(anchors)
+		forgetTrust()
+	}
+	return nil
+}
+
+// zoneTrust is what was found out about a name on the way from the root
+// to an answer: a zone cut, secure with keys validated from the one above
+// or insecure with a proven missing DS; or no cut at all.
+type zoneTrust struct {
+	cut      bool
+	insecure bool
+	keys     []*dns.DNSKEY
+	expire   deadline
+}
+
+// zoneTrusts caches the chain by name, so an answer is validated with
+// the keys of its zone alone until their TTL runs out.
+var zoneTrusts = newBudgetMap("dnssec", zoneTrustCost, zoneTrustAge) // fqdn -> *zoneTrust
+
+func forgetTrust() {
+	zoneTrusts.Range(func(k, _ interface{}) bool {
+		zoneTrusts.Delete(k)
+		return true
+	})
+}
+
+// validateAnswer is the DNSSEC status of the answer r from u: secure if
+// every RRset is signed by the keys of its zone, insecure if one is in a
+// zone below an insecure delegation, bogus otherwise, with why.
+func validateAnswer(u *upstream, r *dns.Msg) (string, error) {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	sigs := make(map[setKey][]*dns.RRSIG)
+	for _, rr := range r.Answer {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := setKey{name, sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := setKey{name, rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	if len(sets) == 0 {
+		return dnssecInsecure, nil // nothing to vouch for
+	}
+	status := dnssecSecure
+	for k, set := range sets {
+		zone := k.name
+		if len(sigs[k]) > 0 {
+			zone = dns.Fqdn(strings.ToLower(sigs[k][0].SignerName))
+		}
+		found, t, err := trustFor(u, zone)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		switch {
+		case t.insecure:
+			status = dnssecInsecure
+		case len(sigs[k]) == 0:
+			return dnssecBogus, fmt.Errorf("%s %s unsigned in signed zone %s", k.name, dns.TypeToString[k.rtype], found)
+		case found != zone || !dns.IsSubDomain(zone, k.name):
+			return dnssecBogus, fmt.Errorf("%s %s signed by %s, not its zone %s", k.name, dns.TypeToString[k.rtype], zone, found)
+		default:
+			if err := verifyRRset(set, sigs[k], zone, t.keys); err != nil {
+				return dnssecBogus, fmt.Errorf("%s %s: %s", k.name, dns.TypeToString[k.rtype], err)
+			}
+		}
+	}
+	return status, nil
+}
+
+// trustFor walks from the root down to name, returning the closest zone
+// enclosing it and what's known of that: its keys, or that it's insecure.
+func trustFor(u *upstream, name string) (string, *zoneTrust, error) {
+	zone := "."
+	t, err := rootTrust(u)
+	if err != nil {
+		return "", nil, err
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0 && !t.insecure; i-- {
+		child := dns.Fqdn(strings.ToLower(strings.Join(labels[i:], ".")))
+		ct, err := childTrust(u, zone, t, child)
+		if err != nil {
+			return "", nil, err
+		}
+		if ct.cut {
+			zone, t = child, ct
+		}
+	}
+	return zone, t, nil
+}
+
+// rootTrust is the root zone with the keys the trust anchors vouch for.
+func rootTrust(u *upstream) (*zoneTrust, error) {
+	if v, ok := zoneTrusts.Load("."); ok && !v.(*zoneTrust).expire.passed() {
+		return v.(*zoneTrust), nil
+	}
+	anchors, _ := trustAnchors.Load().([]dns.RR)
+	keys, ttl, err := validatedKeys(u, ".", anchors)
+	if err != nil {
+		return nil, err
+	}
+	t := &zoneTrust{cut: true, keys: keys, expire: expireIn(ttl)}
+	zoneTrusts.Store(".", t)
+	return t, nil
+}
+
+// childTrust finds out whether child, a name below zone, is a zone cut
+// and whether secure, by the DS zone signs for it or the denial of one.
+func childTrust(u *upstream, zone string, t *zoneTrust, child string) (*zoneTrust, error) {
+	if v, ok := zoneTrusts.Load(child); ok && !v.(*zoneTrust).expire.passed() {
+		return v.(*zoneTrust), nil
+	}
+	r, err := askSigned(u, child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	ds, sigs := rrsetOf(r.Answer, child, dns.TypeDS)
+	ct := &zoneTrust{}
+	ttl := msgTTL(r)
+	switch {
+	case len(ds) > 0:
+		if err := verifyRRset(ds, sigs, zone, t.keys); err != nil {
+			return nil, fmt.Errorf("DS of %s: %s", child, err)
+		}
+		keys, keyTTL, err := validatedKeys(u, child, ds)
+		if err != nil {
+			return nil, err
+		}
+		ct.cut, ct.keys = true, keys
+		if keyTTL < ttl {
+			ttl = keyTTL
+		}
+	case hasCNAME(r.Answer, child):
+		// a CNAME's owner is no cut; a forged one only hides a zone whose
+		// answers then fail as unsigned in the one above
+	default:
+		if ct.cut, err = deniedDS(r.Ns, zone, t.keys, child); err != nil {
+			return nil, fmt.Errorf("DS of %s: %s", child, err)
+		}
+		ct.insecure = ct.cut
+	}
+	ct.expire = expireIn(ttl)
+	zoneTrusts.Store(child, ct)
+	return ct, nil
+}
+
+// validatedKeys asks for the DNSKEYs of zone and returns them if one the
+// DS records in ds are of, a key signing key, signed them all.
+func validatedKeys(u *upstream, zone string, ds []dns.RR) ([]*dns.DNSKEY, time.Duration, error) {
+	r, err := askSigned(u, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	set, sigs := rrsetOf(r.Answer, zone, dns.TypeDNSKEY)
+	var keys []*dns.DNSKEY
+	for _, rr := range set {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	for _, rr := range ds {
+		d := rr.(*dns.DS)
+		for _, k := range keys {
+			if k.Flags&dns.ZONE == 0 || k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := k.ToDS(d.DigestType); kd == nil || !strings.EqualFold(kd.Digest, d.Digest) {
+				continue
+			}
+			if verifyRRset(set, sigs, zone, []*dns.DNSKEY{k}) == nil {
+				return keys, msgTTL(r), nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("DNSKEY of %s: none signed by a key of its DS", zone)
+}
+
+// verifyRRset checks one of sigs, made by zone, is a valid signature of
+// set by one of keys.
+func verifyRRset(set []dns.RR, sigs []*dns.RRSIG, zone string, keys []*dns.DNSKEY) error {
+	now := clk.Now()
+	for _, sig := range sigs {
+		if !strings.EqualFold(dns.Fqdn(sig.SignerName), zone) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, set) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid signature by %s", zone)
+}
+
+// deniedDS checks the NSEC or NSEC3 records in ns, signed by zone, prove
+// child has no DS, and reports whether child is a cut: an insecure
+// delegation, or one maybe, under an NSEC3 opt-out span.
+func deniedDS(ns []dns.RR, zone string, keys []*dns.DNSKEY, child string) (bool, error) {
+	for _, rr := range ns {
+		var bitmap []uint16
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			switch {
+			case strings.EqualFold(n.Hdr.Name, child):
+				bitmap = n.TypeBitMap
+			case canonicalLess(n.Hdr.Name, child) && dns.IsSubDomain(child, n.NextDomain) && !strings.EqualFold(n.NextDomain, child):
+				// an empty non-terminal, the next name being below it
+				bitmap = []uint16{}
+			default:
+				continue
+			}
+		case *dns.NSEC3:
+			switch {
+			case n.Match(child):
+				bitmap = n.TypeBitMap
+			case n.Cover(child) && n.Flags&1 != 0:
+				bitmap = []uint16{dns.TypeNS} // opt-out: there may be an unsigned delegation
+			default:
+				continue
+			}
+		default:
+			continue
+		}
+		set, sigs := rrsetOf(ns, rr.Header().Name, rr.Header().Rrtype)
+		if err := verifyRRset(set, sigs, zone, keys); err != nil {
+			return false, err
+		}
+		has := func(t uint16) bool {
+			for _, b := range bitmap {
+				if b == t {
+					return true
+				}
+			}
+			return false
+		}
+		if has(dns.TypeDS) {
+			return false, errors.New("denied, but listed in the NSEC bitmap")
+		}
+		return has(dns.TypeNS) && !has(dns.TypeSOA), nil
+	}
+	return false, errors.New("denied with no proof")
+}
+
+// canonicalLess orders names as RFC 4034 6.1 does: by label from the
+// right, lowercased.
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// dnssecOf is the status of the answer addr came in for host, "" if it's
+// not the one cached, e.g. pinned from before.
+func dnssecOf(host, addr string) string {
+	if r, ok := cacheResolv.Load(host); ok && r.(*Resolv).addr == addr {
+		return r.(*Resolv).dnssec
+	}
+	return ""
+}
+
+// askSigned asks u for name and qtype with the DO bit, over TCP again if
+// the answer was truncated.
+func askSigned(u *upstream, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(ednsUDPSize, true)
+	r, _, err := exchange(u, m, false)
+	if err == nil && r.Truncated {
+		r, _, err = exchange(u, m, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// rrsetOf is the RRset of name and rtype in rrs, and the RRSIGs over it.
+func rrsetOf(rrs []dns.RR, name string, rtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rtype {
+			set = append(set, rr)
+		}
+	}
+	return set, sigs
+}
+
+func hasCNAME(rrs []dns.RR, name string) bool {
+	set, _ := rrsetOf(rrs, name, dns.TypeCNAME)
+	return len(set) > 0
+}
+
+// msgTTL is the lowest TTL in the answer and authority of r, within
+// negativeTtl and cacheAddrTtl, so a chain is checked again at most that
+// often and at least that seldom.
+func msgTTL(r *dns.Msg) time.Duration {
+	ttl := cacheAddrTtl
+	for _, rr := range append(append([]dns.RR{}, r.Answer...), r.Ns...) {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if ttl < negativeTtl {
+		ttl = negativeTtl
+	}
+	return ttl
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// isTCP reports whether the query came over TCP, where replies aren't
+// truncated and the upstream is asked over TCP too.
+func isTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+// clientSize is the largest reply the client said it can take over UDP.
+func clientSize(w dns.ResponseWriter, m *dns.Msg) int {
+	if isTCP(w) {
+		return dns.MaxMsgSize
+	}
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// upstreamQuery copies m for defDNS with our own OPT RR. Options are hop by
+// hop, so only the DO bit of the client's is kept.
+func upstreamQuery(m *dns.Msg) *dns.Msg {
+	q := m.Copy()
+	do := false
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	removeOPT(q)
+	q.SetEdns0(ednsUDPSize, do)
+	return q
+}
+
+// clientReply fits an upstream reply to the client: upstream options like
+// cookies are dropped, an OPT RR is only sent back if the client sent one,
+// and the reply is truncated with TC set if it's bigger than the client takes.
+func clientReply(w dns.ResponseWriter, m, r *dns.Msg) {
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	removeOPT(r)
+	if copt := m.IsEdns0(); copt != nil {
+		r.SetEdns0(ednsUDPSize, do && copt.Do())
+	} else if r.Rcode > 0xF {
+		r.Rcode = dns.RcodeServerFailure // extended rcodes need an OPT RR
+	}
+	r.Truncate(clientSize(w, m))
+}
+
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
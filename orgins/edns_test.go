@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// addrWriter is a dns.ResponseWriter for a client at addr, only to be
+// asked where the query came from.
+type addrWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+}
+
+func (w addrWriter) RemoteAddr() net.Addr { return w.addr }
+
+var (
+	udpClient = addrWriter{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000}}
+	tcpClient = addrWriter{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000}}
+)
+
+// ednsQuery is an A query for edns.test, with an OPT RR of size and do
+// unless size is 0, carrying opts.
+func ednsQuery(size uint16, do bool, opts ...dns.EDNS0) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("edns.test.", dns.TypeA)
+	if size > 0 {
+		m.SetEdns0(size, do)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, opts...)
+	}
+	return m
+}
+
+// ednsReply answers q with n A records, and an OPT RR with do and opts if
+// withOPT.
+func ednsReply(q *dns.Msg, n int, withOPT, do bool, opts ...dns.EDNS0) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for i := 0; i < n; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "edns.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(198, 51, 100, byte(i)),
+		})
+	}
+	r.Extra = nil
+	if withOPT {
+		r.SetEdns0(4096, do)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, opts...)
+	}
+	return r
+}
+
+func cookie(c string) *dns.EDNS0_COOKIE {
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c}
+}
+
+func TestUpstreamQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *dns.Msg
+		do    bool
+	}{
+		{"no OPT", ednsQuery(0, false), false},
+		{"OPT", ednsQuery(4096, false), false},
+		{"DO", ednsQuery(4096, true), true},
+		{"client cookie", ednsQuery(1232, true, cookie("0102030405060708")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before int
+			if opt := tt.query.IsEdns0(); opt != nil {
+				before = len(opt.Option)
+			}
+			q := upstreamQuery(tt.query)
+			opt := q.IsEdns0()
+			switch {
+			case opt == nil:
+				t.Fatal("no OPT RR")
+			case opt.UDPSize() != ednsUDPSize:
+				t.Errorf("UDP size %d, want %d", opt.UDPSize(), ednsUDPSize)
+			case opt.Do() != tt.do:
+				t.Errorf("DO %v, want %v", opt.Do(), tt.do)
+			case len(opt.Option) != 0:
+				t.Errorf("options %v sent upstream", opt.Option)
+			}
+			if n := len(q.Extra); n != 1 {
+				t.Errorf("%d additional RRs, want the OPT RR", n)
+			}
+			if opt := tt.query.IsEdns0(); opt != nil && len(opt.Option) != before {
+				t.Error("the client's query was changed")
+			}
+		})
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		w         dns.ResponseWriter
+		query     *dns.Msg
+		reply     func(q *dns.Msg) *dns.Msg
+		opt, do   bool
+		truncated bool
+		rcode     int
+	}{
+		{"no OPT, fits in 512", udpClient, ednsQuery(0, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 2, true, false) }, false, false, false, dns.RcodeSuccess},
+		{"no OPT, over 512", udpClient, ednsQuery(0, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 60, true, false) }, false, false, true, dns.RcodeSuccess},
+		{"no OPT over TCP", tcpClient, ednsQuery(0, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 60, true, false) }, false, false, false, dns.RcodeSuccess},
+		{"OPT of 4096", udpClient, ednsQuery(4096, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 60, true, false) }, true, false, false, dns.RcodeSuccess},
+		{"OPT below 512 taken as 512", udpClient, ednsQuery(256, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 60, true, false) }, true, false, true, dns.RcodeSuccess},
+		{"DO both ways", udpClient, ednsQuery(1232, true),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 2, true, true) }, true, true, false, dns.RcodeSuccess},
+		{"DO asked, upstream without", udpClient, ednsQuery(1232, true),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 2, true, false) }, true, false, false, dns.RcodeSuccess},
+		{"DO not asked, upstream with", udpClient, ednsQuery(1232, false),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 2, true, true) }, true, false, false, dns.RcodeSuccess},
+		{"upstream without OPT", udpClient, ednsQuery(1232, true),
+			func(q *dns.Msg) *dns.Msg { return ednsReply(q, 2, false, false) }, true, false, false, dns.RcodeSuccess},
+		{"upstream cookie dropped", udpClient, ednsQuery(1232, false, cookie("0102030405060708")),
+			func(q *dns.Msg) *dns.Msg {
+				return ednsReply(q, 2, true, false, cookie("01020304050607081112131415161718"))
+			}, true, false, false, dns.RcodeSuccess},
+		{"extended rcode kept with OPT", udpClient, ednsQuery(1232, false),
+			func(q *dns.Msg) *dns.Msg {
+				r := ednsReply(q, 0, true, false)
+				r.Rcode = dns.RcodeBadCookie
+				return r
+			}, true, false, false, dns.RcodeBadCookie},
+		{"extended rcode without OPT", udpClient, ednsQuery(0, false),
+			func(q *dns.Msg) *dns.Msg {
+				r := ednsReply(q, 0, true, false)
+				r.Rcode = dns.RcodeBadCookie
+				return r
+			}, false, false, false, dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.reply(tt.query)
+			clientReply(tt.w, tt.query, r)
+			opt := r.IsEdns0()
+			if (opt != nil) != tt.opt {
+				t.Fatalf("OPT RR %v, want %v", opt != nil, tt.opt)
+			}
+			if opt != nil {
+				if opt.Do() != tt.do {
+					t.Errorf("DO %v, want %v", opt.Do(), tt.do)
+				}
+				if len(opt.Option) != 0 {
+					t.Errorf("upstream options %v passed on", opt.Option)
+				}
+			}
+			if r.Truncated != tt.truncated {
+				t.Errorf("TC %v, want %v", r.Truncated, tt.truncated)
+			}
+			if size := clientSize(tt.w, tt.query); r.Len() > size {
+				t.Errorf("reply of %d bytes, the client takes %d", r.Len(), size)
+			}
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultErrorPage is used when errorPageFile is unset.
+const defaultErrorPage = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Reason}}</p>
+<p><small>{{if .Host}}{{.Host}}, {{end}}requested from {{.Client}}</small></p>
+</body>
+</html>
+`
+
+// errorData is what error page templates can use.
+type errorData struct {
+	Host       string `json:"host,omitempty"`
+	Client     string `json:"client"`
+	Reason     string `json:"reason"`
+	Status     int    `json:"status"`
+	StatusText string `json:"-"`
+	Lang       string `json:"-"`
+	Source     string `json:"source"` // always "proxy", telling our errors from the origin's
+}
+
+var errorPage atomic.Value // *template.Template
+
+// loadErrorPage parses errorPageFile, or the default page if it's unset, so
+// a broken template fails at load and not on a request.
+func loadErrorPage() error {
+	text := defaultErrorPage
+	if errorPageFile != "" {
+		data, err := ioutil.ReadFile(errorPageFile)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	t, err := template.New("error").Parse(text)
+	if err != nil {
+		return err
+	}
+	errorPage.Store(t)
+	return nil
+}
+
+// renderError builds the body of a proxy-generated error for req, JSON if
+// the client asked for it.
+func renderError(req *http.Request, status int, reason string) (string, []byte) {
+	host, _ := proxiedHost(req) // never reflect arbitrary Host headers
+	d := &errorData{
+		Host:       host,
+		Reason:     reason,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Lang:       errorPageLang,
+		Source:     "proxy",
+	}
+	if client, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		d.Client = client
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		body, _ := json.Marshal(d)
+		return "application/json", append(body, '\n')
+	}
+	var buf bytes.Buffer
+	if err := errorPage.Load().(*template.Template).Execute(&buf, d); err != nil {
+		log.Errorf("error page: %s", err)
+		return "text/plain; charset=utf-8", []byte(reason + "\n")
+	}
+	return "text/html; charset=utf-8", buf.Bytes()
+}
+
+// serveError writes a proxy-generated error to w.
+func serveError(w http.ResponseWriter, req *http.Request, status int, reason string) {
+	ctype, body := renderError(req, status, reason)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Language", errorPageLang)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
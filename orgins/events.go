@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// event types
+const (
+	evConfigReloaded    = "config_reloaded"
+	evUpstreamUnhealthy = "upstream_unhealthy"
+	evUpstreamHealthy   = "upstream_healthy"
+	evCAExpiry          = "ca_expiry"
+	evBlockedBurst      = "blocked_burst"
+	evUpgraded          = "upgraded"
+	evUpgradeFailed     = "upgrade_failed"
+	evBreakerOpened     = "breaker_opened"
+	evBreakerClosed     = "breaker_closed"
+	evComponentFailed   = "component_failed"
+	evLeafKeyExported   = "leaf_key_exported"
+)
+
+// eventWebhookTypes are posted to eventWebhook, all of them when empty.
+var eventWebhookTypes = []string{evUpstreamUnhealthy, evCAExpiry, evBlockedBurst, evUpgradeFailed, evComponentFailed, evLeafKeyExported}
+
+// event is what /events and the webhook get, one JSON object each.
+type event struct {
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// subscriber gets events through a buffer; when it's full the oldest event
+// is dropped, so a slow consumer never holds up whoever emits.
+type subscriber struct {
+	ch    chan *event
+	types map[string]bool // nil for all
+}
+
+var (
+	subsLock      sync.Mutex
+	subs          = make(map[*subscriber]struct{})
+	eventsDropped = metricCounter("events_dropped_total")
+)
+
+func subscribe(types []string) *subscriber {
+	s := &subscriber{ch: make(chan *event, 64)}
+	if len(types) > 0 {
+		s.types = make(map[string]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	subsLock.Lock()
+	subs[s] = struct{}{}
+	subsLock.Unlock()
+	return s
+}
+
+func unsubscribe(s *subscriber) {
+	subsLock.Lock()
+	delete(subs, s)
+	subsLock.Unlock()
+}
+
+// emit sends an event to every interested subscriber without blocking.
+func emit(typ string, data map[string]interface{}) {
+	ev := &event{Type: typ, Time: time.Now(), Data: data}
+	metricAdd(metricName("events_total", "type", typ), 1)
+	subsLock.Lock()
+	defer subsLock.Unlock()
+	for s := range subs {
+		if s.types != nil && !s.types[typ] {
+			continue
+		}
+		for {
+			select {
+			case s.ch <- ev:
+			default:
+				select {
+				case <-s.ch:
+					atomic.AddInt64(eventsDropped, 1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// eventsHandler streams events as server-sent events, filtered by
+// ?type=a,b.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = strings.Split(t, ",")
+	}
+	s := subscribe(types)
+	defer unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-s.ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// startEventWebhook posts eventWebhookTypes to eventWebhook, retrying with
+// backoff; events keep being dropped oldest-first while it's stuck.
+func startEventWebhook() {
+	if eventWebhook == "" {
+		return
+	}
+	s := subscribe(eventWebhookTypes)
+	go func() {
+		for ev := range s.ch {
+			body, err := json.Marshal(ev)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			backoff := time.Second
+			for try := 1; ; try++ {
+				err = postEvent(body)
+				if err == nil || try == 5 {
+					break
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			if err != nil {
+				logThrottled.Errorf("event webhook", "event webhook: %s", err)
+			}
+		}
+	}()
+}
+
+func postEvent(body []byte) error {
+	resp, err := webhookCli.Post(eventWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// watchBlocked emits evBlockedBurst when more than blockedBurst queries were
+// blocked within a minute, at most once a minute.
+func watchBlocked() {
+	go func() {
+		blocked := queryByDecision[decisionBlocked]
+		last := atomic.LoadInt64(blocked)
+		for {
+			time.Sleep(time.Minute)
+			cur := atomic.LoadInt64(blocked)
+			if n := cur - last; n > blockedBurst {
+				emit(evBlockedBurst, map[string]interface{}{"blocked": n, "window_seconds": 60})
+			}
+			last = cur
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// expiryThresholds are the remaining lifetimes of the CA at which a warning is
+// logged and expiryWebhook called, once each.
+var expiryThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// certExpiry is the /status view of one certificate.
+type certExpiry struct {
+	Subject   string    `json:"subject"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn int64     `json:"expires_in_seconds"`
+}
+
+type expiryAlert struct {
+	certExpiry
+	Threshold string `json:"threshold"`
+}
+
+var (
+	expiryLock  sync.Mutex
+	expiryCA    *certExpiry
+	expiryLeaf  *certExpiry                  // soonest-expiring cached leaf
+	expiryFired = map[string]time.Duration{} // CA serial -> smallest threshold alerted
+	webhookCli  = &http.Client{Timeout: 10 * time.Second, Transport: bootstrapTransport}
+)
+
+func newCertExpiry(subject string, notAfter time.Time) *certExpiry {
+	return &certExpiry{
+		Subject:   subject,
+		NotAfter:  notAfter,
+		ExpiresIn: int64(notAfter.Sub(clk.Now()) / time.Second),
+	}
+}
+
+// checkExpiry updates the expiry gauges, alerts on CA thresholds and drops
+// leaves about to expire so they are minted again on the next handshake.
+func checkExpiry() {
+	ca := currentCA().cert
+	caExp := newCertExpiry(ca.Subject.CommonName, ca.NotAfter)
+	metricSet("ca_expiry_seconds", caExp.ExpiresIn)
+
+	var leafExp *certExpiry
+	cacheCert.Range(func(k, v interface{}) bool {
+		leaf := v.(*tls.Certificate).Leaf
+		if leaf == nil {
+			return true
+		}
+		if leaf.NotAfter.Sub(clk.Now()) < time.Hour {
+			cacheCert.Delete(k)
+			return true
+		}
+		if leafExp == nil || leaf.NotAfter.Before(leafExp.NotAfter) {
+			leafExp = newCertExpiry(leaf.Subject.CommonName, leaf.NotAfter)
+		}
+		return true
+	})
+	if leafExp != nil {
+		metricSet("leaf_expiry_seconds", leafExp.ExpiresIn)
+	}
+
+	expiryLock.Lock()
+	expiryCA, expiryLeaf = caExp, leafExp
+	serial := ca.SerialNumber.String()
+	fired, seen := expiryFired[serial]
+	var crossed time.Duration
+	for _, t := range expiryThresholds {
+		if ca.NotAfter.Sub(clk.Now()) < t && (!seen || t < fired) {
+			crossed = t
+		}
+	}
+	if crossed > 0 {
+		expiryFired[serial] = crossed
+	}
+	expiryLock.Unlock()
+
+	if crossed > 0 {
+		if caExp.ExpiresIn <= 0 {
+			log.Errorf("CA %s expired at %s", caExp.Subject, ca.NotAfter.Format(time.RFC3339))
+		} else {
+			log.Warnf("CA %s expires in %s, at %s", caExp.Subject,
+				ca.NotAfter.Sub(clk.Now()).Round(time.Minute), ca.NotAfter.Format(time.RFC3339))
+		}
+		emit(evCAExpiry, map[string]interface{}{
+			"subject":            caExp.Subject,
+			"not_after":          caExp.NotAfter,
+			"expires_in_seconds": caExp.ExpiresIn,
+			"threshold":          crossed.String(),
+		})
+		go callExpiryWebhook(&expiryAlert{*caExp, crossed.String()})
+	}
+}
+
+func callExpiryWebhook(alert *expiryAlert) {
+	if expiryWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	resp, err := webhookCli.Post(expiryWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("expiry webhook: %s", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Errorf("expiry webhook: %s", resp.Status)
+	}
+}
+
+func pollingExpiry() {
+	checkExpiry()
+	go func() {
+		for {
+			time.Sleep(expiryCheckInterval)
+			checkExpiry()
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// why a connection couldn't be relayed, in the access log and metrics and,
+// where the protocol allows, told to the client
+const (
+	failRuleRejected = "rule-rejected"
+	failResolve      = "resolve-failed"
+	failUnreachable  = "all-addresses-unreachable"
+	failVerify       = "upstream-verify-failed"
+	failTimeout      = "timeout"
+	failLimit        = "limit-exceeded"
+	failOldTLS       = "tls-version-too-old"
+	failCircuitOpen  = "circuit-open"
+	failFingerprint  = "fingerprint-blocked"
+	failClientCert   = "client-cert-failed"
+)
+
+// failAlerts is the TLS alert a failure during the client handshake is sent
+// as, each its own so they can be told apart from the client side.
+var failAlerts = map[string]byte{
+	failRuleRejected: 49,  // access_denied
+	failResolve:      112, // unrecognized_name
+	failUnreachable:  80,  // internal_error
+	failVerify:       46,  // certificate_unknown
+	failTimeout:      90,  // user_canceled
+	failLimit:        40,  // handshake_failure
+	failOldTLS:       70,  // protocol_version
+	failCircuitOpen:  80,  // internal_error, as unreachable: it was, just now
+	failFingerprint:  49,  // access_denied, as a rule would
+	failClientCert:   80,  // internal_error, the credential is ours to fix
+}
+
+// countFailure counts a connection that failed for kind.
+func countFailure(kind string) {
+	metricAdd(metricName("relay_failures_total", "kind", kind), 1)
+}
+
+// failHandshake sends the alert for kind to the client whose ClientHello is
+// being answered, and returns the error that aborts the handshake. Nothing
+// was written to conn yet, so the alert is the first record it gets.
+func failHandshake(conn net.Conn, kind string) error {
+	countFailure(kind)
+	if alert, ok := failAlerts[kind]; ok && alert != 80 {
+		sendAlert(conn, alert)
+	}
+	return relayFailure(kind)
+}
+
+// sendAlert writes a fatal alert to a client in its handshake, which
+// crypto/tls itself only sends internal_error for a failed callback.
+func sendAlert(conn net.Conn, alert byte) {
+	_, _ = conn.Write([]byte{21, 3, 3, 0, 2, 2, alert})
+}
+
+// problem is an RFC 7807 body telling an HTTP client why its request
+// couldn't be relayed.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Kind   string `json:"error"`
+	Host   string `json:"host"`
+	Source string `json:"source"` // always "proxy", as on error pages
+}
+
+// failHTTP answers the request at the start of head with a problem response
+// for kind, if head is one: the upstream failed before sending anything, so
+// the client still waits for a response. Reports whether it answered.
+func failHTTP(w net.Conn, head []byte, host, kind string) bool {
+	isHTTP := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(head, m) {
+			isHTTP = true
+		}
+	}
+	if !isHTTP {
+		return false
+	}
+	status := http.StatusBadGateway
+	if kind == failTimeout {
+		status = http.StatusGatewayTimeout
+	}
+	body, _ := json.Marshal(&problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: host + " couldn't be reached through the proxy: " + kind,
+		Kind:   kind,
+		Host:   host,
+		Source: "proxy",
+	})
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: application/problem+json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	return err == nil
+}
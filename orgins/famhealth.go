@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// famHealth is what the last famWindow direct dials in an address family
+// went like. A family losing connectivity as a whole, like IPv6 on a
+// flapping ISP, is demoted: its addrs are tried last and its cached ones
+// skipped, until a dial in it succeeds again.
+type famHealth struct {
+	mu       sync.Mutex
+	name     string
+	failed   [famWindow]bool // a ring, next is the oldest
+	n, next  int
+	demoted  time.Time // zero while healthy
+	probed   time.Time // the last dial let through while demoted
+	failures int64     // in all, for /status
+}
+
+var famHealths = [2]*famHealth{{name: "ipv4"}, {name: "ipv6"}}
+
+// famOf returns the health of the family of addr (host:port), nil if it's
+// not an IP.
+func famOf(addr string) *famHealth {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil:
+		return famHealths[0]
+	}
+	return famHealths[1]
+}
+
+// recordDial counts the outcome of a direct dial of addr. Only failures
+// reaching addr count, not certificates it presents or clients going away.
+func recordDial(addr string, err error) {
+	f := famOf(addr)
+	if f == nil || err != nil && (errors.Is(err, context.Canceled) || dialFailure(err) == failVerify) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil && !f.demoted.IsZero() {
+		log.Infof("%s is back, %s dialed after %s demoted", f.name, addr, time.Since(f.demoted).Round(time.Second))
+		metricAdd(metricName("family_recoveries_total", "family", f.name), 1)
+		f.demoted, f.n, f.next = time.Time{}, 0, 0
+		return
+	}
+	f.failed[f.next] = err != nil
+	f.next = (f.next + 1) % famWindow
+	if f.n < famWindow {
+		f.n++
+	}
+	if err != nil {
+		f.failures++
+	}
+	if f.demoted.IsZero() && f.n >= famWindow/2 && float64(f.failCount()) >= famFailRatio*float64(f.n) {
+		log.Warnf("%s demoted: %d of the last %d dials failed", f.name, f.failCount(), f.n)
+		metricAdd(metricName("family_demotions_total", "family", f.name), 1)
+		f.demoted, f.probed = time.Now(), time.Now()
+	}
+}
+
+func (f *famHealth) failCount() (n int) {
+	for i := 0; i < f.n; i++ {
+		if f.failed[i] {
+			n++
+		}
+	}
+	return
+}
+
+// famDemoted reports whether addr's family is demoted, except once every
+// famProbeEvery, to let a dial find out whether it's back.
+func famDemoted(addr string) bool {
+	f := famOf(addr)
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.demoted.IsZero() {
+		return false
+	}
+	if time.Since(f.probed) >= famProbeEvery {
+		f.probed = time.Now()
+		return false
+	}
+	return true
+}
+
+// orderByHealth moves the addrs of a demoted family after the others,
+// keeping the order within each. With both families demoted, it doesn't.
+func orderByHealth(addrs []*Resolv) []*Resolv {
+	var good, bad []*Resolv
+	for _, a := range addrs {
+		if famDemoted(a.addr) {
+			bad = append(bad, a)
+		} else {
+			good = append(good, a)
+		}
+	}
+	if len(good) == 0 {
+		return addrs
+	}
+	return append(good, bad...)
+}
+
+type famStatus struct {
+	Family   string     `json:"family"`
+	Recent   int        `json:"recent_dials"`
+	Failed   int        `json:"recent_failures"`
+	Failures int64      `json:"failures_total"`
+	Demoted  *time.Time `json:"demoted_since,omitempty"`
+}
+
+// famReport is the health of both families, for /status.
+func famReport() []famStatus {
+	var ret []famStatus
+	for _, f := range famHealths {
+		f.mu.Lock()
+		s := famStatus{Family: f.name, Recent: f.n, Failed: f.failCount(), Failures: f.failures}
+		if !f.demoted.IsZero() {
+			since := f.demoted
+			s.Demoted = &since
+		}
+		f.mu.Unlock()
+		ret = append(ret, s)
+	}
+	return ret
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// family is an address family preference for upstream dialing.
+type family int
+
+const (
+	famDefault family = iota // rules only: use the global addrFamily
+	famAuto                  // IPv6 first, then IPv4
+	famPrefer4
+	famPrefer6
+	famOnly4
+	famOnly6
+)
+
+var familyNames = map[string]family{
+	"auto":        famAuto,
+	"prefer-ipv4": famPrefer4,
+	"prefer-ipv6": famPrefer6,
+	"ipv4-only":   famOnly4,
+	"ipv6-only":   famOnly6,
+	"ipv4":        famOnly4,
+	"ipv6":        famOnly6,
+}
+
+var defaultFamily = famAuto
+
+// String is the name parseFamily reads back as f.
+func (f family) String() string {
+	switch f {
+	case famPrefer4:
+		return "prefer-ipv4"
+	case famPrefer6:
+		return "prefer-ipv6"
+	case famOnly4:
+		return "ipv4-only"
+	case famOnly6:
+		return "ipv6-only"
+	case famDefault:
+		return "default"
+	}
+	return "auto"
+}
+
+func parseFamily(s string) (family, bool) {
+	f, ok := familyNames[s]
+	return f, ok
+}
+
+// qtypes returns the address queries to send, in preference order.
+func (f family) qtypes() []uint16 {
+	switch f {
+	case famDefault:
+		return defaultFamily.qtypes()
+	case famPrefer4:
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	case famOnly4:
+		return []uint16{dns.TypeA}
+	case famOnly6:
+		return []uint16{dns.TypeAAAA}
+	default:
+		return []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+}
+
+// allows reports whether addr (host:port) may be dialed under f.
+func (f family) allows(addr string) bool {
+	if f == famDefault {
+		f = defaultFamily
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
+	}
+	v4 := net.ParseIP(host).To4() != nil
+	return !(f == famOnly4 && !v4 || f == famOnly6 && v4)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// clientFingerprint is the JA3 fingerprint of a ClientHello: the MD5, in
+// hex, of
+//
+//	version,ciphers,extensions,curves,point formats
+//
+// each list in decimal joined by dashes, in the order the client sent
+// them, GREASE values left out. ClientHelloInfo has no legacy version, so
+// the highest one offered stands in for it, capped at TLS 1.2 as TLS 1.3
+// clients send. It's built on the stack, the hex string being the only
+// allocation for most hellos.
+func clientFingerprint(hello *tls.ClientHelloInfo) string {
+	var buf [512]byte
+	b := buf[:0]
+
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGrease(v) && v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	b = strconv.AppendUint(b, uint64(version), 10)
+
+	b = append(b, ',')
+	b = appendJA3List(b, len(hello.CipherSuites), func(i int) uint16 { return hello.CipherSuites[i] })
+	b = append(b, ',')
+	b = appendJA3List(b, len(hello.Extensions), func(i int) uint16 { return hello.Extensions[i] })
+	b = append(b, ',')
+	b = appendJA3List(b, len(hello.SupportedCurves), func(i int) uint16 { return uint16(hello.SupportedCurves[i]) })
+	b = append(b, ',')
+	b = appendJA3List(b, len(hello.SupportedPoints), func(i int) uint16 { return uint16(hello.SupportedPoints[i]) })
+
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func appendJA3List(b []byte, n int, at func(i int) uint16) []byte {
+	first := true
+	for i := 0; i < n; i++ {
+		v := at(i)
+		if isGrease(v) {
+			continue
+		}
+		if !first {
+			b = append(b, '-')
+		}
+		first = false
+		b = strconv.AppendUint(b, uint64(v), 10)
+	}
+	return b
+}
+
+// isGrease reports whether v is one of the values of RFC 8701, sent to keep
+// servers tolerant of unknown ones.
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+var (
+	fingerprintsSeen  sync.Map // fingerprint -> *int64, its counter
+	fingerprintsCount int64    // entries in fingerprintsSeen
+)
+
+// countFingerprint counts a connection by its client's fingerprint, the
+// first fingerprintsMax distinct ones each on their own, those after as
+// other.
+func countFingerprint(fp string) {
+	if c, ok := fingerprintsSeen.Load(fp); ok {
+		atomic.AddInt64(c.(*int64), 1)
+		return
+	}
+	if atomic.AddInt64(&fingerprintsCount, 1) > fingerprintsMax {
+		atomic.AddInt64(&fingerprintsCount, -1)
+		metricAdd(metricName("client_fingerprints_total", "ja3", "other"), 1)
+		return
+	}
+	c, loaded := fingerprintsSeen.LoadOrStore(fp, metricCounter(metricName("client_fingerprints_total", "ja3", fp)))
+	if loaded {
+		atomic.AddInt64(&fingerprintsCount, -1)
+	}
+	atomic.AddInt64(c.(*int64), 1)
+	metricSet("client_fingerprints_distinct", atomic.LoadInt64(&fingerprintsCount))
+}
+
+// fingerprintPolicy is what the fingerprints section of the config file
+// says about the clients with one fingerprint:
+//
+//	[fingerprints]
+//	e7d705a3286e19ea42f587b344ee6865 = "log"
+//	6734f37431670b3ab4292b8f60f29984 = "block"
+//	b32309a26951912be7dba376398abc3b = "route=wg"
+//
+// log only logs their connections, block refuses them as a rule would, and
+// route sends them through the route named instead of their rule's.
+type fingerprintPolicy struct {
+	block bool
+	route string
+}
+
+// parseFingerprintPolicy reads a value of the fingerprints section,
+// returning what's wrong with it if it's no good.
+func parseFingerprintPolicy(v string) (fingerprintPolicy, string) {
+	switch {
+	case v == "log":
+		return fingerprintPolicy{}, ""
+	case v == "block":
+		return fingerprintPolicy{block: true}, ""
+	case strings.HasPrefix(v, "route=") && len(v) > len("route="):
+		return fingerprintPolicy{route: v[len("route="):]}, ""
+	}
+	return fingerprintPolicy{}, "needs to be log, block or route=name, not " + v
+}
+
+func (p fingerprintPolicy) String() string {
+	switch {
+	case p.block:
+		return "block"
+	case p.route != "":
+		return "route=" + p.route
+	}
+	return "log"
+}
+
+// validFingerprint reports whether fp looks like what clientFingerprint
+// returns.
+func validFingerprint(fp string) bool {
+	if len(fp) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(fp)
+	return err == nil && strings.ToLower(fp) == fp
+}
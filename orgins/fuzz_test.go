@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+// hostileNames seed the fuzzers with what a ClientHello or a query may
+// carry: oversized names and labels, bytes outside LDH, and URLs' ports,
+// paths and userinfo where only a name belongs.
+var hostileNames = []string{
+	"",
+	".",
+	"proxied.test",
+	"www.proxied.test.",
+	"WWW.Proxied.TEST",
+	strings.Repeat("a", 10000),
+	strings.Repeat("a.", 5000) + "proxied.test",
+	strings.Repeat("a", 64) + ".proxied.test",
+	strings.Repeat("a", 63) + ".proxied.test",
+	"ex ample.proxied.test",
+	"exa_mple.proxied.test",
+	"-lead.proxied.test",
+	"a..proxied.test",
+	"ünicode.proxied.test",
+	"a\x00b.proxied.test",
+	"proxied.test\n",
+	"proxied.test:443",
+	"proxied.test/path",
+	"proxied.test/../x",
+	"user@proxied.test",
+	"[::1]:443",
+	"192.0.2.1",
+	"sni-proxy.local",
+	"Check.SNI-Proxy.Local.",
+}
+
+// discardConn is the client connection of a ClientHelloInfo, taking the
+// alerts sent to it.
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discardConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1} }
+
+func (discardConn) LocalAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443} }
+
+// FuzzMatch checks whatever a name is, matching it with the rules never
+// panics, and a rule found for a valid name is its own or a parent's.
+func FuzzMatch(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	v := newView("fuzz", nil, []string{"fuzz"}, false)
+	v.table, v.dump = compileSource("fuzz", []string{"proxied.test", "ads.test block", "co.test resolve-only", "_srv.example.test"})
+	f.Fuzz(func(t *testing.T, name string) {
+		host, ok := normalizeHost(name)
+		if !ok {
+			if validHostname(host) {
+				t.Fatalf("%q: normalized to %q, valid yet refused", name, host)
+			}
+			return
+		}
+		if len(host) > 253 {
+			t.Fatalf("%q: normalized to %d bytes", name, len(host))
+		}
+		r := matchRule(v.table, host)
+		if r != nil && host != r.domain && !strings.HasSuffix(host, "."+r.domain) {
+			t.Fatalf("%q: matched the rule of %q", host, r.domain)
+		}
+		_ = v.match(host)
+	})
+}
+
+// FuzzGetCertificate checks a leaf is minted only for one of our names,
+// always valid ones, and anything else is refused without a leaf being
+// cached for it.
+func FuzzGetCertificate(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	withTestCA(f)
+	f.Fuzz(func(t *testing.T, name string) {
+		info := &tls.ClientHelloInfo{ServerName: name, Conn: discardConn{}}
+		cert, err := getCertificate(info)
+		host, ok := normalizeHost(name)
+		switch {
+		case err != nil && ok && ownName(host):
+			t.Fatalf("%q: no leaf for our own name: %s", name, err)
+		case err != nil:
+			return
+		case !ok || !ownName(host):
+			t.Fatalf("%q: got a leaf for %v", name, cert.Leaf.DNSNames)
+		}
+		for _, dn := range cert.Leaf.DNSNames {
+			if !validHostname(strings.TrimPrefix(dn, "*.")) {
+				t.Fatalf("%q: leaf for %q", name, dn)
+			}
+		}
+		cacheCert.Range(func(k, _ interface{}) bool {
+			if cn := k.(leafKey).cn; !validHostname(strings.TrimPrefix(cn, "*.")) {
+				t.Fatalf("%q: leaf cached for %q", name, cn)
+			}
+			return true
+		})
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// groups name the domains of one service, one group per line of groupsFile:
+//
+//	example example.com examplecdn.net example-static.org
+//
+// A rule for group:example stands for a rule for each member; it's expanded
+// when rules are compiled, so matching stays a plain suffix lookup.
+var (
+	groups      map[string][]string // no async r & w so ok
+	groupByName map[string]string   // member domain -> group
+)
+
+func loadGroups() {
+	gs := make(map[string][]string)
+	byName := make(map[string]string)
+	defer func() { groups, groupByName = gs, byName }()
+
+	fil, err := os.Open(groupsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return
+	}
+	defer func() {
+		if err := fil.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(fil)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := fields[0]
+		if _, ok := gs[name]; ok {
+			log.Errorf("duplicate group %s", name)
+			continue
+		}
+		for _, m := range fields[1:] {
+			domain, ok := normalizeHost(m)
+			if !ok {
+				rejectName("group", m)
+				continue
+			}
+			if other, ok := byName[domain]; ok {
+				log.Errorf("%s is in groups %s and %s, keeping %s", domain, other, name, other)
+				continue
+			}
+			byName[domain] = name
+			gs[name] = append(gs[name], domain)
+		}
+		if len(gs[name]) == 0 {
+			log.Errorf("group %s has no members", name)
+		}
+	}
+}
+
+// expandGroup turns a group:name rule line into one line per member, and
+// returns other lines as they are.
+func expandGroup(line string) ([]string, string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "group:") {
+		return []string{line}, ""
+	}
+	name := strings.TrimPrefix(fields[0], "group:")
+	members, ok := groups[name]
+	if !ok {
+		log.Errorf("unknown group %s", name)
+		return nil, ""
+	}
+	rest := strings.Join(fields[1:], " ")
+	ret := make([]string, len(members))
+	for i, m := range members {
+		ret[i] = m + " " + rest
+	}
+	return ret, name
+}
+
+// groupFor returns the group host belongs to through itself or its closest
+// listed parent, "" for none.
+func groupFor(host string) string {
+	for {
+		if g, ok := groupByName[host]; ok {
+			return g
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return ""
+		}
+		host = host[dot+1:]
+	}
+}
+
+// countGroupBytes adds a finished connection to its group's byte counters.
+// They are keyed by group name only, so a group redefined across reloads
+// keeps counting into the same series.
+func countGroupBytes(group string, up, down int64) {
+	if group == "" {
+		return
+	}
+	atomic.AddInt64(metricCounter(metricName("group_bytes_total", "group", group, "dir", "up")), up)
+	atomic.AddInt64(metricCounter(metricName("group_bytes_total", "group", group, "dir", "down")), down)
+}
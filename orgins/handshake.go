@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// why a client's handshake on the TLS port failed, in the access log and
+// metrics
+const (
+	hsUnknownCA    = "unknown-ca"    // the client doesn't trust our CA: it isn't installed
+	hsCertRejected = "cert-rejected" // it does, but not the leaf: expired, revoked, unsupported
+	hsMismatch     = "mismatch"      // no TLS version or cipher suite in common
+	hsTimeout      = "timeout"
+	hsClosed       = "closed"       // went away mid-handshake, mostly scanners and probes
+	hsNotTLS       = "not-tls"      // most are sniffed out before, as tls_sniffed_total
+	hsRelayFailed  = "relay-failed" // we failed it, counted by its kind too
+	hsOther        = "other"
+)
+
+// handshakeAlerts are the names and classes of the alerts a client sends
+// to fail the handshake, those not here being hsOther. Clients say "I don't
+// trust your issuer" differently: OpenSSL and Go send unknown_ca, browsers
+// and mobile stacks mostly bad_certificate or certificate_unknown, which are
+// taken to mean the same since the leaves we mint are fine otherwise.
+var handshakeAlerts = map[byte]struct{ name, class string }{
+	0:   {"close_notify", hsClosed},
+	40:  {"handshake_failure", hsMismatch}, // what clients send for no common cipher
+	42:  {"bad_certificate", hsUnknownCA},
+	43:  {"unsupported_certificate", hsCertRejected},
+	44:  {"certificate_revoked", hsCertRejected},
+	45:  {"certificate_expired", hsCertRejected}, // mostly a client clock that's wrong
+	46:  {"certificate_unknown", hsUnknownCA},
+	48:  {"unknown_ca", hsUnknownCA},
+	70:  {"protocol_version", hsMismatch},
+	71:  {"insufficient_security", hsMismatch},
+	90:  {"user_canceled", hsClosed},
+	120: {"no_application_protocol", hsMismatch},
+}
+
+// localMismatches are what crypto/tls's own handshake errors say when it
+// finds nothing in common with a client: it has no types for them, only
+// the alert it sent, which it doesn't return.
+var localMismatches = []string{
+	"unsupported versions",
+	"no cipher suite supported",
+	"no mutually supported",
+	"no application protocol",
+	"no ECDHE curve supported",
+}
+
+// relayFailure is the error failHandshake aborts a handshake with.
+type relayFailure string
+
+func (f relayFailure) Error() string { return "relay failed: " + string(f) }
+
+// receivedAlert is the alert the client failed the handshake with, if it
+// did. crypto/tls returns it as a net.OpError "remote error" around its own
+// unexported alert type, a uint8, which is read by kind rather than by the
+// text it prints so a change of wording can't break it.
+func receivedAlert(err error) (byte, bool) {
+	var op *net.OpError
+	if !errors.As(err, &op) || op.Op != "remote error" || op.Err == nil {
+		return 0, false
+	}
+	if v := reflect.ValueOf(op.Err); v.Kind() == reflect.Uint8 {
+		return byte(v.Uint()), true
+	}
+	return 0, false
+}
+
+// handshakeClass is what err, from a client handshake, says went wrong,
+// and the alert the client sent if that's how it failed it.
+func handshakeClass(err error) (class, alert string) {
+	if a, ok := receivedAlert(err); ok {
+		if known, ok := handshakeAlerts[a]; ok {
+			return known.class, known.name
+		}
+		return hsOther, "alert " + strconv.Itoa(int(a))
+	}
+	var rf relayFailure
+	var rh tls.RecordHeaderError
+	var ne net.Error
+	switch {
+	case errors.As(err, &rf):
+		if string(rf) == failOldTLS {
+			return hsMismatch, ""
+		}
+		return hsRelayFailed, ""
+	case errors.As(err, &rh):
+		return hsNotTLS, ""
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return hsTimeout, ""
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return hsClosed, ""
+	}
+	msg := err.Error()
+	for _, m := range localMismatches {
+		if strings.Contains(msg, m) {
+			return hsMismatch, ""
+		}
+	}
+	return hsOther, ""
+}
+
+// failedHandshake counts and logs the client handshake on pc failing with
+// err, for host if it got that far, and lists the client as needing the CA
+// if that's why.
+func failedHandshake(pc net.Conn, entry *log.Entry, host string, err error) {
+	class, alert := handshakeClass(err)
+	metricAdd(metricName("tls_handshake_failures_total", "class", class), 1)
+	fields := log.Fields{"handshake": class, "host": host}
+	if alert != "" {
+		fields["alert"] = alert
+	}
+	entry.WithFields(fields).Debugf("handshake error: %s", err)
+	if class == hsUnknownCA && trackNeedsCA {
+		noteNeedsCA(pc.RemoteAddr(), host)
+	}
+}
+
+// needsCA is a client that failed a handshake for not trusting our CA, to
+// find the device that wasn't set up.
+type needsCA struct {
+	Client string    `json:"client"`
+	Host   string    `json:"last_host,omitempty"`
+	First  time.Time `json:"first_seen"`
+	Last   time.Time `json:"last_seen"`
+	Count  int64     `json:"failures"`
+}
+
+var (
+	needsCALock sync.Mutex
+	needsCAs    = make(map[string]*needsCA) // by IP
+)
+
+// noteNeedsCA lists addr's IP as needing the CA, at most needsCAMax of
+// them, the least recently seen dropped.
+func noteNeedsCA(addr net.Addr, host string) {
+	if addr == nil {
+		return
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	needsCALock.Lock()
+	defer needsCALock.Unlock()
+	n, ok := needsCAs[ip]
+	if !ok {
+		if len(needsCAs) >= needsCAMax {
+			var oldest string
+			for k, c := range needsCAs {
+				if oldest == "" || c.Last.Before(needsCAs[oldest].Last) {
+					oldest = k
+				}
+			}
+			delete(needsCAs, oldest)
+		}
+		n = &needsCA{Client: ip, First: now}
+		needsCAs[ip] = n
+		log.Infof("%s doesn't trust the CA, is it installed there?", ip)
+	}
+	n.Last, n.Count = now, n.Count+1
+	if host != "" {
+		n.Host = host
+	}
+}
+
+// needsCAReport is the clients needing the CA, the most recently seen
+// first; nil without any, to be left out of /status.
+func needsCAReport() []needsCA {
+	needsCALock.Lock()
+	var ret []needsCA
+	for _, n := range needsCAs {
+		ret = append(ret, *n)
+	}
+	needsCALock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Last.After(ret[j].Last) })
+	return ret
+}
+
+// needsCAHandler is /tls/needs-ca: GET lists the clients that didn't trust
+// the CA, DELETE forgets them all, or ?client= one once it's set up.
+func needsCAHandler(w http.ResponseWriter, r *http.Request) {
+	if !trackNeedsCA {
+		http.Error(w, "clients needing the CA aren't tracked", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list := needsCAReport()
+		if list == nil {
+			list = []needsCA{}
+		}
+		writeJSON(w, list)
+	case http.MethodDelete:
+		needsCALock.Lock()
+		if ip := r.URL.Query().Get("client"); ip != "" {
+			delete(needsCAs, ip)
+		} else {
+			needsCAs = make(map[string]*needsCA)
+		}
+		needsCALock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// fakeDNS answers like a resolver would, from answers set per qname/qtype,
+// over plain UDP and TCP (for defDNS) and DoT (for gfwDNS).
+type fakeDNS struct {
+	mu      sync.Mutex
+	answers map[string][]dns.RR
+	ns      map[string][]dns.RR // authority section, e.g. NSEC proofs
+	faults  map[string]string   // timeout, slow, servfail, plain-servfail, truncate or miscase
+	queries map[string]int
+	overTLS map[string]int
+	asAsked map[string]string // the last qname as it came, case and all
+
+	udpAddr, dotAddr string
+}
+
+func fakeKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[qtype]
+}
+
+func newFakeDNS(cert tls.Certificate) (*fakeDNS, error) {
+	f := &fakeDNS{
+		answers: make(map[string][]dns.RR),
+		ns:      make(map[string][]dns.RR),
+		faults:  make(map[string]string),
+		queries: make(map[string]int),
+		overTLS: make(map[string]int),
+		asAsked: make(map[string]string),
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tl, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		_ = pc.Close()
+		_ = tl.Close()
+		return nil, err
+	}
+	f.udpAddr, f.dotAddr = pc.LocalAddr().String(), l.Addr().String()
+	go func() { _ = (&dns.Server{PacketConn: pc, Handler: f}).ActivateAndServe() }()
+	go func() { _ = (&dns.Server{Listener: tl, Handler: f}).ActivateAndServe() }()
+	go func() { _ = (&dns.Server{Listener: l, Net: "tcp-tls", Handler: f}).ActivateAndServe() }()
+	return f, nil
+}
+
+// set makes name answer qtype with ips, nothing meaning NOERROR without records.
+func (f *fakeDNS) set(name string, qtype uint16, ips ...string) {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN %s %s", dns.Fqdn(name), dns.TypeToString[qtype], ip))
+		if err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	f.mu.Lock()
+	f.answers[fakeKey(name, qtype)] = rrs
+	f.mu.Unlock()
+}
+
+// setRRs answers name and qtype with answer, and ns in the authority
+// section.
+func (f *fakeDNS) setRRs(name string, qtype uint16, answer, ns []dns.RR) {
+	f.mu.Lock()
+	f.answers[fakeKey(name, qtype)], f.ns[fakeKey(name, qtype)] = answer, ns
+	f.mu.Unlock()
+}
+
+func (f *fakeDNS) fault(name string, qtype uint16, kind string) {
+	f.mu.Lock()
+	f.faults[fakeKey(name, qtype)] = kind
+	f.mu.Unlock()
+}
+
+// count is how often name was asked for qtype, over either transport.
+func (f *fakeDNS) count(name string, qtype uint16) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[fakeKey(name, qtype)]
+}
+
+// countTLS is how often name was asked for qtype over DoT.
+func (f *fakeDNS) countTLS(name string, qtype uint16) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.overTLS[fakeKey(name, qtype)]
+}
+
+// askedAs is the last qname name was asked for qtype as.
+func (f *fakeDNS) askedAs(name string, qtype uint16) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.asAsked[fakeKey(name, qtype)]
+}
+
+func (f *fakeDNS) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	if len(m.Question) != 1 {
+		return
+	}
+	key := fakeKey(m.Question[0].Name, m.Question[0].Qtype)
+	f.mu.Lock()
+	f.queries[key]++
+	f.asAsked[key] = m.Question[0].Name
+	if w.LocalAddr().String() == f.dotAddr {
+		f.overTLS[key]++
+	}
+	answers, ns, fault := f.answers[key], f.ns[key], f.faults[key]
+	f.mu.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Compress = true
+	switch fault {
+	case "timeout":
+		return
+	case "slow":
+		time.Sleep(200 * time.Millisecond)
+		r.Answer = answers
+	case "servfail":
+		r.Rcode = dns.RcodeServerFailure
+	case "plain-servfail": // answered over DoT only
+		if w.LocalAddr().String() == f.dotAddr {
+			r.Answer = answers
+		} else {
+			r.Rcode = dns.RcodeServerFailure
+		}
+	case "truncate":
+		r.Truncated = true
+	case "miscase":
+		r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		r.Answer = answers
+	default:
+		r.Answer, r.Ns = answers, ns
+	}
+	_ = w.WriteMsg(r)
+}
+
+// fakeClock is a clock moved by hand, its wall and monotonic readings
+// apart.
+type fakeClock struct {
+	mu   sync.Mutex
+	wall time.Time
+	mono time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wall
+}
+
+func (c *fakeClock) Mono() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mono
+}
+
+// step moves the wall clock alone, as NTP syncing does.
+func (c *fakeClock) step(d time.Duration) {
+	c.mu.Lock()
+	c.wall = c.wall.Add(d)
+	c.mu.Unlock()
+}
+
+// advance lets d pass.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.wall, c.mono = c.wall.Add(d), c.mono+d
+	c.mu.Unlock()
+}
+
+// originDialer sends every upstream connection to the fake origin, whatever
+// address was resolved, counting them.
+type originDialer struct {
+	addr  string
+	dials int64
+}
+
+func (d *originDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	atomic.AddInt64(&d.dials, 1)
+	return (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "tcp", d.addr)
+}
+
+func (d *originDialer) DialTLSContext(ctx context.Context, host, addr string, config *tls.Config) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClient(ctx, raw, config)
+}
+
+// selfTestCA is a throwaway CA, issuing leaves for names and IPs.
+type selfTestCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newSelfTestCA(cn string) (*selfTestCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &selfTestCA{cert: cert, key: key, pool: pool}, nil
+}
+
+func (ca *selfTestCA) issue(names []string, ips ...net.IP) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+var (
+	testCAOnce sync.Once
+	testCAErr  error
+)
+
+// withTestCA installs a throwaway CA for leaves to be minted from, unless the
+// harness or another test did.
+func withTestCA(tb testing.TB) {
+	testCAOnce.Do(func() {
+		if caCur.Load() != nil {
+			return
+		}
+		var ca *selfTestCA
+		if ca, testCAErr = newSelfTestCA("test CA"); testCAErr == nil {
+			caCur.Store(&caPair{cert: ca.cert, key: ca.key})
+		}
+	})
+	if testCAErr != nil {
+		tb.Fatal(testCAErr)
+	}
+}
+
+// sign issues tmpl for key, valid for a day from an hour ago unless tmpl
+// says otherwise.
+func (ca *selfTestCA) sign(tmpl *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// harness wires the proxy's real DNS and TLS handlers, on loopback
+// listeners, to a fake resolver pair and a fake origin.
+type harness struct {
+	ca      *selfTestCA // the proxy's CA, clients trust it
+	upCA    *selfTestCA // the origin's, for what is relayed without MITM
+	dns     *fakeDNS
+	origin  *originDialer
+	dnsAddr string // the proxy's DNS, UDP and TCP
+	tlsAddr string // the proxy's TLS port
+	webAddr string // the proxy's plain HTTP port
+}
+
+// selfTestRules is the rule source every scenario runs with.
+var selfTestRules = []string{
+	"proxied.test",
+	"cached.test",
+	"expired.test",
+	"removable.test",
+	"dies.test",
+	"unresolvable.test",
+	"badcert.test",
+	"bogon.test",
+	"blocked.test block",
+	"v6.proxied.test noaaaa",
+	"cdn.proxied.test plain-dns",
+	"longttl.test ttl=5m",
+	"sticky.test sticky",
+	"internal.test verify-name=proxied.test",
+	"misnamed.test verify-name=elsewhere.test",
+	"unchecked.test verify=off",
+}
+
+// selfTestReal is what the fake secure resolver answers for proxied names;
+// the origin dialer ignores it, but it must not be a bogon.
+const selfTestReal = "93.184.216.34"
+
+func newHarness() (*harness, error) {
+	h := new(harness)
+	var err error
+	if h.ca, err = newSelfTestCA("selftest proxy CA"); err != nil {
+		return nil, err
+	}
+	caCur.Store(&caPair{cert: h.ca.cert, key: h.ca.key})
+	issuerLock.Lock()
+	curIssuer = nil
+	issuerLock.Unlock()
+
+	// the origin and the DoT resolver share a CA the proxy trusts upstream
+	upCA, err := newSelfTestCA("selftest origin CA")
+	if err != nil {
+		return nil, err
+	}
+	h.upCA = upCA
+	upstreamRoots = upCA.pool
+	upCert, err := upCA.issue([]string{"proxied.test", "www.proxied.test", "cached.test", "expired.test", "removable.test", "dies.test", "sticky.test"}, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	if h.dns, err = newFakeDNS(upCert); err != nil {
+		return nil, err
+	}
+	defResolver, gfwResolver = h.dns.udpAddr, h.dns.dotAddr
+	upstreams = []*upstream{
+		newUpstream(defResolver, "udp", nil),
+		newUpstream(gfwResolver, "tcp-tls", &tls.Config{RootCAs: upCA.pool}),
+	}
+	for _, name := range []string{"proxied.test", "www.proxied.test", "cached.test", "expired.test", "removable.test", "sticky.test"} {
+		h.dns.set(name, dns.TypeA, selfTestReal)
+		h.dns.set(name, dns.TypeAAAA)
+	}
+	h.dns.set("dies.test", dns.TypeA, "93.184.216.99") // marked suspect, so not selfTestReal
+	h.dns.set("dies.test", dns.TypeAAAA)
+	for _, name := range []string{"badcert.test", "internal.test", "misnamed.test", "unchecked.test"} { // certs not for them
+		h.dns.set(name, dns.TypeA, selfTestReal)
+		h.dns.set(name, dns.TypeAAAA)
+	}
+	h.dns.fault("unresolvable.test", dns.TypeA, "servfail")
+	h.dns.fault("unresolvable.test", dns.TypeAAAA, "servfail")
+	h.dns.set("bogon.test", dns.TypeA, "10.0.0.1")
+	h.dns.set("bogon.test", dns.TypeAAAA)
+	h.dns.set("direct.test", dns.TypeA, selfTestReal)
+	h.dns.fault("servfail.test", dns.TypeA, "servfail")
+	h.dns.fault("slow.test", dns.TypeA, "timeout")
+	h.dns.fault("truncated.test", dns.TypeA, "truncate")
+	var many []string
+	for i := 1; i <= 60; i++ {
+		many = append(many, fmt.Sprintf("93.184.216.%d", i))
+	}
+	h.dns.set("large.test", dns.TypeA, many...)
+	var huge []string
+	for i := 0; i < 200; i++ {
+		huge = append(huge, fmt.Sprintf("93.184.%d.%d", 100+i/250, i%250+1))
+	}
+	h.dns.set("huge.test", dns.TypeA, huge...)
+
+	origin, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{upCert},
+		NextProtos:   []string{"http/1.1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_ = http.Serve(origin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == "dies.test" { // like a reset right after the handshake
+				if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			_, _ = fmt.Fprintf(w, "origin %s", r.Host)
+		}))
+	}()
+	h.origin = &originDialer{addr: origin.Addr().String()}
+	upstreamDialer = h.origin
+
+	v := newView("default", nil, []string{"selftest"}, false)
+	v.table, v.dump = compileSource("selftest", selfTestRules)
+	viewsCur.Store(&viewSet{views: []*view{v}})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h.dnsAddr = pc.LocalAddr().String()
+	tl, err := net.Listen("tcp", h.dnsAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() { _ = (&dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(forwardDns)}).ActivateAndServe() }()
+	go func() { _ = (&dns.Server{Listener: tl, Handler: dns.HandlerFunc(forwardDns)}).ActivateAndServe() }()
+
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h.tlsAddr = list.Addr().String()
+	go acceptLoop(0, list, &tls.Config{GetCertificate: getCertificate})
+
+	if err := loadErrorPage(); err != nil {
+		return nil, err
+	}
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h.webAddr = web.Addr().String()
+	go func() { _ = plainServer(h.webAddr).Serve(plainListener{web}) }()
+	return h, nil
+}
+
+// withSettings stores a copy of the current settings as change leaves it,
+// returning what puts the ones before back.
+func withSettings(change func(s *settings)) (restore func()) {
+	old := currentSettings()
+	s := *old
+	change(&s)
+	settingsCur.Store(&s)
+	return func() { settingsCur.Store(old) }
+}
+
+// query asks the proxy's DNS over UDP like a client would, with EDNS0 if edns.
+func (h *harness) query(name string, qtype uint16, edns bool) (*dns.Msg, error) {
+	return h.exchange("udp", name, qtype, edns)
+}
+
+func (h *harness) queryTCP(name string, qtype uint16) (*dns.Msg, error) {
+	return h.exchange("tcp", name, qtype, false)
+}
+
+func (h *harness) exchange(network, name string, qtype uint16, edns bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	if edns {
+		m.SetEdns0(4096, false)
+	}
+	r, _, err := (&dns.Client{Net: network, Timeout: time.Second}).Exchange(m, h.dnsAddr)
+	return r, err
+}
+
+// fetch connects to the proxy's TLS port for host, checks the forged cert
+// chains to the proxy CA and returns the body of a GET.
+func (h *harness) fetch(host string) (string, error) {
+	return h.fetchTrusting(host, h.ca)
+}
+
+// fetchTrusting is fetch with the chain checked against ca instead.
+func (h *harness) fetchTrusting(host string, ca *selfTestCA) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", h.tlsAddr,
+		&tls.Config{ServerName: host, RootCAs: ca.pool})
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", fmt.Errorf("no response: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// leaf returns the certificate the proxy forges for host.
+func (h *harness) leaf(host string) (*x509.Certificate, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", h.tlsAddr,
+		&tls.Config{ServerName: host, RootCAs: h.ca.pool})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func expectRcode(r *dns.Msg, err error, rcode int) error {
+	if err != nil {
+		return err
+	}
+	if r.Rcode != rcode {
+		return fmt.Errorf("rcode %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[rcode])
+	}
+	return nil
+}
+
+func expectAddr(r *dns.Msg, err error, want string) error {
+	if err := expectRcode(r, err, dns.RcodeSuccess); err != nil {
+		return err
+	}
+	if len(r.Answer) != 1 {
+		return fmt.Errorf("%d answers, want 1", len(r.Answer))
+	}
+	var got net.IP
+	switch a := r.Answer[0].(type) {
+	case *dns.A:
+		got = a.A
+	case *dns.AAAA:
+		got = a.AAAA
+	}
+	if !got.Equal(net.ParseIP(want)) {
+		return fmt.Errorf("answer %s, want %s", got, want)
+	}
+	return nil
+}
+
+func expectBody(h *harness, host string) error {
+	body, err := h.fetch(host)
+	if err != nil {
+		return err
+	}
+	if want := "origin " + host; body != want {
+		return fmt.Errorf("body %q, want %q", body, want)
+	}
+	return nil
+}
+
+// recordSizes notes the TLS records written through it.
+type recordSizes struct {
+	net.Conn
+	mu     sync.Mutex
+	buf    []byte
+	n, max int // application data records, and the longest
+}
+
+func (r *recordSizes) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.buf = append(r.buf, p...)
+	for len(r.buf) >= 5 {
+		l := int(r.buf[3])<<8 | int(r.buf[4])
+		if len(r.buf) < 5+l {
+			break
+		}
+		if r.buf[0] == 23 {
+			r.n++
+			if l > r.max {
+				r.max = l
+			}
+		}
+		r.buf = r.buf[5+l:]
+	}
+	r.mu.Unlock()
+	return r.Conn.Write(p)
+}
+
+// gatedWriter is a disk that takes nothing until gate is closed.
+type gatedWriter struct{ gate chan struct{} }
+
+func (g gatedWriter) Write(p []byte) (int, error) {
+	<-g.gate
+	return len(p), nil
+}
+
+func (gatedWriter) Close() error { return nil }
+
+// tornFile is a journal whose next write gets half its bytes to disk and
+// fails, like a full disk would.
+type tornFile struct {
+	*os.File
+	torn bool
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if f.torn {
+		return f.File.Write(p)
+	}
+	f.torn = true
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, syscall.ENOSPC
+}
+
+// lineCatcher hands over what's written to it a write at a time, for logs
+// the proxy writes from its own goroutines once it has answered.
+type lineCatcher chan []byte
+
+func (c lineCatcher) Write(p []byte) (int, error) {
+	c <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// next returns the next write, waiting for it up to 2s.
+func (c lineCatcher) next() ([]byte, error) {
+	select {
+	case p := <-c:
+		return p, nil
+	case <-time.After(2 * time.Second):
+		return nil, fmt.Errorf("nothing written in 2s")
+	}
+}
+
+// logCatcher is a logrus hook keeping the entries with messages starting
+// with msg.
+type logCatcher struct {
+	msg     string
+	mu      sync.Mutex
+	entries []log.Fields
+}
+
+func (c *logCatcher) Levels() []log.Level { return log.AllLevels }
+
+func (c *logCatcher) Fire(e *log.Entry) error {
+	if strings.HasPrefix(e.Message, c.msg) {
+		c.mu.Lock()
+		c.entries = append(c.entries, e.Data)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// wait returns the first n entries once there are that many.
+func (c *logCatcher) wait(n int) ([]log.Fields, error) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		if len(c.entries) >= n {
+			ret := c.entries[:n]
+			c.mu.Unlock()
+			return ret, nil
+		}
+		c.mu.Unlock()
+	}
+	return nil, fmt.Errorf("fewer than %d %q lines logged", n, c.msg)
+}
+
+// staticSource is a RuleSource with fixed lines, or one that panics.
+type staticSource []string
+
+func (s staticSource) Rules() ([]string, error) {
+	if s == nil {
+		panic("no lines")
+	}
+	return s, nil
+}
+
+func (staticSource) Changed() <-chan struct{} { return nil }
+
+// hookFunc makes a DecisionHook of a func.
+type hookFunc func(host string, client net.Addr, tentative Decision) Decision
+
+func (f hookFunc) Decide(host string, client net.Addr, tentative Decision) Decision {
+	return f(host, client, tentative)
+}
+
+// selfTestAlert stands in for crypto/tls's unexported alert type, a uint8.
+type selfTestAlert uint8
+
+func (a selfTestAlert) Error() string { return "tls: alert " + strconv.Itoa(int(a)) }
+
+func expectRefused(h *harness, host string) error {
+	body, err := h.fetch(host)
+	if err == nil {
+		return fmt.Errorf("got %q, want the connection closed", body)
+	}
+	return nil
+}
+
+// helloLength is the length of the record the ClientHello of config is
+// sent in, as the 5-byte record header says.
+func helloLength(config *tls.Config) (int, error) {
+	c, s := net.Pipe()
+	defer func() { _ = s.Close() }()
+	go func() {
+		_ = tls.Client(c, config).Handshake()
+		_ = c.Close()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(s, head); err != nil {
+		return 0, err
+	}
+	return int(head[3])<<8 | int(head[4]), nil
+}
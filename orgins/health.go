@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ruleCount     int64 // winning rules of the default view, set on reload
+	upstreamsDown int64 // upstreams judged unhealthy, kept by upstream.record
+)
+
+// healthLine is what healthAddr and healthFile say: OK, or DOWN with no
+// healthy upstream, then the version, the rules, the healthy upstreams and
+// the optional components that failed, if any. Atomic reads only, so a
+// watchdog gets it however busy the data path is.
+func healthLine() string {
+	total := int64(len(upstreams))
+	healthy := total - atomic.LoadInt64(&upstreamsDown)
+	state := "OK"
+	if healthy <= 0 {
+		state = "DOWN"
+	}
+	down := ""
+	if names := sup.downNames(); len(names) > 0 {
+		down = " down=" + strings.Join(names, ",")
+	}
+	return fmt.Sprintf("%s %s rules=%d upstreams=%d/%d%s\n", state, version, atomic.LoadInt64(&ruleCount), healthy, total, down)
+}
+
+func openHealth() error {
+	var err error
+	serving.health, err = listenInherited("health", func() (net.Listener, error) {
+		return net.Listen("tcp", healthAddr)
+	})
+	return err
+}
+
+// serveHealth answers every connection to healthAddr with healthLine and
+// closes it, for watchdogs that can only expect a banner. Each gets
+// healthTimeout to take it.
+func serveHealth() error {
+	l := serving.health
+	defer trackServer(healthServer{l})()
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go func() {
+			_ = conn.SetWriteDeadline(time.Now().Add(healthTimeout))
+			_, _ = conn.Write([]byte(healthLine()))
+			_ = conn.Close()
+		}()
+	}
+}
+
+// healthServer stops the health listener on retirement, connections being
+// over as soon as they're answered.
+type healthServer struct{ l net.Listener }
+
+func (s healthServer) Shutdown(context.Context) error { return s.l.Close() }
+
+// writeHealthFile writes healthLine to healthFile every healthEvery, for
+// watchdogs that only look at files; one that stops changing means we're
+// stuck.
+func writeHealthFile() {
+	if healthFile == "" {
+		return
+	}
+	go func() {
+		for {
+			if err := saveHealthFile(); err != nil {
+				logThrottled.Errorf("health file", "%s: %s", healthFile, err)
+			}
+			time.Sleep(healthEvery)
+		}
+	}()
+}
+
+func saveHealthFile() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(healthFile), ".health-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(healthLine()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), healthFile)
+}
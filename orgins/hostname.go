@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidName = errors.New("invalid hostname")
+
+// validHostname checks name (without trailing dot) against the RFC 1035
+// limits: 253 bytes in all, labels of 1 to 63 letters, digits, hyphens and,
+// as seen in the wild, underscores, not starting with a hyphen.
+func validHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	label := 0
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			if label == 0 {
+				return false
+			}
+			label = 0
+			continue
+		case c == '-':
+			if label == 0 {
+				return false
+			}
+		case c == '_', '0' <= c && c <= '9', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		default:
+			return false
+		}
+		if label++; label > 63 {
+			return false
+		}
+	}
+	return label > 0
+}
+
+// rejectName counts and logs a name failing validHostname, quoted and cut
+// short since it may be anything.
+func rejectName(where, name string) {
+	metricAdd(metricName("invalid_names_total", "where", where), 1)
+	if len(name) > 64 {
+		name = name[:64] + "..."
+	}
+	logThrottled.Warnf("invalid "+where, "invalid %s: %s", where, strconv.Quote(name))
+}
+
+// normalizeHost is the one way SNI values, qnames and rule domains are turned
+// into lookup keys, so the DNS and TLS paths can't disagree about a host:
+// one trailing dot is dropped, the rest lowercased and checked with
+// validHostname, which also rejects ports and paths seen in the wild
+// ("example.com:443", "example.com/").
+func normalizeHost(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name, validHostname(name)
+}
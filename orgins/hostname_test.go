@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com.", "example.com", true},
+		{"EXAMPLE.com", "example.com", true},
+		{"WWW.Example.COM.", "www.example.com", true},
+		{"_dmarc.example.com", "_dmarc.example.com", true},
+		{"192.0.2.1", "192.0.2.1", true}, // a valid name, clients don't send IPs as SNI
+		{"example.com:443", "", false},
+		{"example.com/", "", false},
+		{"example.com/path", "", false},
+		{"example.com..", "", false},
+		{".example.com", "", false},
+		{"-example.com", "", false},
+		{"::1", "", false},
+		{"[::1]", "", false},
+		{"[2001:db8::1]:443", "", false},
+		{"", "", false},
+		{".", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeHost(tt.in)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
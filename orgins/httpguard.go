@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// plainListener hands the HTTP port its conns with an ID each, and their
+// request head checked by checkHead before net/http gets to parse it.
+type plainListener struct{ net.Listener }
+
+func (l plainListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	pc := newPeekConn(c)
+	// the whole head must fit, to be checked before any of it is read
+	pc.r = bufio.NewReaderSize(c, httpMaxHeaderBytes)
+	return &plainConn{peekConn: pc}, nil
+}
+
+// plainConn is a conn of the HTTP port. Keep-alives are off there, so the
+// head checked is that of the one request a conn ever carries.
+type plainConn struct {
+	*peekConn
+	checked bool
+}
+
+var errRejected = errors.New("request rejected")
+
+func (c *plainConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		head, err := c.head()
+		if err != nil {
+			return 0, err
+		}
+		if status, why := checkHead(head); status != 0 {
+			c.reject(status, why)
+			return 0, errRejected
+		}
+	}
+	return c.peekConn.Read(p)
+}
+
+// head peeks at the request head, up to and with the empty line ending it.
+func (c *plainConn) head() ([]byte, error) {
+	for {
+		b, _ := c.r.Peek(c.r.Buffered())
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			return b[:i+4], nil
+		}
+		if len(b) == c.r.Size() {
+			return b, nil // too large, for checkHead to tell
+		}
+		if _, err := c.r.Peek(len(b) + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reject answers status and closes, logging why with the conn's ID.
+func (c *plainConn) reject(status int, why string) {
+	metricAdd(metricName("http_rejected_total", "status", fmt.Sprint(status)), 1)
+	c.log.WithField("client", c.RemoteAddr()).Infof("http: rejected with %d: %s", status, why)
+	text := http.StatusText(status)
+	_, _ = fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s\n",
+		status, text, len(text)+1, text)
+	_ = c.Close()
+}
+
+// checkHead returns the status to reject a request head with and why, 0
+// if it's fine. Only heads all parsers would read alike get through: no
+// second Host, no absolute-form target for another host, no body length
+// told two ways, no line past httpMaxHeaderLine, and no control bytes but
+// tabs in between CRLFs.
+func checkHead(head []byte) (int, string) {
+	if !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		return http.StatusRequestHeaderFieldsTooLarge, "head too large"
+	}
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	for _, line := range lines {
+		if len(line) > httpMaxHeaderLine {
+			return http.StatusRequestHeaderFieldsTooLarge, "line too long"
+		}
+		for i := 0; i < len(line); i++ {
+			if b := line[i]; b < ' ' && b != '\t' || b == 0x7f {
+				return http.StatusBadRequest, fmt.Sprintf("control byte %#x", b)
+			}
+		}
+	}
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return http.StatusBadRequest, "malformed request line"
+	}
+	method, target, proto := parts[0], parts[1], parts[2]
+	if proto != "HTTP/1.1" && proto != "HTTP/1.0" {
+		return http.StatusHTTPVersionNotSupported, "protocol " + proto
+	}
+	var hosts, lengths, encodings []string
+	for _, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return http.StatusBadRequest, "malformed header line"
+		}
+		name := line[:colon]
+		if strings.ContainsAny(name, " \t") {
+			return http.StatusBadRequest, "space in header name " + name
+		}
+		value := strings.Trim(line[colon+1:], " \t")
+		switch strings.ToLower(name) {
+		case "host":
+			hosts = append(hosts, value)
+		case "content-length":
+			lengths = append(lengths, value)
+		case "transfer-encoding":
+			encodings = append(encodings, value)
+		}
+	}
+	switch {
+	case len(hosts) > 1:
+		return http.StatusBadRequest, "more than one Host"
+	case len(hosts) == 0 && proto == "HTTP/1.1":
+		return http.StatusBadRequest, "no Host"
+	case len(lengths) > 1:
+		return http.StatusBadRequest, "more than one Content-Length"
+	case len(encodings) > 0 && len(lengths) > 0:
+		return http.StatusBadRequest, "Transfer-Encoding and Content-Length"
+	case len(encodings) > 0 && proto == "HTTP/1.0":
+		return http.StatusBadRequest, "Transfer-Encoding in HTTP/1.0"
+	case len(encodings) > 1 || len(encodings) == 1 && !strings.EqualFold(encodings[0], "chunked"):
+		return http.StatusNotImplemented, "Transfer-Encoding " + strings.Join(encodings, ", ")
+	}
+	if len(lengths) == 1 && (lengths[0] == "" || strings.Trim(lengths[0], "0123456789") != "") {
+		return http.StatusBadRequest, "malformed Content-Length"
+	}
+	if method == http.MethodConnect || !strings.HasPrefix(target, "/") && target != "*" {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return http.StatusBadRequest, "target neither a path nor an http URL"
+		}
+		if len(hosts) == 0 || canonicalHost(u.Host) != canonicalHost(hosts[0]) {
+			return http.StatusBadRequest, "target for another host than Host"
+		}
+	}
+	return 0, ""
+}
+
+// canonicalHost is host lowercased, without a trailing dot nor the default
+// port, as rules are matched against it.
+func canonicalHost(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if port == "" || port == "80" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// hopByHop are the headers that are about one connection, never passed on
+// to the next.
+var hopByHop = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// stripHopByHop drops from h the hop-by-hop headers and those Connection
+// names, so nothing downstream of the HTTP port's handler sees them.
+func stripHopByHop(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// errNotCovered refuses a leaf for a name no proxy rule covers: our CA signs
+// for the names we intercept and our own, not whatever SNI a client sends.
+var errNotCovered = errors.New("no proxy rule covers the name")
+
+// issuedCert is one leaf minted by our CA.
+type issuedCert struct {
+	Domain   string    `json:"domain"`    // its CN, covered with a wildcard
+	Key      string    `json:"cache_key"` // in cacheCert
+	For      string    `json:"for"`       // the SNI, "warm-up", "admin" or "export"
+	Serial   string    `json:"serial"`
+	At       time.Time `json:"at"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+var (
+	issuedLock sync.Mutex
+	issued     []issuedCert // the last issuedKeep, oldest first
+	issuedN    int64
+)
+
+func recordIssued(e issuedCert) {
+	issuedLock.Lock()
+	defer issuedLock.Unlock()
+	if len(issued) >= issuedKeep {
+		issued = append(issued[:0], issued[len(issued)-issuedKeep+1:]...)
+	}
+	issued = append(issued, e)
+	issuedN++
+	metricAdd("leaves_issued_total", 1)
+}
+
+// ownName is whether host is one of the names we serve ourselves, which
+// get a leaf without a rule.
+func ownName(host string) bool {
+	return selfName != "" && (strings.EqualFold(host, selfName) || host == checkHost())
+}
+
+// issuedHandler lists the leaves minted since startup, the last issuedKeep
+// of them, those of domain= only if given.
+func issuedHandler(w http.ResponseWriter, r *http.Request) {
+	domain, _ := normalizeHost(r.URL.Query().Get("domain"))
+	issuedLock.Lock()
+	res := struct {
+		Total  int64        `json:"total"`
+		Issued []issuedCert `json:"issued"`
+	}{issuedN, []issuedCert{}}
+	for _, e := range issued {
+		if domain == "" || e.Domain == domain {
+			res.Issued = append(res.Issued, e)
+		}
+	}
+	issuedLock.Unlock()
+	writeJSON(w, res)
+}
+
+// leafCovered is whether a handshake for host from client, connected to
+// local, would get a leaf: it's one of our names, or passes sniGate as on
+// the TLS port and isn't spliced untouched as resolve-only before that.
+func leafCovered(host string, client, local net.Addr) bool {
+	if ownName(host) {
+		return true
+	}
+	v, _, allowed := sniGate(host, client, local)
+	if m := v.match(host); m != nil && m.resolveOnly {
+		return false
+	}
+	return allowed
+}
+
+// certsHandler is /certs/{domain}: GET the chain of the leaf served for
+// domain as PEM, the cached one or minted as a handshake from the asking
+// client would get it, ?rsa=1 the one for clients without ECDSA. Its
+// private key comes first with ?include_key=1&confirm={domain}, never
+// without the confirm. DELETE drops the cached leaves so the next
+// handshake mints new ones.
+func certsHandler(w http.ResponseWriter, r *http.Request) {
+	host, ok := normalizeHost(strings.TrimPrefix(r.URL.Path, "/certs/"))
+	if !ok {
+		http.Error(w, "/certs/{domain} needs a valid hostname", http.StatusBadRequest)
+		return
+	}
+	cn, gen, err := leafName(host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		withKey := q.Get("include_key") == "1"
+		if withKey && q.Get("confirm") != host {
+			http.Error(w, "include_key=1 needs confirm="+host+" too: the key lets anyone holding it pass for "+host+
+				" to every client trusting our CA", http.StatusBadRequest)
+			return
+		}
+		if !leafCovered(host, requestAddr(r), requestLocal(r)) {
+			metricAdd("leaves_refused_total", 1)
+			log.Warnf("%s: %s asked /certs for a leaf its handshake wouldn't get", host, r.RemoteAddr)
+			http.Error(w, errNotCovered.Error(), http.StatusForbidden)
+			return
+		}
+		cert, err := cachedLeaf(cn, gen, q.Get("rsa") == "1", "export")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var out []byte
+		if withKey {
+			der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Warnf("admin: %s exported the private key of the leaf for %s, serial %s", r.RemoteAddr, cn, cert.Leaf.SerialNumber.Text(16))
+			metricAdd("leaf_keys_exported_total", 1)
+			emit(evLeafKeyExported, map[string]interface{}{"domain": cn, "serial": cert.Leaf.SerialNumber.Text(16), "client": r.RemoteAddr})
+			out = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		}
+		for _, der := range cert.Certificate {
+			out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(out)
+	case http.MethodDelete:
+		n := 0
+		cacheCert.Range(func(k, _ interface{}) bool {
+			if k.(leafKey).cn == cn {
+				cacheCert.Delete(k)
+				n++
+			}
+			return true
+		})
+		log.Infof("admin: dropped %d cached leaves for %s, minted again on next use", n, cn)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
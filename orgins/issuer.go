@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// issuer signs the forged leaves: the root CA itself, or a short-lived
+// intermediate minted from it when useIntermediate is set.
+type issuer struct {
+	cert  *x509.Certificate
+	key   crypto.Signer
+	chain [][]byte // DER certs served after the leaf
+	renew time.Time
+}
+
+var (
+	issuerLock sync.Mutex
+	curIssuer  *issuer
+)
+
+func getIssuer() (*issuer, error) {
+	issuerLock.Lock()
+	defer issuerLock.Unlock()
+
+	if curIssuer != nil && (curIssuer.renew.IsZero() || clk.Now().Before(curIssuer.renew)) {
+		return curIssuer, nil
+	}
+	if !useIntermediate {
+		ca := currentCA()
+		curIssuer = &issuer{cert: ca.cert, key: ca.key}
+		return curIssuer, nil
+	}
+
+	iss, err := mintIntermediate()
+	if err != nil {
+		if curIssuer != nil && clk.Now().Before(curIssuer.cert.NotAfter) {
+			log.Errorf("failed to renew intermediate, keep the old one: %s", err)
+			return curIssuer, nil
+		}
+		return nil, err
+	}
+	log.Infof("intermediate CA minted, valid until %s", iss.cert.NotAfter.Format(time.RFC3339))
+	curIssuer = iss
+	return curIssuer, nil
+}
+
+func mintIntermediate() (*issuer, error) {
+	ca := currentCA()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := clk.Now()
+	notBefore, notAfter, clamped, err := validity(now, intermediateExpire, ca.cert)
+	if err != nil {
+		return nil, err
+	}
+	if clamped {
+		log.Warnf("intermediate CA valid until %s only, when %s expires", notAfter.Format(time.RFC3339), ca.cert.Subject.CommonName)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: ca.cert.Subject.CommonName + " Intermediate",
+		},
+
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.cert, priv.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &issuer{
+		cert:  cert,
+		key:   priv,
+		chain: [][]byte{derBytes},
+		renew: now.Add(notAfter.Sub(now) * 2 / 3),
+	}, nil
+}
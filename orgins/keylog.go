@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// keyLog receives TLS secrets of both legs in NSS key log format, nil when
+// disabled. Only ever enabled by an explicit path, never by default.
+var keyLog io.Writer
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func openKeyLog() error {
+	path := keyLogFile
+	if path == "" {
+		path = os.Getenv("SSLKEYLOGFILE")
+	}
+	if path == "" {
+		return nil
+	}
+	fil, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	keyLog = &lockedWriter{w: fil}
+	log.Warnf("!!! TLS key logging enabled, secrets of every session are written to %s !!!", path)
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// rsaKeys holds RSA keys generated ahead of time, since generating one in the
+// handshake of a legacy client takes a while.
+var rsaKeys = make(chan *rsa.PrivateKey, rsaKeyPool)
+
+func fillRSAKeys() {
+	for {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Errorf("failed to generate RSA key: %s", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		rsaKeys <- key
+	}
+}
+
+func startRSAPool() {
+	if rsaKeyPool > 0 {
+		go fillRSAKeys()
+	}
+}
+
+func rsaKey() (*rsa.PrivateKey, error) {
+	select {
+	case key := <-rsaKeys:
+		return key, nil
+	default:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+}
+
+// leafKey is what a leaf is cached under: its cn and key type, and the
+// generation of the public suffix list the cn was derived with, so a cn
+// derived with a list since replaced never finds a leaf.
+type leafKey struct {
+	cn  string
+	rsa bool
+	gen uint64
+}
+
+func (k leafKey) String() string {
+	s := k.cn
+	if k.rsa {
+		s += " rsa"
+	}
+	return s + "@" + strconv.FormatUint(k.gen, 10)
+}
+
+// leafFor returns a cached or new certificate for cn, derived with the
+// suffix list of generation gen, RSA-keyed for clients that can't do ECDSA.
+func leafFor(info *tls.ClientHelloInfo, cn string, gen uint64) (*tls.Certificate, error) {
+	cert, err := cachedLeaf(cn, gen, false, info.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if info.SupportsCertificate(cert) == nil {
+		return cert, nil
+	}
+	rsaCert, err := cachedLeaf(cn, gen, true, info.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.SupportsCertificate(rsaCert); err != nil {
+		log.Debugf("%s: client supports neither ECDSA nor RSA: %s", info.ServerName, err)
+		return cert, nil
+	}
+	return rsaCert, nil
+}
+
+// cachedLeaf returns the cached leaf for cn or mints one, recording it with
+// what it's for. One minted for a cn derived with a list replaced since, or
+// while the CA was reloaded unless keepLeavesOnCaReload, is handed out once,
+// not cached.
+func cachedLeaf(cn string, gen uint64, useRSA bool, why string) (*tls.Certificate, error) {
+	if warmUp {
+		leafUsed.Store(cn, time.Now())
+	}
+	key := leafKey{cn, useRSA, gen}
+	if cert, ok := cacheCert.Load(key); ok {
+		return cert.(*tls.Certificate), nil
+	}
+	ca := atomic.LoadUint64(&caGen)
+	cert, err := mintLeaf(cn, useRSA)
+	if err != nil {
+		return nil, err
+	}
+	cacheCert.Store(key, cert)
+	if atomic.LoadUint64(&suffixGen) != gen || !keepLeavesOnCaReload && atomic.LoadUint64(&caGen) != ca {
+		// retireLeaves or reloadCA may have run before the Store
+		cacheCert.Delete(key)
+	}
+	recordIssued(issuedCert{Domain: cn, Key: key.String(), For: why, Serial: cert.Leaf.SerialNumber.Text(16), At: time.Now(), NotAfter: cert.Leaf.NotAfter})
+	log.Infof("issued a leaf for %s (%s)", cn, why)
+	return cert, nil
+}
+
+func mintLeaf(cn string, useRSA bool) (*tls.Certificate, error) {
+	var priv crypto.Signer
+	var err error
+	if useRSA {
+		priv, err = rsaKey()
+	} else {
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		log.Errorf("failed to generate private key: %s", err)
+		return nil, err
+	}
+
+	iss, err := getIssuer()
+	if err != nil {
+		log.Errorf("no issuer: %s", err)
+		return nil, err
+	}
+	ski, err := keyID(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	// only used if the issuer has no SubjectKeyId of its own to point to
+	aki, err := keyID(iss.cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	usage := x509.KeyUsageDigitalSignature
+	if useRSA {
+		usage |= x509.KeyUsageKeyEncipherment // RSA key exchange
+	}
+
+	notBefore, notAfter, clamped, err := validity(clk.Now(), certExpire, iss.cert)
+	if err != nil {
+		log.Errorf("%s: %s", cn, err)
+		return nil, err
+	}
+	if clamped {
+		metricAdd("leaves_clamped_total", 1)
+		metricSet("leaf_clamped", 1)
+		logThrottled.Warnf("leaf-clamped", "%s: leaf valid until %s only, when %s expires",
+			cn, notAfter.Format(time.RFC3339), iss.cert.Subject.CommonName)
+	} else {
+		metricSet("leaf_clamped", 0)
+	}
+	serialNumber, err := leafSerial(iss, cn, ski, notBefore, notAfter)
+	if err != nil {
+		log.Errorf("failed to generate serial number: %s", err)
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      currentSubject().name(cn),
+
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          ski,
+		AuthorityKeyId:        aki,
+		DNSNames:              []string{"*." + cn, cn},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, iss.cert, priv.Public(), iss.key)
+	if err != nil {
+		log.Errorf("failed to create certificate: %s", err)
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: append([][]byte{derBytes}, iss.chain...),
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// validity is when a cert minted at now to last life under parent is
+// valid: from certBackdate before, or parent's start if later, to life
+// after, or parent's end if sooner, which clamped says. Past parent's end
+// there's no cert to mint.
+func validity(now time.Time, life time.Duration, parent *x509.Certificate) (notBefore, notAfter time.Time, clamped bool, err error) {
+	if !now.Before(parent.NotAfter) {
+		return notBefore, notAfter, false, fmt.Errorf("%s expired at %s", parent.Subject.CommonName, parent.NotAfter.Format(time.RFC3339))
+	}
+	notBefore, notAfter = now.Add(-certBackdate), now.Add(life)
+	if notBefore.Before(parent.NotBefore) {
+		notBefore = parent.NotBefore
+	}
+	if notAfter.After(parent.NotAfter) {
+		notAfter, clamped = parent.NotAfter, true
+	}
+	return notBefore, notAfter, clamped, nil
+}
+
+// keyID is the RFC 7093 method 1 key identifier: the leftmost 160 bits of
+// the SHA-256 of the subjectPublicKey.
+func keyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(spki.PublicKey.Bytes)
+	return sum[:20], nil
+}
+
+// leafSerial is random, or with deterministicSerials derivedSerial.
+func leafSerial(iss *issuer, cn string, ski []byte, notBefore, notAfter time.Time) (*big.Int, error) {
+	if !deterministicSerials {
+		return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+	return derivedSerial(iss, cn, ski, notBefore, notAfter)
+}
+
+// derivedSerial is keyed by the issuer's private key over cn, the leaf's
+// key identifier and its validity, so whoever holds the CA key can tell a
+// captured leaf is ours by computing it again. It covers all that differs
+// between two leaves for cn: a leaf minted again has a key of its own, so
+// a serial of its own, as RFC 5280 requires of one issuer and Firefox
+// enforces with SEC_ERROR_REUSED_ISSUER_AND_SERIAL.
+func derivedSerial(iss *issuer, cn string, ski []byte, notBefore, notAfter time.Time) (*big.Int, error) {
+	key, err := x509.MarshalPKCS8PrivateKey(iss.key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = fmt.Fprintf(mac, "%s\x00%x\x00%d\x00%d", cn, ski, notBefore.Unix(), notAfter.Unix())
+	return new(big.Int).SetBytes(mac.Sum(nil)[:16]), nil
+}
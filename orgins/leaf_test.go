@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLeafFor(t *testing.T) {
+	withTestCA(t)
+	p256 := []tls.CurveID{tls.X25519, tls.CurveP256}
+	uncompressed := []uint8{0}
+	tests := []struct {
+		name  string
+		hello tls.ClientHelloInfo
+		rsa   bool
+	}{
+		{"tls13", tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+			SupportedCurves:   p256,
+		}, false},
+		{"tls12 ecdhe-ecdsa", tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+			SupportedCurves:   p256,
+			SupportedPoints:   uncompressed,
+		}, false},
+		{"tls12 rsa suites only", tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+			SupportedCurves:   p256,
+			SupportedPoints:   uncompressed,
+		}, true},
+		{"tls13 without ecdsa signatures", tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256},
+			SupportedCurves:   p256,
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := tt.hello
+			hello.ServerName = "leaf-for.test"
+			cert, err := leafFor(&hello, hello.ServerName, atomic.LoadUint64(&suffixGen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch cert.PrivateKey.(type) {
+			case *rsa.PrivateKey:
+				if !tt.rsa {
+					t.Error("got the RSA leaf, want the ECDSA one")
+				}
+			case *ecdsa.PrivateKey:
+				if tt.rsa {
+					t.Error("got the ECDSA leaf, want the RSA one")
+				}
+			default:
+				t.Errorf("leaf keyed with %T", cert.PrivateKey)
+			}
+			if err := hello.SupportsCertificate(cert); err != nil {
+				t.Errorf("client can't use its leaf: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	openConns  int64 // relayed client connections, each holding about 2 fds
+	connBudget int64 // 0 is unlimited
+)
+
+// setupLimits raises RLIMIT_NOFILE as far as allowed and derives connBudget
+// from it unless maxConns is set.
+func setupLimits() {
+	if n := currentSettings().maxConns; n > 0 {
+		connBudget = n
+	} else if n := raiseFdLimit(); n > 0 {
+		connBudget = (int64(n) - fdHeadroom) / 2
+		if connBudget < 1 {
+			connBudget = 1
+		}
+	}
+	metricSet("conn_budget", connBudget)
+	if connBudget > 0 {
+		log.Infof("connection budget %d", connBudget)
+	}
+}
+
+// shedding reports whether new work should be turned away until some
+// connections drain.
+func shedding() bool {
+	return connBudget > 0 && atomic.LoadInt64(&openConns) >= connBudget
+}
+
+func connOpened() {
+	metricSet("conns_open", atomic.AddInt64(&openConns, 1))
+}
+
+func connClosed() {
+	metricSet("conns_open", atomic.AddInt64(&openConns, -1))
+}
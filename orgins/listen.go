@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// numTLSListeners is how many sockets the TLS port is opened with, each with
+// its own accept loop: tlsListeners, or GOMAXPROCS up to 4. More than one
+// needs SO_REUSEPORT.
+func numTLSListeners() int {
+	n := tlsListeners
+	if n <= 0 {
+		if n = runtime.GOMAXPROCS(0); n > 4 {
+			n = 4
+		}
+	}
+	if n > 1 && !reusePortSupported {
+		log.Infof("no SO_REUSEPORT here, using one TLS listener instead of %d", n)
+		n = 1
+	}
+	return n
+}
+
+// listenConfig sets SO_REUSEPORT if reuse, and the transparent socket
+// options in -transparent mode.
+func listenConfig(reuse bool) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				if reuse {
+					serr = setReusePort(fd)
+				}
+				if serr == nil && *transparent {
+					serr = setTransparent(fd, network)
+				}
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+}
+
+// listenTLS opens the TLS listeners on addr.
+func listenTLS(addr string) ([]net.Listener, error) {
+	return listenN(addr, numTLSListeners())
+}
+
+// listenN opens n sockets on addr, with SO_REUSEPORT if more than one.
+func listenN(addr string, n int) ([]net.Listener, error) {
+	if n == 1 {
+		l, err := listenConfig(false).Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	var ret []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := listenConfig(true).Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range ret {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	log.Infof("%d TLS listeners on %s", n, addr)
+	return ret, nil
+}
+
+// acceptLoop hands the connections of one listener to handleConn, till
+// the listener is closed or fails for good.
+func acceptLoop(id int, list net.Listener, config *tls.Config) error {
+	accepted := metricCounter(metricName("tls_accepts_total", "listener", strconv.Itoa(id)))
+	var backoff time.Duration
+	for {
+		for shedding() {
+			metricAdd("accept_shed_total", 1)
+			time.Sleep(50 * time.Millisecond)
+		}
+		conn, err := list.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil // handed over to a new binary, or stopped
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return err
+			}
+			// e.g. EMFILE: wait for connections to drain instead of spinning
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			logThrottled.Errorf("accept", "accept: %s", err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		atomic.AddInt64(accepted, 1)
+		go handleConn(conn, config)
+	}
+}
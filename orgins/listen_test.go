@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkHandshakes is connections per second to a completed handshake
+// on the TLS port opened with 1, 2 and 4 listeners, each with its own
+// accept loop, clients dialing in parallel. It scales with the cores the
+// kernel can spread accepts over.
+func BenchmarkHandshakes(b *testing.B) {
+	withTestCA(b)
+	leaf, err := cachedLeaf("handshakes.test", atomic.LoadUint64(&suffixGen), false, "benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{*leaf}}
+	client := &tls.Config{ServerName: "handshakes.test", InsecureSkipVerify: true}
+	for _, n := range []int{1, 2, 4} {
+		b.Run("listeners="+strconv.Itoa(n), func(b *testing.B) {
+			if n > 1 && !reusePortSupported {
+				b.Skip("no SO_REUSEPORT here")
+			}
+			free, err := listenConfig(reusePortSupported).Listen(context.Background(), "tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			addr := free.Addr().String()
+			_ = free.Close()
+			ls, err := listenN(addr, n)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, l := range ls {
+				go func(l net.Listener) {
+					for {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						go func() {
+							_ = tls.Server(conn, server).Handshake()
+							_ = conn.Close()
+						}()
+					}
+				}(l)
+			}
+			defer func() {
+				for _, l := range ls {
+					_ = l.Close()
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := tls.Dial("tcp", addr, client)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_ = conn.Close()
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// localRecords is the dynamic zone under localZone, records pushed through
+// /zone by whatever registers itself, e.g. containers, by owner name.
+// It's answered authoritatively before rules and forwarding.
+var (
+	localLock    sync.RWMutex
+	localRecords = make(map[string][]dns.RR) // by lowercased FQDN
+	localSerial  uint32                      // of the synthesized SOA, bumped on changes
+)
+
+// localTypes are the record types /zone takes.
+var localTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"TXT":   dns.TypeTXT,
+	"SRV":   dns.TypeSRV,
+}
+
+// checkLocalZone refuses a localZone that the names answered before it
+// would shadow in part.
+func checkLocalZone() error {
+	suffix := currentSettings().localZone
+	if suffix == "" {
+		return nil
+	}
+	zone, ok := normalizeHost(suffix)
+	if !ok {
+		return errors.New("localZone: invalid name " + suffix)
+	}
+	for _, other := range []string{internalZone, selfName} {
+		if other != "" && (underDomain(zone, other) || underDomain(other, zone)) {
+			return fmt.Errorf("localZone %s overlaps %s", suffix, other)
+		}
+	}
+	return nil
+}
+
+// localName turns name, relative to localZone or under it, into the FQDN
+// of a record.
+func localName(name string) (string, bool) {
+	host, ok := normalizeHost(name)
+	if !ok {
+		return "", false
+	}
+	zone := localApex()
+	if !underDomain(host, zone) {
+		host += "." + zone
+		if !validHostname(host) {
+			return "", false
+		}
+	}
+	return dns.Fqdn(host), true
+}
+
+// newLocalRR makes the record of type for value, in the notation of the
+// type: an address, a name, any text, or "priority weight port target".
+func newLocalRR(fqdn string, qtype uint16, ttl time.Duration, value string) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: fqdn, Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(ttl / time.Second)}
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ip := net.ParseIP(value)
+		if ip == nil || (ip.To4() != nil) != (qtype == dns.TypeA) {
+			return nil, fmt.Errorf("%s needs an address of its family, not %q", dns.TypeToString[qtype], value)
+		}
+		if qtype == dns.TypeA {
+			return &dns.A{Hdr: hdr, A: ip.To4()}, nil
+		}
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	case dns.TypeCNAME:
+		target, ok := normalizeHost(value)
+		if !ok {
+			return nil, fmt.Errorf("CNAME needs a hostname, not %q", value)
+		}
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(target)}, nil
+	case dns.TypeTXT:
+		if len(value) > 255 {
+			return nil, errors.New("TXT longer than 255 bytes")
+		}
+		return &dns.TXT{Hdr: hdr, Txt: []string{value}}, nil
+	case dns.TypeSRV:
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("SRV is \"priority weight port target\", not %q", value)
+		}
+		var n [3]uint64
+		for i := range n {
+			v, err := strconv.ParseUint(f[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("SRV: bad number %q", f[i])
+			}
+			n[i] = v
+		}
+		target, ok := normalizeHost(f[3])
+		if !ok {
+			return nil, fmt.Errorf("SRV needs a target hostname, not %q", f[3])
+		}
+		return &dns.SRV{Hdr: hdr, Priority: uint16(n[0]), Weight: uint16(n[1]), Port: uint16(n[2]), Target: dns.Fqdn(target)}, nil
+	}
+	return nil, errors.New("unsupported type " + dns.TypeToString[qtype])
+}
+
+// localConflicts are what a record for fqdn would clash with: the names
+// answered before the zone, a CNAME beside other types, and rules that it
+// would take the place of.
+func localConflicts(fqdn string, qtype uint16) []string {
+	var ret []string
+	host := strings.TrimSuffix(fqdn, ".")
+	if selfName != "" && underDomain(host, selfName) {
+		ret = append(ret, "selfName "+selfName)
+	}
+	if internalZone != "" && underDomain(host, internalZone) {
+		ret = append(ret, "internalZone "+internalZone)
+	}
+	localLock.RLock()
+	for _, rr := range localRecords[fqdn] {
+		if t := rr.Header().Rrtype; t != qtype && (t == dns.TypeCNAME || qtype == dns.TypeCNAME) {
+			ret = append(ret, "a "+dns.TypeToString[t]+" record of the same name")
+			break
+		}
+	}
+	localLock.RUnlock()
+	for _, v := range currentViews().views {
+		if ru := v.match(host); ru != nil {
+			ret = append(ret, fmt.Sprintf("rule %s of %s:%d in view %s", ru, ru.source, ru.line, v.name))
+		}
+	}
+	return ret
+}
+
+// answerLocalZone answers authoritatively for localZone from localRecords,
+// following CNAMEs within it, with NXDOMAIN or NODATA and the SOA when
+// there's nothing.
+func answerLocalZone(m *dns.Msg) (*dns.Msg, bool) {
+	q := m.Question[0]
+	if zone := localApex(); zone == "" || !underDomain(strings.TrimSuffix(q.Name, "."), zone) {
+		return nil, false
+	}
+	msg := new(dns.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+	apex := dns.Fqdn(localApex())
+
+	localLock.RLock()
+	defer localLock.RUnlock()
+	name := strings.ToLower(q.Name)
+	for hops := 0; hops < 8; hops++ {
+		if name == apex {
+			switch q.Qtype {
+			case dns.TypeSOA:
+				msg.Answer = append(msg.Answer, localSOA())
+				return msg, true
+			case dns.TypeNS:
+				msg.Answer = append(msg.Answer, localNS())
+				return msg, true
+			}
+		}
+		rrs := localRecords[name]
+		var cname dns.RR
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t == q.Qtype || q.Qtype == dns.TypeANY {
+				msg.Answer = append(msg.Answer, dns.Copy(rr))
+			} else if t == dns.TypeCNAME {
+				cname = rr
+			}
+		}
+		switch {
+		case len(msg.Answer) > 0 && cname == nil:
+			return msg, true
+		case cname != nil:
+			msg.Answer = append(msg.Answer, dns.Copy(cname))
+			name = strings.ToLower(cname.(*dns.CNAME).Target)
+			if !underDomain(strings.TrimSuffix(name, "."), localApex()) {
+				return msg, true // the client resolves the rest
+			}
+			continue
+		case len(rrs) == 0 && name != apex && !localHasBelow(name):
+			msg.Rcode = dns.RcodeNameError
+		}
+		msg.Ns = []dns.RR{localSOA()}
+		return msg, true
+	}
+	return msg, true // CNAME loop, what we have
+}
+
+// localHasBelow reports whether there are records under name, which then
+// exists though it has none of its own. Called with localLock held.
+func localHasBelow(name string) bool {
+	for owner := range localRecords {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func localApex() string {
+	return strings.ToLower(strings.TrimSuffix(currentSettings().localZone, "."))
+}
+
+// localNSName is the name server of the zone in its SOA and NS: the proxy
+// by selfName, or the apex without one.
+func localNSName() string {
+	if selfName != "" {
+		return dns.Fqdn(selfName)
+	}
+	return dns.Fqdn(localApex())
+}
+
+func localSOA() dns.RR {
+	ttl := uint32(localZoneTtl / time.Second)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(localApex()), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      localNSName(),
+		Mbox:    "hostmaster." + dns.Fqdn(localApex()),
+		Serial:  localSerial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+func localNS() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(localApex()), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(localZoneTtl / time.Second)},
+		Ns:  localNSName(),
+	}
+}
+
+type localRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+func localRecordOf(rr dns.RR) localRecord {
+	h := rr.Header()
+	value := strings.TrimPrefix(rr.String(), h.String())
+	if txt, ok := rr.(*dns.TXT); ok {
+		value = strings.Join(txt.Txt, "")
+	}
+	return localRecord{h.Name, dns.TypeToString[h.Rrtype], h.Ttl, value}
+}
+
+// zoneHandler is /zone: GET lists the records of localZone; POST with
+// name, type, one value or more and optionally ttl replaces the records of
+// that name and type, refused with 409 on conflicts unless force=1; DELETE
+// with name, and optionally type, removes them.
+func zoneHandler(w http.ResponseWriter, r *http.Request) {
+	if currentSettings().localZone == "" {
+		http.Error(w, "no localZone", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		ret := []localRecord{}
+		localLock.RLock()
+		for _, rrs := range localRecords {
+			for _, rr := range rrs {
+				ret = append(ret, localRecordOf(rr))
+			}
+		}
+		localLock.RUnlock()
+		sort.Slice(ret, func(i, j int) bool {
+			if ret[i].Name != ret[j].Name {
+				return ret[i].Name < ret[j].Name
+			}
+			return ret[i].Type < ret[j].Type
+		})
+		writeJSON(w, ret)
+	case http.MethodPost:
+		fqdn, ok := localName(q.Get("name"))
+		if !ok {
+			http.Error(w, "name= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		qtype, ok := localTypes[strings.ToUpper(q.Get("type"))]
+		if !ok {
+			http.Error(w, "type= is A, AAAA, CNAME, TXT or SRV", http.StatusBadRequest)
+			return
+		}
+		ttl := localZoneTtl
+		if v := q.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 || d > 24*time.Hour {
+				http.Error(w, "ttl needs to be between 0s and 24h, not "+v, http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		values := q["value"]
+		if len(values) == 0 || qtype == dns.TypeCNAME && len(values) > 1 {
+			http.Error(w, "value= needs to be given, once for a CNAME", http.StatusBadRequest)
+			return
+		}
+		var rrs []dns.RR
+		for _, v := range values {
+			rr, err := newLocalRR(fqdn, qtype, ttl, v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rrs = append(rrs, rr)
+		}
+		if c := localConflicts(fqdn, qtype); len(c) > 0 && q.Get("force") != "1" {
+			http.Error(w, fqdn+" conflicts with "+strings.Join(c, ", "), http.StatusConflict)
+			return
+		}
+		setLocal(fqdn, qtype, rrs)
+		log.Infof("zone: %s %s set to %s", fqdn, dns.TypeToString[qtype], strings.Join(values, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		fqdn, ok := localName(q.Get("name"))
+		if !ok {
+			http.Error(w, "name= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		qtype := uint16(dns.TypeANY)
+		if t := q.Get("type"); t != "" {
+			if qtype, ok = localTypes[strings.ToUpper(t)]; !ok {
+				http.Error(w, "type= is A, AAAA, CNAME, TXT or SRV", http.StatusBadRequest)
+				return
+			}
+		}
+		if !setLocal(fqdn, qtype, nil) {
+			http.Error(w, "no such record", http.StatusNotFound)
+			return
+		}
+		log.Infof("zone: %s %s deleted", fqdn, dns.TypeToString[qtype])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// setLocal replaces the records of fqdn of qtype, all of them for ANY,
+// with rrs, and saves the zone. It reports whether anything changed.
+func setLocal(fqdn string, qtype uint16, rrs []dns.RR) bool {
+	localLock.Lock()
+	kept := rrs
+	removed := 0
+	for _, rr := range localRecords[fqdn] {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			removed++
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	changed := removed > 0 || len(rrs) > 0
+	if len(kept) == 0 {
+		delete(localRecords, fqdn)
+	} else {
+		localRecords[fqdn] = kept
+	}
+	if changed {
+		localSerial++
+	}
+	localLock.Unlock()
+	if changed {
+		if err := saveLocalZone(); err != nil {
+			log.Errorf("zone: %s", err)
+		}
+	}
+	return changed
+}
+
+// loadLocalZone reads localZoneFile, a zone file as saveLocalZone writes
+// it. Records outside localZone or of other types are skipped.
+func loadLocalZone() error {
+	localSerial = uint32(time.Now().Unix())
+	if currentSettings().localZone == "" || localZoneFile == "" {
+		return nil
+	}
+	fil, err := os.Open(localZoneFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fil.Close() }()
+	zp := dns.NewZoneParser(fil, "", localZoneFile)
+	n := 0
+	localLock.Lock()
+	defer localLock.Unlock()
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		h.Name = strings.ToLower(h.Name)
+		if _, ok := localTypes[dns.TypeToString[h.Rrtype]]; !ok || !underDomain(strings.TrimSuffix(h.Name, "."), localApex()) {
+			log.Errorf("%s: skipped %s", localZoneFile, rr)
+			continue
+		}
+		localRecords[h.Name] = append(localRecords[h.Name], rr)
+		n++
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	log.Infof("zone: %d records from %s", n, localZoneFile)
+	return nil
+}
+
+// saveLocalZone writes localRecords to localZoneFile through a rename.
+func saveLocalZone() error {
+	if localZoneFile == "" {
+		return nil
+	}
+	var lines []string
+	localLock.RLock()
+	for _, rrs := range localRecords {
+		for _, rr := range rrs {
+			lines = append(lines, rr.String())
+		}
+	}
+	localLock.RUnlock()
+	sort.Strings(lines)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(localZoneFile), ".zone-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), localZoneFile)
+}
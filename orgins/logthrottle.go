@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// logThrottled emits identical (key, message) pairs at most once per
+// logThrottleInterval, counting what it swallowed in between. What a burst's
+// last interval swallowed is logged once it's over, by the sweep.
+var logThrottled = &throttledLogger{}
+
+type throttledLogger struct {
+	seen sync.Map // key + format -> *throttleEntry
+}
+
+type throttleEntry struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+	level      log.Level
+	msg        string // as last logged
+	gone       bool   // swept, a new entry takes over
+}
+
+func (t *throttledLogger) Errorf(key, format string, args ...interface{}) {
+	t.logf(log.ErrorLevel, key, format, args...)
+}
+
+func (t *throttledLogger) Warnf(key, format string, args ...interface{}) {
+	t.logf(log.WarnLevel, key, format, args...)
+}
+
+func (t *throttledLogger) Infof(key, format string, args ...interface{}) {
+	t.logf(log.InfoLevel, key, format, args...)
+}
+
+func (t *throttledLogger) logf(level log.Level, key, format string, args ...interface{}) {
+	if !log.IsLevelEnabled(level) {
+		return
+	}
+	now := time.Now()
+	var entry *throttleEntry
+	for {
+		e, ok := t.seen.Load(key + "\x00" + format)
+		if !ok {
+			e, _ = t.seen.LoadOrStore(key+"\x00"+format, new(throttleEntry))
+		}
+		entry = e.(*throttleEntry)
+		entry.mu.Lock()
+		if !entry.gone {
+			break
+		}
+		entry.mu.Unlock()
+	}
+	if now.Sub(entry.last) < logThrottleInterval {
+		entry.suppressed++
+		entry.mu.Unlock()
+		metricAdd(metricName("log_suppressed_total", "level", level.String()), 1)
+		return
+	}
+	suppressed := entry.suppressed
+	msg := fmt.Sprintf(format, args...)
+	entry.last, entry.suppressed, entry.level, entry.msg = now, 0, level, msg
+	entry.mu.Unlock()
+
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (repeated %d times)", msg, suppressed)
+	}
+	log.StandardLogger().Log(level, msg)
+}
+
+// sweep forgets the entries quiet for logThrottleInterval, so the map
+// doesn't grow with every key ever seen, first logging how many more of
+// their message were suppressed since it was last logged.
+func (t *throttledLogger) sweep(now time.Time) {
+	type flush struct {
+		level log.Level
+		msg   string
+	}
+	var flushes []flush
+	t.seen.Range(func(k, v interface{}) bool {
+		entry := v.(*throttleEntry)
+		entry.mu.Lock()
+		if now.Sub(entry.last) >= logThrottleInterval {
+			if entry.suppressed > 0 {
+				flushes = append(flushes, flush{entry.level, fmt.Sprintf("%s (%d more suppressed)", entry.msg, entry.suppressed)})
+			}
+			entry.gone = true
+			t.seen.Delete(k)
+		}
+		entry.mu.Unlock()
+		return true
+	})
+	for _, f := range flushes {
+		log.StandardLogger().Log(f.level, f.msg)
+	}
+}
+
+// pollingLogThrottle sweeps logThrottled every logThrottleInterval.
+func pollingLogThrottle() {
+	go func() {
+		for {
+			time.Sleep(logThrottleInterval)
+			logThrottled.sweep(time.Now())
+		}
+	}()
+}
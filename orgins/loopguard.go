@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The system resolver of the machine this runs on is usually this proxy,
+// so nothing the proxy connects to by itself may be resolved with it: a
+// lookup would come back through forwardDns, wait on itself, and for a
+// proxied name be answered with our own address. Which config fields take
+// hostnames, and how they're resolved:
+//
+//   - defDNS, gfwDNS, paranoidDNS and the resolvers section take IPs only,
+//     checked at startup by checkResolvers; everything else is resolved
+//     through them
+//   - addr of socks and http routes, remote rule sources, eventWebhook,
+//     expiryWebhook and peerURL take hostnames, resolved by
+//     bootstrapResolver, which asks defResolver
+//   - listen addresses take hostnames, resolved the same way when selfName
+//     is answered with them; binding to them is left to the system
+//
+// Should a resolver we forward to still forward to us, queries we send
+// carry loopGuardOption and are refused on the way back in, see loopedBack.
+var bootstrapResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, defResolver)
+	},
+}
+
+// bootstrapDialer is net.Dialer with names resolved by bootstrapResolver.
+var bootstrapDialer = &net.Dialer{KeepAlive: 30 * time.Second, Resolver: bootstrapResolver}
+
+// bootstrapTransport is http.DefaultTransport with names resolved by
+// bootstrapResolver.
+var bootstrapTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           bootstrapDialer.DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// checkResolvers makes sure each resolver is an IP and port, there being
+// nothing to resolve a name of theirs with, and none of them is our own
+// DNS listener.
+func checkResolvers() error {
+	for _, r := range []struct{ name, addr string }{
+		{"plain", defResolver}, {"secure", gfwResolver}, {"paranoid", paranoidResolver},
+	} {
+		if r.addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(r.addr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			return fmt.Errorf("%s resolver %s needs to be an IP and port, names are resolved with it", r.name, r.addr)
+		}
+		for _, l := range dnsAddrs() {
+			if listensOn(l, ip, port) {
+				return fmt.Errorf("%s resolver %s is our own DNS listener %s, queries would go round in a loop", r.name, r.addr, l)
+			}
+		}
+	}
+	return nil
+}
+
+// listensOn reports whether the listen address l takes what's sent to ip
+// and port.
+func listensOn(l string, ip net.IP, port string) bool {
+	host, lport, err := net.SplitHostPort(l)
+	if err != nil || lport != port {
+		return false
+	}
+	lip := net.ParseIP(host)
+	switch {
+	case host == "" || lip != nil && lip.IsUnspecified():
+		return ip.IsLoopback() || localIP(ip)
+	case host == "localhost":
+		return ip.IsLoopback()
+	}
+	return lip != nil && lip.Equal(ip)
+}
+
+// localIP reports whether ip is an address of one of our interfaces.
+func localIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopNonce tells our queries from those of another instance on the same
+// option code.
+var loopNonce = func() []byte {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return b
+}()
+
+// loopMark returns m with loopGuardOption added, leaving m as it is.
+func loopMark(m *dns.Msg) *dns.Msg {
+	if loopGuardOption == 0 {
+		return m
+	}
+	c := *m
+	c.Extra = make([]dns.RR, 0, len(m.Extra)+1)
+	var opt *dns.OPT
+	for _, rr := range m.Extra {
+		if o, ok := rr.(*dns.OPT); ok && opt == nil {
+			cp := *o
+			cp.Option = append([]dns.EDNS0(nil), o.Option...)
+			opt, rr = &cp, &cp
+		}
+		c.Extra = append(c.Extra, rr)
+	}
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(ednsUDPSize)
+		c.Extra = append(c.Extra, opt)
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: loopGuardOption, Data: loopNonce})
+	return &c
+}
+
+// loopedBack reports whether m is a query of ours that came back.
+func loopedBack(m *dns.Msg) bool {
+	if loopGuardOption == 0 {
+		return false
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == loopGuardOption && bytes.Equal(l.Data, loopNonce) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,99 +1,452 @@
 package main
 
 import (
-	"bufio"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
+	"flag"
 	"io"
-	"io/ioutil"
-	"math/big"
 	"net"
-	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
-	"golang.org/x/net/publicsuffix"
 )
 
 const (
 	// certs
 	caCert = "CERT_PUBC.crt"
 	caKey  = "CERT_PRIC.key"
+	// what caKey is: "file", a PEM key; "encrypted", a PEM key encrypted
+	// with the passphrase caKeyPassphrase says where to read, as openssl
+	// pkcs8 -topk8 -v2 aes-256-cbc writes it; "pkcs11", the RFC 7512 URI of
+	// a key in a token, see pkcs11URI. caKeyPassphrase is env:NAME,
+	// file:PATH, cred:NAME for a systemd credential, or prompt
+	caKeyBackend    = "file"
+	caKeyPassphrase = "prompt"
+	// sign leaves with a per-run intermediate instead of the root directly,
+	// renewed after 2/3 of its lifetime
+	useIntermediate    = false
+	intermediateExpire = time.Hour * 24 * 90
+	// leaves and intermediates are valid from certBackdate ago, for clients
+	// whose clock is behind, and never beyond their issuer
+	certBackdate = 5 * time.Minute
+	// on CA reload keep serving cached leaves signed by the old CA until they expire
+	keepLeavesOnCaReload = false
+	// leaf serials derived from the issuer key over the domain, the leaf's
+	// key and validity instead of random, so a captured leaf can be traced
+	// to this CA; a leaf minted again has a new key, so a new serial
+	deterministicSerials = false
+	// POSTed a JSON alert when the CA passes one of expiryThresholds, "" for none
+	expiryWebhook = ""
 	// dns
 	defDNS = "114.114.114.114:53"
 	gfwDNS = "8.8.8.8:853"
+	// a second DNS-over-TLS resolver, run by someone else, that gfwDNS has
+	// to share an address with for rules with the paranoid option; "" for
+	// none
+	paranoidDNS = ""
+	// answers to the lookups of proxied names are validated with DNSSEC up
+	// to the root: a bogus one fails the resolve, an insecure one is used
+	// as without. Root DS records in zone file format are read from
+	// trustAnchorFile, the bundled ones used when it's ""
+	dnssecValidate  = false
+	trustAnchorFile = ""
+	// forwarded queries go to gfwDNS as well, not only the lookups of
+	// proxied names, so none leave in plaintext but those for names of
+	// plain-dns rules. They fail while it does, rather than fall back
+	privateDNS = false
+	// queries forwarded to a plain resolver go with the qname in random
+	// case, dns0x20; an answer not echoing it is counted as forged and the
+	// query asked again once. Resolvers that lowercase the question fail
+	// every query with this on
+	caseRandomize = false
+	// EDNS0 UDP size advertised upstream and to clients
+	ednsUDPSize = 1232
+	// queries sent upstream carry an EDNS0 option with this local-use code,
+	// so one coming back to us, a resolver we forward to forwarding to us,
+	// is answered SERVFAIL instead of going round; 0 for none
+	loopGuardOption = 65433
+	// per upstream and transport, clients kept for reuse until the next
+	// reload, and how long they wait for an answer
+	dnsClientsIdle = 16
+	dnsTimeout     = 2 * time.Second
+	// TTL of spoofed answers; a removed domain is relayed direct that long
+	// after a reload if graceRemoved, since clients still connect to us
+	spoofTtl     = 60 * time.Second
+	graceRemoved = true
+	// spoofed answers of a rule get a TTL as long as it has gone unchanged,
+	// from spoofTtlMin up to its ttl option or spoofTtl
+	adaptiveTtl = false
+	spoofTtlMin = 15 * time.Second
+	// proxied names answer CNAME queries with no records, like the A/AAAA
+	// spoofed for them; with matchCnames a forwarded answer whose CNAME
+	// chain reaches a proxied or blocked name is treated as for that name
+	flattenCnames = false
+	matchCnames   = false
+	// which of A and AAAA spoofed answers are given: auto for the families
+	// the TLS listeners are bound to, ipv4, ipv6 or both; the other type
+	// gets NODATA
+	spoofFamilies = "auto"
+	// what spoofed answers point at, an IPv4 and/or IPv6 address
+	// comma-separated, "" for loopback; needed when the TLS component runs
+	// on another host
+	spoofTarget = ""
+	// EDNS0 option code, a local one from 65001-65534, that debug clients
+	// send to be told how their query was answered; 0 for never
+	provenanceOption = 0
+	// ports
+	advertisedTLSPort  = "443" // what clients connect to, see -tls-listen for binding
+	advertisedHTTPPort = "80"
+	upstreamPort       = "443"
+	// components: each runs without the others, e.g. only TLS behind
+	// another DNS server, or only DNS in front of a TLS proxy elsewhere
+	enableDNS   = true
+	enableHTTP  = true
+	enableTLS   = true
+	enableAdmin = true
+	// a component whose listener fails to bind or is closed under it is
+	// opened again this many times in a row, componentBackoff after the
+	// failure and twice that after each next one, for when e.g. the process
+	// before an upgrade still has the port; per component in the restarts
+	// section of the config file
+	componentRestarts = 3
+	componentBackoff  = 500 * time.Millisecond
 	// time
 	certExpire   = time.Hour * 24 * 30 // a month
 	dialTimeout  = 5 * time.Second
+	minTimeout   = 100 * time.Millisecond // bounds of per-rule timeouts
+	maxTimeout   = time.Minute
+	sniffTimeout = 10 * time.Second // for the first bytes on the TLS port
 	pollInterval = time.Second
 	cacheAddrTtl = 5 * time.Minute
+	negativeTtl  = 30 * time.Second
+	// for the request headers on the HTTP port, twice that for the whole
+	// request or response
+	httpHeaderTimeout  = 5 * time.Second
+	httpMaxHeaderBytes = 8 << 10
+	httpMaxHeaderLine  = 4 << 10
+	// resolvers are asked something this often even when idle
+	upstreamProbeInterval = time.Minute
+	// CA and leaf expiry is checked this often
+	expiryCheckInterval = time.Hour
+	// how long the route that worked for a host is tried first
+	cacheRouteTtl = 10 * time.Minute
+	// rules with the sticky option keep dialing the same upstream addr this
+	// long, retrying it stickyRetries times before failing over to another
+	stickyTtl     = 6 * time.Hour
+	stickyRetries = 2
+	// a new binary started on SIGUSR2 or POST /upgrade must serve within
+	// upgradeTimeout, the old one then relays what it has for up to
+	// upgradeDrain before exiting
+	upgradeTimeout = 30 * time.Second
+	upgradeDrain   = 10 * time.Minute
+	// connections taking slowSetup or longer from accept to the first byte
+	// back get their stages logged, 0 for never; the stages always go to
+	// the conn_stage_ms histograms
+	slowSetup = time.Duration(0)
+	// connections for a host failing breakerFailures times in a row, within
+	// breakerWindow, open its circuit: new ones are refused for
+	// breakerOpenFor, then one is let through as a probe, the wait doubling
+	// up to breakerMaxOpen each time one fails; 0 breakerFailures for never
+	breakerFailures = 5
+	breakerWindow   = time.Minute
+	breakerOpenFor  = 10 * time.Second
+	breakerMaxOpen  = 5 * time.Minute
+	// relay
+	earlyDeathWindow = time.Second // upstream closing this soon is suspicious
+	earlyDeathBytes  = 64          // ... if it sent no more than this
+	replayBufSize    = 64 * 1024   // client bytes kept for retrying on another addr
+	// connections relayed without MITM between plain TCP sockets are
+	// spliced in the kernel on linux unless relaySplice is off; they end
+	// once nothing moved either way for relayIdle, 0 for never
+	relaySplice = true
+	relayIdle   = time.Duration(0)
+	// any relay ends gracefully once relayMaxLife old, and once the client
+	// sent for relayOneWay with nothing coming back, for hygiene on flaky
+	// tunnels; 0 for never. Routes and rules set their own with max-life=
+	// and one-way=
+	relayMaxLife = time.Duration(0)
+	relayOneWay  = time.Duration(0)
+	// on routes with mss or max-record, upstream writes blocking this long
+	// are counted, and stallWarn of them in one connection logged
+	writeStall = 2 * time.Second
+	stallWarn  = 3
+	// clients offering nothing newer are refused with a protocol_version
+	// alert, e.g. tls.VersionTLS12; 0 for whatever crypto/tls accepts
+	minClientTLS = 0
+	// upstream chains: a leaf with only a CommonName is accepted on that
+	// with verifyCNFallback, an expired intermediate sent next to a path
+	// that verifies without it with verifyExpiredIntermediate
+	verifyCNFallback          = false
+	verifyExpiredIntermediate = true
+	// an address family with famFailRatio of its last famWindow direct
+	// dials failing is tried last and its cached addrs skipped; one dial
+	// in it is let through every famProbeEvery to notice it's back
+	famWindow     = 20
+	famFailRatio  = 0.8
+	famProbeEvery = 30 * time.Second
 	// misc
 	logLevel   = log.InfoLevel
 	configFile = "CONF_DOMS.ini"
+	routesFile = "CONF_ROUT.ini"
+	viewsFile  = "CONF_VIEW.ini"
+	groupsFile = "CONF_GRUP.ini"
+	// subject fields of newly minted leaves, see subject
+	subjectFile = "CONF_SUBJ.ini"
+	// ranges connections without SNI are routed for in -transparent mode
+	ipRulesFile = "CONF_CIDR.ini"
+	// public suffix list as published at publicsuffix.org, used instead of
+	// the one built in when set, reread with the rules. Names under TLDs
+	// it doesn't know, single labels included, match rules of any parent
+	// with unknownTLD "registrable", only those naming them with "reject"
+	suffixFile = ""
+	unknownTLD = "registrable"
+	// journal of the rules added through the admin API, replayed after the
+	// static sources at startup; rewritten every runtimeCompactEvery once
+	// it has runtimeCompactMin more entries than twice its rules
+	runtimeFile         = "CONF_RUNT.jsonl"
+	runtimeCompactEvery = time.Hour
+	runtimeCompactMin   = 100
+	// candidate rules compared with configFile without taking effect, ""
+	// for none; also uploadable through the admin API
+	shadowFile = ""
+	// html/template for proxy error pages, "" for the built-in one, and the
+	// language it's in
+	errorPageFile = ""
+	errorPageLang = "en"
+	// remote rule sources are fetched again after
+	remoteRefresh = 6 * time.Hour
+	keyLogFile    = "" // debug only, falls back to $SSLKEYLOGFILE
+	adminAddr     = "localhost:8053"
+	// plain TCP port answering every connection with one status line and
+	// closing it, for watchdogs that can't speak HTTP, "" for none; the
+	// same line is written to healthFile every healthEvery, "" for never
+	healthAddr    = ""
+	healthFile    = ""
+	healthEvery   = 10 * time.Second
+	healthTimeout = 2 * time.Second
+	// beyond loopback, adminAddr and selfName serve the admin API over TLS
+	// only, to clients with a certificate from adminClientCA; the cert is
+	// minted by our CA for adminName unless adminCert and adminKey are set
+	adminName     = selfName
+	adminCert     = ""
+	adminKey      = ""
+	adminClientCA = ""
+	// another instance's admin API, asked for real addrs before the secure
+	// resolver and readable as the rule source "peer:"; after a failure
+	// it's left alone for peerRetry. peerCA verifies it, peerCert and
+	// peerKey are our client cert from its adminClientCA. New rules are
+	// looked for every peerSync
+	peerURL   = ""
+	peerCA    = ""
+	peerCert  = ""
+	peerKey   = ""
+	peerRetry = 30 * time.Second
+	peerSync  = 5 * time.Minute
+	// DNS query log: 1 in queryLogSample forwarded queries and all spoofed,
+	// observed or noaaaa ones, with privateDNS also all sent in plaintext; 0
+	// disables it. JSON lines to queryLogFile, or the standard log.
+	queryLogSample = 0
+	queryLogFile   = ""
+	// drop private addrs from answers for names not in rebindAllow
+	rebindProtect = false
+	// zone answered by the proxy itself, with internalZoneAddr or NXDOMAIN
+	internalZone     = "proxy.local"
+	internalZoneAddr = ""
+	// zone of records set through /zone on the admin API, e.g. by
+	// containers registering themselves, "" for none. They're kept in
+	// memory and in localZoneFile, a zone file, if set. Records without a
+	// ttl and the SOA get localZoneTtl
+	localZone     = ""
+	localZoneFile = ""
+	localZoneTtl  = time.Minute
+	// name answered with the listener addresses, for which the TLS port
+	// serves the admin API
+	selfName = "sni-proxy.local"
+	// identical log lines are emitted at most once per interval
+	logThrottleInterval = 10 * time.Second
+	// a summary of the metrics is logged this often, 0 for never
+	summaryInterval = 5 * time.Minute
+	// upstream address family: auto (IPv6 first), prefer-ipv4, prefer-ipv6,
+	// ipv4-only or ipv6-only
+	addrFamily = "auto"
+	// connection budget for load-shedding, 0 derives it from RLIMIT_NOFILE
+	// leaving fdHeadroom fds for listeners, DNS and files
+	maxConns   = 0
+	fdHeadroom = 64
+	// bytes the caches of leaves, addresses, routes, DNSSEC keys and client
+	// stats take together, about; beyond it each evicts its share, see
+	// budgetMap. 0 for no budget, each cache only bounded by its own limits
+	cachesMaxMemory = 0
+	// TLS sockets opened with SO_REUSEPORT, each with its own accept loop,
+	// 0 for GOMAXPROCS up to 4
+	tlsListeners = 0
+	// events of eventWebhookTypes are POSTed here, "" for none
+	eventWebhook = ""
+	// connections whose rule is gone after a reload are closed after
+	// drainGrace, instead of relaying until either side hangs up
+	drainOnRemove = false
+	drainGrace    = time.Minute
+	// more blocked queries than this in a minute is worth an event
+	blockedBurst = 100
+	// decrypted streams of rules with the capture option go here, the oldest
+	// deleted beyond captureMaxBytes
+	captureDir      = "captures"
+	captureMaxBytes = 256 << 20
+	// per direction of a capture, bytes waiting for the disk; beyond that
+	// the relay goes on and the capture gets a gap
+	captureQueue = 4 << 20
+	// leaves of rules with the warm option and of the warmRecent last used
+	// ones are minted in the background after reloads, warmWorkers at a time
+	warmUp      = false
+	warmRecent  = 100
+	warmWorkers = 1
+	// RSA keys kept ready for clients that can't do ECDSA
+	rsaKeyPool = 2
+	// leaves minted since startup listed on GET /certs/issued, the last
+	// issuedKeep of them
+	issuedKeep = 1000
+	// per-client counters and top names on GET /clients, for the clientsMax
+	// most recently seen clients and clientTopSlots names each; off for
+	// deployments that mustn't keep them. Saved to clientsFile every
+	// clientsSave to survive restarts, "" keeps them in memory
+	trackClients   = true
+	clientsMax     = 1024
+	clientTopSlots = 16
+	clientsFile    = ""
+	clientsSave    = 5 * time.Minute
+	// every distinct name asked for on the DNS port and SNI sent to the TLS
+	// port, with when it was first and last seen, how often, whether a rule
+	// matched it and what was done, on GET /sightings to curate the rules
+	// from; off by default. Kept in sightingsFile, compacted every
+	// sightingsCompact, names not seen for sightingsRetention dropped and
+	// at most sightingsMax kept, the least recently seen evicted.
+	// sightingsHash keeps keyed hashes of the names instead, the key in
+	// sightingsFile.key; views opt out with sightings=off
+	trackSightings     = false
+	sightingsFile      = "CONF_SEEN.jsonl"
+	sightingsMax       = 50000
+	sightingsRetention = 30 * 24 * time.Hour
+	sightingsCompact   = time.Hour
+	sightingsHash      = false
+	// clients failing handshakes for not trusting the CA, listed on GET
+	// /tls/needs-ca and in /status to find the device it wasn't installed
+	// on, the needsCAMax most recently seen
+	trackNeedsCA = true
+	needsCAMax   = 256
+	// client fingerprints counted in metrics each on their own, any more
+	// distinct ones together as other
+	fingerprintsMax = 256
 )
 
 var (
-	// dns setting correspond to the above
-	defDnsCli = sync.Pool{New: func() interface{} {
-		return &dns.Client{Net: "udp"}
-	}}
-	gfwDnsCli = sync.Pool{New: func() interface{} {
-		return &dns.Client{Net: "tcp-tls"}
-	}}
-
-	proxyAddr   map[string]struct{} // no async r & w so ok
 	resolvLock  sync.Map
-	cacheCert   sync.Map
-	cacheResolv sync.Map
+	cacheCert   = newBudgetMap("certs", certCost, certAge)
+	cacheResolv = newBudgetMap("resolve", resolvCost, resolvAge)
+	cacheNeg    = newBudgetMap("negative", deadlineCost, deadlineAge) // host -> deadline, hosts recently found unreachable
+	suspectAddr = newBudgetMap("suspect", deadlineCost, deadlineAge)  // addr -> deadline, addrs that died right after handshake
 
-	caParent *x509.Certificate
-	caPriKey *rsa.PrivateKey
+	configLock sync.Mutex // one updateConfig at a time
+
+	// where defDNS and gfwDNS queries actually go, and the roots upstream
+	// certs are checked against, nil for the system ones; only -config and
+	// the tests change these
+	defResolver, gfwResolver = defDNS, gfwDNS
+	paranoidResolver         = paranoidDNS
+	upstreamRoots            *x509.CertPool
 )
 
 type Resolv struct {
 	addr   string
-	expire time.Time
+	expire deadline
+	dnssec string // status of the answer, "" when not validated
 }
 
 func (r *Resolv) Expired() bool {
-	return r.expire.Before(time.Now())
+	return r.expire.passed()
 }
 
-func needsProxy(domain string) bool {
-	if _, ok := proxyAddr[domain]; ok {
-		return true
-	}
-	secondary, err := publicsuffix.EffectiveTLDPlusOne(domain)
-	if err != nil {
-		log.Errorf("hostname invalid: %s", domain)
-		return false
+// matchRule returns the rule in table for domain or its closest listed
+// parent, down to walkStop.
+func matchRule(table map[string]*rule, domain string) *rule {
+	if r, ok := table[domain]; ok {
+		return r
 	}
-	for domain != secondary {
+	for stop := walkStop(domain); domain != stop; {
 		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			break
+		}
 		domain = domain[dot+1:]
-		if _, ok := proxyAddr[domain]; ok {
-			return true
+		if r, ok := table[domain]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// resolveRealIP asks the peer for host if there's one up, else the secure
+// resolver, putting the addrs of a demoted family last. paranoid is the
+// rule's option.
+func resolveRealIP(host string, fam family, paranoid bool) ([]*Resolv, error) {
+	if peer != nil {
+		if addrs, err, ok := peer.resolve(host, fam, paranoid); ok {
+			if err != nil {
+				return nil, err
+			}
+			return orderByHealth(addrs), nil
 		}
 	}
-	return false
+	return resolveSecure(host, fam, paranoid)
 }
 
-func resolveRealIP(host string) (ret []*Resolv) {
-	cli := gfwDnsCli.Get().(*dns.Client)
-	defer gfwDnsCli.Put(cli)
+// resolveSecure asks the secure resolver for host, dropping bogon and known
+// poison answers and putting those of a demoted family last. When paranoid,
+// paranoidResolver is asked at the same time and only the addrs both name
+// are kept.
+func resolveSecure(host string, fam family, paranoid bool) ([]*Resolv, error) {
+	paranoid = paranoid && paranoidResolver != ""
+	var second []*Resolv
+	var wg sync.WaitGroup
+	if paranoid {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			second = resolveVia(upstreamFor(paranoidResolver), host, fam)
+		}()
+	}
+	addrs := resolveVia(upstreamFor(gfwResolver), host, fam)
+	wg.Wait()
+	if addrs == nil {
+		return nil, errResolve
+	}
+	addrs, err := dropBogons(host, addrs)
+	if err != nil {
+		return nil, err
+	}
+	if addrs, err = dropPoisoned(host, addrs); err != nil {
+		return nil, err
+	}
+	if paranoid {
+		if addrs, err = agreed(host, addrs, second); err != nil {
+			return nil, err
+		}
+	}
+	return orderByHealth(addrs), nil
+}
+
+// resolveVia asks u for the addresses of host in the order fam prefers,
+// nil if it fails or an answer isn't sane.
+func resolveVia(u *upstream, host string, fam family) (ret []*Resolv) {
+	cli := u.client(false)
+	defer cli.put()
 
-	// ask AAAA (ipv6) address first
 	q := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			RecursionDesired: true,
@@ -101,366 +454,886 @@ func resolveRealIP(host string) (ret []*Resolv) {
 		Question: []dns.Question{
 			{
 				Name:   dns.Fqdn(host),
-				Qtype:  dns.TypeAAAA,
 				Qclass: dns.ClassINET,
 			},
 		},
 	}
-	r, _, err := cli.Exchange(q, gfwDNS)
-	if err != nil {
-		log.Warn(err)
-		return
+	if validateDNSSEC {
+		q.SetEdns0(ednsUDPSize, true)
 	}
-	for _, ans := range r.Answer {
-		if a, ok := ans.(*dns.AAAA); ok {
-			ret = append(ret, &Resolv{
-				addr:   net.JoinHostPort(a.AAAA.String(), "443"),
-				expire: time.Now().Add(cacheAddrTtl),
-			})
+	for _, qtype := range fam.qtypes() {
+		q.Id = dns.Id()
+		q.Question[0].Qtype = qtype
+		r, rtt, err := cli.Exchange(q, u.addr)
+		u.record(r, rtt, err)
+		if err != nil {
+			logThrottled.Warnf(host, "%s: %s", host, err)
+			return nil
 		}
-	}
-
-	// ask A (ipv4) address
-	q.Question[0].Qtype = dns.TypeA
-	r, _, err = cli.Exchange(q, gfwDNS)
-	if err != nil {
-		log.Warn(err)
-		return
-	}
-	for _, ans := range r.Answer {
-		if a, ok := ans.(*dns.A); ok {
+		ips, err := saneAddrs(q, r)
+		if err != nil {
+			logThrottled.Warnf(host, "%s: %s from %s, discarded", host, err, u.addr)
+			return nil
+		}
+		status := ""
+		if validateDNSSEC {
+			var why error
+			status, why = validateAnswer(u, r)
+			metricAdd(metricName("dnssec_answers_total", "status", status), 1)
+			if status == dnssecBogus {
+				logThrottled.Warnf("dnssec "+host, "%s: bogus answer from %s, discarded: %s", host, u.addr, why)
+				return nil
+			}
+		}
+		for _, ip := range ips {
 			ret = append(ret, &Resolv{
-				addr:   net.JoinHostPort(a.A.String(), "443"),
-				expire: time.Now().Add(cacheAddrTtl),
+				addr:   net.JoinHostPort(ip.String(), upstreamPort),
+				expire: expireIn(cacheAddrTtl),
+				dnssec: status,
 			})
 		}
 	}
 	return
 }
 
-func forwardTls(conn *tls.Conn) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Error(err)
+// upstreamLeg is the upstream side of a MITM'd connection. It is set up while
+// the client is still in its handshake, so a dead upstream fails the
+// handshake instead of leaving a session that silently dies.
+type upstreamLeg struct {
+	host, dialHost string
+	v              *view
+	r              *rule
+	config         *tls.Config // to the upstream, reused for redials
+	up             net.Conn
+	addr, via      string
+	pinned         string // pinFor before the first dial
+	fp             string // clientFingerprint of the client's hello
+	tried          map[string]struct{}
+	began          time.Time
+	log            *log.Entry // of the client connection
+	stages         *connStages
+}
+
+// sniGate is what a handshake from client, connected to local, for host
+// gets: the client's view, the rule of it the decide hooks settled on, and
+// whether that gets it a leaf rather than refused. /certs asks it too.
+func sniGate(host string, client, local net.Addr) (v *view, r *rule, allowed bool) {
+	v = viewFor(client, local)
+	r = decide("sni", host, client, v.match(host))
+	return v, r, r != nil && !r.block
+}
+
+// dial picks the rule for the client's SNI and connects upstream offering the
+// client's ALPN protocols, then answers the client with what the upstream
+// chose. A failure aborts the handshake with the alert of its kind.
+func (leg *upstreamLeg) dial(hello *tls.ClientHelloInfo, base *tls.Config) (*tls.Config, error) {
+	leg.stages.mark(stageHello)
+	host, ok := normalizeHost(hello.ServerName)
+	if selfName != "" && strings.EqualFold(host, selfName) && adminRemote() {
+		c := base.Clone()
+		requireAdminClient(c, hello.Conn.RemoteAddr())
+		return c, nil
+	}
+	if !ok || ownName(host) {
+		return nil, nil // getCertificate rejects bad names, ours are served locally
+	}
+	leg.fp = clientFingerprint(hello)
+	countFingerprint(leg.fp)
+	if tooOldTLS(hello) {
+		logThrottled.Infof("old tls", "%s: %s offers nothing from minClientTLS on", host, hello.Conn.RemoteAddr())
+		return nil, failHandshake(hello.Conn, failOldTLS)
+	}
+	v, r, allowed := sniGate(host, hello.Conn.RemoteAddr(), hello.Conn.LocalAddr())
+	atomic.AddInt64(v.tlsConns, 1)
+	leg.stages.mark(stageDecided)
+	shadowCompare(v, host, r)
+	sniDecision := "proxy"
+	if r == nil {
+		sniDecision = "pass"
+	} else if r.block {
+		sniDecision = "blocked"
+	}
+	metricAdd(metricName("relay_decisions_total", "by", "sni", "decision", sniDecision), 1)
+	countClientTLS(hello.Conn.RemoteAddr(), host, r != nil && r.block)
+	noteSighting(v, "sni", host, sniDecision)
+	if !allowed {
+		logThrottled.Errorf(host, "%s needs no proxy in view %s", host, v.name)
+		return nil, failHandshake(hello.Conn, failRuleRejected)
+	}
+	leg.log.Debug(host)
+	if pol, ok := currentSettings().fingerprints[leg.fp]; ok {
+		leg.log.Infof("%s: client fingerprint %s, policy %s", host, leg.fp, pol)
+		if pol.block {
+			return nil, failHandshake(hello.Conn, failFingerprint)
 		}
-	}()
+		if pol.route != "" {
+			forced := *r
+			forced.routes = []string{pol.route}
+			r = &forced
+		}
+	}
 
-	if err := conn.Handshake(); err != nil {
-		log.Debugf("handshake error: %s", err.Error())
-		return
+	// with a front, the upstream sees the front name in its ClientHello
+	verifyName, dialHost := host, host
+	if r.front != "" {
+		if r.frontVerify {
+			verifyName = r.front
+		}
+		if r.frontIPs {
+			dialHost = r.front
+		}
+		leg.log.Debugf("%s: fronted as %s, dialing %s, verifying %s", host, r.front, dialHost, verifyName)
 	}
-	host := conn.ConnectionState().ServerName
-	if !needsProxy(host) {
-		log.Errorf("%s needs no proxy", host)
-		return
+	if r.verifyName != "" {
+		verifyName = r.verifyName
 	}
-	log.Debug(host)
 
-	d := &net.Dialer{Timeout: dialTimeout}
 	config := &tls.Config{
+		KeyLogWriter:       keyLog,
+		NextProtos:         hello.SupportedProtos,
 		InsecureSkipVerify: true,
 		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
 			// bypass tls verification and manually do it
-			certs := make([]*x509.Certificate, len(rawCerts))
-			for i, asn1Data := range rawCerts {
-				cert, _ := x509.ParseCertificate(asn1Data)
-				certs[i] = cert
-			}
-			opts := x509.VerifyOptions{
-				DNSName:       host,
-				Intermediates: x509.NewCertPool(),
+			if r.noVerify {
+				logThrottled.Warnf("noverify "+host, "%s: upstream certificate not verified, the rule says verify=off", host)
+				return nil
 			}
-			for _, cert := range certs[1:] {
-				opts.Intermediates.AddCert(cert)
-			}
-			_, err := certs[0].Verify(opts)
+			allowed, err := verifyChain(rawCerts, verifyName, upstreamRoots, upstreamPolicy)
 			if err != nil {
-				log.Warn(err)
+				logThrottled.Warnf(host, "%s: chain rejected by %s", host, err)
+				return err
+			}
+			if allowed != chainVerified {
+				leg.log.Infof("%s: chain allowed by %s", host, allowed)
 			}
-			return err
+			return nil
 		},
 	}
 
+	if exp, ok := cacheNeg.Load(host); ok && !exp.(deadline).passed() {
+		leg.log.Debugf("%s is negatively cached", host)
+		return nil, failHandshake(hello.Conn, failUnreachable)
+	}
+	if shedding() {
+		return nil, failHandshake(hello.Conn, failLimit)
+	}
+	if !breakerAllows(host) {
+		leg.log.Debugf("%s: circuit open", host)
+		return nil, failHandshake(hello.Conn, failCircuitOpen)
+	}
+
+	*leg = upstreamLeg{
+		host:     host,
+		dialHost: dialHost,
+		v:        v,
+		r:        r,
+		config:   config,
+		pinned:   pinFor(dialHost, r),
+		fp:       leg.fp,
+		tried:    make(map[string]struct{}),
+		began:    time.Now(),
+		log:      leg.log,
+		stages:   leg.stages,
+	}
+	ctx := withStages(withConnLog(withTimeouts(hello.Context(), r), leg.log), leg.stages)
 	var i net.Conn
-	var err error
-	lock := new(sync.Mutex)
-	actualL, _ := resolvLock.LoadOrStore(host, lock) // one resolve at a time
-	lock = actualL.(*sync.Mutex)
-	lock.Lock()
+	var addr, via string
+	err := useClientCert(config, r)
+	if err == nil {
+		i, addr, via, err = dialRoutes(ctx, dialHost, r, config, leg.tried)
+	}
+	if err != nil {
+		if err == errBogon || err == errPoisoned {
+			// the secure answer was garbage, it won't be better right away
+			cacheNeg.Store(host, expireIn(negativeTtl))
+		}
+		timeouts := r.timeouts()
+		failed := dialFailure(err)
+		if failed == failClientCert {
+			logThrottled.Warnf("client cert "+host, "%s: %s", host, err)
+		}
+		if !errors.Is(err, context.Canceled) { // the client gave up, not the upstream
+			breakerRecord(host, failed)
+		}
+		leg.stages.report(leg.log, host)
+		leg.log.WithFields(log.Fields{
+			"host":              host,
+			"mode":              "mitm",
+			"epoch":             v.epoch,
+			"dial_timeout":      timeouts.dial,
+			"handshake_timeout": timeouts.handshake,
+			"dur":               time.Since(leg.began).Round(time.Millisecond),
+			"failed":            failed,
+			"verify":            r.verifyOverride(),
+			"pin":               pinUse(r, leg.pinned, ""),
+			"ja3":               leg.fp,
+		}).Info("access")
+		return nil, failHandshake(hello.Conn, failed)
+	}
+	leg.up, leg.addr, leg.via = i, addr, via
+	breakerRecord(host, "")
 
-	if r, ok := cacheResolv.Load(host); ok && !r.(*Resolv).Expired() {
-		i, err = tls.DialWithDialer(d, "tcp", r.(*Resolv).addr, config)
-	} else {
-		err = errors.New("no cached addr")
+	answer := base.Clone()
+	answer.GetCertificate = leg.certificate
+	answer.NextProtos = nil
+	if tc, ok := i.(connectionState); ok && tc.ConnectionState().NegotiatedProtocol != "" {
+		answer.NextProtos = []string{tc.ConnectionState().NegotiatedProtocol}
 	}
+	return answer, nil
+}
 
+// certificate is the leaf for the host the leg was dialed for, the rule
+// having been checked before anything is minted.
+func (leg *upstreamLeg) certificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cn, gen, err := leafName(leg.host)
 	if err != nil {
-		addrs := resolveRealIP(host)
-		if addrs == nil {
-			log.Warnf("%s resolve error", host)
-			lock.Unlock()
-			return
+		return nil, err
+	}
+	return leafFor(info, cn, gen)
+}
+
+// forwardTls terminates the client's TLS on pc and relays it to the upstream
+// dialed during the handshake.
+func forwardTls(pc net.Conn, base *tls.Config) {
+	leg := &upstreamLeg{log: connLog(pc), stages: newConnStages(acceptedAt(pc))}
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return leg.dial(hello, base)
+	}
+	conn := tls.Server(pc, config)
+	defer func() {
+		if err := conn.Close(); err != nil {
+			leg.log.Error(err)
 		}
-		for _, addr := range addrs {
-			i, err = tls.DialWithDialer(d, "tcp", addr.addr, config)
-			if err == nil {
-				cacheResolv.Store(host, addr)
-				break
+	}()
+
+	if err := conn.Handshake(); err != nil {
+		host := leg.host
+		if host == "" {
+			host = conn.ConnectionState().ServerName
+		}
+		failedHandshake(pc, leg.log, host, err)
+		if leg.up != nil {
+			if err := leg.up.Close(); err != nil {
+				leg.log.Debug(err)
 			}
 		}
-		if err != nil {
-			log.Infof("%s is IP-blocked", host)
-			lock.Unlock()
-			return
+		return
+	}
+	leg.stages.mark(stageClientHandshake)
+	if leg.up == nil {
+		// only our own names get through the handshake without an upstream
+		host, _ := normalizeHost(conn.ConnectionState().ServerName)
+		if selfName != "" && strings.EqualFold(host, selfName) {
+			serveSelf(conn)
+		} else if host == checkHost() {
+			serveHTTP(conn, checkHandler(true))
+		}
+		return
+	}
+
+	host, v, r := leg.host, leg.v, leg.r
+	i, addr, via := leg.up, leg.addr, leg.via
+	timeouts := r.timeouts()
+	ctx := withConnLog(withTimeouts(context.Background(), r), leg.log)
+	group := groupFor(host)
+	lc, untrack := trackConn(conn, host, "mitm", v, r)
+	defer untrack()
+	lc.addr.Store(addr)
+	countTLS("client", conn)
+	countTLS("upstream", i)
+
+	rw := &replayWriter{dst: i, buf: make([]byte, 0, 4096)}
+	var down int64
+	closed, failed := "client", ""
+	defer func() {
+		if lc.drained() {
+			closed = "drained"
+		}
+		countGroupBytes(group, rw.written(), down)
+		fields := log.Fields{
+			"host":              host,
+			"group":             group,
+			"mode":              "mitm",
+			"epoch":             v.epoch,
+			"route":             via,
+			"addr":              addr,
+			"front":             r.front,
+			"verify":            r.verifyOverride(),
+			"dial_timeout":      timeouts.dial,
+			"handshake_timeout": timeouts.handshake,
+			"up":                rw.written(),
+			"down":              down,
+			"dur":               time.Since(leg.began).Round(time.Millisecond),
+			"setup":             leg.stages.setup().Round(time.Millisecond),
+			"closed":            closed,
+			"failed":            failed,
+			"pin":               pinUse(r, leg.pinned, addr),
+			"ja3":               leg.fp,
+		}
+		if validateDNSSEC {
+			fields["dnssec"] = dnssecOf(host, addr)
+		}
+		tlsFields(fields, "client", conn)
+		tlsFields(fields, "upstream", rw.current())
+		if c, ok := rw.current().(*clampedConn); ok {
+			stalls := c.writeStalls()
+			fields["write_stalls"] = stalls
+			if stalls >= stallWarn {
+				logThrottled.Warnf("stall "+via, "%s: %d upstream writes stalled on route %s despite its clamp, try a lower mss or max-record", host, stalls, via)
+			}
+		}
+		leg.stages.report(leg.log, host)
+		leg.log.WithFields(fields).Info("access")
+	}()
+
+	// no capture rules, no overhead
+	var upW, downW io.Writer = &firstWrite{rw, leg.stages, stageFirstUp}, &firstWrite{conn, leg.stages, stageFirstDown}
+	if r.capture {
+		if c := startCapture(connID(pc), host, conn.ConnectionState().NegotiatedProtocol); c != nil {
+			upW, downW = c.teeUp(upW), c.teeDown(downW)
+			defer func() { c.close(addr, closed) }()
 		}
 	}
-	lock.Unlock()
+	timer := time.AfterFunc(earlyDeathWindow, rw.commit)
+	defer timer.Stop()
 	defer func() {
-		if err := i.Close(); err != nil {
-			log.Error(err)
+		if err := rw.current().Close(); err != nil {
+			leg.log.Error(err)
 		}
 	}()
 
-	finished := make(chan struct{}, 2)
-	go func() {
-		_, _ = io.Copy(i, conn)
-		finished <- struct{}{}
+	// the limits are watched on live counts, rw's and down only add up later;
+	// expiring the client's deadline ends both copies. Idle is for relays
+	// without MITM only, see relayIdle
+	limits := relayLimitsFor(r, via)
+	limits.idle = 0
+	var upLive, downLive int64
+	if limits.tick() > 0 {
+		upW, downW = countingWriter{upW, &upLive}, countingWriter{downW, &downLive}
+	}
+	stop := limits.watch(&upLive, &downLive, conn)
+	defer func() {
+		if ended := stop(); ended != "" {
+			closed = ended
+			_ = conn.SetDeadline(time.Time{}) // for the close_notify
+		}
 	}()
+
+	finished := make(chan struct{}, 1)
 	go func() {
-		_, _ = io.Copy(conn, i)
+		_, _ = io.Copy(upW, conn)
 		finished <- struct{}{}
 	}()
-	<-finished
-}
+	deaths := 0
+	for {
+		start := time.Now()
+		downC := make(chan int64, 1)
+		go func(i net.Conn) {
+			n, _ := io.Copy(downW, i)
+			downC <- n
+		}(i)
 
-func forwardDns(w dns.ResponseWriter, m *dns.Msg) {
-	if len(m.Question) > 1 { // is multiple-question query valid?
-		log.WithField("len", len(m.Question)).Fatal("too many questions")
-	}
+		var n int64
+		select {
+		case <-finished:
+			return
+		case n = <-downC:
+		}
+		down += n
+		if n > earlyDeathBytes || time.Since(start) >= earlyDeathWindow {
+			closed = "upstream"
+			return
+		}
+		closed = "early death"
 
-	if m.Question[0].Qtype == dns.TypeA || m.Question[0].Qtype == dns.TypeAAAA {
-		domain := m.Question[0].Name
-		if needsProxy(domain[:len(domain)-1]) {
-			msg := new(dns.Msg)
-			msg.SetReply(m)
-			msg.Authoritative = true
-			hdr := dns.RR_Header{
-				Name:   domain,
-				Rrtype: m.Question[0].Qtype,
-				Class:  dns.ClassINET,
-				Ttl:    60,
-			}
-			switch m.Question[0].Qtype {
-			case dns.TypeA:
-				msg.Answer = []dns.RR{
-					&dns.A{
-						Hdr: hdr,
-						A:   net.IPv4(127, 0, 0, 1),
-					},
-				}
-			case dns.TypeAAAA:
-				msg.Answer = []dns.RR{
-					&dns.AAAA{
-						Hdr:  hdr,
-						AAAA: net.IPv6loopback,
-					},
-				}
+		// upstream died right away: most likely RST-injected after the handshake
+		leg.log.Infof("%s: %s closed early after %d bytes", host, addr, n)
+		suspectAddr.Store(addr, expireIn(cacheAddrTtl))
+		cacheResolv.Delete(host)
+		deaths++
+		if n != 0 {
+			return
+		}
+
+		leg.tried[addr] = struct{}{}
+		next, nextAddr, nextVia, err := dialRoutes(ctx, leg.dialHost, r, leg.config, leg.tried)
+		if err != nil {
+			cacheNeg.Store(host, expireIn(negativeTtl))
+			leg.log.Infof("%s died early on %d addrs, negatively cached", host, deaths)
+			failed = dialFailure(err)
+			countFailure(failed)
+			breakerRecord(host, failed)
+			if down == 0 && failHTTP(conn, rw.head(), host, failed) {
+				closed = "answered"
 			}
-			if err := w.WriteMsg(msg); err != nil {
-				log.Error(err)
+			return
+		}
+		if err := rw.swap(next); err != nil {
+			leg.log.Debugf("%s: %s", host, err)
+			if err := next.Close(); err != nil {
+				leg.log.Error(err)
 			}
 			return
 		}
+		if err := i.Close(); err != nil {
+			leg.log.Debug(err)
+		}
+		i, addr, via = next, nextAddr, nextVia
+		lc.addr.Store(addr)
 	}
+}
+
+// resolve cache lookups of dialUpstream, for the hit rate
+var (
+	resolveHits   = metricCounter(metricName("resolve_cache_total", "result", "hit"))
+	resolveMisses = metricCounter(metricName("resolve_cache_total", "result", "miss"))
+)
 
-	cli := defDnsCli.Get().(*dns.Client)
-	defer defDnsCli.Put(cli)
+// dialUpstream connects to host, trying its pin and then the cached address
+// first, and skipping addresses in tried or recently marked suspect.
+func dialUpstream(ctx context.Context, host string, ru *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, error) {
+	d := ru.dialer(upstreamDialer)
+	lock := new(sync.Mutex)
+	actualL, _ := resolvLock.LoadOrStore(host, lock) // one resolve at a time
+	lock = actualL.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if i, addr, ok := dialPinned(ctx, d, host, ru, config, tried); ok {
+		return i, addr, nil
+	}
+	if r, ok := cacheResolv.Load(host); ok && !r.(*Resolv).Expired() {
+		atomic.AddInt64(resolveHits, 1)
+		addr := r.(*Resolv).addr
+		if _, skip := tried[addr]; !skip && ru.family.allows(addr) && !famDemoted(addr) {
+			stagesFrom(ctx).markOnce(stageResolved)
+			i, err := d.DialTLSContext(ctx, host, addr, config)
+			recordDial(addr, err)
+			if err == nil {
+				pinAddr(host, addr, ru)
+				return i, addr, nil
+			}
+			tried[addr] = struct{}{}
+		}
+	} else {
+		atomic.AddInt64(resolveMisses, 1)
+	}
 
-	r, _, err := cli.Exchange(m, defDNS)
+	addrs, err := resolveRealIP(host, ru.family, ru.paranoid)
 	if err != nil {
-		log.Warn(err)
-		return
+		if err == errResolve {
+			logThrottled.Warnf(host, "%s resolve error", host)
+			metricAdd(metricName("dial_failures_total", "kind", "resolve"), 1)
+		}
+		return nil, "", err
 	}
-	if err := w.WriteMsg(r); err != nil {
-		log.Error(err)
+	err = errors.New("no usable addr")
+	for _, addr := range addrs {
+		if _, skip := tried[addr.addr]; skip {
+			continue
+		}
+		if exp, ok := suspectAddr.Load(addr.addr); ok && !exp.(deadline).passed() {
+			continue
+		}
+		var i net.Conn
+		stagesFrom(ctx).markOnce(stageResolved)
+		i, err = d.DialTLSContext(ctx, host, addr.addr, config)
+		recordDial(addr.addr, err)
+		if err == nil {
+			cacheResolv.Store(host, addr)
+			pinAddr(host, addr.addr, ru)
+			return i, addr.addr, nil
+		}
+		tried[addr.addr] = struct{}{}
 	}
+	logThrottled.Infof(host, "%s is IP-blocked", host)
+	metricAdd(metricName("dial_failures_total", "kind", "unreachable"), 1)
+	return nil, "", err
 }
 
-func getCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if info.ServerName == "" {
-		return nil, errors.New("no SNI info")
+func forwardDns(w dns.ResponseWriter, m *dns.Msg) {
+	defer noteDNSAnswer()
+	if !clientAllowed(w.RemoteAddr(), "dns") {
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeRefused)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		return
 	}
-
-	if cert, ok := cacheCert.Load(info.ServerName); ok {
-		return cert.(*tls.Certificate), nil
+	if loopedBack(m) {
+		logThrottled.Errorf("dns loop", "a query we sent came back from %s: it forwards to us, we forward to it; answering SERVFAIL", w.RemoteAddr())
+		metricAdd("dns_loops_total", 1)
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeServerFailure)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		return
 	}
-
-	secondary, err := publicsuffix.EffectiveTLDPlusOne(info.ServerName)
-	if err != nil {
-		log.Errorf("invalid hostname: %s", secondary)
-		return nil, err
+	w, m = wrapProvenance(w, m)
+	v := viewFor(w.RemoteAddr(), w.LocalAddr())
+	if len(m.Question) != 1 { // multiple questions are never answered in practice
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeFormatError)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		if len(m.Question) > 0 {
+			recordQuery(w, v, &m.Question[0], decisionBlocked, "", dns.RcodeFormatError, 0)
+		}
+		return
 	}
+	q := &m.Question[0]
 
-	var cn string
-	if info.ServerName == secondary {
-		cn = secondary
-	} else {
-		dot := strings.IndexByte(info.ServerName, '.')
-		cn = info.ServerName[dot+1:]
+	if msg, ok := answerSelf(m); ok {
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionLocal, "", msg.Rcode, 0)
+		return
+	}
+	if msg, ok := answerInternal(m); ok {
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionLocal, "", msg.Rcode, 0)
+		return
+	}
+	if msg, ok := answerLocalZone(m); ok {
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionLocal, "", msg.Rcode, 0)
+		return
 	}
 
-	if cert, ok := cacheCert.Load(cn); ok {
-		return cert.(*tls.Certificate), nil
+	domain, ok := normalizeHost(q.Name)
+	if q.Name != "." && !ok {
+		rejectName("qname", q.Name)
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeRefused)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionBlocked, "", dns.RcodeRefused, 0)
+		return
+	}
+	if msg, ok := answerQtype(m); ok {
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		decision := decisionLocal
+		if msg.Rcode != dns.RcodeSuccess {
+			decision = decisionBlocked
+		}
+		recordQuery(w, v, q, decision, "", msg.Rcode, 0)
+		return
+	}
+	ru := decide("dns", domain, w.RemoteAddr(), v.match(domain))
+	noteRule(w, ru)
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		shadowCompare(v, domain, ru)
+	}
+	decision := decisionForwarded
+	if *observe && ru != nil && (ru.block || q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		observeName(domain, ru, false)
+		decision, ru = decisionObserved, nil
+	}
+	if ru != nil && ru.block {
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeNameError)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionBlocked, "", dns.RcodeNameError, 0)
+		return
+	}
+	if ru != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		spoof(w, v, m, ru)
+		return
+	}
+	if ru != nil && q.Qtype == dns.TypeCNAME && flattenCnames {
+		// what we spoof has no CNAME, so neither has the name
+		msg := new(dns.Msg)
+		msg.SetReply(m)
+		msg.Authoritative = true
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordSpoofed(w, v, q, 0)
+		return
 	}
 
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Errorf("failed to generate private key: %s", err)
-		return nil, err
+	fwd := v.forwardedFor(domain)
+	noAAAA := fwd != nil && fwd.noAAAA
+	if noAAAA && q.Qtype == dns.TypeAAAA {
+		// all the answer would have is stripped, no need to ask
+		if err := w.WriteMsg(noData(m, spoofTTL(fwd, time.Now()))); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionNoAAAA, "", dns.RcodeSuccess, 0)
+		return
 	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	resolver := forwardTo(fwd != nil && fwd.plainDNS)
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
+	for i, u := range forwardOrder(resolver) {
+		if i > 0 {
+			metricAdd(metricName("dns_failovers_total", "from", resolver, "to", u.addr), 1)
+		}
+		resolver = u.addr
+		r, rtt, err = exchangeShared(u, m, isTCP(w))
+		// failing the case check says the path to resolver is tampered
+		// with rather than that it's down, and isn't failed over
+		if err == nil && r.Rcode != dns.RcodeServerFailure || errors.Is(err, errCaseMismatch) {
+			break
+		}
+	}
 	if err != nil {
-		log.Errorf("failed to generate serial number: %s", err)
-		return nil, err
+		logThrottled.Warnf(q.Name, "%s: %s", q.Name, err)
+		recordQuery(w, v, q, decision, resolver, dns.RcodeServerFailure, rtt)
+		return
 	}
+	if n := stripRebinding(strings.TrimSuffix(q.Name, "."), r); n > 0 {
+		logThrottled.Warnf(q.Name, "%s: dropped %d private addrs, possible DNS rebinding", q.Name, n)
+	}
+	if noAAAA && stripAAAA(r) > 0 {
+		decision = decisionNoAAAA
+	}
+	if matchCnames && !*observe && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if ru := matchCnameChain(v, domain, r); ru != nil && ru.block {
+			noteRule(w, ru)
+			msg := new(dns.Msg)
+			msg.SetRcode(m, dns.RcodeNameError)
+			if err := w.WriteMsg(msg); err != nil {
+				log.Error(err)
+			}
+			recordQuery(w, v, q, decisionBlocked, resolver, dns.RcodeNameError, rtt)
+			return
+		} else if ru != nil {
+			noteRule(w, ru)
+			spoof(w, v, m, ru)
+			return
+		}
+	}
+	clientReply(w, m, r)
+	if err := w.WriteMsg(r); err != nil {
+		log.Error(err)
+	}
+	recordQuery(w, v, q, decision, resolver, r.Rcode, rtt)
+}
 
-	template := &x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName: cn,
-			Country:    []string{"CN"},
-		},
-
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(certExpire),
+// spoof answers the A or AAAA query m with our own address, as ru says.
+func spoof(w dns.ResponseWriter, v *view, m *dns.Msg, ru *rule) {
+	q := &m.Question[0]
+	if shedding() {
+		// we couldn't take the connection anyway, let clients fail fast
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeServerFailure)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(w, v, q, decisionBlocked, "", dns.RcodeServerFailure, 0)
+		return
+	}
+	ttl := spoofTTL(ru, time.Now())
+	if !spoofs(q.Qtype) {
+		// no listener of that family, don't send clients to a dead port
+		if err := w.WriteMsg(noData(m, ttl)); err != nil {
+			log.Error(err)
+		}
+		recordSpoofed(w, v, q, ttl)
+		return
+	}
+	msg := new(dns.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl / time.Second),
+	}
+	ip4, ip6 := v.spoofTo(w.LocalAddr())
+	switch q.Qtype {
+	case dns.TypeA:
+		msg.Answer = []dns.RR{
+			&dns.A{
+				Hdr: hdr,
+				A:   ip4,
+			},
+		}
+	case dns.TypeAAAA:
+		msg.Answer = []dns.RR{
+			&dns.AAAA{
+				Hdr:  hdr,
+				AAAA: ip6,
+			},
+		}
+	}
+	if err := w.WriteMsg(msg); err != nil {
+		log.Error(err)
+	}
+	recordSpoofed(w, v, q, ttl)
+}
 
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		DNSNames:              []string{"*." + cn, cn},
+func getCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if info.ServerName == "" {
+		return nil, errors.New("no SNI info")
+	}
+	name, ok := normalizeHost(info.ServerName)
+	if !ok {
+		rejectName("sni", info.ServerName)
+		return nil, errInvalidName
+	}
+	// proxied names get theirs from the leg that dialed them, see dial
+	if !ownName(name) {
+		metricAdd("leaves_refused_total", 1)
+		logThrottled.Warnf("refused "+name, "%s: %s asked for a leaf no proxy rule covers", name, info.Conn.RemoteAddr())
+		sendAlert(info.Conn, 112) // unrecognized_name
+		return nil, errNotCovered
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, caParent, priv.Public(), caPriKey)
+	cn, gen, err := leafName(name)
 	if err != nil {
-		log.Errorf("failed to create certificate: %s", err)
+		log.Errorf("invalid hostname: %s", name)
 		return nil, err
 	}
-
-	cert := &tls.Certificate{
-		Certificate: [][]byte{derBytes},
-		PrivateKey:  priv,
-	}
-	cacheCert.Store(cn, cert)
-	return cert, nil
+	return leafFor(info, cn, gen)
 }
 
-func updateConfig() {
-	fil, err := os.Open(configFile)
-	if err != nil {
-		log.Fatal(err)
+func updateConfig(refetch bool) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	reloadSettings()
+	ipRules = loadIPRules()
+	if err := loadErrorPage(); err != nil {
+		log.Errorf("error page not reloaded: %s", err)
 	}
-	defer func() {
-		if err := fil.Close(); err != nil {
-			log.Fatal(err)
+	updateSelfAddrs()
+	if err := loadSuffixList(); err != nil {
+		log.Errorf("public suffix list not reloaded: %s", err)
+	}
+	if err := loadTrustAnchors(); err != nil {
+		log.Errorf("trust anchors not reloaded: %s", err)
+	}
+	vs := loadViews()
+	var sources []string
+	for _, v := range vs {
+		sources = append(sources, v.sources...)
+	}
+	refreshSources(sources, refetch)
+	loadGroups()
+	loadSubject()
+	pt := false
+	epoch := atomic.LoadInt64(&configEpoch) + 1
+	for _, v := range vs {
+		v.epoch = epoch
+		v.table, v.dump = compileRules(v.sources)
+		for _, r := range v.table {
+			pt = pt || r.resolveOnly
 		}
-	}()
-	scanner := bufio.NewScanner(fil)
-
-	newMap := make(map[string]struct{})
-	for scanner.Scan() {
-		text := strings.TrimSpace(scanner.Text())
-		if text != "" {
-			newMap[text] = struct{}{}
+		if v.name == "default" {
+			atomic.StoreInt64(&ruleCount, int64(len(v.table)))
 		}
 	}
-	proxyAddr = newMap
+	old := currentViews().views
+	carrySince(old, vs, time.Now())
+	forgetRemoved(old, vs)
+	viewsCur.Store(&viewSet{views: vs, passthrough: pt})
+	atomic.StoreInt64(&configEpoch, epoch)
+	emit(evConfigReloaded, map[string]interface{}{"views": len(vs), "refetched": refetch, "epoch": epoch})
+	forgetClientCerts()
+	drainRemoved()
+	warmLeaves()
+	loadShadowFile(refetch)
 }
 
 func pollingFileChange() { // only polling works due to different behaviors of editors
-	initStat, err := os.Stat(configFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	updateConfig()
+	updateConfig(true)
+	watchPlugins()
+	files := localSources()
+	initStat := statAll(files)
+	fetched := time.Now()
 
 	go func() {
 		for {
 			time.Sleep(pollInterval)
 
-			stat, err := os.Stat(configFile)
-			if err != nil {
-				log.Fatal(err)
+			stat := statAll(files)
+			changed := false
+			for i := range stat {
+				changed = changed || fileChanged(stat[i], initStat[i])
 			}
-
-			if stat.Size() != initStat.Size() || stat.ModTime() != initStat.ModTime() {
+			refetch := hasRemote() && time.Since(fetched) >= remoteRefresh
+			if changed || refetch {
 				log.Info("conf file changed")
-				updateConfig()
-				initStat = stat
+				updateConfig(refetch)
+				files = localSources() // the views may name other sources now
+				initStat = statAll(files)
+				if refetch {
+					fetched = time.Now()
+				}
 			}
 		}
 	}()
 }
 
+// fileChanged compares two stats of a file, nil meaning it didn't exist.
+func fileChanged(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	return a.Size() != b.Size() || a.ModTime() != b.ModTime()
+}
+
 func init() {
 	log.SetLevel(logLevel)
+}
 
-	// read ca cert
-	certPEMBlock, err := ioutil.ReadFile(caCert)
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	flag.Parse()
+	if *provenanceName != "" {
+		os.Exit(runProvenance(*provenanceName))
 	}
-	certDERBlock, _ := pem.Decode(certPEMBlock)
-	caParent, err = x509.ParseCertificate(certDERBlock.Bytes)
-	if err != nil {
-		log.Fatal(err)
+	if *convertConfig {
+		os.Exit(runConvertConfig())
 	}
-
-	keyPEMBlock, err := ioutil.ReadFile(caKey)
-	if err != nil {
-		log.Fatal(err)
+	pluginsFrozen = true
+	if err := setup(); err != nil {
+		log.Error(err)
+		os.Exit(exitCode(err))
 	}
-	keyDERBlock, _ := pem.Decode(keyPEMBlock)
-	caPriKey, err = x509.ParsePKCS1PrivateKey(keyDERBlock.Bytes)
-	if err != nil {
-		log.Fatal(err)
+	if *dumpConfig {
+		updateConfig(true)
+		os.Exit(runDumpConfig())
 	}
-}
 
-func main() {
-	pollingFileChange()
-
-	// UDP port 53: listen to DNS queries
-	go func() {
-		log.Fatal(dns.ListenAndServe("localhost:53", "udp", dns.HandlerFunc(forwardDns)))
-	}()
+	sup = newSupervisor(components, retire)
+	if err := openListeners(sup); err != nil {
+		log.Error(err)
+		os.Exit(exitCode(err))
+	}
+	setSpoofFamilies(serving.tls)
+	sup.start()
+	log.Infof("serving %s", strings.Join(enabledComponents(), ", "))
+	writeHealthFile()
+	loadInBackground()
 
-	// TCP port 80: listen to HTTP port to avoid redirection
+	// the process before an upgrade serves on until we have the rules
 	go func() {
-		log.Fatal(http.ListenAndServe("localhost:80", http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				http.Error(w, r.Host+" accessed with http", http.StatusForbidden)
-			}),
-		))
+		waitReady()
+		signalReady()
 	}()
-
-	list, err := tls.Listen("tcp", "localhost:443", &tls.Config{
-		GetCertificate: getCertificate,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		if err := list.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	for {
-		conn, err := list.Accept()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		go forwardTls(conn.(*tls.Conn))
+	// SIGUSR2 or POST /upgrade: hand the listeners to a new binary
+	watchUpgradeSignal()
+	<-retired
+	if err := sup.failure(); err != nil {
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Each cache is bounded by what it's for, but on a router with 128MB that
+// isn't enough: together they can still take the box down. With a budget,
+// cachesMaxMemory or caches_max_memory in the config file, they share it.
+// Every entry is charged about the bytes it takes, and a store that takes
+// the total over the budget has every cache evict its share of the excess,
+// in proportion to its size and its entries closest to expiring or the
+// oldest first, down to cacheLowWater of the budget so the next store
+// doesn't have to. Relayed connections are charged too but can't be
+// evicted, the caches make room for them.
+
+// cacheLowWater is the part of the budget evicting gets the caches down to.
+const cacheLowWater = 0.9
+
+// Entry costs, as measured on amd64: a sync.Map entry with its key and
+// value boxed, beyond the strings and structs they point at; what a parsed
+// leaf takes beyond its DER; the keys minted for leaves, once used.
+const (
+	syncMapEntry   = 112
+	leafParsed     = 2560
+	ecdsaLeafKey   = 768
+	rsaKeyPerByte  = 17 // of the modulus, for the CRT values and precomputations
+	clientEntry    = 160
+	nameCountEntry = 40
+	liveConnEntry  = 320
+)
+
+// budgeted is a cache the budget covers.
+type budgeted interface {
+	cacheName() string
+	usage() (bytes, entries int64)
+	// shed evicts entries worth want bytes or a little more, the least
+	// useful first, returning how many it freed
+	shed(want int64) int64
+}
+
+// budgetedCaches are the caches sharing the budget.
+func budgetedCaches() []budgeted {
+	return []budgeted{cacheCert, cacheResolv, cacheNeg, suspectAddr, cacheRoute, cnameAliases, zoneTrusts, clientsCache{}, connsCache{}}
+}
+
+// budgetMap is a sync.Map whose entries are charged against the budget.
+// Reads are a sync.Map's; writes take mu so bytes is what's stored.
+type budgetMap struct {
+	sync.Map
+	name string
+	cost func(key, val interface{}) int64 // beyond syncMapEntry
+	age  func(val interface{}) int64      // the lowest are evicted first
+
+	mu             sync.Mutex
+	bytes, entries int64
+	evicted        *int64
+}
+
+func newBudgetMap(name string, cost func(key, val interface{}) int64, age func(val interface{}) int64) *budgetMap {
+	return &budgetMap{name: name, cost: cost, age: age, evicted: metricCounter(metricName("cache_evictions_total", "cache", name))}
+}
+
+func (m *budgetMap) Store(key, val interface{}) {
+	m.mu.Lock()
+	if old, ok := m.Map.Load(key); ok {
+		atomic.AddInt64(&m.bytes, -syncMapEntry-m.cost(key, old))
+		atomic.AddInt64(&m.entries, -1)
+	}
+	m.Map.Store(key, val)
+	atomic.AddInt64(&m.bytes, syncMapEntry+m.cost(key, val))
+	atomic.AddInt64(&m.entries, 1)
+	m.mu.Unlock()
+	enforceBudget()
+}
+
+func (m *budgetMap) Delete(key interface{}) {
+	m.remove(key)
+}
+
+// remove deletes key, returning the bytes that freed.
+func (m *budgetMap) remove(key interface{}) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.Map.Load(key)
+	if !ok {
+		return 0
+	}
+	m.Map.Delete(key)
+	c := syncMapEntry + m.cost(key, old)
+	atomic.AddInt64(&m.bytes, -c)
+	atomic.AddInt64(&m.entries, -1)
+	return c
+}
+
+func (m *budgetMap) cacheName() string { return m.name }
+
+func (m *budgetMap) usage() (int64, int64) {
+	return atomic.LoadInt64(&m.bytes), atomic.LoadInt64(&m.entries)
+}
+
+func (m *budgetMap) shed(want int64) int64 {
+	type entry struct {
+		key interface{}
+		age int64
+	}
+	var es []entry
+	m.Range(func(k, v interface{}) bool {
+		es = append(es, entry{k, m.age(v)})
+		return true
+	})
+	sort.Slice(es, func(i, j int) bool { return es[i].age < es[j].age })
+	var freed int64
+	for _, e := range es {
+		if freed >= want {
+			break
+		}
+		if c := m.remove(e.key); c > 0 {
+			freed += c
+			atomic.AddInt64(m.evicted, 1)
+		}
+	}
+	return freed
+}
+
+// certCost is what the leaf c takes: its DER, parsed, and its key. The
+// chain is the issuer's, shared by all of them.
+func certCost(key, val interface{}) int64 {
+	c := val.(*tls.Certificate)
+	n := int64(len(key.(leafKey).cn)) + leafParsed
+	if len(c.Certificate) > 0 {
+		n += int64(len(c.Certificate[0]))
+	}
+	switch k := c.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		n += ecdsaLeafKey
+	case *rsa.PrivateKey:
+		n += int64(k.Size()) * rsaKeyPerByte
+	}
+	return n
+}
+
+func certAge(val interface{}) int64 {
+	return val.(*tls.Certificate).Leaf.NotBefore.UnixNano()
+}
+
+func resolvCost(key, val interface{}) int64 {
+	r := val.(*Resolv)
+	return int64(len(key.(string))+len(r.addr)+len(r.dnssec)) + 48
+}
+
+func resolvAge(val interface{}) int64 { return int64(val.(*Resolv).expire) }
+
+// deadlineCost is for maps from a name or addr to when it expires.
+func deadlineCost(key, _ interface{}) int64 { return int64(len(key.(string))) }
+
+func deadlineAge(val interface{}) int64 { return int64(val.(deadline)) }
+
+func routeChoiceCost(key, val interface{}) int64 {
+	return int64(len(key.(string))+len(val.(*routeChoice).name)) + 32
+}
+
+func routeChoiceAge(val interface{}) int64 { return int64(val.(*routeChoice).expire) }
+
+func aliasCost(key, val interface{}) int64 {
+	return int64(len(key.(string))+len(val.(*alias).target)) + 32
+}
+
+func aliasAge(val interface{}) int64 { return int64(val.(*alias).expire) }
+
+// zoneTrustCost counts the DNSKEYs as miekg/dns keeps them, the key in
+// base64 and the owner name in strings of their own.
+func zoneTrustCost(key, val interface{}) int64 {
+	n := int64(len(key.(string))) + 64
+	for _, k := range val.(*zoneTrust).keys {
+		n += int64(len(k.Hdr.Name)+len(k.PublicKey)) + dnskeyEntry
+	}
+	return n
+}
+
+// dnskeyEntry is a *dns.DNSKEY beyond its strings.
+const dnskeyEntry = 96
+
+func zoneTrustAge(val interface{}) int64 { return int64(val.(*zoneTrust).expire) }
+
+// clientsCache is the per-client stats, charged as they change and evicted
+// from, the least recently seen first, when a store to another cache finds
+// the budget exceeded.
+type clientsCache struct{}
+
+// clientsBytes is what clients takes, changed under clientsLock.
+var clientsBytes int64
+
+func clientCost(ip string, c *clientStat) int64 {
+	n := int64(len(ip)) + clientEntry
+	for _, t := range c.Top {
+		n += int64(len(t.Name)) + nameCountEntry
+	}
+	return n
+}
+
+// recountClients charges clients afresh, after they were replaced. Called
+// with clientsLock held.
+func recountClients() {
+	var n int64
+	for ip, c := range clients {
+		n += clientCost(ip, c)
+	}
+	atomic.StoreInt64(&clientsBytes, n)
+}
+
+func (clientsCache) cacheName() string { return "clients" }
+
+func (clientsCache) usage() (int64, int64) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	return atomic.LoadInt64(&clientsBytes), int64(len(clients))
+}
+
+func (clientsCache) shed(want int64) int64 {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	ips := make([]string, 0, len(clients))
+	for ip := range clients {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return clients[ips[i]].Last.Before(clients[ips[j]].Last) })
+	var freed int64
+	for _, ip := range ips {
+		if freed >= want {
+			break
+		}
+		c := clientCost(ip, clients[ip])
+		delete(clients, ip)
+		atomic.AddInt64(&clientsBytes, -c)
+		freed += c
+		metricAdd(metricName("cache_evictions_total", "cache", "clients"), 1)
+	}
+	return freed
+}
+
+// connsCache is the registry of relayed connections, charged but never
+// evicted from.
+type connsCache struct{}
+
+var connsBytes, connsCount int64
+
+func liveConnCost(lc *liveConn) int64 {
+	return int64(len(lc.cid)+len(lc.host)+len(lc.domain)) + liveConnEntry
+}
+
+func (connsCache) cacheName() string { return "conns" }
+
+func (connsCache) usage() (int64, int64) {
+	return atomic.LoadInt64(&connsBytes), atomic.LoadInt64(&connsCount)
+}
+
+func (connsCache) shed(int64) int64 { return 0 }
+
+// cacheShedding is 1 while enforceBudget evicts, for one eviction at a time.
+var cacheShedding int32
+
+// enforceBudget evicts from every cache its share of what they take beyond
+// the budget, if they do.
+func enforceBudget() {
+	budget := currentSettings().cacheBudget
+	if budget <= 0 {
+		return
+	}
+	caches := budgetedCaches()
+	sizes := make([]int64, len(caches))
+	var total int64
+	for i, c := range caches {
+		sizes[i], _ = c.usage()
+		total += sizes[i]
+	}
+	if total <= budget || !atomic.CompareAndSwapInt32(&cacheShedding, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&cacheShedding, 0)
+
+	excess := total - int64(float64(budget)*cacheLowWater)
+	var evictable int64
+	for i, c := range caches {
+		if _, ok := c.(connsCache); !ok {
+			evictable += sizes[i]
+		}
+	}
+	if evictable == 0 {
+		return
+	}
+	var freed int64
+	for i, c := range caches {
+		if sizes[i] == 0 {
+			continue
+		}
+		// rounded up, so that the shares add up to all of excess
+		freed += c.shed((excess*sizes[i] + evictable - 1) / evictable)
+	}
+	metricAdd("cache_budget_sheds_total", 1)
+	metricAdd("cache_budget_freed_bytes_total", freed)
+	if freed < excess {
+		logThrottled.Warnf("cache budget", "caches take %d bytes, over the budget of %d even with all they could evict gone", total-freed, budget)
+	}
+}
+
+// cacheUsage is one cache in /status.
+type cacheUsage struct {
+	Name    string `json:"name"`
+	Bytes   int64  `json:"bytes"`
+	Entries int64  `json:"entries"`
+}
+
+// cacheStatus is the caches in /status, what they take against the budget.
+type cacheStatus struct {
+	Budget int64        `json:"budget,omitempty"`
+	Bytes  int64        `json:"bytes"`
+	Caches []cacheUsage `json:"caches"`
+}
+
+func cacheReport() *cacheStatus {
+	s := &cacheStatus{Budget: currentSettings().cacheBudget, Caches: []cacheUsage{}}
+	for _, c := range budgetedCaches() {
+		u := cacheUsage{Name: c.cacheName()}
+		u.Bytes, u.Entries = c.usage()
+		s.Bytes += u.Bytes
+		s.Caches = append(s.Caches, u)
+	}
+	return s
+}
+
+// byteUnits are the suffixes parseByteSize takes, binary ones.
+var byteUnits = []struct {
+	suffix string
+	shift  uint
+}{{"GB", 30}, {"MB", 20}, {"KB", 10}, {"B", 0}}
+
+// parseByteSize reads a size such as "16MB" or "512KB", or bytes without a
+// unit.
+func parseByteSize(s string) (int64, error) {
+	shift := uint(0)
+	num := s
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, shift = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > 1<<(62-shift) {
+		return 0, errors.New("needs a size such as \"16MB\", 0 for none")
+	}
+	return n << shift, nil
+}
+
+// formatByteSize is n as parseByteSize reads it, in the largest unit it's
+// a whole number of.
+func formatByteSize(n int64) string {
+	for _, u := range byteUnits {
+		if n != 0 && n%(1<<u.shift) == 0 {
+			return strconv.FormatInt(n>>u.shift, 10) + u.suffix
+		}
+	}
+	return "0"
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds counters keyed by their full name including labels, in the
+// Prometheus text format, e.g. `log_suppressed_total{key="example.com"}`.
+var metrics sync.Map
+
+func metricName(base string, labels ...string) string {
+	if len(labels) == 0 {
+		return base
+	}
+	var b strings.Builder
+	b.WriteString(base)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func metricAdd(name string, delta int64) {
+	v, ok := metrics.Load(name)
+	if !ok {
+		v, _ = metrics.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+func metricSet(name string, val int64) {
+	v, ok := metrics.Load(name)
+	if !ok {
+		v, _ = metrics.LoadOrStore(name, new(int64))
+	}
+	atomic.StoreInt64(v.(*int64), val)
+}
+
+func metricGet(name string) int64 {
+	if v, ok := metrics.Load(name); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+// metricCounter returns the counter itself, for hot paths that can't afford
+// building the name on every increment.
+func metricCounter(name string) *int64 {
+	v, _ := metrics.LoadOrStore(name, new(int64))
+	return v.(*int64)
+}
+
+// latencyBuckets are the upper bounds in milliseconds of histogram buckets.
+var latencyBuckets = [...]int64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// histogram counts latency observations into latencyBuckets, the last slot
+// being everything above.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]int64
+	sum    int64 // ms
+}
+
+var histograms sync.Map // name -> *histogram
+
+func metricHistogram(name string) *histogram {
+	v, ok := histograms.Load(name)
+	if !ok {
+		v, _ = histograms.LoadOrStore(name, new(histogram))
+	}
+	return v.(*histogram)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := int64(d / time.Millisecond)
+	i := 0
+	for i < len(latencyBuckets) && ms > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, ms)
+}
+
+// quantile returns the upper bound of the bucket holding quantile q, -1 if
+// nothing was observed and the largest bound if it's in the overflow bucket.
+func (h *histogram) quantile(q float64) int64 {
+	var counts [len(latencyBuckets) + 1]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return -1
+	}
+	rank := int64(q * float64(total))
+	var seen int64
+	for i, c := range counts[:len(latencyBuckets)] {
+		seen += c
+		if seen > rank {
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// withSuffix inserts suffix into a metric name before its labels and adds
+// the extra label if given.
+func withSuffix(name, suffix, extra string) string {
+	base, labels := name, ""
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		base, labels = name[:i], name[i+1:len(name)-1]
+	}
+	if extra != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += extra
+	}
+	if labels == "" {
+		return base + suffix
+	}
+	return base + suffix + "{" + labels + "}"
+}
+
+// sampleGauges sets the gauges read off state rather than kept as it
+// changes, before the registry is read for /metrics or the summary line.
+func sampleGauges() {
+	metricSet("leaves_cached", mapSize(cacheCert))
+	metricSet("upstreams_total", int64(len(upstreams)))
+	metricSet("sightings_tracked", currentSightings().size())
+	metricSet("upstreams_healthy", int64(len(upstreams))-atomic.LoadInt64(&upstreamsDown))
+	for _, u := range upstreams {
+		metricSet(metricName("dns_upstream_last_success_seconds", "upstream", u.addr), u.lastSuccess())
+	}
+	for _, c := range budgetedCaches() {
+		bytes, _ := c.usage()
+		metricSet(metricName("cache_bytes", "cache", c.cacheName()), bytes)
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	sampleGauges()
+	var lines []string
+	metrics.Range(func(k, v interface{}) bool {
+		lines = append(lines, fmt.Sprintf("%s %d", k, atomic.LoadInt64(v.(*int64))))
+		return true
+	})
+	sort.Strings(lines)
+
+	// histogram lines stay in bucket order
+	var names []string
+	histograms.Range(func(k, _ interface{}) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		h := metricHistogram(name)
+		var cum int64
+		for i := range h.counts {
+			cum += atomic.LoadInt64(&h.counts[i])
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			lines = append(lines, fmt.Sprintf("%s %d", withSuffix(name, "_bucket", `le="`+le+`"`), cum))
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s %d", withSuffix(name, "_sum", ""), atomic.LoadInt64(&h.sum)),
+			fmt.Sprintf("%s %d", withSuffix(name, "_count", ""), cum),
+			fmt.Sprintf("%s %d", withSuffix(name, "_p95", ""), h.quantile(0.95)))
+	}
+	for _, l := range lines {
+		_, _ = fmt.Fprintln(w, l)
+	}
+}
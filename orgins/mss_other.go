@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+)
+
+const mssSupported = false
+
+func setMSS(fd uintptr, mss int) error {
+	return errors.New("TCP_MAXSEG not supported")
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const mssSupported = true
+
+// setMSS caps the segments of a socket not yet connected, and the MSS it
+// advertises, at mss.
+func setMSS(fd uintptr, mss int) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+}
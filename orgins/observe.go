@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var observe = flag.Bool("observe", false,
+	"forward all DNS unchanged and relay TLS directly, only reporting what would have been proxied, in /status")
+
+// observed is what observe mode saw of a domain with a rule, in hourly
+// buckets covering the last day.
+type observed struct {
+	queries [24]int64
+	snis    [24]int64
+	hours   [24]int64 // unix hour each bucket is for
+	blocked bool
+	secure  []string // what the secure resolver answers
+	asked   time.Time
+}
+
+var (
+	observeLock  sync.Mutex
+	observations = make(map[string]*observed)
+	observeSince = time.Now()
+)
+
+func (o *observed) bucket(now time.Time) int {
+	hour := now.Unix() / 3600
+	i := int(hour % 24)
+	if o.hours[i] != hour {
+		o.hours[i], o.queries[i], o.snis[i] = hour, 0, 0
+	}
+	return i
+}
+
+func (o *observed) sum(counts *[24]int64, now time.Time) (n int64) {
+	hour := now.Unix() / 3600
+	for i := range counts {
+		if hour-o.hours[i] < 24 {
+			n += counts[i]
+		}
+	}
+	return
+}
+
+// observeName notes that domain, matched by r, was asked for or connected to
+// and would have been spoofed or blocked. The secure answer is looked up
+// now and then, for comparing with what the default resolver said.
+func observeName(domain string, r *rule, sni bool) {
+	now := time.Now()
+	observeLock.Lock()
+	o, ok := observations[domain]
+	if !ok {
+		o = new(observed)
+		observations[domain] = o
+	}
+	i := o.bucket(now)
+	if sni {
+		o.snis[i]++
+	} else {
+		o.queries[i]++
+	}
+	o.blocked = r.block
+	lookup := !r.block && now.Sub(o.asked) > cacheAddrTtl
+	if lookup {
+		o.asked = now
+	}
+	observeLock.Unlock()
+
+	if lookup {
+		go func() {
+			addrs, err := resolveRealIP(domain, r.family, r.paranoid)
+			var secure []string
+			for _, a := range addrs {
+				host, _, _ := net.SplitHostPort(a.addr)
+				secure = append(secure, host)
+			}
+			if err != nil {
+				secure = []string{err.Error()}
+			}
+			observeLock.Lock()
+			o.secure = secure
+			observeLock.Unlock()
+		}()
+	}
+}
+
+// observedInfo is the /status view of an observed domain.
+type observedInfo struct {
+	Domain  string   `json:"domain"`
+	Queries int64    `json:"queries"`
+	SNIs    int64    `json:"tls_connections"`
+	Blocked bool     `json:"would_block,omitempty"`
+	Secure  []string `json:"secure_answer,omitempty"`
+}
+
+// observeReport is the top domains of the last 24h that would have been
+// proxied or blocked, nil outside observe mode.
+func observeReport() interface{} {
+	if !*observe {
+		return nil
+	}
+	now := time.Now()
+	var top []*observedInfo
+	observeLock.Lock()
+	for domain, o := range observations {
+		info := &observedInfo{
+			Domain:  domain,
+			Queries: o.sum(&o.queries, now),
+			SNIs:    o.sum(&o.snis, now),
+			Blocked: o.blocked,
+			Secure:  o.secure,
+		}
+		if info.Queries+info.SNIs > 0 {
+			top = append(top, info)
+		}
+	}
+	observeLock.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if a, b := top[i].Queries+top[i].SNIs, top[j].Queries+top[j].SNIs; a != b {
+			return a > b
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if len(top) > 100 {
+		top = top[:100]
+	}
+	return struct {
+		Since time.Time       `json:"since"`
+		Top   []*observedInfo `json:"top"`
+	}{observeSince, top}
+}
+
+// observeConn relays a TLS connection received in observe mode to where the
+// default resolver says host is, untouched.
+func observeConn(pc *peekConn, host string) {
+	v := viewFor(pc.RemoteAddr(), pc.LocalAddr())
+	if r := v.match(host); r != nil {
+		observeName(host, r, true)
+	}
+	noteSighting(v, "sni", host, "observed")
+	began := time.Now()
+	up, addr, err := dialDirect(host)
+	if err != nil {
+		logThrottled.Warnf(host, "%s: observe: %s", host, err)
+		return
+	}
+	defer closeConn(up)
+	upN, downN, ended := splice(pc, up, relayLimitsFor(nil, "direct"))
+
+	pc.log.WithFields(log.Fields{
+		"host":   host,
+		"mode":   "observe",
+		"addr":   addr,
+		"up":     upN,
+		"down":   downN,
+		"dur":    time.Since(began).Round(time.Millisecond),
+		"closed": ended,
+	}).Info("access")
+}
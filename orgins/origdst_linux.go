@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// setTransparent lets a listener accept connections TPROXY sends it for
+// addresses that aren't its own.
+func setTransparent(fd uintptr, network string) error {
+	if network == "tcp6" {
+		return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
+
+// originalDst is where a transparently intercepted connection was headed:
+// the NAT destination before a REDIRECT, or with TPROXY the local address.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	local := tc.LocalAddr().(*net.TCPAddr)
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		if local.IP.To4() == nil {
+			// IP6T_SO_ORIGINAL_DST fills a sockaddr_in6, the size of an
+			// ip6_mtuinfo's leading member
+			var info *unix.IPv6MTUInfo
+			if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST); serr == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				dst = &net.TCPAddr{
+					IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+			return
+		}
+		// SO_ORIGINAL_DST fills a sockaddr_in, which fits an ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); serr == nil {
+			a := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(a[4], a[5], a[6], a[7]),
+				Port: int(binary.BigEndian.Uint16(a[2:4])),
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		// not NATed: with TPROXY the socket carries the original address
+		return local, nil
+	}
+	return dst, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const transparentSupported = false
+
+func setTransparent(fd uintptr, network string) error {
+	return errors.New("transparent mode needs linux")
+}
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent mode needs linux")
+}
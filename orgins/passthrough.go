@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxRecord is the largest TLS record, header included.
+const maxRecord = 5 + 16384
+
+var errHelloRead = errors.New("hello read")
+
+// helloConn feeds recorded ClientHello bytes to a throwaway tls.Server.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// peekServerName returns the SNI of the ClientHello at the start of pc
+// without consuming it, "" if it doesn't fit in one record.
+func peekServerName(pc *peekConn) string {
+	pc.r = bufio.NewReaderSize(pc.r, maxRecord)
+	_ = pc.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer func() { _ = pc.SetReadDeadline(time.Time{}) }()
+	head, err := pc.r.Peek(5)
+	if err != nil {
+		return ""
+	}
+	record, err := pc.r.Peek(5 + (int(head[3])<<8 | int(head[4])))
+	if err != nil {
+		return ""
+	}
+
+	var name string
+	srv := tls.Server(helloConn{Conn: pc.Conn, r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	})
+	_ = srv.Handshake()
+	return name
+}
+
+// passthrough splices a connection for a resolve-only rule to the real
+// address of host, leaving TLS end to end so pinned certificates still work.
+func passthrough(pc *peekConn, host string, v *view, r *rule) {
+	began := time.Now()
+	up, addr, err := dialRaw(context.Background(), host, r)
+	if err != nil {
+		logThrottled.Warnf(host, "%s: passthrough: %s", host, err)
+		return
+	}
+	defer closeConn(up)
+	lc, untrack := trackConn(pc, host, "passthrough", v, r)
+	defer untrack()
+	lc.addr.Store(addr)
+
+	upN, downN, closed := splice(pc, up, relayLimitsFor(r, "realip"))
+	if lc.drained() {
+		closed = "drained"
+	}
+	group := groupFor(host)
+	countGroupBytes(group, upN, downN)
+	pc.log.WithFields(log.Fields{
+		"host":   host,
+		"group":  group,
+		"mode":   "passthrough",
+		"epoch":  v.epoch,
+		"addr":   addr,
+		"up":     upN,
+		"down":   downN,
+		"dur":    time.Since(began).Round(time.Millisecond),
+		"closed": closed,
+	}).Info("access")
+}
+
+// dialDirect opens a plain TCP connection to host at what the resolver
+// queries are forwarded to says, for names we don't proxy.
+func dialDirect(host string) (net.Conn, string, error) {
+	addrs := resolveVia(upstreamFor(forwardTo(false)), host, defaultFamily)
+	var up net.Conn
+	err := errResolve
+	for _, a := range addrs {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		up, err = upstreamDialer.(rawDialer).DialContext(ctx, a.addr)
+		cancel()
+		if err == nil {
+			return up, a.addr, nil
+		}
+	}
+	return nil, "", err
+}
+
+// dialRaw opens a plain TCP connection to the real address of host, the
+// cached one first, through upstreamDialer as every upstream connection.
+func dialRaw(ctx context.Context, host string, r *rule) (net.Conn, string, error) {
+	d := upstreamDialer.(rawDialer)
+	ctx = withTimeouts(ctx, r)
+	if c, ok := cacheResolv.Load(host); ok && !c.(*Resolv).Expired() && r.family.allows(c.(*Resolv).addr) && !famDemoted(c.(*Resolv).addr) {
+		i, err := d.DialContext(ctx, c.(*Resolv).addr)
+		recordDial(c.(*Resolv).addr, err)
+		if err == nil {
+			return i, c.(*Resolv).addr, nil
+		}
+	}
+	addrs, err := resolveRealIP(host, r.family, r.paranoid)
+	if err != nil {
+		return nil, "", err
+	}
+	err = errors.New("no usable addr")
+	for _, addr := range addrs {
+		if exp, ok := suspectAddr.Load(addr.addr); ok && !exp.(deadline).passed() {
+			continue
+		}
+		var i net.Conn
+		i, err = d.DialContext(ctx, addr.addr)
+		recordDial(addr.addr, err)
+		if err == nil {
+			cacheResolv.Store(host, addr)
+			return i, addr.addr, nil
+		}
+	}
+	return nil, "", err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// peerPrefix names the rules of peerURL as a rule source.
+const peerPrefix = "peer:"
+
+// peerAnswer is what /peer/resolve answers: the addrs the peer's secure
+// resolver gave for Host, bogons dropped, as bare IPs valid for TTL seconds.
+type peerAnswer struct {
+	Host  string   `json:"host"`
+	Addrs []string `json:"addrs"`
+	TTL   int      `json:"ttl"`
+	Error string   `json:"error,omitempty"` // failResolve if the peer couldn't either
+}
+
+// peerResolveHandler is GET /peer/resolve?host=[&family=][&paranoid=1], for other
+// instances using this one as their secure resolver. It never asks a peer
+// of its own, so two instances pointing at each other don't loop.
+func peerResolveHandler(w http.ResponseWriter, r *http.Request) {
+	host, ok := normalizeHost(r.URL.Query().Get("host"))
+	if !ok {
+		http.Error(w, "host= needs a valid hostname", http.StatusBadRequest)
+		return
+	}
+	fam := defaultFamily
+	if f := r.URL.Query().Get("family"); f != "" {
+		if fam, ok = parseFamily(f); !ok {
+			http.Error(w, "unknown family "+f, http.StatusBadRequest)
+			return
+		}
+	}
+	ans := &peerAnswer{Host: host, Addrs: []string{}, TTL: int(cacheAddrTtl / time.Second)}
+	addrs, err := resolveSecure(host, fam, r.URL.Query().Get("paranoid") == "1")
+	if err != nil {
+		ans.Error = dialFailure(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(ans)
+		return
+	}
+	for _, a := range addrs {
+		if ip, _, err := net.SplitHostPort(a.addr); err == nil {
+			ans.Addrs = append(ans.Addrs, ip)
+		}
+	}
+	writeJSON(w, ans)
+}
+
+// peerRulesHandler is GET /peer/rules, the rules of the asking peer's view
+// as plain lines, with an ETag so an unchanged list costs a 304.
+func peerRulesHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := exportRules(viewFor(requestAddr(r), requestLocal(r)).table, "plain")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// peerClient asks another instance for real addrs before our own secure
+// resolver, and reads its rules. After a failure it's left alone for
+// peerRetry, so a laptop away from home falls back to its own resolvers
+// at the cost of one failed request.
+type peerClient struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	downUntil deadline
+	lastErr   string
+	etag      string
+	lines     []string
+	changed   chan struct{}
+
+	answered, fellBack int64
+}
+
+var peer *peerClient // nil without peerURL
+
+// loadPeer sets up peer from peerURL, with peerCA to verify it and
+// peerCert and peerKey to present to it.
+func loadPeer() error {
+	if peerURL == "" {
+		return nil
+	}
+	if _, err := url.Parse(peerURL); err != nil {
+		return errors.New("peerURL: " + err.Error())
+	}
+	config := &tls.Config{}
+	if peerCA != "" {
+		data, err := ioutil.ReadFile(peerCA)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return errors.New(peerCA + ": no certificates")
+		}
+	}
+	if peerCert != "" {
+		pair, err := tls.LoadX509KeyPair(peerCert, peerKey)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	peer = newPeerClient(peerURL, &http.Client{
+		Timeout: dnsTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: config,
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     bootstrapDialer.DialContext,
+		},
+	})
+	go peer.sync()
+	log.Infof("asking peer %s before the secure resolver", redact(peerURL))
+	return nil
+}
+
+func newPeerClient(base string, client *http.Client) *peerClient {
+	return &peerClient{url: strings.TrimSuffix(base, "/"), client: client, changed: make(chan struct{}, 1)}
+}
+
+// up reports whether p is worth asking, that is it didn't fail in the last
+// peerRetry.
+func (p *peerClient) up() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.downUntil.passed()
+}
+
+func (p *peerClient) failed(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.downUntil.passed() {
+		logThrottled.Warnf("peer", "peer %s: %s, using our own resolvers for %s", redact(p.url), err, peerRetry)
+	}
+	p.downUntil = expireIn(peerRetry)
+	p.lastErr = err.Error()
+}
+
+// resolve asks p for the addrs of host. ok is false if p couldn't be asked
+// and the caller should resolve itself; a peer that can't resolve host
+// either answers errResolve.
+func (p *peerClient) resolve(host string, fam family, paranoid bool) (ret []*Resolv, err error, ok bool) {
+	if !p.up() {
+		atomic.AddInt64(&p.fellBack, 1)
+		return nil, nil, false
+	}
+	query := "/peer/resolve?host=" + url.QueryEscape(host) + "&family=" + fam.String()
+	if paranoid {
+		query += "&paranoid=1"
+	}
+	resp, err := p.client.Get(p.url + query)
+	if err != nil {
+		p.failed(err)
+		atomic.AddInt64(&p.fellBack, 1)
+		return nil, nil, false
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var ans peerAnswer
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		p.failed(errors.New(resp.Status))
+		atomic.AddInt64(&p.fellBack, 1)
+		return nil, nil, false
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ans); err != nil {
+		p.failed(err)
+		atomic.AddInt64(&p.fellBack, 1)
+		return nil, nil, false
+	}
+	atomic.AddInt64(&p.answered, 1)
+	if ans.Error != "" || len(ans.Addrs) == 0 {
+		return nil, errResolve, true
+	}
+	ttl := time.Duration(ans.TTL) * time.Second
+	if ttl <= 0 || ttl > cacheAddrTtl {
+		ttl = cacheAddrTtl
+	}
+	for _, ip := range ans.Addrs {
+		addr := net.JoinHostPort(ip, upstreamPort)
+		if net.ParseIP(ip) != nil && fam.allows(addr) {
+			ret = append(ret, &Resolv{addr: addr, expire: expireIn(ttl)})
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errResolve, true
+	}
+	return ret, nil, true
+}
+
+// Rules is the peer: rule source, fetched with the ETag of the last
+// answer, so an unchanged list isn't sent again.
+func (p *peerClient) Rules() ([]string, error) {
+	_, lines, err := p.fetchRules()
+	return lines, err
+}
+
+func (p *peerClient) fetchRules() (changed bool, lines []string, err error) {
+	req, err := http.NewRequest(http.MethodGet, p.url+"/peer/rules", nil)
+	if err != nil {
+		return false, nil, err
+	}
+	p.mu.Lock()
+	etag, last := p.etag, p.lines
+	p.mu.Unlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, last, nil
+	case http.StatusOK:
+	default:
+		return false, nil, errors.New(resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, nil, err
+	}
+	if lines, err = sourceData(data); err != nil {
+		return false, nil, err
+	}
+	p.mu.Lock()
+	p.etag, p.lines = resp.Header.Get("ETag"), lines
+	p.mu.Unlock()
+	return true, lines, nil
+}
+
+func (p *peerClient) Changed() <-chan struct{} { return p.changed }
+
+// sync checks for new rules every peerSync, telling Changed when there are.
+func (p *peerClient) sync() {
+	for {
+		time.Sleep(peerSync)
+		changed, _, err := p.fetchRules()
+		if err != nil {
+			log.Debugf("peer rules: %s", err)
+			continue
+		}
+		if changed {
+			select {
+			case p.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+type peerStatus struct {
+	URL      string     `json:"url"`
+	Up       bool       `json:"up"`
+	Down     *time.Time `json:"down_until,omitempty"`
+	LastErr  string     `json:"last_error,omitempty"`
+	ETag     string     `json:"rules_etag,omitempty"`
+	Answered int64      `json:"answered"`
+	FellBack int64      `json:"fell_back"`
+}
+
+// status is p for /status, nil without a peer.
+func (p *peerClient) status() *peerStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := &peerStatus{URL: redact(p.url), Up: p.downUntil.passed(), LastErr: p.lastErr, ETag: p.etag,
+		Answered: atomic.LoadInt64(&p.answered), FellBack: atomic.LoadInt64(&p.fellBack)}
+	if !st.Up {
+		until := p.downUntil.wall()
+		st.Down = &until
+	}
+	return st
+}
+
+// peerSource returns the peer for the peer: rule source.
+func peerSource() (RuleSource, error) {
+	if peer == nil {
+		return nil, fmt.Errorf("%s source without peerURL", peerPrefix)
+	}
+	return peer, nil
+}
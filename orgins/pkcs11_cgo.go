@@ -0,0 +1,154 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// tokenSigner signs with a key that never leaves its token, over one
+// session, which PKCS#11 doesn't let be used by two at once.
+type tokenSigner struct {
+	mu  sync.Mutex
+	ctx *pkcs11.Ctx
+	sh  pkcs11.SessionHandle
+	key pkcs11.ObjectHandle
+	pub crypto.PublicKey
+}
+
+// openToken loads the module of u, logs in to its token and finds the
+// private key whose public half is pub.
+func openToken(u *pkcs11URI, pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("CA key is a %T, a token can sign with ECDSA and RSA keys only", pub)
+	}
+	ctx := pkcs11.New(u.module)
+	if ctx == nil {
+		return nil, fmt.Errorf("PKCS#11 module %s couldn't be loaded, check module-path", u.module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("PKCS#11 module %s: %s", u.module, err)
+	}
+	fail := func(err error) (crypto.Signer, error) {
+		_ = ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return fail(fmt.Errorf("PKCS#11 module %s: %s", u.module, err))
+	}
+	slot, found := uint(0), false
+	for _, s := range slots {
+		if u.slot >= 0 && s != uint(u.slot) {
+			continue
+		}
+		if u.token != "" {
+			if info, err := ctx.GetTokenInfo(s); err != nil || info.Label != u.token {
+				continue
+			}
+		}
+		slot, found = s, true
+		break
+	}
+	if !found {
+		return fail(fmt.Errorf("no token %q in a slot of %s: is it plugged in? pkcs11-tool --module %s --list-token-slots lists them", u.token, u.module, u.module))
+	}
+	sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fail(fmt.Errorf("token %q: %s", u.token, err))
+	}
+	pin, err := u.tokenPIN()
+	if err != nil {
+		return fail(err)
+	}
+	if err := ctx.Login(sh, pkcs11.CKU_USER, string(pin)); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		switch err {
+		case pkcs11.Error(pkcs11.CKR_PIN_INCORRECT):
+			return fail(fmt.Errorf("token %q: wrong PIN from %s", u.token, u.pin))
+		case pkcs11.Error(pkcs11.CKR_PIN_LOCKED):
+			return fail(fmt.Errorf("token %q: PIN locked after too many wrong ones, unlock it with the SO PIN", u.token))
+		}
+		return fail(fmt.Errorf("token %q: login: %s", u.token, err))
+	}
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}
+	if u.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.object))
+	}
+	if u.id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.id))
+	}
+	if err := ctx.FindObjectsInit(sh, template); err != nil {
+		return fail(err)
+	}
+	keys, _, err := ctx.FindObjects(sh, 2)
+	_ = ctx.FindObjectsFinal(sh)
+	switch {
+	case err != nil:
+		return fail(err)
+	case len(keys) == 0:
+		return fail(fmt.Errorf("token %q has no private key %q: pkcs11-tool --module %s --login --list-objects lists them", u.token, u.object, u.module))
+	case len(keys) > 1:
+		return fail(fmt.Errorf("token %q has more than one private key matching, name one with object= or id=", u.token))
+	}
+	return &tokenSigner{ctx: ctx, sh: sh, key: keys[0], pub: pub}, nil
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey { return s.pub }
+
+// digestInfos are the DER prefixes of RFC 8017 DigestInfo, which RSA
+// PKCS#1 v1.5 signs the digest inside of.
+var digestInfos = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign signs digest in the token: ECDSA, its r and s turned into the
+// ASN.1 crypto.Signer returns, or RSA PKCS#1 v1.5, which is what
+// x509.CreateCertificate asks RSA keys for.
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	data, mech := digest, pkcs11.CKM_ECDSA
+	if _, ok := s.pub.(*rsa.PublicKey); ok {
+		if _, pss := opts.(*rsa.PSSOptions); pss {
+			return nil, errors.New("token keys sign RSA PKCS#1 v1.5 only, not PSS")
+		}
+		prefix, ok := digestInfos[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("token keys don't sign %s digests", opts.HashFunc())
+		}
+		data, mech = append(append([]byte(nil), prefix...), digest...), pkcs11.CKM_RSA_PKCS
+	}
+	s.mu.Lock()
+	err := s.ctx.SignInit(s.sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(uint(mech), nil)}, s.key)
+	var sig []byte
+	if err == nil {
+		sig, err = s.ctx.Sign(s.sh, data)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		metricAdd("ca_token_failures_total", 1)
+		return nil, fmt.Errorf("token: %s", err)
+	}
+	metricAdd("ca_token_signatures_total", 1)
+	if mech == pkcs11.CKM_RSA_PKCS {
+		return sig, nil
+	}
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])})
+}
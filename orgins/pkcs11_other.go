@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// openToken fails: PKCS#11 modules are C libraries, loaded through cgo.
+func openToken(*pkcs11URI, crypto.PublicKey) (crypto.Signer, error) {
+	return nil, errors.New("caKeyBackend pkcs11 needs a build with cgo, CGO_ENABLED=1")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Extension points for code built into the binary, registered from an init
+// function so they're in place before main starts serving:
+//
+//	func init() {
+//		RegisterRuleSource("org", newOrgSource())
+//		RegisterDecisionHook(officeHook{})
+//	}
+//
+// RuleSource, DecisionHook, Decision and the Register functions are kept as
+// they are; anything else in the package may change from one commit to the
+// next, and plugins must not rely on it. A plugin lives in its own file of
+// package main, behind a build tag, like plugin_example.go.
+
+// RuleSource supplies rule lines in the format of configFile from somewhere
+// other than a file or URL. Registered as name, it's listed in ruleSources
+// or viewsFile as "plugin:name", and merged in that order like any source.
+type RuleSource interface {
+	// Rules returns the current lines. It's called on every reload, so it
+	// should answer from memory; on error the last good lines stay in use.
+	Rules() ([]string, error)
+	// Changed receives when Rules has something new, which triggers a
+	// reload. nil if the source only changes on reloads caused otherwise.
+	Changed() <-chan struct{}
+}
+
+// Decision is what the proxy does with a host.
+type Decision string
+
+const (
+	DecisionProxy Decision = "proxy"   // spoofed in DNS, relayed through a route
+	DecisionPass  Decision = "pass"    // resolved and connected to as without us
+	DecisionBlock Decision = "blocked" // NXDOMAIN, and connections refused
+)
+
+// DecisionHook may override what the rules decided for a host, both when
+// it's queried and when a client connects for it. Hooks run in the order
+// registered, each getting the decision of the one before; a panic is
+// logged and leaves the decision as it was.
+type DecisionHook interface {
+	Decide(host string, client net.Addr, tentative Decision) Decision
+}
+
+var (
+	pluginSources = make(map[string]RuleSource)
+	decisionHooks atomic.Value // []DecisionHook, replaced whole as one is added
+	pluginsFrozen bool         // set once serving starts, registering after is a bug
+)
+
+func currentHooks() []DecisionHook {
+	hooks, _ := decisionHooks.Load().([]DecisionHook)
+	return hooks
+}
+
+const pluginPrefix = "plugin:"
+
+// RegisterRuleSource makes src available as "plugin:name".
+func RegisterRuleSource(name string, src RuleSource) {
+	if pluginsFrozen {
+		panic("RegisterRuleSource " + name + " after start")
+	}
+	if _, ok := pluginSources[name]; ok {
+		panic("RegisterRuleSource: duplicate " + name)
+	}
+	pluginSources[name] = src
+}
+
+// RegisterDecisionHook adds h after the hooks registered before it.
+func RegisterDecisionHook(h DecisionHook) {
+	if pluginsFrozen {
+		panic("RegisterDecisionHook after start")
+	}
+	hooks := currentHooks()
+	decisionHooks.Store(append(hooks[:len(hooks):len(hooks)], h))
+}
+
+// fileSource and remoteSource are the built-in sources: a local file, polled
+// by pollingFileChange, and an http(s) URL, refetched every remoteRefresh.
+type fileSource string
+type remoteSource string
+
+func (f fileSource) Rules() ([]string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return sourceData(data)
+}
+
+func (fileSource) Changed() <-chan struct{} { return nil }
+
+func (u remoteSource) Rules() ([]string, error) {
+	data, err := fetchRemote(string(u))
+	if err != nil {
+		return nil, err
+	}
+	return sourceData(data)
+}
+
+func (remoteSource) Changed() <-chan struct{} { return nil }
+
+// sourceFor returns what reads the rule source named src.
+func sourceFor(src string) (RuleSource, error) {
+	switch {
+	case strings.HasPrefix(src, pluginPrefix):
+		s, ok := pluginSources[strings.TrimPrefix(src, pluginPrefix)]
+		if !ok {
+			return nil, fmt.Errorf("no plugin registered as %s", strings.TrimPrefix(src, pluginPrefix))
+		}
+		return s, nil
+	case src == peerPrefix:
+		return peerSource()
+	case src == runtimePrefix:
+		return runtimeRules, nil
+	case isRemote(src):
+		return remoteSource(src), nil
+	}
+	return fileSource(src), nil
+}
+
+// watchPlugins reloads the config whenever a plugin source says it changed.
+func watchPlugins() {
+	for name, src := range pluginSources {
+		ch := src.Changed()
+		if ch == nil {
+			continue
+		}
+		go func(name string, ch <-chan struct{}) {
+			for range ch {
+				log.Infof("rule source %s%s changed", pluginPrefix, name)
+				updateConfig(false)
+			}
+		}(name, ch)
+	}
+	if peer != nil {
+		go func() {
+			for range peer.Changed() {
+				log.Infof("rule source %s changed", peerPrefix)
+				updateConfig(false)
+			}
+		}()
+	}
+}
+
+func decisionOf(r *rule) Decision {
+	switch {
+	case r == nil:
+		return DecisionPass
+	case r.block:
+		return DecisionBlock
+	}
+	return DecisionProxy
+}
+
+// decide runs the decision hooks for host asked about or connected to by
+// client, r being what the rules say, and returns the rule to go by: r if
+// the hooks agree, otherwise one made up for their decision.
+func decide(stage, host string, client net.Addr, r *rule) *rule {
+	hooks := currentHooks()
+	if len(hooks) == 0 {
+		return r
+	}
+	tentative := decisionOf(r)
+	d := tentative
+	for _, h := range hooks {
+		d = runHook(h, host, client, d)
+	}
+	if d == tentative {
+		return r
+	}
+	metricAdd(metricName("hook_overrides_total", "stage", stage, "decision", string(d)), 1)
+	log.Debugf("%s: %s overridden to %s by a hook", host, tentative, d)
+	switch d {
+	case DecisionPass:
+		return nil
+	case DecisionBlock:
+		return &rule{block: true, domain: host, source: "hook"}
+	}
+	return &rule{domain: host, source: "hook"}
+}
+
+// runHook calls h, keeping d if it panics or answers nonsense.
+func runHook(h DecisionHook, host string, client net.Addr, d Decision) (ret Decision) {
+	defer func() {
+		if p := recover(); p != nil {
+			metricAdd("hook_panics_total", 1)
+			logThrottled.Errorf("hook "+host, "decision hook %T panicked on %s: %v", h, host, p)
+			ret = d
+		}
+	}()
+	switch ret = h.Decide(host, client, d); ret {
+	case DecisionProxy, DecisionPass, DecisionBlock:
+		return ret
+	}
+	logThrottled.Errorf("hook "+host, "decision hook %T: unknown decision %q for %s", h, ret, host)
+	return d
+}
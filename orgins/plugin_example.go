@@ -0,0 +1,135 @@
+//go:build exampleplugin
+// +build exampleplugin
+
+// An example plugin, built in with -tags exampleplugin: rules from an
+// internal service, and a hook letting one office network go direct. Each
+// is only registered if configured.
+//
+// The service at $ORG_RULES_URL answers GET with
+//
+//	{"proxy": ["example.com", ...], "block": ["ads.example", ...]}
+//
+// and the source is listed in ruleSources or viewsFile as plugin:org.
+// $ORG_OFFICE_NET is the office network as a CIDR, e.g. 10.20.0.0/16.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	if url := os.Getenv("ORG_RULES_URL"); url != "" {
+		RegisterRuleSource("org", newOrgSource(url, time.Minute))
+	}
+	if cidr := os.Getenv("ORG_OFFICE_NET"); cidr != "" {
+		_, office, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Errorf("plugin:org: ORG_OFFICE_NET: %s", err)
+			return
+		}
+		RegisterDecisionHook(officeHook{office})
+	}
+}
+
+// orgSource polls the service every interval, and says it changed when
+// the lists did.
+type orgSource struct {
+	url     string
+	mu      sync.Mutex
+	lines   []string
+	err     error
+	changed chan struct{}
+}
+
+func newOrgSource(url string, interval time.Duration) *orgSource {
+	s := &orgSource{url: url, changed: make(chan struct{}, 1)}
+	s.poll()
+	go func() {
+		for range time.Tick(interval) {
+			s.poll()
+		}
+	}()
+	return s
+}
+
+func (s *orgSource) poll() {
+	lines, err := s.fetch()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Warnf("plugin:org: %s", err)
+		s.err = err
+		return
+	}
+	if reflect.DeepEqual(lines, s.lines) && s.err == nil {
+		return
+	}
+	s.lines, s.err = lines, nil
+	select {
+	case s.changed <- struct{}{}:
+	default: // a reload is pending anyway
+	}
+}
+
+func (s *orgSource) fetch() ([]string, error) {
+	cli := &http.Client{Timeout: 10 * time.Second, Transport: bootstrapTransport}
+	resp, err := cli.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var lists struct {
+		Proxy []string `json:"proxy"`
+		Block []string `json:"block"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lists); err != nil {
+		return nil, err
+	}
+	lines := append([]string(nil), lists.Proxy...)
+	for _, d := range lists.Block {
+		lines = append(lines, d+" block")
+	}
+	return lines, nil
+}
+
+func (s *orgSource) Rules() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lines == nil {
+		return nil, s.err
+	}
+	return s.lines, nil
+}
+
+func (s *orgSource) Changed() <-chan struct{} {
+	return s.changed
+}
+
+// officeHook lets clients in office, which has its own way out, go direct
+// for everything but blocked names.
+type officeHook struct {
+	office *net.IPNet
+}
+
+func (h officeHook) Decide(host string, client net.Addr, tentative Decision) Decision {
+	var ip net.IP
+	switch a := client.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if tentative == DecisionProxy && ip != nil && h.office.Contains(ip) {
+		return DecisionPass
+	}
+	return tentative
+}
@@ -0,0 +1,113 @@
+//go:build exampleplugin
+// +build exampleplugin
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrgSource(t *testing.T) {
+	var mu sync.Mutex
+	status, body := http.StatusOK, `{"proxy": ["example.com", "example.org"], "block": ["ads.example"]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	serve := func(s int, b string) {
+		mu.Lock()
+		status, body = s, b
+		mu.Unlock()
+	}
+	changed := func(s *orgSource) bool {
+		select {
+		case <-s.Changed():
+			return true
+		default:
+			return false
+		}
+	}
+
+	s := newOrgSource(srv.URL, time.Hour)
+	want := []string{"example.com", "example.org", "ads.example block"}
+	if lines, err := s.Rules(); err != nil || !reflect.DeepEqual(lines, want) {
+		t.Fatalf("rules %q, %v; want %q", lines, err, want)
+	}
+	if !changed(s) {
+		t.Error("first lists not signalled")
+	}
+
+	s.poll()
+	if changed(s) {
+		t.Error("signalled with the lists unchanged")
+	}
+
+	serve(http.StatusOK, `{"proxy": ["example.net"]}`)
+	s.poll()
+	if lines, _ := s.Rules(); !reflect.DeepEqual(lines, []string{"example.net"}) || !changed(s) {
+		t.Errorf("new lists %q, signalled %v", lines, changed(s))
+	}
+
+	// a failing service keeps the lists it gave last
+	serve(http.StatusInternalServerError, "oops")
+	s.poll()
+	if lines, err := s.Rules(); err != nil || !reflect.DeepEqual(lines, []string{"example.net"}) {
+		t.Errorf("after a failed poll, rules %q, %v", lines, err)
+	}
+	serve(http.StatusOK, `{"proxy": ["example.net"]}`)
+	s.poll()
+	if !changed(s) {
+		t.Error("recovery from a failed poll not signalled")
+	}
+
+	serve(http.StatusOK, "not json")
+	down := newOrgSource(srv.URL, time.Hour)
+	if lines, err := down.Rules(); lines != nil || err == nil {
+		t.Errorf("rules %q, %v from a service that never answered right", lines, err)
+	}
+}
+
+func TestOfficeHook(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.20.0.0/16")
+	h := officeHook{office}
+	in := &net.TCPAddr{IP: net.ParseIP("10.20.3.4"), Port: 50000}
+	out := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	tests := []struct {
+		client    net.Addr
+		tentative Decision
+		want      Decision
+	}{
+		{in, DecisionProxy, DecisionPass},
+		{in, DecisionBlock, DecisionBlock},
+		{in, DecisionPass, DecisionPass},
+		{&net.UDPAddr{IP: net.ParseIP("10.20.255.1")}, DecisionProxy, DecisionPass},
+		{out, DecisionProxy, DecisionProxy},
+		{out, DecisionBlock, DecisionBlock},
+		{nil, DecisionProxy, DecisionProxy},
+	}
+	for _, tt := range tests {
+		if got := h.Decide("example.com", tt.client, tt.tentative); got != tt.want {
+			t.Errorf("%v, %s: %s, want %s", tt.client, tt.tentative, got, tt.want)
+		}
+	}
+
+	// hooked into decide, as init registers it with ORG_OFFICE_NET set
+	defer decisionHooks.Store(currentHooks())
+	decisionHooks.Store([]DecisionHook(nil))
+	RegisterDecisionHook(h)
+	if r := decide("sni", "example.com", in, &rule{domain: "example.com"}); r != nil {
+		t.Errorf("office client proxied by %+v", r)
+	}
+	if r := decide("sni", "example.com", out, &rule{domain: "example.com"}); r == nil || r.block {
+		t.Errorf("other client gets %+v, want the rule", r)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Clients reach the proxy on the standard ports, since the spoofed answers
+// only carry an address. The bind addresses can differ when a redirect
+// forwards the standard ports, e.g. without CAP_NET_BIND_SERVICE.
+var (
+	dnsListen  = flag.String("dns-listen", "localhost:53", "UDP and TCP addresses to serve DNS on, comma separated")
+	tlsListen  = flag.String("tls-listen", "localhost:"+advertisedTLSPort, "TCP address to serve TLS on")
+	httpListen = flag.String("http-listen", "localhost:"+advertisedHTTPPort, "TCP address to serve plain HTTP on")
+	redirected = flag.Bool("redirected", false,
+		"the standard ports are redirected to the listen addresses, so don't warn about them")
+)
+
+const usageRedirect = `
+Clients always connect to ports 53, 80 and 443. To listen on higher ports
+without CAP_NET_BIND_SERVICE, redirect the standard ones, e.g. with nftables:
+
+  nft add table ip nat
+  nft add chain ip nat output '{ type nat hook output priority -100; }'
+  nft add rule ip nat output ip daddr 127.0.0.1 udp dport 53 redirect to :5353
+  nft add rule ip nat output ip daddr 127.0.0.1 tcp dport 53 redirect to :5353
+  nft add rule ip nat output ip daddr 127.0.0.1 tcp dport 443 redirect to :8443
+  nft add rule ip nat output ip daddr 127.0.0.1 tcp dport 80 redirect to :8080
+
+and run with -dns-listen localhost:5353 -tls-listen localhost:8443
+-http-listen localhost:8080 -redirected.
+`
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), usageRedirect)
+	}
+}
+
+// dnsAddrs are the addresses of -dns-listen. Views picked by the address
+// clients ask on need one each: a wildcard UDP socket can't tell.
+func dnsAddrs() []string {
+	return strings.Split(*dnsListen, ",")
+}
+
+// checkPorts warns about listen addresses clients won't reach by themselves.
+func checkPorts() error {
+	type listen struct {
+		name, addr, port string
+		enabled          bool
+	}
+	var ls []listen
+	for _, a := range dnsAddrs() {
+		ls = append(ls, listen{"dns-listen", a, "53", enableDNS})
+	}
+	for _, l := range append(ls,
+		listen{"tls-listen", *tlsListen, advertisedTLSPort, enableTLS},
+		listen{"http-listen", *httpListen, advertisedHTTPPort, enableHTTP},
+	) {
+		if !l.enabled {
+			continue
+		}
+		_, port, err := net.SplitHostPort(l.addr)
+		if err != nil {
+			return fmt.Errorf("-%s: %s", l.name, err)
+		}
+		if port != l.port && !*redirected {
+			log.Warnf("-%s is on port %s but clients use %s, redirect it (see -help) and pass -redirected",
+				l.name, port, l.port)
+		}
+	}
+	return nil
+}
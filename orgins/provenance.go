@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+var provenanceName = flag.String("provenance", "",
+	"ask the DNS listener how it answers `name`, with the provenanceOption, print why and exit")
+
+// provenanceClients lists the CIDRs of debug clients, whose queries are told
+// how they were answered even without the option. Only used when
+// provenanceOption is set.
+var provenanceClients = []string{}
+
+var provenanceNets []*net.IPNet // parsed provenanceClients
+
+// provenancePrefix asks for the provenance of the name after it as a TXT
+// answer, for clients that can't show EDNS0 options.
+const provenancePrefix = "_proxy-debug."
+
+func parseProvenanceClients() error {
+	for _, c := range provenanceClients {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return errors.New("provenanceClients: " + err.Error())
+		}
+		provenanceNets = append(provenanceNets, n)
+	}
+	return nil
+}
+
+func provenanceClient(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, n := range provenanceNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func askedProvenance(m *dns.Msg, code uint16) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provenanceWriter holds back the reply to a debug query until recordQuery
+// says how it was answered, to add that to it.
+type provenanceWriter struct {
+	dns.ResponseWriter
+	code  uint16 // provenanceOption as the query came in
+	query *dns.Msg
+	txt   *dns.Msg // the _proxy-debug query, answered with TXT instead
+	reply *dns.Msg
+	rule  *rule
+}
+
+func (p *provenanceWriter) WriteMsg(m *dns.Msg) error {
+	p.reply = m
+	return nil
+}
+
+// wrapProvenance returns w and m as they are unless provenanceOption is set
+// and m is a debug query: one carrying the option, or any from
+// provenanceClients. A _proxy-debug TXT query is turned into the A query
+// for the name it's about.
+func wrapProvenance(w dns.ResponseWriter, m *dns.Msg) (dns.ResponseWriter, *dns.Msg) {
+	code := currentSettings().provenanceCode
+	if code == 0 || len(m.Question) != 1 {
+		return w, m
+	}
+	if !askedProvenance(m, code) && !provenanceClient(w.RemoteAddr()) {
+		return w, m
+	}
+	q := m.Question[0]
+	if q.Qtype == dns.TypeTXT && len(q.Name) > len(provenancePrefix) &&
+		strings.EqualFold(q.Name[:len(provenancePrefix)], provenancePrefix) {
+		inner := m.Copy()
+		inner.Question[0].Name = q.Name[len(provenancePrefix):]
+		inner.Question[0].Qtype = dns.TypeA
+		return &provenanceWriter{ResponseWriter: w, code: code, query: inner, txt: m}, inner
+	}
+	if m.IsEdns0() == nil {
+		return w, m // nowhere to put the option
+	}
+	return &provenanceWriter{ResponseWriter: w, code: code, query: m}, m
+}
+
+// noteRule tells a debug query's writer which rule matched.
+func noteRule(w dns.ResponseWriter, r *rule) {
+	if p, ok := w.(*provenanceWriter); ok {
+		p.rule = r
+	}
+}
+
+// provenance is how a query was answered, as key=value pairs.
+func provenance(decision int, r *rule, upstream string, rcode int) []string {
+	ret := []string{"decision=" + decisionNames[decision]}
+	if r != nil {
+		ret = append(ret, "rule="+r.domain, "source="+r.source+":"+strconv.Itoa(r.line))
+	}
+	if upstream != "" {
+		ret = append(ret, "upstream="+upstream)
+	}
+	return append(ret, "rcode="+dns.RcodeToString[rcode])
+}
+
+// flush sends the held back reply with its provenance, or the TXT answer
+// for a _proxy-debug query. Nothing is sent if nothing was written and the
+// client asked for an option, as when the upstream didn't answer.
+func (p *provenanceWriter) flush(decision int, upstream string, rcode int) {
+	text := provenance(decision, p.rule, upstream, rcode)
+	reply := p.reply
+	switch {
+	case p.txt != nil:
+		reply = new(dns.Msg)
+		reply.SetReply(p.txt)
+		reply.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: p.txt.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: text,
+		}}
+		reply.Truncate(clientSize(p.ResponseWriter, p.txt))
+	case reply == nil:
+		return
+	default:
+		opt := reply.IsEdns0()
+		if opt == nil {
+			reply.SetEdns0(ednsUDPSize, p.query.IsEdns0().Do())
+			opt = reply.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: p.code, Data: []byte(strings.Join(text, " "))})
+		if reply.Len() > clientSize(p.ResponseWriter, p.query) {
+			opt.Option = opt.Option[:len(opt.Option)-1]
+			logThrottled.Infof("provenance", "%s: no room for the provenance option", p.query.Question[0].Name)
+		}
+	}
+	if err := p.ResponseWriter.WriteMsg(reply); err != nil {
+		log.Error(err)
+	}
+}
+
+// askProvenance asks addr for the A records of name with the provenance
+// option, returning the reply and the option's key=value pairs.
+func askProvenance(addr, name string) (*dns.Msg, []string, error) {
+	code := currentSettings().provenanceCode
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m.SetEdns0(ednsUDPSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code})
+	r, _, err := (&dns.Client{Timeout: dnsTimeout}).Exchange(m, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == code {
+				return r, strings.Fields(string(l.Data)), nil
+			}
+		}
+	}
+	return r, nil, errors.New("no provenance in the answer, is provenanceOption the same there?")
+}
+
+// runProvenance is -provenance: it prints how the DNS listener answers name.
+func runProvenance(name string) int {
+	if currentSettings().provenanceCode == 0 {
+		fmt.Fprintln(os.Stderr, "provenanceOption isn't set")
+		return exitPermanent
+	}
+	r, fields, err := askProvenance(dnsAddrs()[0], name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("%s %s\n", dns.Fqdn(name), dns.RcodeToString[r.Rcode])
+	for _, rr := range r.Answer {
+		fmt.Printf("  %s\n", rr)
+	}
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) == 2 {
+			fmt.Printf("  %-9s %s\n", kv[0], kv[1])
+		}
+	}
+	return 0
+}
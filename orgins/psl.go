@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// suffixList is a public suffix list read from suffixFile: rules by their
+// name, *.name and !name rules kept apart.
+type suffixList struct {
+	normal, wildcard, exception map[string]bool
+}
+
+var (
+	suffixCur atomic.Value // *suffixList, unset for the one in x/net
+	suffixSum [sha256.Size]byte
+	// suffixGen is bumped as a list other than the one before is loaded,
+	// after it's stored
+	suffixGen uint64
+)
+
+var tldPolicy = unknownTLD
+
+func checkUnknownTLD() error {
+	switch tldPolicy {
+	case "registrable", "reject":
+		return nil
+	}
+	return errors.New("unknownTLD is registrable or reject, not " + tldPolicy)
+}
+
+// loadSuffixList reads suffixFile, if there's one. Called at setup and on
+// every reload, keeping the last good list on errors.
+func loadSuffixList() error {
+	if suffixFile == "" {
+		return nil
+	}
+	f, err := os.Open(suffixFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	sum := sha256.New()
+	l, err := parseSuffixList(io.TeeReader(f, sum))
+	if err != nil {
+		return fmt.Errorf("%s: %s", suffixFile, err)
+	}
+	var got [sha256.Size]byte
+	copy(got[:], sum.Sum(nil))
+	useSuffixList(l, got)
+	return nil
+}
+
+// useSuffixList makes l, read from a file summing to sum, the list; nil
+// and no sum for the one in x/net. A list other than the one before
+// retires the leaves derived with that.
+func useSuffixList(l *suffixList, sum [sha256.Size]byte) {
+	suffixCur.Store(l)
+	if sum == suffixSum {
+		return
+	}
+	suffixSum = sum
+	retireLeaves(atomic.AddUint64(&suffixGen, 1))
+}
+
+func parseSuffixList(r io.Reader) (*suffixList, error) {
+	l := &suffixList{make(map[string]bool), make(map[string]bool), make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule, set := fields[0], l.normal
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rule, set = rule[1:], l.exception
+		case strings.HasPrefix(rule, "*."):
+			rule, set = rule[2:], l.wildcard
+		}
+		ascii, err := idna.Lookup.ToASCII(rule)
+		if err != nil {
+			log.Debugf("public suffix list: skipped %s: %s", fields[0], err)
+			continue
+		}
+		set[ascii] = true
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("no rules")
+	}
+	return l, nil
+}
+
+// publicSuffix is the public suffix of domain, by the longest rule that
+// matches it, and whether a rule did rather than the implicit * one, which
+// takes the last label of names under TLDs the list doesn't know.
+func (l *suffixList) publicSuffix(domain string) (string, bool) {
+	for rest := domain; ; {
+		dot := strings.IndexByte(rest, '.')
+		if l.exception[rest] {
+			return rest[dot+1:], true
+		}
+		if l.normal[rest] || dot >= 0 && l.wildcard[rest[dot+1:]] {
+			return rest, true
+		}
+		if dot < 0 {
+			return rest, false
+		}
+		rest = rest[dot+1:]
+	}
+}
+
+// publicSuffix is the public suffix of domain by suffixFile, or the list
+// built into x/net without one.
+func publicSuffix(domain string) (string, bool) {
+	if l, ok := suffixCur.Load().(*suffixList); ok && l != nil {
+		return l.publicSuffix(domain)
+	}
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	// private rules, e.g. github.io, aren't ICANN's but listed all the same
+	return suffix, icann || strings.IndexByte(suffix, '.') >= 0
+}
+
+// registrable is the registrable domain of domain, its public suffix and
+// one label more, or domain itself if it's a public suffix already; and
+// whether the list knew the suffix.
+func registrable(domain string) (string, bool) {
+	suffix, listed := publicSuffix(domain)
+	if len(suffix) >= len(domain) {
+		return domain, listed
+	}
+	head := domain[:len(domain)-len(suffix)-1]
+	return head[strings.LastIndexByte(head, '.')+1:] + "." + suffix, listed
+}
+
+// walkStop is the last parent of domain matchRule looks for rules of. With
+// a listed suffix that's the registrable domain, there being no rules for
+// public suffixes; otherwise every parent with unknownTLD registrable, and
+// none with reject. IP literals only ever match exactly.
+func walkStop(domain string) string {
+	if net.ParseIP(domain) != nil {
+		return domain
+	}
+	reg, listed := registrable(domain)
+	switch {
+	case listed:
+		return reg
+	case tldPolicy == "reject":
+		return domain
+	}
+	return ""
+}
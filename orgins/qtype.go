@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// what forwardDns does with a query type
+const (
+	qtypeForward = iota
+	qtypeNotImp  // NOTIMP, for zone transfers
+	qtypeMinimal // a synthesized HINFO, for ANY (RFC 8482)
+	numQtypeActions
+)
+
+var qtypeActionNames = [numQtypeActions]string{"forward", "notimp", "minimal"}
+
+// qtypePolicy lists the query types forwardDns handles; any other type is
+// refused. Add types here for clients that really need them.
+var qtypePolicy = map[uint16]int{
+	dns.TypeA:     qtypeForward,
+	dns.TypeAAAA:  qtypeForward,
+	dns.TypeHTTPS: qtypeForward,
+	dns.TypeMX:    qtypeForward,
+	dns.TypeTXT:   qtypeForward,
+	dns.TypeSRV:   qtypeForward,
+	dns.TypePTR:   qtypeForward,
+	dns.TypeSOA:   qtypeForward,
+	dns.TypeNS:    qtypeForward,
+	dns.TypeCNAME: qtypeForward,
+	dns.TypeCAA:   qtypeForward,
+	dns.TypeAXFR:  qtypeNotImp,
+	dns.TypeIXFR:  qtypeNotImp,
+	dns.TypeANY:   qtypeMinimal,
+}
+
+var (
+	qtypeRefused = metricCounter(metricName("dns_qtype_policy_total", "action", "refused"))
+	qtypeActions [numQtypeActions]*int64
+)
+
+func init() {
+	for i := qtypeNotImp; i < numQtypeActions; i++ {
+		qtypeActions[i] = metricCounter(metricName("dns_qtype_policy_total", "action", qtypeActionNames[i]))
+	}
+}
+
+// answerQtype answers m itself if qtypePolicy says its type isn't
+// forwarded, counting what it did.
+func answerQtype(m *dns.Msg) (*dns.Msg, bool) {
+	q := &m.Question[0]
+	action, ok := qtypePolicy[q.Qtype]
+	if !ok {
+		atomic.AddInt64(qtypeRefused, 1)
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeRefused)
+		return msg, true
+	}
+	if action == qtypeForward {
+		return nil, false
+	}
+	atomic.AddInt64(qtypeActions[action], 1)
+
+	msg := new(dns.Msg)
+	switch action {
+	case qtypeNotImp:
+		msg.SetRcode(m, dns.RcodeNotImplemented)
+	case qtypeMinimal:
+		msg.SetReply(m)
+		msg.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+			Cpu: "RFC8482",
+		}}
+	}
+	return msg, true
+}
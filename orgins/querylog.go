@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// decisions forwardDns takes on a query
+const (
+	decisionSpoofed = iota
+	decisionForwarded
+	decisionBlocked
+	decisionLocal
+	decisionObserved // would have been spoofed or blocked, forwarded in observe mode
+	decisionNoAAAA   // forwarded for a noaaaa rule with AAAA records stripped, or NODATA
+	numDecisions
+)
+
+var decisionNames = [numDecisions]string{"spoofed", "forwarded", "blocked", "local", "observed", "noaaaa"}
+
+var (
+	// queryLog receives sampled queries as JSON lines when queryLogFile is
+	// set, otherwise they go to the standard logger
+	queryLog     atomic.Value // *lockedWriter
+	querySampled int64
+
+	// counters looked up once, so counting a query never allocates
+	queryByType     = make(map[uint16]*int64)
+	queryTypeOther  = metricCounter(metricName("dns_queries_total", "qtype", "other"))
+	queryByDecision [numDecisions]*int64
+	forwardedBy     = make(map[string]*int64) // by upstream transport
+	upstreamLatency = metricHistogram("dns_upstream_latency_ms")
+)
+
+func init() {
+	for _, t := range []uint16{
+		dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeMX,
+		dns.TypeTXT, dns.TypeSRV, dns.TypePTR, dns.TypeNS, dns.TypeSOA, dns.TypeANY,
+	} {
+		queryByType[t] = metricCounter(metricName("dns_queries_total", "qtype", dns.TypeToString[t]))
+	}
+	for i, name := range decisionNames {
+		queryByDecision[i] = metricCounter(metricName("dns_decisions_total", "decision", name))
+	}
+	for _, t := range []string{"udp", "tcp", "tls"} {
+		forwardedBy[t] = metricCounter(metricName("dns_forwarded_total", "transport", t))
+	}
+}
+
+type queryRecord struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Client   string    `json:"client"`
+	View     string    `json:"view"`
+	Decision string    `json:"decision"`
+	Upstream string    `json:"upstream,omitempty"`
+	Via      string    `json:"transport,omitempty"` // how upstream was asked, udp, tcp or tls
+	Rcode    string    `json:"rcode"`
+	Latency  float64   `json:"latency_ms"`
+	TTL      uint32    `json:"ttl,omitempty"` // of spoofed answers
+}
+
+func openQueryLog() error {
+	if queryLogSample <= 0 || queryLogFile == "" {
+		return nil
+	}
+	fil, err := os.OpenFile(queryLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	queryLog.Store(&lockedWriter{w: fil})
+	return nil
+}
+
+// recordQuery counts a handled query and logs 1 in queryLogSample of them,
+// plus every spoofed one. upstream is empty and rtt zero when not forwarded.
+func recordQuery(w dns.ResponseWriter, v *view, q *dns.Question, decision int, upstream string, rcode int, rtt time.Duration) {
+	logQuery(w, v, q, decision, upstream, rcode, rtt, 0)
+}
+
+// recordSpoofed is recordQuery for a spoofed answer with the given TTL.
+func recordSpoofed(w dns.ResponseWriter, v *view, q *dns.Question, ttl time.Duration) {
+	logQuery(w, v, q, decisionSpoofed, "", dns.RcodeSuccess, 0, ttl)
+}
+
+func logQuery(w dns.ResponseWriter, v *view, q *dns.Question, decision int, upstream string, rcode int, rtt, ttl time.Duration) {
+	if p, ok := w.(*provenanceWriter); ok {
+		p.flush(decision, upstream, rcode)
+	}
+	if c, ok := queryByType[q.Qtype]; ok {
+		atomic.AddInt64(c, 1)
+	} else {
+		atomic.AddInt64(queryTypeOther, 1)
+	}
+	atomic.AddInt64(queryByDecision[decision], 1)
+	atomic.AddInt64(v.decisions[decision], 1)
+	countClientQuery(w.RemoteAddr(), q.Name, decision)
+	noteSighting(v, "dns", q.Name, decisionNames[decision])
+	via := ""
+	if u := upstreamFor(upstream); u != nil {
+		via = u.transport(isTCP(w))
+		atomic.AddInt64(forwardedBy[via], 1)
+	}
+	if upstream != "" {
+		upstreamLatency.observe(rtt)
+	}
+
+	s := currentSettings()
+	if s.querySample <= 0 {
+		return
+	}
+	// with privateDNS, all that left in plaintext is there to be checked
+	plain := s.privateForward && via != "" && via != "tls"
+	if !plain && decision != decisionSpoofed && decision != decisionObserved && decision != decisionNoAAAA && atomic.AddInt64(&querySampled, 1)%s.querySample != 0 {
+		return
+	}
+
+	rec := &queryRecord{
+		Time:     time.Now(),
+		Name:     q.Name,
+		Type:     dns.TypeToString[q.Qtype],
+		Client:   w.RemoteAddr().String(),
+		View:     v.name,
+		Decision: decisionNames[decision],
+		Upstream: upstream,
+		Via:      via,
+		Rcode:    dns.RcodeToString[rcode],
+		Latency:  float64(rtt) / float64(time.Millisecond),
+		TTL:      uint32(ttl / time.Second),
+	}
+	out, _ := queryLog.Load().(*lockedWriter)
+	if out == nil {
+		log.WithFields(log.Fields{
+			"qname":     rec.Name,
+			"qtype":     rec.Type,
+			"client":    rec.Client,
+			"view":      rec.View,
+			"decision":  rec.Decision,
+			"upstream":  rec.Upstream,
+			"transport": rec.Via,
+			"rcode":     rec.Rcode,
+			"latency":   rtt,
+			"ttl":       rec.TTL,
+		}).Info("query")
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// processStart is what startup times are measured from.
+var processStart = time.Now()
+
+// readiness tracks the subsystems loading in the background once the
+// listeners serve. Until the rules are in, DNS forwards every name and TLS
+// turns every name away, so a slow remote source doesn't keep DNS down.
+var readiness struct {
+	sync.Mutex
+	pending map[string]bool
+	took    map[string]time.Duration
+	done    chan struct{} // closed when nothing is pending
+}
+
+var firstDNS int64 // nanoseconds from processStart, 0 before
+
+func init() {
+	readiness.pending = make(map[string]bool)
+	readiness.took = make(map[string]time.Duration)
+	readiness.done = make(chan struct{})
+	close(readiness.done)
+}
+
+// expectReady adds subsystems markReady is to be called for.
+func expectReady(names ...string) {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if len(readiness.pending) == 0 && len(names) > 0 {
+		readiness.done = make(chan struct{})
+	}
+	for _, name := range names {
+		readiness.pending[name] = true
+	}
+}
+
+// markReady notes that name has come up, the first time it's called.
+func markReady(name string) {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if !readiness.pending[name] {
+		return
+	}
+	delete(readiness.pending, name)
+	took := time.Since(processStart)
+	readiness.took[name] = took
+	log.Infof("%s ready %s after start", name, took.Round(time.Millisecond))
+	if len(readiness.pending) == 0 {
+		close(readiness.done)
+	}
+}
+
+// waitReady blocks until no subsystem is pending.
+func waitReady() {
+	readiness.Lock()
+	done := readiness.done
+	readiness.Unlock()
+	<-done
+}
+
+// loadInBackground loads the rules, fetching remote sources, and warms
+// leaves after the listeners are up.
+func loadInBackground() {
+	expectReady("rules")
+	if warmUp && enableTLS {
+		expectReady("warm")
+	}
+	go func() {
+		pollingFileChange()
+		markReady("rules")
+	}()
+}
+
+// noteDNSAnswer logs how long after start the first DNS query was
+// answered, the outage a restart costs the network.
+func noteDNSAnswer() {
+	if atomic.LoadInt64(&firstDNS) != 0 {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&firstDNS, 0, int64(time.Since(processStart))) {
+		log.Infof("first DNS answer %s after start", time.Duration(atomic.LoadInt64(&firstDNS)).Round(time.Millisecond))
+	}
+}
+
+// readyzHandler is GET /readyz: 200 once every subsystem is up, 503 with
+// the ones still loading before.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness.Lock()
+	res := struct {
+		Ready    bool             `json:"ready"`
+		Pending  []string         `json:"pending"`
+		ReadyMs  map[string]int64 `json:"ready_after_ms"`
+		FirstDNS int64            `json:"first_dns_answer_ms,omitempty"`
+	}{Pending: []string{}, ReadyMs: make(map[string]int64)}
+	for name := range readiness.pending {
+		res.Pending = append(res.Pending, name)
+	}
+	for name, took := range readiness.took {
+		res.ReadyMs[name] = took.Milliseconds()
+	}
+	readiness.Unlock()
+	sort.Strings(res.Pending)
+	res.Ready = len(res.Pending) == 0
+	res.FirstDNS = time.Duration(atomic.LoadInt64(&firstDNS)).Milliseconds()
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// replayWriter forwards client bytes upstream while remembering them, so the
+// stream can be replayed to another upstream if the first one dies early.
+type replayWriter struct {
+	mu  sync.Mutex
+	dst net.Conn
+	buf []byte // nil once replaying is no longer possible
+	n   int64
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.n += int64(len(p))
+	if w.buf == nil {
+		return w.dst.Write(p)
+	}
+	if len(w.buf)+len(p) > replayBufSize {
+		w.buf = nil
+		return w.dst.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	// on failure the bytes stay in buf and reach the next upstream on swap
+	_, _ = w.dst.Write(p)
+	return len(p), nil
+}
+
+// commit stops buffering, after which swap always fails.
+func (w *replayWriter) commit() {
+	w.mu.Lock()
+	w.buf = nil
+	w.mu.Unlock()
+}
+
+// swap replays the buffered bytes to dst and makes it the new destination.
+func (w *replayWriter) swap(dst net.Conn) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf == nil {
+		return errors.New("replay buffer gone")
+	}
+	if _, err := dst.Write(w.buf); err != nil {
+		return err
+	}
+	w.dst = dst
+	return nil
+}
+
+func (w *replayWriter) current() net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dst
+}
+
+// head returns the client bytes buffered so far, nil once committed.
+func (w *replayWriter) head() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.buf...)
+}
+
+// written is the number of client bytes accepted so far.
+func (w *replayWriter) written() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n
+}
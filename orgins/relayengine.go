@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// relayEngine moves bytes one way, from src to dst, until src is done or
+// either side fails, adding what reached dst to n as it goes so the relay's
+// watch sees progress. It leaves closing to the caller.
+type relayEngine interface {
+	name() string
+	copy(dst, src net.Conn, n *int64) error
+}
+
+// copyEngine copies through a buffer in userspace, which works for any
+// conns, tls.Conn and capture tees included.
+type copyEngine struct{}
+
+func (copyEngine) name() string { return "copy" }
+
+func (copyEngine) copy(dst, src net.Conn, n *int64) error {
+	_, err := io.Copy(countingWriter{dst, n}, src)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	k, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(k))
+	return k, err
+}
+
+// engineFor picks how to move bytes from src to dst: spliced in the kernel
+// when both are plain TCP and relaySplice allows, copied otherwise.
+func engineFor(dst, src net.Conn) relayEngine {
+	if relaySplice {
+		if e := spliceEngineFor(dst, src); e != nil {
+			return e
+		}
+	}
+	return copyEngine{}
+}
+
+// splice relays between a client and an upstream until both sides are
+// done or l ends it, passing half-closes on, and returns the bytes sent
+// each way and why l ended it, if it did. What sniffing read ahead of the
+// client goes first, so the rest can come straight from its socket.
+func splice(client, up net.Conn, l relayLimits) (upN, downN int64, ended string) {
+	if pc, ok := client.(*peekConn); ok {
+		if k := pc.r.Buffered(); k > 0 {
+			head, _ := pc.r.Peek(k)
+			n, err := up.Write(head)
+			if err != nil {
+				return int64(n), 0, ""
+			}
+			_, _ = pc.r.Discard(k)
+			upN = int64(n)
+		}
+		client = pc.Conn
+	}
+	u, d, ended := relayConns(client, up, engineFor(up, client), engineFor(client, up), l)
+	return upN + u, d, ended
+}
+
+// relayConns runs upE from client to up and downE back until both are
+// done, half-closing each side once nothing more will be written to it,
+// or until l ends it.
+func relayConns(client, up net.Conn, upE, downE relayEngine, l relayLimits) (upN, downN int64, ended string) {
+	metricAdd(metricName("relays_total", "engine", upE.name()), 1)
+	stop := l.watch(&upN, &downN, client, up)
+	done := make(chan struct{})
+	go func() {
+		_ = upE.copy(up, client, &upN)
+		closeWrite(up)
+		close(done)
+	}()
+	_ = downE.copy(client, up, &downN)
+	closeWrite(client)
+	<-done
+	if ended = stop(); ended != "" {
+		// let the FINs and close_notify out, they're what makes it graceful
+		_ = client.SetDeadline(time.Time{})
+		_ = up.SetDeadline(time.Time{})
+	}
+	return atomic.LoadInt64(&upN), atomic.LoadInt64(&downN), ended
+}
+
+// why a relay was ended by its limits, for the closed field of the access log
+const (
+	endedIdle    = "idle"
+	endedMaxLife = "max-life"
+	endedOneWay  = "one-way"
+)
+
+// relayLimits end a relay whatever is still moving through it: once
+// nothing moved either way for idle, once it's maxLife old, and once the
+// client kept sending for oneWay with nothing back, as on a tunnel whose
+// far end died while its near end still acknowledges everything. Only
+// client bytes going unanswered count as one-way, downloads the client
+// sends nothing during are fine. 0 for never.
+type relayLimits struct {
+	idle, maxLife, oneWay time.Duration
+}
+
+// relayLimitsFor are the limits of a connection for r that went via the
+// route named via: those set on r, else on the route, else the global ones.
+// r may be nil for connections no rule matched.
+func relayLimitsFor(r *rule, via string) relayLimits {
+	l := currentSettings().limits
+	if p, ok := currentSettings().routes[via].(proxyRoute); ok {
+		l = l.or(p.limits)
+	}
+	if r != nil {
+		l = l.or(r.limits)
+	}
+	return l
+}
+
+// or is l with what o sets instead.
+func (l relayLimits) or(o relayLimits) relayLimits {
+	if o.idle > 0 {
+		l.idle = o.idle
+	}
+	if o.maxLife > 0 {
+		l.maxLife = o.maxLife
+	}
+	if o.oneWay > 0 {
+		l.oneWay = o.oneWay
+	}
+	return l
+}
+
+// relayLimitRange is what max-life= and one-way= of rules and routes may
+// be set to.
+var relayLimitRange = map[string][2]time.Duration{
+	"max-life": {time.Minute, 7 * 24 * time.Hour},
+	"one-way":  {10 * time.Second, 24 * time.Hour},
+}
+
+// set sets k of l, max-life or one-way, to v, returning the range v is out
+// of if it's no good.
+func (l *relayLimits) set(k, v string) (outOf string) {
+	rng := relayLimitRange[k]
+	d, err := time.ParseDuration(v)
+	if err != nil || d < rng[0] || d > rng[1] {
+		return rng[0].String() + " and " + rng[1].String()
+	}
+	if k == "max-life" {
+		l.maxLife = d
+	} else {
+		l.oneWay = d
+	}
+	return ""
+}
+
+// opts are l as the options of a rule or route line.
+func (l relayLimits) opts() []string {
+	var ret []string
+	if l.maxLife > 0 {
+		ret = append(ret, "max-life="+l.maxLife.String())
+	}
+	if l.oneWay > 0 {
+		ret = append(ret, "one-way="+l.oneWay.String())
+	}
+	return ret
+}
+
+// tick is how often watch checks l: four times per the shortest limit, so
+// a relay ends late by a quarter of it at most. 0 if l has none.
+func (l relayLimits) tick() time.Duration {
+	var t time.Duration
+	for _, d := range []time.Duration{l.idle, l.maxLife, l.oneWay} {
+		if d > 0 && (t == 0 || d < t) {
+			t = d
+		}
+	}
+	return t / 4
+}
+
+// relaysEnded count the relays ended by their limits, by why.
+var relaysEnded = map[string]*int64{
+	endedIdle:    metricCounter("relays_idle_closed_total"),
+	endedMaxLife: metricCounter("relays_max_life_closed_total"),
+	endedOneWay:  metricCounter("relays_one_way_closed_total"),
+}
+
+// watch ends a relay once it breaks l, going by the counts up and down its
+// engines keep, by expiring the deadlines of conns: every engine sees that
+// as the end of its reads and writes. stop returns why it ended the relay,
+// "" if it didn't.
+func (l relayLimits) watch(up, down *int64, conns ...net.Conn) (stop func() string) {
+	tick := l.tick()
+	if tick <= 0 {
+		return func() string { return "" }
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	var ended string
+	go func() {
+		defer close(done)
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		began := time.Now()
+		lastUp, lastDown := int64(0), int64(0)
+		upAt, downAt := began, began
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+			}
+			now := time.Now()
+			if n := atomic.LoadInt64(up); n != lastUp {
+				lastUp, upAt = n, now
+			}
+			if n := atomic.LoadInt64(down); n != lastDown {
+				lastDown, downAt = n, now
+			}
+			switch {
+			case l.maxLife > 0 && now.Sub(began) >= l.maxLife:
+				ended = endedMaxLife
+			case l.idle > 0 && now.Sub(upAt) >= l.idle && now.Sub(downAt) >= l.idle:
+				ended = endedIdle
+			case l.oneWay > 0 && now.Sub(downAt) >= l.oneWay && upAt.After(downAt):
+				ended = endedOneWay
+			default:
+				continue
+			}
+			atomic.AddInt64(relaysEnded[ended], 1)
+			for _, c := range conns {
+				_ = c.SetDeadline(now)
+			}
+			return
+		}
+	}()
+	return func() string {
+		close(quit)
+		<-done
+		return ended
+	}
+}
+
+func closeWrite(c net.Conn) {
+	if pc, ok := c.(*peekConn); ok {
+		c = pc.Conn
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// relayEngines are the engines there are here, by name, each picked for a
+// pair of TCP conns as engineFor would.
+func relayEngines() map[string]func(dst, src net.Conn) relayEngine {
+	ret := map[string]func(dst, src net.Conn) relayEngine{
+		"copy": func(net.Conn, net.Conn) relayEngine { return copyEngine{} },
+	}
+	if spliceEngineFor(&net.TCPConn{}, &net.TCPConn{}) != nil {
+		ret["splice"] = spliceEngineFor
+	}
+	return ret
+}
+
+// loopRelay relays a loopback client through relayConns, with engines
+// from pick, to a loopback origin run by origin. client gets the conn to
+// the relay, closed after; the counts are the relay's.
+func loopRelay(pick func(dst, src net.Conn) relayEngine, origin func(net.Conn), client func(net.Conn) error) (upN, downN int64, err error) {
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = ol.Close() }()
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = rl.Close() }()
+
+	go func() {
+		c, err := ol.Accept()
+		if err != nil {
+			return
+		}
+		origin(c)
+		_ = c.Close()
+	}()
+	type counts struct{ up, down int64 }
+	relayed := make(chan counts, 1)
+	go func() {
+		c, err := rl.Accept()
+		if err != nil {
+			relayed <- counts{-1, -1}
+			return
+		}
+		defer func() { _ = c.Close() }()
+		u, err := net.Dial("tcp", ol.Addr().String())
+		if err != nil {
+			relayed <- counts{-1, -1}
+			return
+		}
+		defer func() { _ = u.Close() }()
+		up, down, _ := relayConns(c, u, pick(u, c), pick(c, u), relayLimits{idle: currentSettings().limits.idle})
+		relayed <- counts{up, down}
+	}()
+
+	c, err := net.Dial("tcp", rl.Addr().String())
+	if err != nil {
+		return 0, 0, err
+	}
+	err = client(c)
+	_ = c.Close()
+	select {
+	case n := <-relayed:
+		if n.up < 0 {
+			return 0, 0, errors.New("relay couldn't reach the origin")
+		}
+		return n.up, n.down, err
+	case <-time.After(10 * time.Second):
+		return 0, 0, errors.New("relay never finished")
+	}
+}
+
+// BenchmarkRelay is the throughput of each relay engine there is here over
+// loopback, an op being a 256 KiB buffer sent each way: the client's first,
+// then the origin's once the client has half-closed.
+func BenchmarkRelay(b *testing.B) {
+	engines := relayEngines()
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := make([]byte, 256<<10)
+	for _, name := range names {
+		pick := engines[name]
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(2 * int64(len(buf)))
+			b.ResetTimer()
+			up, down, err := loopRelay(pick, func(c net.Conn) {
+				_, _ = io.Copy(ioutil.Discard, c)
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+			}, func(c net.Conn) error {
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(buf); err != nil {
+						return err
+					}
+				}
+				_ = c.(*net.TCPConn).CloseWrite()
+				_, err := io.Copy(ioutil.Discard, c)
+				return err
+			})
+			b.StopTimer()
+			if want := int64(b.N) * int64(len(buf)); err != nil || up != want || down != want {
+				b.Fatalf("relayed %d up and %d down, want %d: %v", up, down, want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// removedUntil is until when clients may still hold our spoofed answer
+	// for a domain no longer proxied
+	removedUntil sync.Map // domain -> deadline
+	graceEnd     int64    // deadline the last grace window ends, so handleConn only peeks when needed
+)
+
+// proxiedDomains lists the domains some view proxies, with the rule whose
+// spoofed answers live longest.
+func proxiedDomains(vs []*view, now time.Time) map[string]*rule {
+	ret := make(map[string]*rule)
+	for _, v := range vs {
+		if v.direct {
+			continue
+		}
+		for d, r := range v.table {
+			if r.block || r.forwarded() {
+				continue
+			}
+			if o, ok := ret[d]; !ok || spoofTTL(r, now) > spoofTTL(o, now) {
+				ret[d] = r
+			}
+		}
+	}
+	return ret
+}
+
+// forgetRemoved compares the domains proxied before and after a reload.
+// Removed ones lose their cached addresses and leaves, and with graceRemoved
+// are relayed direct as long as the TTL of their last spoofed answers, as
+// clients keep connecting to us that long; added ones lose their negative
+// cache entries.
+func forgetRemoved(old, vs []*view) {
+	now := time.Now()
+	before, after := proxiedDomains(old, now), proxiedDomains(vs, now)
+	if len(before) == 0 {
+		return // first load, or after an upgrade: nothing cached is stale
+	}
+	cns := make(map[string]bool) // leaves still needed
+	for d := range after {
+		if cn, err := leafCN(d); err == nil {
+			cns[cn] = true
+		}
+	}
+	for d, r := range before {
+		if _, ok := after[d]; ok {
+			continue
+		}
+		forgetHosts(cacheResolv, d)
+		forgetHosts(cacheRoute, d)
+		forgetHosts(&stickyPins, d)
+		if cn, gen, err := leafName(d); err == nil && !cns[cn] {
+			cacheCert.Delete(leafKey{cn, false, gen})
+			cacheCert.Delete(leafKey{cn, true, gen})
+		}
+		if !graceRemoved {
+			log.Infof("%s is no longer proxied", d)
+			continue
+		}
+		ttl := spoofTTL(r, now)
+		end := expireIn(ttl)
+		removedUntil.Store(d, end)
+		if int64(end) > atomic.LoadInt64(&graceEnd) {
+			atomic.StoreInt64(&graceEnd, int64(end))
+		}
+		log.Infof("%s is no longer proxied, relaying it direct for %s", d, ttl)
+	}
+	for d := range after {
+		if _, ok := before[d]; !ok {
+			forgetHosts(cacheNeg, d)
+			removedUntil.Delete(d)
+		}
+	}
+}
+
+// hostMap is a host-keyed cache, a sync.Map or a budgetMap.
+type hostMap interface {
+	Range(f func(key, val interface{}) bool)
+	Delete(key interface{})
+}
+
+// forgetHosts deletes domain and its subdomains from a host-keyed cache.
+func forgetHosts(m hostMap, domain string) {
+	m.Range(func(key, _ interface{}) bool {
+		if host := key.(string); host == domain || strings.HasSuffix(host, "."+domain) {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+// graceActive reports whether some removed domain may still be in its grace
+// window.
+func graceActive() bool {
+	return !deadline(atomic.LoadInt64(&graceEnd)).passed()
+}
+
+// inGrace reports whether host or a parent was removed while clients may
+// still hold our answer for it, dropping the entries found expired.
+func inGrace(host string) bool {
+	for d := host; d != ""; {
+		if end, ok := removedUntil.Load(d); ok {
+			if !end.(deadline).passed() {
+				return true
+			}
+			removedUntil.Delete(d)
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return false
+}
+
+// relayRemoved splices a connection for a recently removed domain to its
+// default resolver address, as if the client had asked the resolver itself.
+func relayRemoved(pc *peekConn, host string) {
+	began := time.Now()
+	up, addr, err := dialDirect(host)
+	if err != nil {
+		logThrottled.Warnf(host, "%s: removed, direct: %s", host, err)
+		return
+	}
+	defer closeConn(up)
+	upN, downN, ended := splice(pc, up, relayLimitsFor(nil, "direct"))
+
+	pc.log.WithFields(log.Fields{
+		"host":   host,
+		"group":  groupFor(host),
+		"mode":   "removed",
+		"addr":   addr,
+		"up":     upN,
+		"down":   downN,
+		"dur":    time.Since(began).Round(time.Millisecond),
+		"closed": ended,
+	}).Info("access")
+}
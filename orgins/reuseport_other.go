@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+)
+
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT not supported")
+}
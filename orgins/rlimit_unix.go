@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// raiseFdLimit lifts the soft RLIMIT_NOFILE to the hard one and returns the
+// resulting limit, 0 if unknown.
+func raiseFdLimit() uint64 {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		log.Warnf("getrlimit: %s", err)
+		return 0
+	}
+	if lim.Cur < lim.Max {
+		old := lim.Cur
+		lim.Cur = lim.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+			log.Warnf("failed to raise fd limit from %d: %s", old, err)
+			lim.Cur = old
+		} else {
+			log.Infof("fd limit raised from %d to %d", old, lim.Cur)
+		}
+	}
+	return uint64(lim.Cur)
+}
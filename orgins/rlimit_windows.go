@@ -0,0 +1,6 @@
+package main
+
+// raiseFdLimit has nothing to raise on windows, the limit is unknown.
+func raiseFdLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// route is a named way of reaching an upstream host.
+type route interface {
+	// dial returns an established TLS connection to host and the address it
+	// went to, skipping addresses in tried.
+	dial(ctx context.Context, host string, r *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, error)
+}
+
+var cacheRoute = newBudgetMap("routes", routeChoiceCost, routeChoiceAge) // host -> *routeChoice, the route that worked last
+
+type routeChoice struct {
+	name   string
+	expire deadline
+}
+
+func builtinRoutes() map[string]route {
+	return map[string]route{
+		"realip": realipRoute{},
+		"direct": directRoute{},
+	}
+}
+
+// realipRoute dials the addresses the secure resolver returns.
+type realipRoute struct{}
+
+func (realipRoute) dial(ctx context.Context, host string, r *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, error) {
+	return dialUpstream(ctx, host, r, config, tried)
+}
+
+// directRoute dials whatever the resolver queries are forwarded to says, as
+// if there were no proxy.
+type directRoute struct{}
+
+func (directRoute) dial(ctx context.Context, host string, r *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, error) {
+	addrs := resolveVia(upstreamFor(forwardTo(false)), host, r.family)
+	if addrs == nil {
+		return nil, "", errResolve
+	}
+	d := r.dialer(upstreamDialer)
+	err := errors.New("no usable addr")
+	for _, addr := range orderByHealth(addrs) {
+		if _, skip := tried[addr.addr]; skip {
+			continue
+		}
+		var i net.Conn
+		i, err = d.DialTLSContext(ctx, host, addr.addr, config)
+		recordDial(addr.addr, err)
+		if err == nil {
+			return i, addr.addr, nil
+		}
+		tried[addr.addr] = struct{}{}
+	}
+	return nil, "", err
+}
+
+// proxyRoute tunnels through a SOCKS5 or HTTP proxy at addr.
+type proxyRoute struct {
+	addr   string
+	d      dialer
+	clamp  clamp
+	limits relayLimits
+}
+
+func (p proxyRoute) dial(ctx context.Context, host string, r *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, error) {
+	if _, skip := tried[p.addr]; skip {
+		return nil, "", errors.New("already tried")
+	}
+	tried[p.addr] = struct{}{}
+	i, err := r.dialer(p.d).DialTLSContext(ctx, host, net.JoinHostPort(host, upstreamPort), config)
+	if err != nil {
+		return nil, p.addr, err
+	}
+	return p.clamp.wrap(i), p.addr, nil
+}
+
+// dialRoutes walks the fallback chain of r for host, starting with the route
+// that worked last time, and returns the connection, address and route name.
+func dialRoutes(ctx context.Context, host string, r *rule, config *tls.Config, tried map[string]struct{}) (net.Conn, string, string, error) {
+	chain := r.routes
+	if len(chain) == 0 {
+		chain = []string{"realip"}
+	}
+	if c, ok := cacheRoute.Load(host); ok && !c.(*routeChoice).expire.passed() {
+		name := c.(*routeChoice).name
+		ordered, found := []string{name}, false
+		for _, n := range chain {
+			if n == name {
+				found = true
+			} else {
+				ordered = append(ordered, n)
+			}
+		}
+		if found {
+			chain = ordered
+		}
+	}
+
+	err := errors.New("no route")
+	for _, name := range chain {
+		rt, ok := currentSettings().routes[name]
+		if !ok {
+			continue
+		}
+		var i net.Conn
+		var addr string
+		i, addr, err = rt.dial(ctx, host, r, config, tried)
+		if err == nil {
+			cacheRoute.Store(host, &routeChoice{name: name, expire: expireIn(cacheRouteTtl)})
+			return i, addr, name, nil
+		}
+		connLogFrom(ctx).Debugf("%s: route %s failed: %s", host, name, err)
+	}
+	return nil, "", "", err
+}
+
+// loadRoutes reads routesFile, one route per line:
+//
+//	socks name=wg addr=127.0.0.1:1081
+//	http name=corp addr=proxy.corp:3128
+//
+// and returns them by name, each as its line without the name, the way the
+// routes section of the config file has them. A missing file just means no
+// extra routes; a line without a name is logged and skipped.
+func loadRoutes() map[string]string {
+	ret := make(map[string]string)
+	fil, err := os.Open(routesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return ret
+	}
+	defer func() {
+		if err := fil.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(fil)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, spec := "", []string{fields[0]}
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "name=") {
+				name = f[len("name="):]
+			} else {
+				spec = append(spec, f)
+			}
+		}
+		if name == "" {
+			log.Errorf("route needs name and addr: %s", scanner.Text())
+			continue
+		}
+		if _, ok := ret[name]; ok {
+			log.Errorf("duplicate route %s", name)
+			continue
+		}
+		ret[name] = strings.Join(spec, " ")
+	}
+	return ret
+}
+
+// compileRoutes turns specs as loadRoutes returns them into routes, with
+// mss and max-record options as in clamp, and max-life and one-way as in
+// relayLimits for the relays going through. realip and direct always exist.
+// Also returned is what's wrong with them: a route with a bad option goes
+// without it, one that can't be dialed is left out.
+func compileRoutes(specs map[string]string) (map[string]route, []string) {
+	ret := builtinRoutes()
+	var bad []string
+	for name, spec := range specs {
+		if _, ok := ret[name]; ok {
+			bad = append(bad, "route "+name+" is built in")
+			continue
+		}
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			bad = append(bad, "route "+name+" is empty")
+			continue
+		}
+		opts := parseOpts(fields[1:])
+		addr := opts["addr"]
+		if addr == "" {
+			bad = append(bad, "route "+name+" needs addr")
+			continue
+		}
+		c, why := parseClamp(opts)
+		var l relayLimits
+		for k := range relayLimitRange {
+			if v, ok := opts[k]; ok {
+				if outOf := l.set(k, v); outOf != "" {
+					why = append(why, k+" needs to be between "+outOf+", not "+v)
+				}
+			}
+		}
+		for _, w := range why {
+			bad = append(bad, "route "+name+": "+w)
+		}
+		switch fields[0] {
+		case "socks":
+			ret[name] = proxyRoute{addr: addr, d: socksDialer{proxy: addr, control: c.control()}, clamp: c, limits: l}
+		case "http":
+			ret[name] = proxyRoute{addr: addr, d: httpDialer{proxy: addr, control: c.control()}, clamp: c, limits: l}
+		default:
+			bad = append(bad, "route "+name+": unknown type "+fields[0])
+		}
+	}
+	sort.Strings(bad)
+	return ret, bad
+}
+
+// parseOpts turns key=value fields into a map.
+func parseOpts(fields []string) map[string]string {
+	ret := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if eq := strings.IndexByte(f, '='); eq > 0 {
+			ret[f[:eq]] = f[eq+1:]
+		} else {
+			ret[f] = ""
+		}
+	}
+	return ret
+}
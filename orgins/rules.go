@@ -0,0 +1,354 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// rule is what a line of a rule source says about a domain and its subdomains:
+//
+//	example.com route=realip,wg priority=10
+//	example.org front=cdn.example.net front-verify=front front-ips
+//	nas.example verify-name=nas.internal.lan
+//	example.net family=ipv4
+//	ads.example block
+//	v6broken.example noaaaa
+//	cdn.example plain-dns
+//	broken.example capture
+//	bank.example resolve-only paranoid
+//	mail.example warm
+//	slow.example dial-timeout=15s handshake-timeout=20s
+//	login.example sticky=12h
+//	chat.example max-life=6h one-way=2m
+//	mtls.example client-cert=/etc/sni/mtls.pem client-key=/etc/sni/mtls.key
+//	group:example route=wg
+type rule struct {
+	routes   []string // fallback chain of route names, realip when empty
+	priority int      // breaks ties between lines of the same source
+
+	// domain fronting: SNI sent upstream instead of the host, whether the
+	// upstream cert is checked against the front rather than the host, and
+	// whether the front's addresses are dialed rather than the host's
+	front       string
+	frontVerify bool
+	frontIPs    bool
+
+	// the upstream cert is checked against verifyName instead, for a
+	// self-hosted service with a cert for its internal name only; noVerify
+	// doesn't check it at all, an escape hatch logged on every use
+	verifyName string
+	noVerify   bool
+
+	// PEM files of the credential presented to origins asking for a client
+	// certificate, see useClientCert
+	clientCert, clientKey string
+
+	family   family // upstream address family, famDefault for the global one
+	paranoid bool   // the secure answer has to agree with paranoidResolver's
+	block    bool   // answered NXDOMAIN instead of proxied
+
+	// forwarded rather than proxied, without AAAA records: for names whose
+	// IPv6 addresses don't work, which clients are slow to fall back from
+	noAAAA bool
+
+	// forwarded rather than proxied, to defResolver even with privateDNS:
+	// for names answered by where the resolver is, e.g. CDNs, or that the
+	// secure resolver fails on
+	plainDNS bool
+
+	// TLS is spliced to the real address instead of terminated, for apps
+	// pinning their certificates
+	resolveOnly bool
+
+	// decrypted traffic is written to captureDir, never without this option
+	capture bool
+
+	warm bool // leaf minted ahead of the first connection, see warmUp
+
+	// upstream connect and TLS handshake timeouts, 0 for dialTimeout
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+
+	// the upstream addr is pinned for stickyTtl, or as long as stickyTtl
+	// says if set, see stickyPins
+	sticky    bool
+	stickyTtl time.Duration
+
+	// max-life and one-way of its relays, 0 for those of the route or the
+	// global ones
+	limits relayLimits
+
+	ttl   time.Duration // of spoofed answers, 0 for spoofTtl
+	since time.Time     // last reload the rule changed in, for adaptiveTtl
+
+	// origin
+	domain string
+	group  string // the rule was for group:name
+	source string
+	line   int
+}
+
+// parseRule parses one configFile line, returning an empty domain for blank
+// lines and comments.
+func parseRule(line string) (string, *rule) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", nil
+	}
+	domain, ok := normalizeHost(fields[0])
+	if !ok {
+		rejectName("rule", fields[0])
+		return "", nil
+	}
+	r := new(rule)
+	for k, v := range parseOpts(fields[1:]) {
+		switch k {
+		case "route":
+			for _, name := range strings.Split(v, ",") {
+				if _, ok := currentSettings().routes[name]; !ok {
+					log.Errorf("%s: unknown route %s", fields[0], name)
+					continue
+				}
+				r.routes = append(r.routes, name)
+			}
+		case "front":
+			name, ok := normalizeHost(v)
+			if !ok {
+				log.Errorf("%s: front needs a hostname, not %s", fields[0], v)
+				continue
+			}
+			r.front = name
+		case "front-verify":
+			switch v {
+			case "host":
+			case "front":
+				r.frontVerify = true
+			default:
+				log.Errorf("%s: front-verify is host or front, not %s", fields[0], v)
+			}
+		case "front-ips":
+			r.frontIPs = true
+		case "verify-name":
+			name, ok := normalizeHost(v)
+			if !ok {
+				log.Errorf("%s: verify-name needs a hostname, not %s", fields[0], v)
+				continue
+			}
+			r.verifyName = name
+		case "verify":
+			switch v {
+			case "on":
+			case "off":
+				log.Warnf("%s: verify=off, upstream certificates won't be checked", fields[0])
+				r.noVerify = true
+			default:
+				log.Errorf("%s: verify is on or off, not %s", fields[0], v)
+			}
+		case "client-cert":
+			r.clientCert = v
+		case "client-key":
+			r.clientKey = v
+		case "block":
+			r.block = true
+		case "resolve-only":
+			r.resolveOnly = true
+		case "noaaaa":
+			r.noAAAA = true
+		case "plain-dns":
+			r.plainDNS = true
+		case "paranoid":
+			if paranoidResolver == "" {
+				log.Errorf("%s: paranoid needs paranoidDNS", fields[0])
+				continue
+			}
+			r.paranoid = true
+		case "warm":
+			r.warm = true
+		case "capture":
+			log.Warnf("%s: capture is on, decrypted traffic will be written to %s", fields[0], captureDir)
+			r.capture = true
+		case "family":
+			f, ok := parseFamily(v)
+			if !ok {
+				log.Errorf("%s: unknown family %s", fields[0], v)
+				continue
+			}
+			r.family = f
+		case "dial-timeout", "handshake-timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < minTimeout || d > maxTimeout {
+				log.Errorf("%s: %s needs to be between %s and %s, not %s", fields[0], k, minTimeout, maxTimeout, v)
+				continue
+			}
+			if k == "dial-timeout" {
+				r.dialTimeout = d
+			} else {
+				r.handshakeTimeout = d
+			}
+		case "ttl":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second || d > 24*time.Hour {
+				log.Errorf("%s: ttl needs to be between 1s and 24h, not %s", fields[0], v)
+				continue
+			}
+			r.ttl = d
+		case "sticky":
+			r.sticky = true
+			if v == "" {
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Minute || d > 7*24*time.Hour {
+				log.Errorf("%s: sticky needs to be between 1m and 168h, not %s", fields[0], v)
+				continue
+			}
+			r.stickyTtl = d
+		case "max-life", "one-way":
+			if outOf := r.limits.set(k, v); outOf != "" {
+				log.Errorf("%s: %s needs to be between %s, not %s", fields[0], k, outOf, v)
+			}
+		case "priority":
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				log.Errorf("%s: bad priority %s", fields[0], v)
+				continue
+			}
+			r.priority = p
+		default:
+			log.Errorf("%s: unknown option %s", fields[0], k)
+		}
+	}
+	if r.front == "" && (r.frontVerify || r.frontIPs) {
+		log.Errorf("%s: front-verify and front-ips need front", fields[0])
+	}
+	if (r.clientCert == "") != (r.clientKey == "") {
+		log.Errorf("%s: client-cert and client-key go together", fields[0])
+		r.clientCert, r.clientKey = "", ""
+	}
+	if r.noAAAA && (r.block || r.resolveOnly) {
+		log.Errorf("%s: noaaaa goes with neither block nor resolve-only", fields[0])
+		r.noAAAA = false
+	}
+	if r.plainDNS && (r.block || r.resolveOnly) {
+		log.Errorf("%s: plain-dns goes with neither block nor resolve-only", fields[0])
+		r.plainDNS = false
+	}
+	if r.verifyName != "" && (r.frontVerify || r.noVerify) {
+		log.Errorf("%s: verify-name goes with neither front-verify nor verify=off", fields[0])
+		r.frontVerify, r.noVerify = false, false
+	}
+	return domain, r
+}
+
+// String is r as a line parseRule reads back into the same rule, options in
+// a fixed order.
+func (r *rule) String() string {
+	fields := []string{r.domain}
+	add := func(cond bool, opt string) {
+		if cond {
+			fields = append(fields, opt)
+		}
+	}
+	add(len(r.routes) > 0, "route="+strings.Join(r.routes, ","))
+	add(r.front != "", "front="+r.front)
+	add(r.frontVerify, "front-verify=front")
+	add(r.frontIPs, "front-ips")
+	add(r.verifyName != "", "verify-name="+r.verifyName)
+	add(r.noVerify, "verify=off")
+	add(r.clientCert != "", "client-cert="+r.clientCert+" client-key="+r.clientKey)
+	add(r.family != famDefault, "family="+r.family.String())
+	add(r.block, "block")
+	add(r.resolveOnly, "resolve-only")
+	add(r.noAAAA, "noaaaa")
+	add(r.plainDNS, "plain-dns")
+	add(r.paranoid, "paranoid")
+	add(r.warm, "warm")
+	add(r.capture, "capture")
+	add(r.dialTimeout > 0, "dial-timeout="+r.dialTimeout.String())
+	add(r.handshakeTimeout > 0, "handshake-timeout="+r.handshakeTimeout.String())
+	add(r.sticky && r.stickyTtl == 0, "sticky")
+	add(r.sticky && r.stickyTtl > 0, "sticky="+r.stickyTtl.String())
+	fields = append(fields, r.limits.opts()...)
+	add(r.ttl > 0, "ttl="+r.ttl.String())
+	add(r.priority != 0, "priority="+strconv.Itoa(r.priority))
+	return strings.Join(fields, " ")
+}
+
+// forwarded reports whether r has its name forwarded rather than proxied,
+// for a noaaaa or plain-dns option.
+func (r *rule) forwarded() bool {
+	return r.noAAAA || r.plainDNS
+}
+
+// verifyOverride is how r changes what the upstream cert is checked
+// against, for the access log: "" when it doesn't.
+func (r *rule) verifyOverride() string {
+	switch {
+	case r.noVerify:
+		return "off"
+	case r.verifyName != "":
+		return "name=" + r.verifyName
+	}
+	return ""
+}
+
+// timeouts are the dial timeouts of r, the global one where it sets none.
+func (r *rule) timeouts() dialTimeouts {
+	t := dialTimeouts{dialTimeout, dialTimeout}
+	if r.dialTimeout > 0 {
+		t.dial = r.dialTimeout
+	}
+	if r.handshakeTimeout > 0 {
+		t.handshake = r.handshakeTimeout
+	}
+	return t
+}
+
+// dialer returns d, fronted if the rule says so.
+func (r *rule) dialer(d dialer) dialer {
+	if r.front == "" {
+		return d
+	}
+	return frontDialer{dialer: d, front: r.front}
+}
+
+// ruleInfo is the admin API view of a rule.
+type ruleInfo struct {
+	Domain   string   `json:"domain"`
+	Group    string   `json:"group,omitempty"`
+	Routes   []string `json:"routes,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Front    string   `json:"front,omitempty"`
+	Block    bool     `json:"block,omitempty"`
+	Capture  bool     `json:"capture,omitempty"`
+	Resolve  bool     `json:"resolve_only,omitempty"`
+	NoAAAA   bool     `json:"noaaaa,omitempty"`
+	PlainDNS bool     `json:"plain_dns,omitempty"`
+	Sticky   string   `json:"sticky,omitempty"`
+	Source   string   `json:"source"`
+	Line     int      `json:"line"`
+}
+
+func (r *rule) info() *ruleInfo {
+	info := &ruleInfo{
+		Domain:   r.domain,
+		Group:    r.group,
+		Routes:   r.routes,
+		Priority: r.priority,
+		Front:    r.front,
+		Block:    r.block,
+		Capture:  r.capture,
+		Resolve:  r.resolveOnly,
+		NoAAAA:   r.noAAAA,
+		PlainDNS: r.plainDNS,
+		Source:   r.source,
+		Line:     r.line,
+	}
+	if d := stickyFor(r); d > 0 {
+		info.Sticky = d.String()
+	}
+	return info
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ruleSources are merged in order, a later source overriding an earlier one
+// for the same domain. Entries are file paths or http(s) URLs of plain lists
+// or base64 gfwlists, plugin:name for a registered RuleSource, peer: for
+// the rules of peerURL, or runtime: for those added through the admin API.
+var ruleSources = []string{configFile, runtimePrefix}
+
+var (
+	sourceLock   sync.Mutex
+	sourceLines  = make(map[string][]string)  // last good content of each source
+	sourceLoaded = make(map[string]time.Time) // when it was read
+	sourceErrors = make(map[string]string)    // why the last read failed, if it did
+)
+
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// refreshSources reads the given sources. Remote sources are only fetched
+// when refetch is set, otherwise their last content is reused; a source that
+// fails to load also keeps its last content.
+func refreshSources(sources []string, refetch bool) {
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
+	done := make(map[string]bool)
+	for _, src := range sources {
+		if done[src] {
+			continue // shared by several views
+		}
+		done[src] = true
+		if _, ok := sourceLines[src]; ok && isRemote(src) && !refetch {
+			continue
+		}
+		fresh, err := readSource(src)
+		if err != nil {
+			log.Errorf("rule source %s: %s", src, err)
+			sourceErrors[src] = err.Error()
+			continue
+		}
+		sourceLines[src] = fresh
+		sourceLoaded[src] = time.Now()
+		delete(sourceErrors, src)
+	}
+}
+
+// compileRules merges the last content of sources, a later source
+// overriding an earlier one, and also returns every parsed rule in merge order.
+func compileRules(sources []string) (map[string]*rule, []*rule) {
+	return compileReplacing(sources, "", nil)
+}
+
+// compileReplacing is compileRules with the lines of source src taken to be
+// lines instead of what was read from it.
+func compileReplacing(sources []string, src string, lines []string) (map[string]*rule, []*rule) {
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
+	merged := make(map[string]*rule)
+	var all []*rule
+	for _, s := range sources {
+		read := sourceLines[s]
+		if s == src {
+			read = lines
+		}
+		own, parsed := compileSource(s, read)
+		all = append(all, parsed...)
+		for domain, r := range own {
+			merged[domain] = r
+		}
+	}
+	return merged, all
+}
+
+// compileSource parses the lines of one source, expanding group rules; within
+// a source the higher priority wins, then the later line.
+func compileSource(src string, lines []string) (map[string]*rule, []*rule) {
+	own := make(map[string]*rule)
+	var all []*rule
+	for n, line := range lines {
+		expanded, group := expandGroup(line)
+		for _, line := range expanded {
+			domain, r := parseRule(line)
+			if domain == "" {
+				continue
+			}
+			r.domain, r.source, r.line, r.group = domain, src, n+1, group
+			all = append(all, r)
+			if old, ok := own[domain]; ok && old.priority > r.priority {
+				continue
+			}
+			own[domain] = r
+		}
+	}
+	return own, all
+}
+
+func readSource(src string) (lines []string, err error) {
+	s, err := sourceFor(src)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			lines, err = nil, fmt.Errorf("panic: %v", p) // a plugin's
+		}
+	}()
+	return s.Rules()
+}
+
+// sourceData splits the content of a source into lines, decoding gfwlists.
+func sourceData(data []byte) ([]string, error) {
+	if lines, ok := decodeGfwlist(data); ok {
+		return lines, nil
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func fetchRemote(url string) ([]byte, error) {
+	cli := &http.Client{Timeout: 30 * time.Second, Transport: fetchTransport}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// decodeGfwlist turns a base64 AutoProxy list into plain domain lines, keeping
+// only domain rules ("||example.com", ".example.com", "|http://example.com").
+// Exceptions and regex rules have no domain-list equivalent and are dropped.
+func decodeGfwlist(data []byte) ([]string, bool) {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil || !bytes.HasPrefix(raw, []byte("[AutoProxy")) {
+		return nil, false
+	}
+	var lines []string
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '!', line[0] == '[', line[0] == '/', strings.HasPrefix(line, "@@"):
+			continue
+		case strings.HasPrefix(line, "||"):
+			line = line[2:]
+		case strings.HasPrefix(line, "|"):
+			line = strings.TrimPrefix(strings.TrimPrefix(line[1:], "http://"), "https://")
+		case line[0] == '.':
+			line = line[1:]
+		}
+		if i := strings.IndexAny(line, "/*:%"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.IndexByte(line, '.') < 0 {
+			continue
+		}
+		if _, ok := seen[line]; !ok {
+			seen[line] = struct{}{}
+			lines = append(lines, line)
+		}
+	}
+	return lines, true
+}
+
+// localSources lists the files whose changes trigger a reload.
+func localSources() []string {
+	ret := append([]string{}, currentSettings().files...)
+	ret = append(ret, ipRulesFile, viewsFile, groupsFile, subjectFile)
+	if shadowFile != "" && !isRemote(shadowFile) {
+		ret = append(ret, shadowFile)
+	}
+	if errorPageFile != "" {
+		ret = append(ret, errorPageFile)
+	}
+	if suffixFile != "" {
+		ret = append(ret, suffixFile)
+	}
+	seen := make(map[string]bool)
+	for _, v := range currentViews().views {
+		for _, src := range v.sources {
+			if !isRemote(src) && !strings.HasPrefix(src, pluginPrefix) && src != peerPrefix && src != runtimePrefix && !seen[src] {
+				seen[src] = true
+				ret = append(ret, src)
+			}
+		}
+		for _, r := range v.table {
+			for _, f := range []string{r.clientCert, r.clientKey} {
+				if f != "" && !seen[f] {
+					seen[f] = true
+					ret = append(ret, f)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func hasRemote() bool {
+	for _, v := range currentViews().views {
+		for _, src := range v.sources {
+			if isRemote(src) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func statAll(files []string) []os.FileInfo {
+	ret := make([]os.FileInfo, len(files))
+	for i, f := range files {
+		ret[i], _ = os.Stat(f)
+	}
+	return ret
+}
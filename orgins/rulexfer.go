@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// exportedRule is a rule in the json export format. Only Rule is read back
+// on import, the rest is there for whoever reads the export.
+type exportedRule struct {
+	Domain  string     `json:"domain"`
+	Action  string     `json:"action"` // proxy, block, resolve-only, noaaaa or plain-dns
+	Routes  []string   `json:"routes,omitempty"`
+	Rule    string     `json:"rule"` // the line, as in configFile
+	Group   string     `json:"group,omitempty"`
+	Source  string     `json:"source"`
+	Line    int        `json:"line"`
+	AddedAt *time.Time `json:"added_at,omitempty"` // last changed, as far as this process knows
+}
+
+// sortedRules returns the rules of table by domain.
+func sortedRules(table map[string]*rule) []*rule {
+	ret := make([]*rule, 0, len(table))
+	for _, r := range table {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].domain < ret[j].domain })
+	return ret
+}
+
+// exportRules writes table in format: plain lines as in configFile,
+// gfwlist (AutoProxy, proxied domains only, options dropped) or json.
+func exportRules(table map[string]*rule, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "", "plain":
+		for _, r := range sortedRules(table) {
+			buf.WriteString(r.String() + "\n")
+		}
+	case "gfwlist":
+		var list bytes.Buffer
+		list.WriteString("[AutoProxy 0.2.9]\n")
+		for _, r := range sortedRules(table) {
+			if !r.block && !r.forwarded() {
+				list.WriteString("||" + r.domain + "\n")
+			}
+		}
+		enc := base64.StdEncoding.EncodeToString(list.Bytes())
+		for len(enc) > 64 {
+			buf.WriteString(enc[:64] + "\n")
+			enc = enc[64:]
+		}
+		buf.WriteString(enc + "\n")
+	case "json":
+		ret := []exportedRule{}
+		for _, r := range sortedRules(table) {
+			e := exportedRule{Domain: r.domain, Action: "proxy", Routes: r.routes, Rule: r.String(),
+				Group: r.group, Source: r.source, Line: r.line}
+			if r.block {
+				e.Action = "block"
+			} else if r.resolveOnly {
+				e.Action = "resolve-only"
+			} else if r.noAAAA {
+				e.Action = "noaaaa"
+			} else if r.plainDNS {
+				e.Action = "plain-dns"
+			}
+			if !r.since.IsZero() {
+				since := r.since
+				e.AddedAt = &since
+			}
+			ret = append(ret, e)
+		}
+		data, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(data, '\n'))
+	default:
+		return nil, fmt.Errorf("unknown format %s, plain, gfwlist or json", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// importLines turns data in format, "" to tell from the data, into rule
+// lines.
+func importLines(data []byte, format string) ([]string, error) {
+	if format == "" {
+		switch trimmed := bytes.TrimSpace(data); {
+		case bytes.HasPrefix(trimmed, []byte("[")) && json.Valid(trimmed):
+			format = "json"
+		default:
+			format = "plain" // sourceData tells gfwlists apart itself
+		}
+	}
+	switch format {
+	case "plain", "gfwlist":
+		lines, err := sourceData(data)
+		if err == nil && format == "gfwlist" {
+			if _, ok := decodeGfwlist(data); !ok {
+				return nil, fmt.Errorf("not a gfwlist")
+			}
+		}
+		return lines, err
+	case "json":
+		var rules []exportedRule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, err
+		}
+		lines := make([]string, len(rules))
+		for i, e := range rules {
+			lines[i] = e.Rule
+		}
+		return lines, nil
+	}
+	return nil, fmt.Errorf("unknown format %s, plain, gfwlist or json", format)
+}
+
+// ruleDiff is what an import changes in the rules of configFile.
+type ruleDiff struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Changed  []string `json:"changed"`
+	Same     int      `json:"unchanged"`
+	Rejected int      `json:"rejected"` // lines that didn't parse, see the log
+	Applied  bool     `json:"applied"`
+}
+
+func diffRules(old, new map[string]*rule) *ruleDiff {
+	d := &ruleDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for domain, r := range new {
+		o, ok := old[domain]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, domain)
+		case o.signature() != r.signature():
+			d.Changed = append(d.Changed, domain)
+		default:
+			d.Same++
+		}
+	}
+	for domain := range old {
+		if _, ok := new[domain]; !ok {
+			d.Removed = append(d.Removed, domain)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+// exportHandler is GET /rules/export?format=plain|gfwlist|json[&view=name],
+// the effective rules of a view, default unless view= is given.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("view")
+	if name == "" {
+		name = "default"
+	}
+	v := viewByName(name)
+	if v == nil {
+		http.Error(w, "no view "+name, http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	data, err := exportRules(v.table, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_, _ = w.Write(data)
+}
+
+// importHandler is POST /rules/import[?format=plain|gfwlist|json][&dry_run=1]
+// with the rules as the body or its "file" part. They replace configFile
+// and are reloaded, unless dry_run; either way the answer is the diff.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<20)
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			http.Error(w, ferr.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err = ioutil.ReadAll(f)
+		_ = f.Close()
+	} else {
+		data, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines, err := importLines(data, r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sourceLock.Lock()
+	old, _ := compileSource(configFile, sourceLines[configFile])
+	sourceLock.Unlock()
+	fresh, parsed := compileSource(configFile, lines)
+	d := diffRules(old, fresh)
+	ok := make(map[int]bool)
+	for _, r := range parsed {
+		ok[r.line] = true
+	}
+	for n, line := range lines {
+		if f := strings.Fields(line); len(f) > 0 && !strings.HasPrefix(f[0], "#") && !ok[n+1] {
+			d.Rejected++
+		}
+	}
+	if r.URL.Query().Get("dry_run") != "1" {
+		if err := writeRulesFile(lines); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("rules imported: %d added, %d removed, %d changed", len(d.Added), len(d.Removed), len(d.Changed))
+		updateConfig(false)
+		d.Applied = true
+	}
+	writeJSON(w, d)
+}
+
+// writeRulesFile replaces configFile with lines, through a rename so the
+// poller never reads it half written.
+func writeRulesFile(lines []string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), ".import-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(configFile); err == nil {
+		_ = os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), configFile)
+}
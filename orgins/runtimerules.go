@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// runtimePrefix names the rules added at runtime as a rule source. It's the
+// last of the default ruleSources, so they override the static ones.
+const runtimePrefix = "runtime:"
+
+// journalEntry is one line of runtimeFile: a rule line added, or the rule
+// of a domain removed.
+type journalEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"` // add or remove
+	Domain string    `json:"domain"`
+	Line   string    `json:"line,omitempty"`
+	Source string    `json:"source"` // who made the change, e.g. admin
+}
+
+// runtimeStore is the rules added at runtime, kept in an append-only
+// journal rather than written into configFile, so a reload racing a write
+// or a crash in the middle of one can't corrupt the static rules. A change
+// is acknowledged only once its journal line is synced; replaying the
+// journal at startup gets back every acknowledged change, and a torn last
+// line from a crash is cut off.
+type runtimeStore struct {
+	mu      sync.Mutex
+	path    string
+	f       journalFile
+	domains []string          // in the order they were added
+	lines   map[string]string // by domain
+	entries int               // in the journal, for compaction
+}
+
+var runtimeRules = newRuntimeStore(runtimeFile)
+
+// journalFile is what the journal is appended to, an *os.File.
+type journalFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Close() error
+}
+
+func newRuntimeStore(path string) *runtimeStore {
+	return &runtimeStore{path: path, lines: make(map[string]string)}
+}
+
+// Rules is the runtime: rule source.
+func (s *runtimeStore) Rules() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0, len(s.domains))
+	for _, d := range s.domains {
+		ret = append(ret, s.lines[d])
+	}
+	return ret, nil
+}
+
+func (*runtimeStore) Changed() <-chan struct{} { return nil }
+
+// open replays the journal and opens it for appending. A last line without
+// its newline or not parsing is what a crash mid-write leaves, and is cut
+// off; a bad line before it is skipped.
+func (s *runtimeStore) open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	good := 0 // bytes up to the end of the last good line
+	for off := 0; off < len(data); {
+		end := bytes.IndexByte(data[off:], '\n')
+		if end < 0 {
+			break // torn tail
+		}
+		line := data[off : off+end]
+		off += end + 1
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil || (e.Op != "add" && e.Op != "remove") {
+			if off == len(data) {
+				break // torn tail that happened to end in a newline
+			}
+			log.Errorf("%s: skipped bad entry %q", s.path, line)
+			good = off
+			continue
+		}
+		s.apply(e)
+		good = off
+	}
+	if good < len(data) {
+		log.Warnf("%s: cut off %d bytes of an incomplete last entry", s.path, len(data)-good)
+		if err := os.Truncate(s.path, int64(good)); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	log.Infof("%s: %d runtime rules from %d entries", s.path, len(s.domains), s.entries)
+	return nil
+}
+
+// apply changes the rules by e. Called with mu held.
+func (s *runtimeStore) apply(e journalEntry) {
+	s.entries++
+	_, had := s.lines[e.Domain]
+	switch {
+	case e.Op == "add" && !had:
+		s.domains = append(s.domains, e.Domain)
+		s.lines[e.Domain] = e.Line
+	case e.Op == "add":
+		s.lines[e.Domain] = e.Line
+	case had:
+		delete(s.lines, e.Domain)
+		for i, d := range s.domains {
+			if d == e.Domain {
+				s.domains = append(s.domains[:i], s.domains[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// record appends es to the journal and syncs it, then applies them. Nothing
+// is applied if the write or sync fails, and what was written of them is cut
+// off so the next entry doesn't follow a torn line.
+func (s *runtimeStore) record(es ...journalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("runtime rules not loaded")
+	}
+	var buf bytes.Buffer
+	for _, e := range es {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return s.cutBack(fi.Size(), err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return s.cutBack(fi.Size(), err)
+	}
+	for _, e := range es {
+		s.apply(e)
+	}
+	return nil
+}
+
+// cutBack truncates the journal to size, where it ended before a write that
+// failed with err. If it can't, the journal is closed: appending after a
+// torn line would lose the entry it's merged into at the next replay.
+// Called with mu held.
+func (s *runtimeStore) cutBack(size int64, err error) error {
+	if terr := s.f.Truncate(size); terr != nil {
+		log.Errorf("%s: torn entry not cut off, runtime rules can't change until restarted: %s", s.path, terr)
+		_ = s.f.Close()
+		s.f = nil
+	}
+	return err
+}
+
+// compact rewrites the journal as one add per rule, if it's grown to more
+// than twice that. The new journal is synced before it replaces the old,
+// and the directory after, so a crash leaves one or the other.
+func (s *runtimeStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil || s.entries <= 2*len(s.domains)+runtimeCompactMin {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".runtime-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	w := bufio.NewWriter(tmp)
+	now := time.Now()
+	for _, d := range s.domains {
+		data, err := json.Marshal(journalEntry{Time: now, Op: "add", Domain: d, Line: s.lines[d], Source: "compaction"})
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		_, _ = w.Write(data)
+		_ = w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_ = s.f.Close()
+	log.Infof("%s: compacted %d entries to %d", s.path, s.entries, len(s.domains))
+	s.f, s.entries = f, len(s.domains)
+	return nil
+}
+
+// loadRuntimeRules replays runtimeFile, and compacts it every
+// runtimeCompactEvery from then on.
+func loadRuntimeRules() error {
+	if err := runtimeRules.open(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := runtimeRules.compact(); err != nil {
+				logThrottled.Errorf("runtime compact", "%s: %s", runtimeFile, err)
+			}
+			time.Sleep(runtimeCompactEvery)
+		}
+	}()
+	return nil
+}
+
+// runtimeHandler is /rules/runtime: GET lists the runtime rules, POST adds
+// the rule lines of the body, replacing those of the same domains, DELETE
+// removes the rule of ?domain=. Changes are answered once they're synced
+// to the journal, and reloaded right after.
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		lines, _ := runtimeRules.Rules()
+		writeJSON(w, lines)
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var es []journalEntry
+		var added []string
+		for _, line := range strings.Split(string(data), "\n") {
+			domain, ru := parseRule(line)
+			if ru == nil {
+				if f := strings.Fields(line); len(f) > 0 && !strings.HasPrefix(f[0], "#") {
+					http.Error(w, "not a rule: "+line, http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+			ru.domain = domain
+			es = append(es, journalEntry{Time: time.Now(), Op: "add", Domain: domain, Line: ru.String(), Source: "admin"})
+			added = append(added, domain)
+		}
+		if len(es) == 0 {
+			http.Error(w, "no rules in the body", http.StatusBadRequest)
+			return
+		}
+		if err := runtimeRules.record(es...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("runtime rules added: %s", strings.Join(added, ", "))
+		updateConfig(false)
+		writeJSON(w, map[string][]string{"added": added})
+	case http.MethodDelete:
+		domain, ok := normalizeHost(r.URL.Query().Get("domain"))
+		if !ok {
+			http.Error(w, "domain= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		runtimeRules.mu.Lock()
+		_, had := runtimeRules.lines[domain]
+		runtimeRules.mu.Unlock()
+		if !had {
+			http.Error(w, "no runtime rule for "+domain, http.StatusNotFound)
+			return
+		}
+		if err := runtimeRules.record(journalEntry{Time: time.Now(), Op: "remove", Domain: domain, Source: "admin"}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("runtime rule removed: %s", domain)
+		updateConfig(false)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
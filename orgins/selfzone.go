@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// selfAddrs are the addresses the listeners are bound to, answered for
+// selfName. No async r & w so ok.
+var selfAddrs []net.IP
+
+// updateSelfAddrs derives selfAddrs from the listen addresses, expanding
+// wildcard binds to the addresses of the interfaces.
+func updateSelfAddrs() {
+	var ret []net.IP
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ret = append(ret, ip)
+		}
+	}
+	var listens []string
+	for _, l := range []struct {
+		addr    string
+		enabled bool
+	}{{*tlsListen, enableTLS}, {*httpListen, enableHTTP}, {currentSettings().adminAddr, enableAdmin}} {
+		if l.enabled {
+			listens = append(listens, l.addr)
+		}
+	}
+	for _, l := range listens {
+		host, _, err := net.SplitHostPort(l)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if host == "" || ip != nil && ip.IsUnspecified() {
+			ifAddrs, err := net.InterfaceAddrs()
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			for _, a := range ifAddrs {
+				n, ok := a.(*net.IPNet)
+				if !ok || n.IP.IsLinkLocalUnicast() || ip != nil && (ip.To4() != nil) != (n.IP.To4() != nil) {
+					continue
+				}
+				add(n.IP)
+			}
+			continue
+		}
+		if ip != nil {
+			add(ip)
+			continue
+		}
+		ips, err := bootstrapResolver.LookupIP(context.Background(), "ip", host)
+		if err != nil {
+			log.Errorf("listen address %s: %s", l, err)
+			continue
+		}
+		for _, ip := range ips {
+			add(ip)
+		}
+	}
+	selfAddrs = ret
+}
+
+// answerSelf answers authoritatively for selfName and checkHost with the
+// listener addresses, and NXDOMAIN for other names under selfName.
+func answerSelf(m *dns.Msg) (*dns.Msg, bool) {
+	q := m.Question[0]
+	name := strings.TrimSuffix(q.Name, ".")
+	if selfName == "" || !underDomain(name, selfName) {
+		return nil, false
+	}
+	msg := new(dns.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+	if !strings.EqualFold(name, selfName) && !strings.EqualFold(name, checkHost()) {
+		msg.Rcode = dns.RcodeNameError
+		return msg, true
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	for _, ip := range selfAddrs {
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return msg, true
+}
+
+// selfAdminAllowed tells whether a client may use the admin API through
+// selfName: the same clients that can reach adminAddr. Beyond loopback the
+// handshake has checked their client certificate already.
+func selfAdminAllowed(client net.Addr) bool {
+	host, _, err := net.SplitHostPort(currentSettings().adminAddr)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return true
+	}
+	a, ok := client.(*net.TCPAddr)
+	return ok && a.IP.IsLoopback()
+}
+
+// serveSelf serves the admin API on a TLS connection made to selfName, and
+// returns when the client is done. conn is left open for the caller to close.
+func serveSelf(conn net.Conn) {
+	if !selfAdminAllowed(conn.RemoteAddr()) {
+		log.Infof("%s: admin API through %s refused", conn.RemoteAddr(), selfName)
+		return
+	}
+	serveHTTP(conn, adminHandler())
+}
+
+// serveHTTP serves h on one connection until the client is done with it.
+func serveHTTP(conn net.Conn, h http.Handler) {
+	l := &oneConnListener{conn: conn, done: make(chan struct{})}
+	srv := &http.Server{Handler: h, IdleTimeout: time.Minute}
+	_ = srv.Serve(l)
+}
+
+// oneConnListener hands a single connection to an http.Server, then blocks
+// until the server is done with it.
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return &doneConn{Conn: c, l: l}, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *oneConnListener) Close() error { return nil }
+
+func (l *oneConnListener) Addr() net.Addr { return dummyAddr{} }
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return selfName }
+
+// doneConn tells its listener it's finished instead of closing.
+type doneConn struct {
+	net.Conn
+	l *oneConnListener
+}
+
+func (c *doneConn) Close() error {
+	c.l.once.Do(func() { close(c.l.done) })
+	return nil
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	configPath = flag.String("config", "",
+		"structured config `file` with its includes, see settings; without it the constants, flags and CONF_*.ini files are all there is")
+	convertConfig = flag.Bool("convert-config", false,
+		"print the config file equivalent to the constants, flags and CONF_*.ini files in use, and exit")
+)
+
+// settings are one snapshot of the config file, in TOML:
+//
+//	include = ["routes.toml"]
+//
+//	[listeners]
+//	dns = "localhost:53"
+//	tls = "localhost:443"
+//	http = "localhost:80"
+//
+//	[resolvers]
+//	plain = "114.114.114.114:53"
+//	secure = "8.8.8.8:853"
+//	paranoid = ""
+//
+//	[routes]
+//	wg = "socks addr=127.0.0.1:1081 mss=1240 max-life=6h"
+//
+//	[rules]
+//	sources = ["CONF_DOMS.ini", "runtime:"]
+//
+//	[limits]
+//	max_conns = 0
+//	relay_idle = "0s"
+//	relay_max_life = "6h"
+//	relay_one_way = "2m"
+//	caches_max_memory = "16MB"
+//
+//	[logging]
+//	level = "info"
+//	sightings_retention = "720h"
+//
+//	[admin]
+//	addr = "localhost:8053"
+//
+//	[fingerprints]
+//	6734f37431670b3ab4292b8f60f29984 = "block"
+//
+//	[restarts]
+//	tls = "tries=5 backoff=1s"
+//
+// Only strings, integers and one-line lists of strings are understood,
+// which is all it needs. Keys left out keep the value of the constant or
+// flag they stand for; listen flags given on the command line beat the
+// file. Routes are as in routesFile with the name as the key, the rule
+// sources those of the default view as in ruleSources, the fingerprints
+// as in fingerprintPolicy, the restarts by component as parseRestartPolicy
+// reads them. Resolvers are IPs, bootstrapResolver says what else takes
+// hostnames.
+//
+// A snapshot is never changed once stored: a reload parses and checks the
+// file and its includes into a fresh one and swaps it in whole, or keeps
+// the last good one if anything is wrong. Listeners, resolvers, max_conns
+// and the admin addr are only read at startup and keep their values.
+// Without -config the snapshot is made of the constants, the flags and
+// routesFile.
+type settings struct {
+	files []string // what it was read from, watched for changes
+
+	dnsListen, tlsListen, httpListen string
+	plainDNS, secureDNS, paranoidDNS string
+	adminAddr                        string
+	maxConns                         int64
+
+	routeSpecs  map[string]string // by name, as loadRoutes returns them
+	routes      map[string]route  // compiled from routeSpecs
+	sources     []string
+	limits      relayLimits // global ones, the relay_* keys
+	cacheBudget int64       // bytes, caches_max_memory
+	logLevel    log.Level
+	// how long a name not seen again is kept in sightings,
+	// sightings_retention
+	sightingsRetention time.Duration
+
+	fingerprints map[string]fingerprintPolicy // by clientFingerprint
+	restarts     map[string]restartPolicy     // by component, those not the default
+
+	// constants there are no keys for, read per query: in the snapshot so
+	// the tests can change them under a running server
+	caseCheck      bool   // caseRandomize
+	privateForward bool   // privateDNS
+	querySample    int64  // queryLogSample
+	provenanceCode uint16 // provenanceOption
+	localZone      string
+}
+
+var settingsCur atomic.Value // *settings
+
+// currentSettings is the snapshot handlers read, the built-in one until
+// setup stores one.
+func currentSettings() *settings {
+	if s, ok := settingsCur.Load().(*settings); ok {
+		return s
+	}
+	return builtinSettings()
+}
+
+func builtinSettings() *settings {
+	return &settings{
+		dnsListen:   *dnsListen,
+		tlsListen:   *tlsListen,
+		httpListen:  *httpListen,
+		plainDNS:    defDNS,
+		secureDNS:   gfwDNS,
+		paranoidDNS: paranoidDNS,
+		adminAddr:   adminAddr,
+		maxConns:    maxConns,
+		routeSpecs:  map[string]string{},
+		routes:      builtinRoutes(),
+		sources:     ruleSources,
+		limits:      relayLimits{idle: relayIdle, maxLife: relayMaxLife, oneWay: relayOneWay},
+		cacheBudget: cachesMaxMemory,
+		logLevel:    logLevel,
+
+		sightingsRetention: sightingsRetention,
+
+		fingerprints: map[string]fingerprintPolicy{},
+		restarts:     map[string]restartPolicy{},
+
+		caseCheck:      caseRandomize,
+		privateForward: privateDNS,
+		querySample:    queryLogSample,
+		provenanceCode: provenanceOption,
+		localZone:      localZone,
+	}
+}
+
+// legacySettings are the settings without -config, from the constants,
+// flags and routesFile. What's wrong with a route is logged and skipped, as
+// it always was.
+func legacySettings() *settings {
+	s := builtinSettings()
+	s.files = []string{routesFile}
+	s.routeSpecs = loadRoutes()
+	var bad []string
+	s.routes, bad = compileRoutes(s.routeSpecs)
+	for _, b := range bad {
+		log.Error(b)
+	}
+	return s
+}
+
+// loadSettings reads the settings as they are now, from -config if set.
+func loadSettings() (*settings, error) {
+	if *configPath == "" {
+		return legacySettings(), nil
+	}
+	s, err := parseSettings(*configPath, ioutil.ReadFile)
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dns-listen":
+			s.dnsListen = *dnsListen
+		case "tls-listen":
+			s.tlsListen = *tlsListen
+		case "http-listen":
+			s.httpListen = *httpListen
+		}
+	})
+	return s, nil
+}
+
+// setupSettings stores the first snapshot and applies what's only read at
+// startup.
+func setupSettings() error {
+	s, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	*dnsListen, *tlsListen, *httpListen = s.dnsListen, s.tlsListen, s.httpListen
+	defResolver, gfwResolver, paranoidResolver = s.plainDNS, s.secureDNS, s.paranoidDNS
+	if defResolver != defDNS || gfwResolver != gfwDNS {
+		upstreams = []*upstream{
+			newUpstream(defResolver, "udp", nil),
+			newUpstream(gfwResolver, "tcp-tls", nil),
+		}
+	}
+	storeSettings(s)
+	return nil
+}
+
+// reloadSettings swaps in the settings as they are now, or keeps the last
+// good ones if anything is wrong with them. What's only read at startup
+// keeps its value, with a warning if the file changed it.
+func reloadSettings() {
+	s, err := loadSettings()
+	if err != nil {
+		log.Errorf("config not reloaded, keeping the last good one: %s", err)
+		metricAdd("config_reload_failures_total", 1)
+		return
+	}
+	old := currentSettings()
+	for _, f := range []struct {
+		key      string
+		was, now *string
+	}{
+		{"listeners.dns", &old.dnsListen, &s.dnsListen},
+		{"listeners.tls", &old.tlsListen, &s.tlsListen},
+		{"listeners.http", &old.httpListen, &s.httpListen},
+		{"resolvers.plain", &old.plainDNS, &s.plainDNS},
+		{"resolvers.secure", &old.secureDNS, &s.secureDNS},
+		{"resolvers.paranoid", &old.paranoidDNS, &s.paranoidDNS},
+		{"admin.addr", &old.adminAddr, &s.adminAddr},
+	} {
+		if *f.now != *f.was {
+			log.Warnf("%s changed to %q, that takes a restart", f.key, *f.now)
+			*f.now = *f.was
+		}
+	}
+	if s.maxConns != old.maxConns {
+		log.Warnf("limits.max_conns changed to %d, that takes a restart", s.maxConns)
+		s.maxConns = old.maxConns
+	}
+	storeSettings(s)
+}
+
+func storeSettings(s *settings) {
+	settingsCur.Store(s)
+	log.SetLevel(s.logLevel)
+}
+
+// settingsError is everything wrong with a config file and its includes,
+// one problem per entry.
+type settingsError []string
+
+func (e settingsError) Error() string { return strings.Join(e, "; ") }
+
+// settingsParser reads a config file and its includes into s.
+type settingsParser struct {
+	s    *settings
+	read func(name string) ([]byte, error)
+	at   map[string]string // section.key -> where it was set
+	bad  settingsError
+}
+
+// parseSettings reads the config file name and its includes with read into
+// a fresh snapshot, starting from the built-in settings. A file read fails
+// with the error of the read, anything wrong in them with a settingsError.
+func parseSettings(name string, read func(name string) ([]byte, error)) (*settings, error) {
+	p := &settingsParser{s: builtinSettings(), read: read, at: make(map[string]string)}
+	if err := p.file(name); err != nil {
+		return nil, err
+	}
+	var bad []string
+	p.s.routes, bad = compileRoutes(p.s.routeSpecs)
+	p.bad = append(p.bad, bad...)
+	for fp, pol := range p.s.fingerprints {
+		if _, ok := p.s.routes[pol.route]; pol.route != "" && !ok {
+			p.bad = append(p.bad, "fingerprint "+fp+": unknown route "+pol.route)
+		}
+	}
+	if len(p.bad) > 0 {
+		return nil, p.bad
+	}
+	return p.s, nil
+}
+
+var settingsSections = map[string]bool{
+	"listeners": true, "resolvers": true, "routes": true, "rules": true,
+	"limits": true, "logging": true, "admin": true, "fingerprints": true,
+	"restarts": true,
+}
+
+func (p *settingsParser) file(name string) error {
+	for _, f := range p.s.files {
+		if f == name {
+			p.bad = append(p.bad, name+" is included twice")
+			return nil
+		}
+	}
+	data, err := p.read(name)
+	if err != nil {
+		return err
+	}
+	p.s.files = append(p.s.files, name)
+
+	section, skip := "", false
+	for n, line := range strings.Split(string(data), "\n") {
+		at := name + ":" + strconv.Itoa(n+1)
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !commentOnly(line[end+1:]) {
+				p.bad = append(p.bad, at+": bad section header")
+				section, skip = "", true
+				continue
+			}
+			section = strings.TrimSpace(line[1:end])
+			skip = !settingsSections[section]
+			if skip {
+				p.bad = append(p.bad, at+": unknown section "+section)
+			}
+			continue
+		}
+		if skip {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			p.bad = append(p.bad, at+": want key = value")
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		v, err := parseSettingValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			p.bad = append(p.bad, at+": "+key+": "+err.Error())
+			continue
+		}
+		full := section + "." + key
+		if prev, ok := p.at[full]; ok {
+			p.bad = append(p.bad, at+": "+key+" already set at "+prev)
+			continue
+		}
+		p.at[full] = at
+		if full == ".include" {
+			if !v.list {
+				p.bad = append(p.bad, at+": include needs a list of files")
+				continue
+			}
+			for _, inc := range v.strs {
+				if err := p.file(inc); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if why := p.set(section, key, v); why != "" {
+			p.bad = append(p.bad, at+": "+key+": "+why)
+		}
+	}
+	return nil
+}
+
+// settingValue is the value of a key: one quoted string, a list of them,
+// or one bare word such as an integer.
+type settingValue struct {
+	strs       []string
+	list, bare bool
+}
+
+func (v settingValue) str() (string, bool) {
+	if v.list || v.bare {
+		return "", false
+	}
+	return v.strs[0], true
+}
+
+func parseSettingValue(raw string) (settingValue, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		q, err := strconv.QuotedPrefix(raw)
+		if err != nil || !commentOnly(raw[len(q):]) {
+			return settingValue{}, fmt.Errorf("bad string %s", raw)
+		}
+		s, _ := strconv.Unquote(q)
+		return settingValue{strs: []string{s}}, nil
+	case strings.HasPrefix(raw, "["):
+		v := settingValue{list: true}
+		rest := strings.TrimSpace(raw[1:])
+		for !strings.HasPrefix(rest, "]") {
+			q, err := strconv.QuotedPrefix(rest)
+			if err != nil || q[0] != '"' {
+				return settingValue{}, fmt.Errorf("bad list %s, only strings go in one", raw)
+			}
+			s, _ := strconv.Unquote(q)
+			v.strs = append(v.strs, s)
+			rest = strings.TrimSpace(rest[len(q):])
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return settingValue{}, fmt.Errorf("bad list %s", raw)
+			}
+		}
+		if !commentOnly(rest[1:]) {
+			return settingValue{}, fmt.Errorf("bad list %s", raw)
+		}
+		return v, nil
+	}
+	word := raw
+	if i := strings.IndexByte(word, '#'); i >= 0 {
+		word = strings.TrimSpace(word[:i])
+	}
+	if word == "" || strings.ContainsAny(word, " \t") {
+		return settingValue{}, fmt.Errorf("bad value %s", raw)
+	}
+	return settingValue{strs: []string{word}, bare: true}, nil
+}
+
+func commentOnly(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// set sets key of section to v, returning what's wrong if it can't.
+func (p *settingsParser) set(section, key string, v settingValue) string {
+	s := p.s
+	if section == "routes" {
+		spec, ok := v.str()
+		if !ok {
+			return "needs a string"
+		}
+		s.routeSpecs[key] = spec
+		return ""
+	}
+	if section == "fingerprints" {
+		spec, ok := v.str()
+		if !ok {
+			return "needs a string"
+		}
+		if !validFingerprint(key) {
+			return "isn't a fingerprint, 32 lowercase hex digits"
+		}
+		pol, why := parseFingerprintPolicy(spec)
+		s.fingerprints[key] = pol
+		return why
+	}
+	if section == "restarts" {
+		spec, ok := v.str()
+		if !ok {
+			return "needs a string"
+		}
+		var names []string
+		known := false
+		for _, c := range components {
+			names = append(names, c.name)
+			known = known || c.name == key
+		}
+		if !known {
+			return "isn't a component, one of " + strings.Join(names, ", ")
+		}
+		p, why := parseRestartPolicy(spec)
+		s.restarts[key] = p
+		return why
+	}
+	addrs := map[string]*string{
+		"listeners.tls":      &s.tlsListen,
+		"listeners.http":     &s.httpListen,
+		"resolvers.plain":    &s.plainDNS,
+		"resolvers.secure":   &s.secureDNS,
+		"resolvers.paranoid": &s.paranoidDNS,
+		"admin.addr":         &s.adminAddr,
+	}
+	full := section + "." + key
+	switch full {
+	case "listeners.dns":
+		a, ok := v.str()
+		if !ok {
+			return "needs a string"
+		}
+		for _, one := range strings.Split(a, ",") {
+			if _, _, err := net.SplitHostPort(one); err != nil {
+				return err.Error()
+			}
+		}
+		s.dnsListen = a
+	case "listeners.tls", "listeners.http", "resolvers.plain", "resolvers.secure", "resolvers.paranoid", "admin.addr":
+		a, ok := v.str()
+		if !ok {
+			return "needs a string"
+		}
+		if a != "" || full != "resolvers.paranoid" {
+			host, _, err := net.SplitHostPort(a)
+			if err != nil {
+				return err.Error()
+			}
+			if section == "resolvers" && net.ParseIP(host) == nil {
+				return "needs an IP, names are resolved with it"
+			}
+		}
+		*addrs[full] = a
+	case "rules.sources":
+		if !v.list || len(v.strs) == 0 {
+			return "needs a list of one source or more"
+		}
+		s.sources = v.strs
+	case "limits.max_conns":
+		if !v.bare {
+			return "needs a number from 0 on"
+		}
+		n, err := strconv.ParseInt(v.strs[0], 10, 64)
+		if err != nil || n < 0 {
+			return "needs a number from 0 on"
+		}
+		s.maxConns = n
+	case "limits.relay_idle", "limits.relay_max_life", "limits.relay_one_way":
+		a, ok := v.str()
+		d, err := time.ParseDuration(a)
+		if !ok || err != nil || d < 0 {
+			return "needs a duration such as \"6h\", 0 for never"
+		}
+		switch key {
+		case "relay_idle":
+			s.limits.idle = d
+		case "relay_max_life":
+			s.limits.maxLife = d
+		case "relay_one_way":
+			s.limits.oneWay = d
+		}
+		opt := strings.Replace(strings.TrimPrefix(key, "relay_"), "_", "-", 1)
+		if rng, ok := relayLimitRange[opt]; ok && d != 0 && (d < rng[0] || d > rng[1]) {
+			return "needs to be 0 or between " + rng[0].String() + " and " + rng[1].String()
+		}
+	case "limits.caches_max_memory":
+		a, ok := v.str()
+		if !ok {
+			return "needs a size such as \"16MB\", 0 for none"
+		}
+		n, err := parseByteSize(a)
+		if err != nil {
+			return err.Error()
+		}
+		s.cacheBudget = n
+	case "logging.level":
+		a, ok := v.str()
+		l, err := log.ParseLevel(a)
+		if !ok || err != nil {
+			return "needs a level such as \"info\""
+		}
+		s.logLevel = l
+	case "logging.sightings_retention":
+		a, ok := v.str()
+		d, err := time.ParseDuration(a)
+		if !ok || err != nil || d < time.Hour {
+			return "needs a duration from 1h on, such as \"720h\""
+		}
+		s.sightingsRetention = d
+	default:
+		return "unknown key in " + section
+	}
+	return ""
+}
+
+// encode is s as a config file, such that parseSettings reads it back.
+func (s *settings) encode() []byte {
+	var b bytes.Buffer
+	section := func(name string) { fmt.Fprintf(&b, "\n[%s]\n", name) }
+	set := func(key, val string) { fmt.Fprintf(&b, "%s = %s\n", key, strconv.Quote(val)) }
+
+	section("listeners")
+	set("dns", s.dnsListen)
+	set("tls", s.tlsListen)
+	set("http", s.httpListen)
+
+	section("resolvers")
+	set("plain", s.plainDNS)
+	set("secure", s.secureDNS)
+	set("paranoid", s.paranoidDNS)
+
+	section("routes")
+	var names []string
+	for name := range s.routeSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		set(name, s.routeSpecs[name])
+	}
+
+	section("rules")
+	var quoted []string
+	for _, src := range s.sources {
+		quoted = append(quoted, strconv.Quote(src))
+	}
+	fmt.Fprintf(&b, "sources = [%s]\n", strings.Join(quoted, ", "))
+
+	section("limits")
+	fmt.Fprintf(&b, "max_conns = %d\n", s.maxConns)
+	set("relay_idle", s.limits.idle.String())
+	set("relay_max_life", s.limits.maxLife.String())
+	set("relay_one_way", s.limits.oneWay.String())
+	set("caches_max_memory", formatByteSize(s.cacheBudget))
+
+	section("logging")
+	set("level", s.logLevel.String())
+	set("sightings_retention", s.sightingsRetention.String())
+
+	section("admin")
+	set("addr", s.adminAddr)
+
+	section("fingerprints")
+	var fps []string
+	for fp := range s.fingerprints {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	for _, fp := range fps {
+		set(fp, s.fingerprints[fp].String())
+	}
+
+	section("restarts")
+	var comps []string
+	for name := range s.restarts {
+		comps = append(comps, name)
+	}
+	sort.Strings(comps)
+	for _, name := range comps {
+		set(name, s.restarts[name].String())
+	}
+	return b.Bytes()
+}
+
+// runConvertConfig is -convert-config: the config file for the setup in use
+// without it, with routesFile folded in. Rule sources are still read from
+// their files, CONF_DOMS.ini included.
+func runConvertConfig() int {
+	fmt.Printf("# converted by -convert-config from the constants, flags and %s\n", routesFile)
+	if _, err := os.Stdout.Write(legacySettings().encode()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return 0
+}
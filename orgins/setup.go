@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// exit codes
+const (
+	exitFailure   = 1 // anything else
+	exitPermanent = 2 // a file is there but unusable, retrying won't help
+	exitGaveUp    = 3 // files still missing or unreadable after -wait-for-files
+	// a mandatory component failed to open or while serving
+	exitDNS  = 4
+	exitHTTP = 5
+	exitTLS  = 6
+)
+
+var waitForFiles = flag.Duration("wait-for-files", 0,
+	"keep retrying missing or unreadable CA and config files this long before giving up, e.g. while a volume is mounted")
+
+// setupError carries the exit code main should use.
+type setupError struct {
+	code int
+	err  error
+}
+
+func (e *setupError) Error() string { return e.err.Error() }
+
+func (e *setupError) Unwrap() error { return e.err }
+
+func exitCode(err error) int {
+	var se *setupError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return exitFailure
+}
+
+// isTransient tells errors that may go away by themselves, like a path that
+// isn't mounted yet, from ones that won't.
+func isTransient(err error) bool {
+	return os.IsNotExist(err) || os.IsPermission(err)
+}
+
+// retryFiles runs fn until it succeeds, fails permanently, or -wait-for-files
+// runs out, backing off between attempts.
+func retryFiles(what string, fn func() error) error {
+	deadline := time.Now().Add(*waitForFiles)
+	backoff := 100 * time.Millisecond
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return &setupError{exitPermanent, err}
+		}
+		if !time.Now().Add(backoff).Before(deadline) {
+			return &setupError{exitGaveUp, err}
+		}
+		log.Warnf("%s: %s, retry in %s", what, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// setup loads everything the listeners need, in dependency order. The rules
+// aren't among it, see loadInBackground.
+func setup() error {
+	if err := retryFiles("config", setupSettings); err != nil {
+		return err
+	}
+	fam, ok := parseFamily(addrFamily)
+	if !ok {
+		return &setupError{exitPermanent, errors.New("unknown addrFamily " + addrFamily)}
+	}
+	defaultFamily = fam
+	if err := checkPorts(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := checkResolvers(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := parseClientAllow(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := parseProvenanceClients(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := parsePoisonAddrs(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if paranoidResolver != "" {
+		upstreams = append(upstreams, newUpstream(paranoidResolver, "tcp-tls", nil))
+	}
+	if err := checkComponents(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := parseSpoofTarget(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := checkUnknownTLD(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := loadSuffixList(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := loadTrustAnchors(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := checkLocalZone(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := loadLocalZone(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if *transparent && !transparentSupported {
+		return &setupError{exitPermanent, errors.New("-transparent needs linux")}
+	}
+	if err := retryFiles("error page", loadErrorPage); err != nil {
+		return err
+	}
+	setupLimits()
+	if err := openKeyLog(); err != nil {
+		return &setupError{exitFailure, err}
+	}
+	if err := openQueryLog(); err != nil {
+		return &setupError{exitFailure, err}
+	}
+
+	if needCA() {
+		if err := setupCAKey(); err != nil {
+			return &setupError{exitPermanent, err}
+		}
+		if err := retryFiles("CA", func() error {
+			ca, err := loadCA()
+			if err != nil {
+				return err
+			}
+			caCur.Store(ca)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if _, err := getIssuer(); err != nil {
+			return &setupError{exitPermanent, err}
+		}
+	}
+	if err := loadAdminTLS(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+	if err := loadPeer(); err != nil {
+		return &setupError{exitPermanent, err}
+	}
+
+	loadClients()
+	if err := loadSightings(); err != nil {
+		return &setupError{exitFailure, err}
+	}
+	if err := loadRuntimeRules(); err != nil {
+		return &setupError{exitFailure, err}
+	}
+	if err := restoreSnapshot(); err != nil {
+		log.Warnf("upgrade: no snapshot taken over: %s", err)
+	}
+	if err := retryFiles("config", func() error {
+		_, err := os.Stat(configFile)
+		return err
+	}); err != nil {
+		return err
+	}
+	if needCA() {
+		pollingCAChange()
+		pollingExpiry()
+		startRSAPool()
+	}
+	pollingUpstreams()
+	pollingSummary()
+	pollingLogThrottle()
+	startEventWebhook()
+	watchBlocked()
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shadowSet is a candidate rule set evaluated next to the default view's,
+// counting where it would decide differently without affecting anything.
+// It's evaluated as what promoting it would make of the default view: its
+// sources merged as they are, with the candidate in place of configFile.
+type shadowSet struct {
+	from  string // shadowFile or "upload"
+	lines []string
+	rules int              // in the candidate itself
+	table map[string]*rule // the default view's with the candidate promoted
+	epoch int64            // configEpoch of the default view it was merged into
+	// promotable is false when the default view doesn't take rules from
+	// configFile: the candidate is then evaluated on its own, which isn't
+	// what promoting it would do.
+	promotable bool
+
+	newly, noLonger int64 // divergences since it was loaded
+
+	mu      sync.Mutex
+	domains map[string]string // diverging domain -> kind, at most shadowMaxDomains
+}
+
+const shadowMaxDomains = 1000
+
+var (
+	shadowCur       atomic.Value // *shadowSet, nil when there's none
+	newlyProxied    = metricCounter(metricName("shadow_divergence_total", "kind", "newly_proxied"))
+	noLongerProxied = metricCounter(metricName("shadow_divergence_total", "kind", "no_longer_proxied"))
+)
+
+func init() {
+	shadowCur.Store((*shadowSet)(nil))
+}
+
+func currentShadow() *shadowSet {
+	return shadowCur.Load().(*shadowSet)
+}
+
+// newShadow evaluates lines as replacing configFile in the default view v,
+// carrying over what old, the set it replaces if any, counted.
+func newShadow(from string, lines []string, v *view, old *shadowSet) *shadowSet {
+	own, _ := compileSource(from, lines)
+	s := &shadowSet{from: from, lines: lines, rules: len(own), table: own, epoch: v.epoch, domains: make(map[string]string)}
+	for _, src := range v.sources {
+		if src == configFile {
+			s.table, _ = compileReplacing(v.sources, configFile, lines)
+			s.promotable = true
+		}
+	}
+	if old != nil {
+		s.newly, s.noLonger = atomic.LoadInt64(&old.newly), atomic.LoadInt64(&old.noLonger)
+		old.mu.Lock()
+		for d, k := range old.domains {
+			s.domains[d] = k
+		}
+		old.mu.Unlock()
+	}
+	return s
+}
+
+func defaultView() *view {
+	vs := currentViews().views
+	return vs[len(vs)-1]
+}
+
+// loadShadowFile (re)loads shadowFile unless an uploaded candidate is being
+// evaluated, and merges the candidate into the reloaded default view again
+// either way.
+func loadShadowFile(refetch bool) {
+	cur := currentShadow()
+	if shadowFile == "" || cur != nil && (cur.from != shadowFile || isRemote(shadowFile) && !refetch) {
+		if cur != nil {
+			shadowCur.Store(newShadow(cur.from, cur.lines, defaultView(), cur))
+		}
+		return
+	}
+	lines, err := readSource(shadowFile)
+	if err != nil {
+		log.Errorf("shadow rules %s: %s", shadowFile, err)
+		return
+	}
+	shadowCur.Store(newShadow(shadowFile, lines, defaultView(), nil))
+}
+
+func proxies(r *rule) bool {
+	return r != nil && !r.block && !r.forwarded()
+}
+
+// shadowCompare checks what the candidate set says about domain for clients
+// of the default view, given what the active set said.
+func shadowCompare(v *view, domain string, active *rule) {
+	s := currentShadow()
+	if s == nil || v.name != "default" || v.direct || domain == "" {
+		return
+	}
+	was, would := proxies(active), proxies(matchRule(s.table, domain))
+	if was == would {
+		return
+	}
+	kind := "newly_proxied"
+	if would {
+		atomic.AddInt64(newlyProxied, 1)
+		atomic.AddInt64(&s.newly, 1)
+	} else {
+		kind = "no_longer_proxied"
+		atomic.AddInt64(noLongerProxied, 1)
+		atomic.AddInt64(&s.noLonger, 1)
+	}
+	logThrottled.Infof("shadow "+domain, "shadow: %s %s", domain, kind)
+
+	s.mu.Lock()
+	if _, ok := s.domains[domain]; ok || len(s.domains) < shadowMaxDomains {
+		s.domains[domain] = kind
+	}
+	s.mu.Unlock()
+}
+
+// shadowSummary is the admin API view of the candidate set.
+type shadowSummary struct {
+	From            string            `json:"from"`
+	Rules           int               `json:"rules"`
+	Promotable      bool              `json:"promotable"`
+	NewlyProxied    int64             `json:"newly_proxied"`
+	NoLongerProxied int64             `json:"no_longer_proxied"`
+	Domains         map[string]string `json:"domains"`
+}
+
+func (s *shadowSet) summary() *shadowSummary {
+	ret := &shadowSummary{
+		From:            s.from,
+		Rules:           s.rules,
+		Promotable:      s.promotable,
+		NewlyProxied:    atomic.LoadInt64(&s.newly),
+		NoLongerProxied: atomic.LoadInt64(&s.noLonger),
+		Domains:         make(map[string]string),
+	}
+	s.mu.Lock()
+	for d, k := range s.domains {
+		ret.Domains[d] = k
+	}
+	s.mu.Unlock()
+	return ret
+}
+
+// promoteShadow makes the candidate the active rule set by replacing
+// configFile with it, atomically, and reloading. It refuses unless that is
+// what was evaluated: the default view takes rules from configFile and
+// hasn't been reloaded since the candidate was merged into it.
+func promoteShadow() error {
+	s := currentShadow()
+	if s == nil {
+		return os.ErrNotExist
+	}
+	if !s.promotable {
+		return fmt.Errorf("the default view doesn't take rules from %s, the shadow rules were evaluated on their own", configFile)
+	}
+	if v := defaultView(); v.epoch != s.epoch {
+		return errors.New("the rules were reloaded since the shadow rules were evaluated against them, try again")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), ".promote-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strings.Join(s.lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if fi, err := os.Stat(configFile); err == nil {
+		_ = os.Chmod(tmp.Name(), fi.Mode())
+	}
+	if err := os.Rename(tmp.Name(), configFile); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	log.Infof("shadow rules from %s promoted to %s", s.from, configFile)
+	shadowCur.Store((*shadowSet)(nil))
+	updateConfig(false)
+	return nil
+}
+
+// shadowHandler serves /shadow: GET the divergence summary, POST a candidate
+// set as the body, DELETE it. /shadow/promote makes it active.
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s := currentShadow()
+		if s == nil {
+			http.Error(w, "no shadow rules", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, s.summary())
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lines, err := sourceData(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		shadowCur.Store(newShadow("upload", lines, defaultView(), nil))
+		_, _ = w.Write([]byte("ok\n"))
+	case http.MethodDelete:
+		shadowCur.Store((*shadowSet)(nil))
+		_, _ = w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, "GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sighting is what's known of a name asked for on the DNS port or sent as
+// SNI to the TLS port, for curating the rules from real traffic: whether a
+// rule of the client's view matched it and what was done with it the last
+// time it was seen.
+type sighting struct {
+	Name     string    `json:"name"` // or its sightingHash
+	Via      string    `json:"via"`  // dns or sni
+	First    time.Time `json:"first_seen"`
+	Last     time.Time `json:"last_seen"`
+	Hits     int64     `json:"hits"`
+	Decision string    `json:"decision"`
+	Matched  bool      `json:"matched"`
+}
+
+type sightingKey struct{ name, via string }
+
+// sightingEvent is one name seen, as the data path hands it over.
+type sightingEvent struct {
+	v                   *view
+	name, via, decision string
+	at                  time.Time
+}
+
+// sightingStore keeps the sightings of the last sightingsRetention in
+// memory, at most sightingsMax of them, and in an append-only log of their
+// states: those changed are appended every sightingsFlush, replaying takes
+// the last state of each, and compacting rewrites it with one line per
+// sighting. The data path only hands names to a queue, dropping them when
+// it's full; one goroutine does the rest, so nothing waits for the disk.
+type sightingStore struct {
+	path string
+	key  []byte // what names are hashed with, nil to keep them as they are
+	ch   chan sightingEvent
+
+	mu    sync.Mutex
+	seen  map[sightingKey]*sighting
+	dirty map[sightingKey]bool
+
+	fileMu sync.Mutex
+	f      *os.File
+	lines  int // in the log, for compaction
+}
+
+// sightings holds the store, nil unless trackSightings.
+var sightings atomic.Value // *sightingStore
+
+func currentSightings() *sightingStore {
+	s, _ := sightings.Load().(*sightingStore)
+	return s
+}
+
+// sightingsFlush is how often changed sightings are appended to the log.
+const sightingsFlush = time.Minute
+
+var (
+	sightingsDropped = metricCounter("sightings_dropped_total")
+	sightingsEvicted = metricCounter("sightings_evicted_total")
+)
+
+func newSightingStore(path string) *sightingStore {
+	return &sightingStore{
+		path:  path,
+		ch:    make(chan sightingEvent, 4096),
+		seen:  make(map[sightingKey]*sighting),
+		dirty: make(map[sightingKey]bool),
+	}
+}
+
+// noteSighting hands name, seen via dns or sni from a client of v, to the
+// store, unless v opted out or the queue is full.
+func noteSighting(v *view, via, name, decision string) {
+	s := currentSightings()
+	if s == nil || v.noSightings {
+		return
+	}
+	select {
+	case s.ch <- sightingEvent{v, name, via, decision, time.Now()}:
+	default:
+		atomic.AddInt64(sightingsDropped, 1)
+	}
+}
+
+// sightingHash is name as kept with sightingsHash: a keyed hash, so the log
+// doesn't say what was looked up, yet a name can still be looked for.
+func (s *sightingStore) sightingHash(name string) string {
+	if s.key == nil {
+		return name
+	}
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(name))
+	return "hmac:" + hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// loadKey reads the key names are hashed with from the path's .key file,
+// making one the first time.
+func (s *sightingStore) loadKey() error {
+	path := s.path + ".key"
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data = make([]byte, 32)
+		if _, err := rand.Read(data); err != nil {
+			return err
+		}
+		data = []byte(hex.EncodeToString(data))
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	s.key, err = hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(s.key) < 16 {
+		return errors.New(path + ": needs a key of 16 hex bytes or more")
+	}
+	return nil
+}
+
+// open replays the log, dropping what's past retention and cutting off a
+// torn last line, and opens it for appending.
+func (s *sightingStore) open() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cutoff := time.Now().Add(-currentSettings().sightingsRetention)
+	good := 0
+	for off := 0; off < len(data); {
+		end := bytes.IndexByte(data[off:], '\n')
+		if end < 0 {
+			break // torn tail
+		}
+		line := data[off : off+end]
+		off += end + 1
+		var g sighting
+		if err := json.Unmarshal(line, &g); err != nil || g.Name == "" {
+			if off == len(data) {
+				break
+			}
+			log.Errorf("%s: skipped bad entry %q", s.path, line)
+			good = off
+			continue
+		}
+		good = off
+		s.lines++
+		if g.Last.After(cutoff) {
+			s.seen[sightingKey{g.Name, g.Via}] = &g
+		}
+	}
+	if good < len(data) {
+		log.Warnf("%s: cut off %d bytes of an incomplete last entry", s.path, len(data)-good)
+		if err := os.Truncate(s.path, int64(good)); err != nil {
+			return err
+		}
+	}
+	for len(s.seen) > sightingsMax {
+		s.evict()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.Infof("%s: %d names seen from %d entries", s.path, len(s.seen), s.lines)
+	return nil
+}
+
+// run takes the names handed over, flushes and compacts, forever.
+func (s *sightingStore) run() {
+	flush := time.NewTicker(sightingsFlush)
+	compact := time.NewTicker(sightingsCompact)
+	for {
+		select {
+		case e := <-s.ch:
+			s.apply(e)
+		case <-flush.C:
+			if err := s.flush(); err != nil {
+				logThrottled.Errorf("sightings", "%s: %s", s.path, err)
+			}
+		case <-compact.C:
+			if err := s.compact(false); err != nil {
+				logThrottled.Errorf("sightings", "%s: %s", s.path, err)
+			}
+		}
+	}
+}
+
+func (s *sightingStore) apply(e sightingEvent) {
+	name := strings.TrimSuffix(strings.ToLower(e.name), ".")
+	if name == "" {
+		return
+	}
+	matched := e.v.matchAny(name) != nil
+	k := sightingKey{s.sightingHash(name), e.via}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.seen[k]
+	if !ok {
+		if len(s.seen) >= sightingsMax {
+			s.evict()
+		}
+		g = &sighting{Name: k.name, Via: k.via, First: e.at}
+		s.seen[k] = g
+	}
+	g.Last, g.Decision, g.Matched = e.at, e.decision, matched
+	g.Hits++
+	s.dirty[k] = true
+}
+
+// evict drops the least recently seen sighting. A scan, but off the data
+// path and only with the store full. Called with mu held, or before run.
+func (s *sightingStore) evict() {
+	var oldest sightingKey
+	var last time.Time
+	for k, g := range s.seen {
+		if last.IsZero() || g.Last.Before(last) {
+			oldest, last = k, g.Last
+		}
+	}
+	delete(s.seen, oldest)
+	delete(s.dirty, oldest)
+	atomic.AddInt64(sightingsEvicted, 1)
+}
+
+// flush appends the sightings changed since the last flush to the log.
+// fileMu is taken first, as compact does, so what a compaction wrote is
+// never followed by older states.
+func (s *sightingStore) flush() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	var buf bytes.Buffer
+	n := 0
+	for k := range s.dirty {
+		if g, ok := s.seen[k]; ok {
+			data, _ := json.Marshal(g)
+			buf.Write(data)
+			buf.WriteByte('\n')
+			n++
+		}
+	}
+	s.dirty = make(map[sightingKey]bool)
+	s.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.lines += n
+	return nil
+}
+
+// compact drops what's past retention, then rewrites the log as one line
+// per sighting if it's grown to more than twice that, or if force. As with
+// the runtime rules, a crash leaves the old log or the new one.
+func (s *sightingStore) compact(force bool) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	cutoff := time.Now().Add(-currentSettings().sightingsRetention)
+	s.mu.Lock()
+	var all []sighting
+	for k, g := range s.seen {
+		if g.Last.Before(cutoff) {
+			delete(s.seen, k)
+			delete(s.dirty, k)
+			continue
+		}
+		all = append(all, *g)
+	}
+	s.dirty = make(map[sightingKey]bool) // all of them are written now
+	s.mu.Unlock()
+	if !force && s.lines <= 2*len(all)+100 {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".sightings-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	w := bufio.NewWriter(tmp)
+	for i := range all {
+		data, _ := json.Marshal(&all[i])
+		_, _ = w.Write(data)
+		_ = w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_ = s.f.Close()
+	log.Infof("%s: compacted %d entries to %d", s.path, s.lines, len(all))
+	s.f, s.lines = f, len(all)
+	return nil
+}
+
+// purge forgets name, or every sighting if it's "", and rewrites the log
+// without it right away.
+func (s *sightingStore) purge(name string) (int, error) {
+	hashed := s.sightingHash(name)
+	s.mu.Lock()
+	n := 0
+	for k := range s.seen {
+		if name == "" || k.name == hashed {
+			delete(s.seen, k)
+			delete(s.dirty, k)
+			n++
+		}
+	}
+	s.mu.Unlock()
+	return n, s.compact(true)
+}
+
+// report is the sightings last seen since since, via "" for both, the most
+// hit first.
+func (s *sightingStore) report(since time.Time, via, name string) []sighting {
+	if name != "" {
+		name = s.sightingHash(name)
+	}
+	s.mu.Lock()
+	ret := []sighting{}
+	for k, g := range s.seen {
+		if g.Last.Before(since) || via != "" && k.via != via || name != "" && k.name != name {
+			continue
+		}
+		ret = append(ret, *g)
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Hits != ret[j].Hits {
+			return ret[i].Hits > ret[j].Hits
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (s *sightingStore) size() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.seen))
+}
+
+// loadSightings replays sightingsFile and starts recording, if
+// trackSightings.
+func loadSightings() error {
+	if !trackSightings {
+		return nil
+	}
+	s := newSightingStore(sightingsFile)
+	if sightingsHash {
+		if err := s.loadKey(); err != nil {
+			return err
+		}
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	sightings.Store(s)
+	go s.run()
+	return nil
+}
+
+// sightingsHandler is /sightings: GET exports the names seen, as JSON or
+// with ?format=csv, ?days= those seen in the last days, ?via=dns or sni
+// those seen that way, ?name= one, looked for by its hash with
+// sightingsHash. DELETE forgets them all, or ?name= one.
+func sightingsHandler(w http.ResponseWriter, r *http.Request) {
+	s := currentSightings()
+	if s == nil {
+		http.Error(w, "sightings aren't tracked", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	name := ""
+	if v := q.Get("name"); v != "" {
+		host, ok := normalizeHost(v)
+		if !ok {
+			http.Error(w, "name= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		name = host
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var since time.Time
+		if d := q.Get("days"); d != "" {
+			n, err := strconv.Atoi(d)
+			if err != nil || n <= 0 {
+				http.Error(w, "days= needs a number from 1 on", http.StatusBadRequest)
+				return
+			}
+			since = time.Now().AddDate(0, 0, -n)
+		}
+		via := q.Get("via")
+		if via != "" && via != "dns" && via != "sni" {
+			http.Error(w, "via= is dns or sni", http.StatusBadRequest)
+			return
+		}
+		seen := s.report(since, via, name)
+		switch q.Get("format") {
+		case "", "json":
+			writeJSON(w, seen)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			cw := csv.NewWriter(w)
+			_ = cw.Write([]string{"name", "via", "first_seen", "last_seen", "hits", "decision", "matched"})
+			for _, g := range seen {
+				_ = cw.Write([]string{g.Name, g.Via, g.First.UTC().Format(time.RFC3339), g.Last.UTC().Format(time.RFC3339),
+					strconv.FormatInt(g.Hits, 10), g.Decision, strconv.FormatBool(g.Matched)})
+			}
+			cw.Flush()
+		default:
+			http.Error(w, "format= is json or csv", http.StatusBadRequest)
+		}
+	case http.MethodDelete:
+		n, err := s.purge(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("sightings: purged %d", n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// peekConn lets the first bytes of a connection be inspected before it's
+// handed on, without losing them.
+type peekConn struct {
+	net.Conn
+	r        *bufio.Reader
+	id       string     // newConnID, given at accept
+	log      *log.Entry // with id as the conn field
+	accepted time.Time
+}
+
+func newPeekConn(c net.Conn) *peekConn {
+	id := newConnID()
+	return &peekConn{Conn: c, r: bufio.NewReaderSize(c, 4096), id: id, log: log.WithField("conn", id), accepted: time.Now()}
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"),
+}
+
+// handleConn sniffs a connection accepted on the TLS port: TLS goes on to
+// forwardTls, plain HTTP gets told off, anything else is dropped. In
+// -transparent mode, intercepted connections without SNI are relayed by
+// destination IP instead.
+func handleConn(raw net.Conn, config *tls.Config) {
+	connOpened()
+	defer connClosed()
+	if !clientAllowed(raw.RemoteAddr(), "tls") {
+		closeConn(raw)
+		return
+	}
+
+	pc := newPeekConn(raw)
+	_ = raw.SetReadDeadline(time.Now().Add(sniffTimeout))
+	head, err := pc.r.Peek(4)
+	_ = raw.SetReadDeadline(time.Time{})
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			// the server may be the one to speak first
+			if dst := interceptedDst(raw); dst != nil {
+				relayByIP(pc, dst)
+				closeConn(raw)
+				return
+			}
+		}
+		metricAdd(metricName("tls_sniffed_total", "kind", "short"), 1)
+		pc.log.Debugf("%s: nothing to sniff: %s", raw.RemoteAddr(), err)
+		closeConn(raw)
+		return
+	}
+
+	// handshake record, SSL 3.0 / TLS 1.x
+	if head[0] == 0x16 && head[1] == 0x03 {
+		if *observe {
+			// clients with cached spoofed answers, or that hardcode us
+			if host, ok := normalizeHost(peekServerName(pc)); ok {
+				observeConn(pc, host)
+			}
+			closeConn(raw)
+			return
+		}
+		if currentViews().passthrough || *transparent || graceActive() {
+			name := peekServerName(pc)
+			if host, ok := normalizeHost(name); ok {
+				v := viewFor(raw.RemoteAddr(), raw.LocalAddr())
+				r := v.match(host)
+				if r != nil && r.resolveOnly {
+					metricAdd(metricName("relay_decisions_total", "by", "sni", "decision", "passthrough"), 1)
+					noteSighting(v, "sni", host, "passthrough")
+					passthrough(pc, host, v, r)
+					closeConn(raw)
+					return
+				}
+				if r == nil && inGrace(host) {
+					metricAdd(metricName("relay_decisions_total", "by", "sni", "decision", "removed"), 1)
+					noteSighting(v, "sni", host, "removed")
+					relayRemoved(pc, host)
+					closeConn(raw)
+					return
+				}
+			} else if dst := interceptedDst(raw); name == "" && dst != nil {
+				relayByIP(pc, dst)
+				closeConn(raw)
+				return
+			}
+		}
+		forwardTls(pc, config)
+		return
+	}
+	if dst := interceptedDst(raw); dst != nil {
+		relayByIP(pc, dst)
+		closeConn(raw)
+		return
+	}
+	for _, m := range httpMethods {
+		if bytes.Equal(head, m) {
+			metricAdd(metricName("tls_sniffed_total", "kind", "http"), 1)
+			rejectPlainHTTP(pc)
+			closeConn(raw)
+			return
+		}
+	}
+	metricAdd(metricName("tls_sniffed_total", "kind", "unknown"), 1)
+	pc.log.Debugf("%s: not TLS: % x", raw.RemoteAddr(), head)
+	closeConn(raw)
+}
+
+func rejectPlainHTTP(pc *peekConn) {
+	_ = pc.SetDeadline(time.Now().Add(sniffTimeout))
+	req, err := http.ReadRequest(pc.r)
+	if err != nil {
+		return
+	}
+	log.Infof("%s: plain HTTP to %q sent to the HTTPS port", pc.RemoteAddr(), req.Host)
+	req.RemoteAddr = pc.RemoteAddr().String()
+	reason := "plain HTTP sent to HTTPS port"
+	if host, ok := proxiedHost(req); ok {
+		reason = fmt.Sprintf("plain HTTP sent to HTTPS port, try https://%s/", host)
+	}
+	ctype, body := renderError(req, http.StatusBadRequest, reason)
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":     {ctype},
+			"Content-Language": {errorPageLang},
+		},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	if err := resp.Write(pc); err != nil {
+		log.Debug(err)
+	}
+}
+
+func closeConn(c net.Conn) {
+	if err := c.Close(); err != nil {
+		log.Debug(err)
+	}
+}
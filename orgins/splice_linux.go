@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceChunk is the most one splice call moves, a pipe's default capacity.
+const spliceChunk = 64 << 10
+
+// spliceEngine moves bytes between two TCP sockets through a pipe with
+// splice(2), so they never reach userspace. A kernel refusing either socket
+// with EINVAL gets the rest copied instead.
+type spliceEngine struct{}
+
+func spliceEngineFor(dst, src net.Conn) relayEngine {
+	_, ok1 := dst.(*net.TCPConn)
+	_, ok2 := src.(*net.TCPConn)
+	if ok1 && ok2 {
+		return spliceEngine{}
+	}
+	return nil
+}
+
+func (spliceEngine) name() string { return "splice" }
+
+func (spliceEngine) copy(dst, src net.Conn, n *int64) error {
+	sc, err := src.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	dc, err := dst.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return spliceFallback(dst, src, n, err)
+	}
+	defer func() {
+		_ = unix.Close(p[0])
+		_ = unix.Close(p[1])
+	}()
+
+	for {
+		var got int64
+		var serr error
+		// false makes the runtime wait for readability, deadlines included
+		if err := sc.Read(func(fd uintptr) bool {
+			got, serr = unix.Splice(int(fd), nil, p[1], nil, spliceChunk, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return serr != unix.EAGAIN
+		}); err != nil {
+			return err
+		}
+		switch {
+		case serr == unix.EINTR:
+			continue
+		case serr == unix.EINVAL:
+			return spliceFallback(dst, src, n, serr)
+		case serr != nil:
+			return serr
+		case got == 0:
+			return nil // EOF
+		}
+		for got > 0 {
+			var put int64
+			var werr error
+			if err := dc.Write(func(fd uintptr) bool {
+				put, werr = unix.Splice(p[0], nil, int(fd), nil, int(got), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				return werr != unix.EAGAIN
+			}); err != nil {
+				return err
+			}
+			switch {
+			case werr == unix.EINTR:
+				continue
+			case werr == unix.EINVAL:
+				// what's in the pipe has to come out the slow way first
+				if err := drainPipe(p[0], dst, int(got), n); err != nil {
+					return err
+				}
+				return spliceFallback(dst, src, n, werr)
+			case werr != nil:
+				return werr
+			}
+			got -= put
+			atomic.AddInt64(n, put)
+		}
+	}
+}
+
+func spliceFallback(dst, src net.Conn, n *int64, why error) error {
+	metricAdd("relay_splice_fallbacks_total", 1)
+	logThrottled.Infof("splice", "splice unavailable, copying instead: %s", why)
+	return copyEngine{}.copy(dst, src, n)
+}
+
+// drainPipe reads the left bytes of the pipe r into dst.
+func drainPipe(r int, dst net.Conn, left int, n *int64) error {
+	buf := make([]byte, spliceChunk)
+	for left > 0 {
+		if left < len(buf) {
+			buf = buf[:left]
+		}
+		k, err := unix.Read(r, buf)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf[:k]); err != nil {
+			return err
+		}
+		atomic.AddInt64(n, int64(k))
+		left -= k
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// spliceEngineFor is nil, only linux has splice(2).
+func spliceEngineFor(dst, src net.Conn) relayEngine { return nil }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// spoofTypes tells which of A and AAAA spoofed answers point at us, from
+// spoofFamilies and the TLS listeners; the other type gets NODATA, as it
+// would lead to a dead port. Set up once by main, swapped whole.
+type spoofTypes struct {
+	a, aaaa bool
+}
+
+var spoofCur atomic.Value // spoofTypes
+
+func init() {
+	spoofCur.Store(spoofTypes{a: true, aaaa: true})
+}
+
+// spoofIPv4 and spoofIPv6 are what spoofed answers point at, loopback
+// unless spoofTarget says otherwise. Set up once by setup.
+var spoofIPv4, spoofIPv6 = net.IPv4(127, 0, 0, 1), net.IPv6loopback
+
+// parseSpoofTarget sets spoofIPv4 and spoofIPv6 from spoofTarget. A family
+// it has no address of isn't spoofed.
+func parseSpoofTarget() error {
+	if spoofTarget == "" {
+		return nil
+	}
+	spoofIPv4, spoofIPv6 = nil, nil
+	for _, s := range strings.Split(spoofTarget, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		switch {
+		case ip == nil:
+			return errors.New("spoofTarget: bad address " + s)
+		case ip.To4() != nil:
+			spoofIPv4 = ip.To4()
+		default:
+			spoofIPv6 = ip
+		}
+	}
+	return nil
+}
+
+// listenerFamilies reports which address families addrs accept, a
+// wildcard IPv6 bind being dual-stack.
+func listenerFamilies(addrs []net.Addr) (v4, v6 bool) {
+	for _, a := range addrs {
+		t, ok := a.(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		switch {
+		case t.IP.To4() != nil:
+			v4 = true
+		case t.IP == nil || t.IP.IsUnspecified():
+			v4, v6 = true, true
+		default:
+			v6 = true
+		}
+	}
+	return
+}
+
+// setSpoofFamilies sets which of A and AAAA are spoofed from spoofFamilies,
+// for auto from the families of spoofTarget or else those ls are bound to.
+func setSpoofFamilies(ls []net.Listener) {
+	var a, aaaa bool
+	switch spoofFamilies {
+	case "ipv4":
+		a, aaaa = true, false
+	case "ipv6":
+		a, aaaa = false, true
+	case "both":
+		a, aaaa = true, true
+	default:
+		if spoofFamilies != "auto" {
+			log.Errorf("unknown spoofFamilies %s, using auto", spoofFamilies)
+		}
+		if spoofTarget != "" {
+			a, aaaa = spoofIPv4 != nil, spoofIPv6 != nil
+			break
+		}
+		var addrs []net.Addr
+		for _, l := range ls {
+			addrs = append(addrs, l.Addr())
+		}
+		v4, v6 := listenerFamilies(addrs)
+		if !v4 && !v6 {
+			v4, v6 = true, true // nothing to go by
+		}
+		a, aaaa = v4, v6
+	}
+	a, aaaa = a && spoofIPv4 != nil, aaaa && spoofIPv6 != nil
+	if !a || !aaaa {
+		log.Infof("spoofed answers: A %t, AAAA %t", a, aaaa)
+	}
+	spoofCur.Store(spoofTypes{a: a, aaaa: aaaa})
+}
+
+// spoofs reports whether spoofed answers of qtype point at us.
+func spoofs(qtype uint16) bool {
+	t := spoofCur.Load().(spoofTypes)
+	return qtype == dns.TypeA && t.a || qtype == dns.TypeAAAA && t.aaaa
+}
+
+// noData answers m with no records and an SOA for its name, so clients
+// cache the absence for ttl.
+func noData(m *dns.Msg, ttl time.Duration) *dns.Msg {
+	q := m.Question[0]
+	mname := "localhost."
+	if selfName != "" {
+		mname = dns.Fqdn(selfName)
+	}
+	secs := uint32(ttl / time.Second)
+	msg := new(dns.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+	msg.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: strings.ToLower(q.Name), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: secs},
+		Ns:      mname,
+		Mbox:    "hostmaster." + mname,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  secs,
+	}}
+	return msg
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Stages of a MITM connection, in the order they're reached: the upstream
+// is dialed while the client's handshake waits in GetConfigForClient, so
+// the client handshake ends after the upstream one.
+const (
+	stageAccept          = iota
+	stageHello           // client hello read
+	stageDecided         // rule picked
+	stageResolved        // first upstream addr in hand, cached or resolved
+	stageDialed          // TCP up to the addr that worked
+	stageUpHandshake     // TLS with the upstream
+	stageClientHandshake // TLS with the client
+	stageFirstUp         // first byte client -> upstream
+	stageFirstDown       // first byte upstream -> client
+	numStages
+)
+
+var slowThreshold = slowSetup
+
+var stageNames = [numStages]string{"accept", "hello", "decided", "resolved", "dialed",
+	"upstream_handshake", "client_handshake", "first_up", "first_down"}
+
+// connStages is when a connection reached each stage, in monotonic
+// nanoseconds since it was accepted plus one, 0 for not (yet).
+type connStages struct {
+	began time.Time
+	at    [numStages]int64
+}
+
+func newConnStages(accepted time.Time) *connStages {
+	s := &connStages{began: accepted}
+	s.at[stageAccept] = 1
+	return s
+}
+
+// mark notes stage as reached now, again if it was already: dials and
+// handshakes count from the last attempt.
+func (s *connStages) mark(stage int) {
+	if s != nil {
+		atomic.StoreInt64(&s.at[stage], int64(time.Since(s.began))+1)
+	}
+}
+
+// markOnce notes stage as reached now unless it was already.
+func (s *connStages) markOnce(stage int) {
+	if s != nil {
+		atomic.CompareAndSwapInt64(&s.at[stage], 0, int64(time.Since(s.began))+1)
+	}
+}
+
+// deltas is how long each reached stage took since the one reached
+// before it.
+func (s *connStages) deltas() map[int]time.Duration {
+	ret := make(map[int]time.Duration)
+	prev := int64(1)
+	for stage := stageHello; stage < numStages; stage++ {
+		at := atomic.LoadInt64(&s.at[stage])
+		if at == 0 {
+			continue
+		}
+		if at > prev {
+			ret[stage] = time.Duration(at - prev)
+		} else {
+			ret[stage] = 0
+		}
+		prev = at
+	}
+	return ret
+}
+
+// setup is from accept to the first byte back to the client, or to now
+// if it hasn't come.
+func (s *connStages) setup() time.Duration {
+	if at := atomic.LoadInt64(&s.at[stageFirstDown]); at != 0 {
+		return time.Duration(at - 1)
+	}
+	return time.Since(s.began)
+}
+
+// report observes the stages into the conn_stage_ms histograms and, past
+// slowSetup, logs the breakdown to e. Called once, as the connection ends.
+func (s *connStages) report(e *log.Entry, host string) {
+	ds := s.deltas()
+	var parts []string
+	for stage := stageHello; stage < numStages; stage++ {
+		d, ok := ds[stage]
+		if !ok {
+			continue
+		}
+		metricHistogram(metricName("conn_stage_ms", "stage", stageNames[stage])).observe(d)
+		parts = append(parts, fmt.Sprintf("%s=%s", stageNames[stage], d.Round(time.Millisecond)))
+	}
+	if setup := s.setup(); slowThreshold > 0 && setup >= slowThreshold {
+		metricAdd("conns_slow_setup_total", 1)
+		e.WithField("setup", setup.Round(time.Millisecond)).Warnf("%s: slow setup: %s", host, strings.Join(parts, " "))
+	}
+}
+
+type stagesKey struct{}
+
+// withStages hands the stages of a connection down to its dial.
+func withStages(ctx context.Context, s *connStages) context.Context {
+	return context.WithValue(ctx, stagesKey{}, s)
+}
+
+// stagesFrom is nil for dials of no connection, which mark ignores.
+func stagesFrom(ctx context.Context) *connStages {
+	s, _ := ctx.Value(stagesKey{}).(*connStages)
+	return s
+}
+
+// firstWrite marks stage on the first write through it.
+type firstWrite struct {
+	w     io.Writer
+	s     *connStages
+	stage int
+}
+
+func (f *firstWrite) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		f.s.markOnce(f.stage)
+	}
+	return f.w.Write(p)
+}
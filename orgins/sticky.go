@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// stickyPins are the upstream addrs hosts of sticky rules stay on, for
+// services whose sessions or rate limits are tied to one edge
+var stickyPins sync.Map // host -> *pin
+
+type pin struct {
+	addr   string
+	expire deadline
+	manual bool // set through the admin API, kept on failover
+}
+
+// pinJSON is a pin as /sticky lists it and an upgrade hands it over, the
+// expiry on the wall clock.
+type pinJSON struct {
+	Host   string    `json:"host,omitempty"`
+	Addr   string    `json:"addr"`
+	Expire time.Time `json:"expire"`
+	Manual bool      `json:"manual,omitempty"`
+}
+
+func (p *pin) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pinJSON{Addr: p.addr, Expire: p.expire.wall(), Manual: p.manual})
+}
+
+func (p *pin) UnmarshalJSON(data []byte) error {
+	var j pinJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*p = pin{addr: j.Addr, expire: deadlineAt(j.Expire), manual: j.Manual}
+	return nil
+}
+
+// pinFor returns the addr host is pinned to, "" if none: its own pin if r
+// is sticky, one set through the admin API whatever r is.
+func pinFor(host string, r *rule) string {
+	val, ok := stickyPins.Load(host)
+	if !ok {
+		return ""
+	}
+	p := val.(*pin)
+	if p.expire.passed() {
+		stickyPins.Delete(host)
+		return ""
+	}
+	if !p.manual && stickyFor(r) == 0 {
+		return "" // the rule stopped being sticky, let it run out
+	}
+	return p.addr
+}
+
+// stickyFor is how long r pins the addrs it dials, 0 if it doesn't.
+func stickyFor(r *rule) time.Duration {
+	if r == nil || !r.sticky {
+		return 0
+	}
+	if r.stickyTtl > 0 {
+		return r.stickyTtl
+	}
+	return stickyTtl
+}
+
+// dialPinned dials the addr host is pinned to, up to 1+stickyRetries times
+// so a brief failure doesn't move the pin. ok is false if there's no pin to
+// try; a pin that stays unreachable is added to tried.
+func dialPinned(ctx context.Context, d dialer, host string, ru *rule, config *tls.Config, tried map[string]struct{}) (i net.Conn, addr string, ok bool) {
+	addr = pinFor(host, ru)
+	if _, skip := tried[addr]; addr == "" || skip || !ru.family.allows(addr) {
+		return nil, "", false
+	}
+	stagesFrom(ctx).markOnce(stageResolved)
+	for n := 0; n <= stickyRetries && ctx.Err() == nil; n++ {
+		i, err := d.DialTLSContext(ctx, host, addr, config)
+		recordDial(addr, err)
+		if err == nil {
+			return i, addr, true
+		}
+		log.Debugf("%s: pinned %s: %s", host, addr, err)
+	}
+	tried[addr] = struct{}{}
+	logThrottled.Warnf("pin "+host, "%s: pinned %s unreachable, failing over", host, addr)
+	return nil, "", false
+}
+
+// pinAddr pins host to addr if r is sticky, unless it's pinned through the
+// admin API.
+func pinAddr(host, addr string, r *rule) {
+	ttl := stickyFor(r)
+	if ttl == 0 {
+		return
+	}
+	if val, ok := stickyPins.Load(host); ok {
+		if p := val.(*pin); p.manual && !p.expire.passed() {
+			return
+		} else if p.addr != addr && !p.expire.passed() {
+			log.Infof("%s: pin moved from %s to %s", host, p.addr, addr)
+		}
+	}
+	stickyPins.Store(host, &pin{addr: addr, expire: expireIn(ttl)})
+}
+
+// pinUse is what the access log says about how addr was picked, given the
+// pinFor from before the dial: "sticky" if it's the pin, "fresh" if it was
+// resolved though r is sticky or there was a pin, "" otherwise.
+func pinUse(r *rule, pinned, addr string) string {
+	switch {
+	case pinned != "" && pinned == addr:
+		return "sticky"
+	case pinned != "" || stickyFor(r) > 0:
+		return "fresh"
+	}
+	return ""
+}
+
+// stickyHandler serves /sticky: GET lists the pins, POST host= addr= [ttl=]
+// pins host by hand, DELETE host= clears its pin.
+func stickyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		ret := []pinJSON{}
+		stickyPins.Range(func(key, val interface{}) bool {
+			if p := val.(*pin); !p.expire.passed() {
+				ret = append(ret, pinJSON{Host: key.(string), Addr: p.addr, Expire: p.expire.wall(), Manual: p.manual})
+			}
+			return true
+		})
+		sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+		writeJSON(w, ret)
+	case http.MethodPost:
+		host, ok := normalizeHost(q.Get("host"))
+		if !ok {
+			http.Error(w, "host= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		addr := q.Get("addr")
+		if net.ParseIP(addr) != nil {
+			addr = net.JoinHostPort(addr, upstreamPort)
+		}
+		if ip, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(ip) == nil {
+			http.Error(w, "addr= needs an IP, with or without port", http.StatusBadRequest)
+			return
+		}
+		ttl := stickyTtl
+		if v := q.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad ttl "+v, http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		stickyPins.Store(host, &pin{addr: addr, expire: expireIn(ttl), manual: true})
+		log.Infof("%s: pinned to %s for %s through the admin API", host, addr, ttl)
+		_, _ = w.Write([]byte("ok\n"))
+	case http.MethodDelete:
+		host, ok := normalizeHost(q.Get("host"))
+		if !ok {
+			http.Error(w, "host= needs a valid hostname", http.StatusBadRequest)
+			return
+		}
+		if _, ok := stickyPins.Load(host); !ok {
+			http.Error(w, host+" isn't pinned", http.StatusNotFound)
+			return
+		}
+		stickyPins.Delete(host)
+		log.Infof("%s: pin cleared through the admin API", host)
+		_, _ = w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, "GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
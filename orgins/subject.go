@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509/pkix"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// subject is the template for the subject of newly minted leaves, from
+// subjectFile, one field per line, all optional:
+//
+//	organization Example Corp
+//	country DE
+//	unit Proxy
+//	commonname off
+//
+// Without the file leaves carry only a CommonName. commonname off leaves
+// the subject empty and the names in the SANs alone, which is what modern
+// verifiers look at; keep it on for ancient clients that still read the CN.
+// Leaves already minted keep their subject until they expire.
+type subject struct {
+	Organization string `json:"organization,omitempty"`
+	Country      string `json:"country,omitempty"`
+	Unit         string `json:"unit,omitempty"`
+	NoCommonName bool   `json:"no_common_name,omitempty"`
+}
+
+var leafSubject atomic.Value // *subject
+
+func currentSubject() *subject {
+	if s, ok := leafSubject.Load().(*subject); ok {
+		return s
+	}
+	return &subject{}
+}
+
+// name is the subject of the leaf for cn.
+func (s *subject) name(cn string) pkix.Name {
+	var n pkix.Name
+	if !s.NoCommonName {
+		n.CommonName = cn
+	}
+	if s.Organization != "" {
+		n.Organization = []string{s.Organization}
+	}
+	if s.Country != "" {
+		n.Country = []string{s.Country}
+	}
+	if s.Unit != "" {
+		n.OrganizationalUnit = []string{s.Unit}
+	}
+	return n
+}
+
+// loadSubject reads subjectFile into leafSubject. A missing file means the
+// minimal subject; a bad line is logged and skipped.
+func loadSubject() {
+	s := &subject{}
+	defer func() { leafSubject.Store(s) }()
+
+	fil, err := os.Open(subjectFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return
+	}
+	defer func() {
+		if err := fil.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(fil)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		value := strings.Join(fields[1:], " ")
+		switch fields[0] {
+		case "organization":
+			s.Organization = value
+		case "country":
+			if len(value) != 2 {
+				log.Errorf("%s: country needs a two-letter code: %s", subjectFile, scanner.Text())
+				continue
+			}
+			s.Country = strings.ToUpper(value)
+		case "unit":
+			s.Unit = value
+		case "commonname":
+			switch value {
+			case "on":
+				s.NoCommonName = false
+			case "off":
+				s.NoCommonName = true
+			default:
+				log.Errorf("%s: commonname is on or off: %s", subjectFile, scanner.Text())
+			}
+		default:
+			log.Errorf("%s: unknown field: %s", subjectFile, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error(err)
+	}
+}
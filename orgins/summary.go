@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metricsSnapshot reads every counter and gauge once, after sampleGauges.
+func metricsSnapshot() map[string]int64 {
+	sampleGauges()
+	ret := make(map[string]int64)
+	metrics.Range(func(k, v interface{}) bool {
+		ret[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return ret
+}
+
+// labelOf is the value of label in name if it's a metric of base, e.g.
+// "spoofed" for dns_decisions_total{decision="spoofed"}.
+func labelOf(name, base, label string) (string, bool) {
+	if !strings.HasPrefix(name, base+"{") {
+		return "", false
+	}
+	i := strings.Index(name, label+`="`)
+	if i < 0 {
+		return "", false
+	}
+	val, err := strconv.QuotedPrefix(name[i+len(label)+1:])
+	if err != nil {
+		return "", false
+	}
+	val, err = strconv.Unquote(val)
+	return val, err == nil
+}
+
+// summarizer turns two snapshots of the registry into the summary line:
+// gauges as they are now, counters as what they grew by since the last.
+// The counters themselves are never reset, so /metrics stays monotonic;
+// each interval gets exactly what was counted after the last read of it.
+type summarizer struct {
+	prev map[string]int64
+	at   time.Time
+}
+
+func (s *summarizer) fields(now time.Time, cur map[string]int64) log.Fields {
+	secs := now.Sub(s.at).Seconds()
+	delta := func(name string) int64 { return cur[name] - s.prev[name] }
+	rate := func(n int64, per float64) float64 { return math.Round(float64(n)/secs*per*100) / 100 }
+
+	var accepted, hits, misses int64
+	failures := make(map[string]int64)
+	f := log.Fields{
+		"interval":      now.Sub(s.at).Round(time.Second),
+		"conns_open":    cur["conns_open"],
+		"leaves_cached": cur["leaves_cached"],
+		"upstreams":     strconv.FormatInt(cur["upstreams_healthy"], 10) + "/" + strconv.FormatInt(cur["upstreams_total"], 10),
+	}
+	for name := range cur {
+		if _, ok := labelOf(name, "tls_accepts_total", "listener"); ok {
+			accepted += delta(name)
+		}
+		if d, ok := labelOf(name, "dns_decisions_total", "decision"); ok {
+			f["dns_qps_"+d] = rate(delta(name), 1)
+		}
+		if r, ok := labelOf(name, "resolve_cache_total", "result"); ok {
+			if r == "hit" {
+				hits += delta(name)
+			} else {
+				misses += delta(name)
+			}
+		}
+		if kind, ok := labelOf(name, "relay_failures_total", "kind"); ok && delta(name) > 0 {
+			failures[kind] = delta(name)
+		}
+	}
+	f["conns_per_min"] = rate(accepted, 60)
+	if hits+misses > 0 {
+		f["resolve_hit_rate"] = math.Round(float64(hits)/float64(hits+misses)*1000) / 1000
+	}
+	kinds := make([]string, 0, len(failures))
+	for kind := range failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if failures[kinds[i]] != failures[kinds[j]] {
+			return failures[kinds[i]] > failures[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	if len(kinds) > 3 {
+		kinds = kinds[:3]
+	}
+	for i, kind := range kinds {
+		kinds[i] = kind + "=" + strconv.FormatInt(failures[kind], 10)
+	}
+	f["top_failures"] = strings.Join(kinds, " ")
+	s.prev, s.at = cur, now
+	return f
+}
+
+// pollingSummary logs the summary line every summaryInterval, if it's set.
+func pollingSummary() {
+	if summaryInterval <= 0 {
+		return
+	}
+	s := &summarizer{prev: metricsSnapshot(), at: time.Now()}
+	go func() {
+		for {
+			time.Sleep(summaryInterval)
+			log.WithFields(s.fields(time.Now(), metricsSnapshot())).Info("summary")
+		}
+	}()
+}
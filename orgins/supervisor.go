@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The components' serve loops are run by the supervisor, each in its own
+// goroutine. A mandatory component that fails, to open or while serving,
+// stops the others through retire, draining as after an upgrade, and main
+// exits with its exit code; an optional one, the admin API or the health
+// port, is only logged and marked down in /status and the health line.
+// Before either, a listener that couldn't be bound or was closed under its
+// loop is opened again as the component's restartPolicy says.
+
+// restartPolicy is how often a component is opened again before it's taken
+// to have failed: tries times in a row, backoff after the first failure
+// and twice as long after each next one.
+type restartPolicy struct {
+	tries   int
+	backoff time.Duration
+}
+
+// restartsOf is the restartPolicy of the component name, componentRestarts
+// and componentBackoff unless the config file says otherwise.
+func restartsOf(name string) restartPolicy {
+	if p, ok := currentSettings().restarts[name]; ok {
+		return p
+	}
+	return restartPolicy{componentRestarts, componentBackoff}
+}
+
+// parseRestartPolicy reads a policy of the restarts section, such as
+// "tries=5 backoff=1s", what's left out being the default's.
+func parseRestartPolicy(spec string) (restartPolicy, string) {
+	p := restartPolicy{componentRestarts, componentBackoff}
+	for _, opt := range strings.Fields(spec) {
+		eq := strings.IndexByte(opt, '=')
+		if eq < 0 {
+			return p, "want tries=N backoff=DURATION, got " + opt
+		}
+		switch v := opt[eq+1:]; opt[:eq] {
+		case "tries":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return p, "tries needs a number from 0 on"
+			}
+			p.tries = n
+		case "backoff":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > time.Minute {
+				return p, "backoff needs a duration up to 1m, such as \"500ms\""
+			}
+			p.backoff = d
+		default:
+			return p, "unknown option " + opt[:eq]
+		}
+	}
+	return p, ""
+}
+
+func (p restartPolicy) String() string {
+	return fmt.Sprintf("tries=%d backoff=%s", p.tries, p.backoff)
+}
+
+// errStoppedServing is a serve loop returning with nobody having stopped it,
+// its listener closed under it.
+var errStoppedServing = errors.New("stopped serving, its listener was closed")
+
+// restartable reports whether err may go away with the listener opened
+// again: the address still taken or not there yet, or the listener gone.
+func restartable(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) || err == errStoppedServing {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// supervisor runs the serve loops of comps, stopping them all with stop
+// when a mandatory one fails.
+type supervisor struct {
+	comps    []*component
+	stop     func()
+	stopping int32 // 1 once stop was called, serve loops returning then being no failure
+
+	mu   sync.Mutex
+	err  error             // the mandatory component's failing, a *setupError
+	down map[string]string // optional components failed, with why
+	// names of down, for the health line to read without a lock
+	downList atomic.Value
+}
+
+// sup is main's supervisor, nil in tests.
+var sup *supervisor
+
+func newSupervisor(comps []*component, stop func()) *supervisor {
+	return &supervisor{comps: comps, stop: stop, down: make(map[string]string)}
+}
+
+// open opens the enabled components, each as its restartPolicy says. An
+// optional one that can't be opened is marked down and not served.
+func (s *supervisor) open() error {
+	for _, c := range s.comps {
+		if !c.enabled {
+			continue
+		}
+		err := c.open()
+		for tries := 0; err != nil && restartable(err) && tries < restartsOf(c.name).tries; tries++ {
+			wait := restartsOf(c.name).backoff << uint(tries)
+			log.Warnf("%s: %s, trying again in %s", c.name, err, wait)
+			time.Sleep(wait)
+			err = c.open()
+		}
+		if err != nil {
+			if c.mandatory {
+				return &setupError{c.exit, fmt.Errorf("%s: %w", c.name, err)}
+			}
+			s.markDown(c, err)
+		}
+	}
+	return nil
+}
+
+// start runs the serve loops of the components open opened.
+func (s *supervisor) start() {
+	for _, c := range s.comps {
+		if !c.enabled || s.isDown(c.name) {
+			continue
+		}
+		metricAdd(metricName("components_enabled", "component", c.name), 1)
+		metricSet(metricName("component_up", "component", c.name), 1)
+		go s.supervise(c)
+	}
+}
+
+// supervise serves c till it's stopped, opening it again while its
+// failures are restartable and its restartPolicy lets it.
+func (s *supervisor) supervise(c *component) {
+	err := c.serve()
+	for tries := 0; ; tries++ {
+		if s.stopped() {
+			return
+		}
+		if err == nil {
+			err = errStoppedServing
+		}
+		p := restartsOf(c.name)
+		if !restartable(err) || tries >= p.tries {
+			s.fail(c, err)
+			return
+		}
+		wait := p.backoff << uint(tries)
+		logThrottled.Warnf("restart "+c.name, "%s: %s, opening it again in %s", c.name, err, wait)
+		metricAdd(metricName("component_restarts_total", "component", c.name), 1)
+		time.Sleep(wait)
+		if s.stopped() {
+			return
+		}
+		began := time.Now()
+		if err = c.open(); err == nil {
+			err = c.serve()
+			if time.Since(began) > time.Minute {
+				tries = -1 // served a while, the next failure is a first one
+			}
+		}
+	}
+}
+
+// fail marks c down if it's optional, or stops the others if it isn't.
+func (s *supervisor) fail(c *component, err error) {
+	metricAdd(metricName("component_failures_total", "component", c.name), 1)
+	if !c.mandatory {
+		s.markDown(c, err)
+		return
+	}
+	log.Errorf("%s: %s", c.name, err)
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = &setupError{c.exit, fmt.Errorf("%s: %w", c.name, err)}
+	}
+	s.mu.Unlock()
+	metricSet(metricName("component_up", "component", c.name), 0)
+	emit(evComponentFailed, map[string]interface{}{"component": c.name, "error": err.Error()})
+	s.shutdown(c.name + " failed")
+}
+
+func (s *supervisor) markDown(c *component, err error) {
+	log.Errorf("%s failed, serving on without it: %s", c.name, err)
+	s.mu.Lock()
+	s.down[c.name] = err.Error()
+	var names []string
+	for name := range s.down {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s.downList.Store(names)
+	s.mu.Unlock()
+	metricSet(metricName("component_up", "component", c.name), 0)
+	emit(evComponentFailed, map[string]interface{}{"component": c.name, "error": err.Error()})
+}
+
+func (s *supervisor) isDown(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.down[name]
+	return ok
+}
+
+// downNames are the optional components down, sorted; none without a
+// supervisor.
+func (s *supervisor) downNames() []string {
+	if s == nil {
+		return nil
+	}
+	names, _ := s.downList.Load().([]string)
+	return names
+}
+
+// downReport is the optional components down with why, for /status.
+func (s *supervisor) downReport() map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.down) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(s.down))
+	for name, why := range s.down {
+		ret[name] = why
+	}
+	return ret
+}
+
+// shutdown stops every component, once, saying why.
+func (s *supervisor) shutdown(why string) {
+	if !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return
+	}
+	log.Infof("%s, stopping", why)
+	s.stop()
+}
+
+func (s *supervisor) stopped() bool { return atomic.LoadInt32(&s.stopping) == 1 }
+
+// failure is the failing of the mandatory component that stopped the
+// others, nil if none did.
+func (s *supervisor) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// serveAll runs loops, the serve loops of one component's listeners, till
+// they've all returned: once one has, stop makes the others return too.
+// The error is the first one's.
+func serveAll(stop func(), loops ...func() error) error {
+	if len(loops) == 0 {
+		return nil
+	}
+	errs := make(chan error, len(loops))
+	for _, loop := range loops {
+		go func(loop func() error) { errs <- loop() }(loop)
+	}
+	err := <-errs
+	stop()
+	for range loops[1:] {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
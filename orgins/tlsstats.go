@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tlsVersions names the versions connections are counted by; anything
+// else is "other".
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+var clientTLSMin uint16 = minClientTLS
+
+// tlsSeen counts relayed connections by leg, version, cipher family and
+// ALPN, each of them from a short list so the counters stay few.
+var tlsSeen sync.Map // tlsKey -> *int64
+
+type tlsKey struct {
+	Leg     string `json:"leg"` // client or upstream
+	Version string `json:"version"`
+	Cipher  string `json:"cipher"`
+	ALPN    string `json:"alpn"`
+}
+
+type tlsCount struct {
+	tlsKey
+	Conns int64 `json:"conns"`
+}
+
+func tlsVersionName(v uint16) string {
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return "other"
+}
+
+// cipherFamily is the bulk cipher of suite, which is what tells modern
+// clients from legacy ones; the key exchange varies too much to count by.
+func cipherFamily(suite uint16) string {
+	name := tls.CipherSuiteName(suite)
+	switch {
+	case strings.Contains(name, "_GCM_"):
+		return "aes-gcm"
+	case strings.Contains(name, "CHACHA20"):
+		return "chacha20"
+	case strings.Contains(name, "_CBC_") && strings.Contains(name, "3DES"):
+		return "3des"
+	case strings.Contains(name, "_CBC_"):
+		return "aes-cbc"
+	case strings.Contains(name, "RC4"):
+		return "rc4"
+	}
+	return "other"
+}
+
+func alpnName(proto string) string {
+	switch proto {
+	case "":
+		return "none"
+	case "h2", "http/1.1", "h3":
+		return proto
+	}
+	return "other"
+}
+
+// connectionState is what has a TLS ConnectionState, like *tls.Conn and the
+// wrappers of upstream legs.
+type connectionState interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// countTLS counts the handshake of one leg of a relayed connection, in
+// metrics and for /status.
+func countTLS(leg string, c interface{}) {
+	cs, ok := c.(connectionState)
+	if !ok {
+		return
+	}
+	st := cs.ConnectionState()
+	k := tlsKey{leg, tlsVersionName(st.Version), cipherFamily(st.CipherSuite), alpnName(st.NegotiatedProtocol)}
+	val, ok := tlsSeen.Load(k)
+	if !ok {
+		val, _ = tlsSeen.LoadOrStore(k, metricCounter(metricName("tls_connections_total",
+			"leg", k.Leg, "version", k.Version, "cipher", k.Cipher, "alpn", k.ALPN)))
+	}
+	atomic.AddInt64(val.(*int64), 1)
+}
+
+// tlsFields adds what leg negotiated on c to the access log fields.
+func tlsFields(fields log.Fields, leg string, c interface{}) {
+	cs, ok := c.(connectionState)
+	if !ok {
+		return
+	}
+	st := cs.ConnectionState()
+	fields[leg+"_tls"] = tlsVersionName(st.Version)
+	fields[leg+"_cipher"] = tls.CipherSuiteName(st.CipherSuite)
+	fields[leg+"_alpn"] = st.NegotiatedProtocol
+}
+
+// tlsReport lists the counts of tlsSeen, for /status.
+func tlsReport() []tlsCount {
+	ret := []tlsCount{}
+	tlsSeen.Range(func(key, val interface{}) bool {
+		ret = append(ret, tlsCount{key.(tlsKey), atomic.LoadInt64(val.(*int64))})
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i].tlsKey, ret[j].tlsKey
+		if a.Leg != b.Leg {
+			return a.Leg < b.Leg
+		}
+		return ret[i].Conns > ret[j].Conns
+	})
+	return ret
+}
+
+// tooOldTLS reports whether the best version a client offers is below
+// minClientTLS, 0 letting every version crypto/tls takes through.
+func tooOldTLS(hello *tls.ClientHelloInfo) bool {
+	if clientTLSMin == 0 {
+		return false
+	}
+	for _, v := range hello.SupportedVersions {
+		if v&0x0f0f != 0x0a0a && v >= clientTLSMin { // GREASE values aren't versions
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var transparent = flag.Bool("transparent", false,
+	"the TLS port gets intercepted traffic (nftables redirect or TPROXY), so connections without SNI are relayed to their original destination")
+
+// ipRule sends connections without SNI to a range through a route:
+//
+//	10.8.0.0/16 route=wg
+//	2001:db8:42::/48 route=corp
+//
+// Destinations no rule covers are relayed directly.
+type ipRule struct {
+	net   *net.IPNet
+	route string
+}
+
+var ipRules []*ipRule // no async r & w so ok
+
+// loadIPRules reads ipRulesFile, most specific range first. A missing file
+// just means everything is relayed directly.
+func loadIPRules() []*ipRule {
+	var ret []*ipRule
+	fil, err := os.Open(ipRulesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return nil
+	}
+	defer func() {
+		if err := fil.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(fil)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		_, n, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			log.Errorf("bad cidr %s", fields[0])
+			continue
+		}
+		name := parseOpts(fields[1:])["route"]
+		if _, ok := currentSettings().routes[name].(proxyRoute); !ok {
+			log.Errorf("%s: route needs to name a socks or http route, not %q", fields[0], name)
+			continue
+		}
+		ret = append(ret, &ipRule{net: n, route: name})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		oi, _ := ret[i].net.Mask.Size()
+		oj, _ := ret[j].net.Mask.Size()
+		return oi > oj
+	})
+	return ret
+}
+
+func matchIPRule(ip net.IP) *ipRule {
+	for _, r := range ipRules {
+		if r.net.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// interceptedDst is where a connection was headed in -transparent mode, nil
+// if it was made to the proxy itself or transparent mode is off.
+func interceptedDst(c net.Conn) *net.TCPAddr {
+	if !*transparent {
+		return nil
+	}
+	dst, err := originalDst(c)
+	if err != nil {
+		log.Debugf("%s: no original destination: %s", c.RemoteAddr(), err)
+		return nil
+	}
+	if local, ok := c.LocalAddr().(*net.TCPAddr); ok && dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		return nil
+	}
+	return dst
+}
+
+// relayByIP relays a connection without SNI to dst, through the route of its
+// ipRule if any, without looking at the bytes.
+func relayByIP(pc *peekConn, dst *net.TCPAddr) {
+	began := time.Now()
+	decision, via := "pass", "direct"
+	var d rawDialer = upstreamDialer.(rawDialer)
+	if r := matchIPRule(dst.IP); r != nil {
+		decision, via = "proxy", r.route
+		d = currentSettings().routes[r.route].(proxyRoute).d.(rawDialer)
+	}
+	metricAdd(metricName("relay_decisions_total", "by", "ip", "decision", decision), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	up, err := d.DialContext(ctx, dst.String())
+	cancel()
+	if err != nil {
+		logThrottled.Warnf(dst.String(), "%s via %s: %s", dst, via, err)
+		return
+	}
+	defer closeConn(up)
+	upN, downN, ended := splice(pc, up, relayLimitsFor(nil, via))
+
+	pc.log.WithFields(log.Fields{
+		"host":   "",
+		"mode":   "ip",
+		"route":  via,
+		"addr":   dst.String(),
+		"up":     upN,
+		"down":   downN,
+		"dur":    time.Since(began).Round(time.Millisecond),
+		"closed": ended,
+	}).Info("access")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// spoofTTL is how long clients may keep a spoofed answer for r: its ttl
+// option or spoofTtl, and with adaptiveTtl no longer than the rule has gone
+// unchanged.
+func spoofTTL(r *rule, now time.Time) time.Duration {
+	max := spoofTtl
+	if r.ttl > 0 {
+		max = r.ttl
+	}
+	if !adaptiveTtl {
+		return max
+	}
+	return adaptTTL(max, now.Sub(r.since))
+}
+
+// adaptTTL grows from spoofTtlMin for a rule just added or changed to max for
+// one unchanged that long, so a rule being edited doesn't linger in caches.
+func adaptTTL(max, age time.Duration) time.Duration {
+	ttl := age.Truncate(time.Second)
+	if ttl < spoofTtlMin {
+		ttl = spoofTtlMin
+	}
+	if ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// signature is what tells a changed rule from the same one reloaded.
+func (r *rule) signature() string {
+	c := *r
+	c.source, c.line, c.since = "", 0, time.Time{}
+	return fmt.Sprintf("%+v", c)
+}
+
+// carrySince sets when each rule of vs was last changed: unchanged ones keep
+// the time from the view of the same name in old, others get now.
+func carrySince(old, vs []*view, now time.Time) {
+	for _, v := range vs {
+		var prev map[string]*rule
+		for _, o := range old {
+			if o.name == v.name {
+				prev = o.table
+			}
+		}
+		for d, r := range v.table {
+			r.since = now
+			if p, ok := prev[d]; ok && p.signature() == r.signature() {
+				r.since = p.since
+			}
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// upgradeEnv names the fds a process started by upgrade inherits, from 3 on,
+// comma-separated: the listeners, then the snapshot and ready pipes.
+const upgradeEnv = "SNIPROXY_INHERIT"
+
+// serving holds the listeners main opened, so they can be handed to a new
+// binary and then stopped; those of components that are off stay nil. Set
+// up by main, and again by a component's open when it's restarted.
+var serving struct {
+	dnsUDP []net.PacketConn // one of each per -dns-listen address
+	dnsTCP []net.Listener
+	http   net.Listener
+	admin  net.Listener // also nil if adminAddr couldn't be bound
+	health net.Listener
+	tls    []net.Listener
+}
+
+// shutdowner is a server retire stops, as http.Server.
+type shutdowner interface{ Shutdown(context.Context) error }
+
+var (
+	serversLock sync.Mutex
+	servers     []shutdowner // those serving, see trackServer
+)
+
+// trackServer adds srv to what retire stops, returning what takes it out
+// again once it's done serving.
+func trackServer(srv shutdowner) func() {
+	serversLock.Lock()
+	servers = append(servers, srv)
+	serversLock.Unlock()
+	return func() {
+		serversLock.Lock()
+		defer serversLock.Unlock()
+		for i, s := range servers {
+			if s == srv {
+				servers = append(servers[:i], servers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// closeAll closes ls, as a component's serve loops stop or its open starts
+// afresh.
+func closeAll(ls []net.Listener) {
+	for _, l := range ls {
+		if err := l.Close(); err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+var (
+	upgrading int32                 // 1 while a new binary is being started
+	retired   = make(chan struct{}) // closed once retire has drained
+	inherited map[string][]*os.File // by name, taken as used
+)
+
+func init() {
+	names := os.Getenv(upgradeEnv)
+	if names == "" {
+		return
+	}
+	_ = os.Unsetenv(upgradeEnv) // not for our own children
+	inherited = make(map[string][]*os.File)
+	for i, name := range strings.Split(names, ",") {
+		inherited[name] = append(inherited[name], os.NewFile(uintptr(3+i), name))
+	}
+}
+
+// inheritedFile returns the next fd handed over as name, nil if none.
+func inheritedFile(name string) *os.File {
+	fs := inherited[name]
+	if len(fs) == 0 {
+		return nil
+	}
+	inherited[name] = fs[1:]
+	return fs[0]
+}
+
+// listenInherited returns the TCP listener handed over as name, or opens
+// one with listen.
+func listenInherited(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	f := inheritedFile(name)
+	if f == nil {
+		return listen()
+	}
+	defer func() { _ = f.Close() }()
+	return net.FileListener(f)
+}
+
+// openListeners binds what the enabled components of s serve, or takes it
+// over from the process that started us. Listeners handed over for
+// components that are off here are closed.
+func openListeners(s *supervisor) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	for _, name := range listenerNames {
+		for f := inheritedFile(name); f != nil; f = inheritedFile(name) {
+			log.Infof("upgrade: %s listener handed over but not enabled, closing it", name)
+			_ = f.Close()
+		}
+	}
+	return nil
+}
+
+// snapshot is what a new binary gets from the old one besides the
+// listeners, so it doesn't start cold. Deadlines go over on the wall clock,
+// the monotonic one being the process's own.
+type snapshot struct {
+	Epoch   int64                  `json:"epoch"`
+	Resolv  map[string]resolvRec   `json:"resolv"`
+	Neg     map[string]time.Time   `json:"neg"`
+	Suspect map[string]time.Time   `json:"suspect"`
+	Leaves  map[string]time.Time   `json:"leaves"` // leafUsed, for the warm-up
+	Pins    map[string]*pin        `json:"pins"`
+	Clients map[string]*clientStat `json:"clients"`
+}
+
+type resolvRec struct {
+	Addr   string    `json:"addr"`
+	Expire time.Time `json:"expire"`
+	DNSSEC string    `json:"dnssec,omitempty"`
+}
+
+func takeSnapshot() *snapshot {
+	s := &snapshot{
+		Epoch:   atomic.LoadInt64(&configEpoch),
+		Resolv:  make(map[string]resolvRec),
+		Neg:     make(map[string]time.Time),
+		Suspect: make(map[string]time.Time),
+		Leaves:  make(map[string]time.Time),
+		Pins:    make(map[string]*pin),
+		Clients: copyClients(),
+	}
+	cacheResolv.Range(func(key, val interface{}) bool {
+		if r := val.(*Resolv); !r.Expired() {
+			s.Resolv[key.(string)] = resolvRec{r.addr, r.expire.wall(), r.dnssec}
+		}
+		return true
+	})
+	deadlines := func(m *budgetMap, into map[string]time.Time) {
+		m.Range(func(key, val interface{}) bool {
+			if d := val.(deadline); !d.passed() {
+				into[key.(string)] = d.wall()
+			}
+			return true
+		})
+	}
+	deadlines(cacheNeg, s.Neg)
+	deadlines(suspectAddr, s.Suspect)
+	leafUsed.Range(func(key, val interface{}) bool {
+		s.Leaves[key.(string)] = val.(time.Time)
+		return true
+	})
+	stickyPins.Range(func(key, val interface{}) bool {
+		if p := val.(*pin); !p.expire.passed() {
+			s.Pins[key.(string)] = p
+		}
+		return true
+	})
+	return s
+}
+
+// restoreSnapshot loads the snapshot handed over by the old binary, if we
+// were started by one. Called before the first updateConfig, so epochs
+// carry on from the old process.
+func restoreSnapshot() error {
+	f := inheritedFile("snapshot")
+	if f == nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	_ = f.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	var s snapshot
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&configEpoch, s.Epoch)
+	for host, r := range s.Resolv {
+		cacheResolv.Store(host, &Resolv{addr: r.Addr, expire: deadlineAt(r.Expire), dnssec: r.DNSSEC})
+	}
+	for host, t := range s.Neg {
+		cacheNeg.Store(host, deadlineAt(t))
+	}
+	for addr, t := range s.Suspect {
+		suspectAddr.Store(addr, deadlineAt(t))
+	}
+	for cn, t := range s.Leaves {
+		// derived with the suffix list of the binary before, maybe another
+		if derivedCN(cn) {
+			leafUsed.Store(cn, t)
+		}
+	}
+	for host, p := range s.Pins {
+		stickyPins.Store(host, p)
+	}
+	restoreClients(s.Clients)
+	log.Infof("took over epoch %d, %d resolved addrs, %d pins", s.Epoch, len(s.Resolv), len(s.Pins))
+	return nil
+}
+
+// signalReady tells the process that started us we're serving, so it can
+// stop. Does nothing if we weren't started by upgrade.
+func signalReady() {
+	f := inheritedFile("ready")
+	if f == nil {
+		return
+	}
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Errorf("upgrade: %s", err)
+	}
+	_ = f.Close()
+}
+
+// upgrade starts the binary at our path with our arguments, handing it the
+// listeners and a snapshot, and waits up to upgradeTimeout for it to serve.
+// On success we stop accepting and retire in the background; on failure the
+// new process is killed and we go on serving.
+func upgrade() error {
+	if !upgradeSupported {
+		return errors.New("upgrade: not supported here")
+	}
+	if !atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+		return errors.New("upgrade: already in progress")
+	}
+	err := startSuccessor()
+	if err != nil {
+		atomic.StoreInt32(&upgrading, 0)
+		emit(evUpgradeFailed, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	go sup.shutdown("upgrade: handed over")
+	return nil
+}
+
+func startSuccessor() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	add := func(name string, l interface{ File() (*os.File, error) }) error {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		files = append(files, f)
+		return nil
+	}
+	for i := range serving.dnsUDP {
+		if err := add("dns-udp", serving.dnsUDP[i].(*net.UDPConn)); err != nil {
+			return err
+		}
+		if err := add("dns-tcp", serving.dnsTCP[i].(*net.TCPListener)); err != nil {
+			return err
+		}
+	}
+	if serving.http != nil {
+		if err := add("http", serving.http.(*net.TCPListener)); err != nil {
+			return err
+		}
+	}
+	if serving.admin != nil {
+		if err := add("admin", serving.admin.(*net.TCPListener)); err != nil {
+			return err
+		}
+	}
+	for _, l := range serving.tls {
+		if err := add("tls", l.(*net.TCPListener)); err != nil {
+			return err
+		}
+	}
+	if serving.health != nil {
+		if err := add("health", serving.health.(*net.TCPListener)); err != nil {
+			return err
+		}
+	}
+	snapR, snapW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = snapW.Close() }()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		_ = snapR.Close()
+		return err
+	}
+	defer func() { _ = readyR.Close() }()
+	names = append(names, "snapshot", "ready")
+	files = append(files, snapR, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	for _, f := range files {
+		_ = f.Close() // the child has its own copies now
+	}
+	files = nil
+	log.Infof("upgrade: started %s as pid %d", exe, cmd.Process.Pid)
+
+	fail := func(err error) error {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	if err := json.NewEncoder(snapW).Encode(takeSnapshot()); err != nil {
+		return fail(err)
+	}
+	_ = snapW.Close()
+	_ = readyR.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := io.ReadFull(readyR, make([]byte, 1)); err != nil {
+		if err == io.EOF {
+			err = errors.New("new process exited before serving")
+		}
+		return fail(errors.New("upgrade: " + err.Error()))
+	}
+	_ = cmd.Process.Release()
+	emit(evUpgraded, map[string]interface{}{"pid": cmd.Process.Pid})
+	return nil
+}
+
+// retire stops accepting on every listener, handed over to a new process
+// or given up on with a component that failed, then waits up to
+// upgradeDrain for the relays in flight before letting main exit.
+func retire() {
+	log.Infof("draining %d connections", atomic.LoadInt64(&openConns))
+	closeAll(serving.tls)
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeDrain)
+	defer cancel()
+	serversLock.Lock()
+	stopping := append([]shutdowner(nil), servers...)
+	serversLock.Unlock()
+	for _, s := range stopping {
+		go func(s shutdowner) {
+			if err := s.Shutdown(ctx); err != nil {
+				log.Debug(err)
+			}
+		}(s)
+	}
+	for atomic.LoadInt64(&openConns) > 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&openConns); n > 0 {
+		log.Warnf("upgrade: exiting with %d connections left", n)
+	}
+	close(retired)
+}
+
+// dnsServer adapts dns.Server to the Shutdown of http.Server.
+type dnsServer struct {
+	*dns.Server
+}
+
+func (s dnsServer) Shutdown(ctx context.Context) error {
+	return s.ShutdownContext(ctx)
+}
+
+// upgradeHandler is POST /upgrade on the admin API.
+func upgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := upgrade(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const upgradeSupported = true
+
+// watchUpgradeSignal upgrades to the binary at our path on SIGUSR2.
+func watchUpgradeSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			if err := upgrade(); err != nil {
+				log.Errorf("upgrade: %s", err)
+			}
+		}
+	}()
+}
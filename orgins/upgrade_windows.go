@@ -0,0 +1,6 @@
+package main
+
+// no fd inheritance to hand listeners over with
+const upgradeSupported = false
+
+func watchUpgradeSignal() {}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// upstreamWindow is how many recent exchanges an upstream's health is
+// judged on.
+const upstreamWindow = 64
+
+// upstream tracks the health of one resolver as seen from here, from real
+// queries and the periodic probe alike.
+type upstream struct {
+	addr    string
+	clients *clientPool // over the upstream's own transport
+	tcp     *clientPool // for clients asking over TCP, nil for DoT
+
+	mu      sync.Mutex
+	ok      [upstreamWindow]bool
+	rtt     [upstreamWindow]time.Duration
+	next    int
+	filled  int
+	lastOK  time.Time
+	healthy bool
+
+	latency *histogram
+	errors  map[string]*int64 // by errorKinds
+}
+
+var errorKinds = []string{"timeout", "tls", "servfail", "mismatch", "network"}
+
+var upstreams = []*upstream{
+	newUpstream(defDNS, "udp", nil),
+	newUpstream(gfwDNS, "tcp-tls", nil),
+}
+
+// newUpstream tracks the resolver at addr, asked over net: udp, with tcp
+// for clients asking over TCP, or tcp-tls checked against tlsConfig, nil
+// for the system roots.
+func newUpstream(addr, net string, tlsConfig *tls.Config) *upstream {
+	u := &upstream{
+		addr:    addr,
+		clients: newClientPool(addr, net, tlsConfig),
+		healthy: true,
+		latency: metricHistogram(metricName("dns_upstream_rtt_ms", "upstream", addr)),
+		errors:  make(map[string]*int64),
+	}
+	for _, k := range errorKinds {
+		u.errors[k] = metricCounter(metricName("dns_upstream_errors_total", "upstream", addr, "type", k))
+	}
+	if net == "udp" {
+		u.tcp = newClientPool(addr, "tcp", nil)
+	}
+	return u
+}
+
+// forwardTo is where queries for names we don't proxy go: the secure
+// resolver with privateDNS unless plain, for a plain-dns rule, else the
+// default one.
+func forwardTo(plain bool) string {
+	if currentSettings().privateForward && !plain {
+		return gfwResolver
+	}
+	return defResolver
+}
+
+// forwardOrder is the upstreams a query forwardTo sent to resolver is asked
+// by in turn, until one answers: resolver, then the secure one if resolver
+// is another, since failing over that way leaks nothing. Those their score
+// judges unhealthy are asked last.
+func forwardOrder(resolver string) []*upstream {
+	order := []*upstream{upstreamFor(resolver)}
+	if u := upstreamFor(gfwResolver); resolver != gfwResolver && u != nil {
+		order = append(order, u)
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].isHealthy() && !order[j].isHealthy() })
+	return order
+}
+
+func upstreamFor(addr string) *upstream {
+	for _, u := range upstreams {
+		if u.addr == addr {
+			return u
+		}
+	}
+	return nil
+}
+
+// transport is how u is asked a query that came over TCP if tcp: udp, tcp
+// or tls.
+func (u *upstream) transport(tcp bool) string {
+	switch {
+	case u.clients.net == "tcp-tls":
+		return "tls"
+	case tcp:
+		return "tcp"
+	}
+	return "udp"
+}
+
+// errorKind sorts a failed exchange into one of errorKinds, "" if it wasn't one.
+func errorKind(r *dns.Msg, err error) string {
+	var nerr net.Error
+	var rerr tls.RecordHeaderError
+	var cerr x509.UnknownAuthorityError
+	var herr x509.HostnameError
+	switch {
+	case err == nil && r != nil && r.Rcode == dns.RcodeServerFailure:
+		return "servfail"
+	case err == nil:
+		return ""
+	case errors.Is(err, errCaseMismatch):
+		return "mismatch"
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	case errors.As(err, &rerr), errors.As(err, &cerr), errors.As(err, &herr):
+		return "tls"
+	default:
+		return "network"
+	}
+}
+
+// record notes the outcome of an exchange with u.
+func (u *upstream) record(r *dns.Msg, rtt time.Duration, err error) {
+	kind := errorKind(r, err)
+	if kind != "" {
+		atomic.AddInt64(u.errors[kind], 1)
+	} else {
+		u.latency.observe(rtt)
+	}
+
+	u.mu.Lock()
+	u.ok[u.next] = kind == ""
+	u.rtt[u.next] = rtt
+	u.next = (u.next + 1) % upstreamWindow
+	if u.filled < upstreamWindow {
+		u.filled++
+	}
+	if kind == "" {
+		u.lastOK = time.Now()
+	}
+	// judged on a few samples at least, so one timeout doesn't flap it
+	okN := 0
+	for i := 0; i < u.filled; i++ {
+		if u.ok[i] {
+			okN++
+		}
+	}
+	healthy := u.filled < 8 || okN*2 >= u.filled
+	changed := healthy != u.healthy
+	u.healthy = healthy
+	u.mu.Unlock()
+
+	if changed {
+		typ, down := evUpstreamHealthy, int64(-1)
+		if !healthy {
+			typ, down = evUpstreamUnhealthy, 1
+		}
+		atomic.AddInt64(&upstreamsDown, down)
+		emit(typ, map[string]interface{}{"upstream": u.addr, "last_error": kind})
+	}
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// lastSuccess is the unix time of u's last successful exchange, 0 if none.
+func (u *upstream) lastSuccess() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.lastOK.IsZero() {
+		return 0
+	}
+	return u.lastOK.Unix()
+}
+
+// upstreamStatus is the /status view of an upstream.
+type upstreamStatus struct {
+	Addr        string           `json:"addr"`
+	Score       float64          `json:"score"` // successes in the window, 0 to 1
+	Samples     int              `json:"samples"`
+	P50         float64          `json:"p50_ms"`
+	P95         float64          `json:"p95_ms"`
+	LastSuccess *time.Time       `json:"last_success,omitempty"`
+	Errors      map[string]int64 `json:"errors"`
+	Clients     clientStats      `json:"clients"`
+}
+
+// clientStats is how an upstream's clients were handed out.
+type clientStats struct {
+	Hits int64 `json:"hits"` // reused from the pool
+	Made int64 `json:"made"`
+	Idle int   `json:"idle"`
+}
+
+func (u *upstream) status() *upstreamStatus {
+	u.mu.Lock()
+	st := &upstreamStatus{Addr: u.addr, Samples: u.filled, Errors: map[string]int64{}}
+	if !u.lastOK.IsZero() {
+		last := u.lastOK
+		st.LastSuccess = &last
+	}
+	var rtts []time.Duration
+	for i := 0; i < u.filled; i++ {
+		if u.ok[i] {
+			rtts = append(rtts, u.rtt[i])
+		}
+	}
+	u.mu.Unlock()
+
+	for k, c := range u.errors {
+		st.Errors[k] = atomic.LoadInt64(c)
+	}
+	for _, p := range []*clientPool{u.clients, u.tcp} {
+		if p != nil {
+			st.Clients.Hits += atomic.LoadInt64(p.hits)
+			st.Clients.Made += atomic.LoadInt64(p.made)
+			st.Clients.Idle += p.idleCount()
+		}
+	}
+	if st.Samples == 0 {
+		st.Score = 1 // not judged yet
+		return st
+	}
+	st.Score = float64(len(rtts)) / float64(st.Samples)
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		ms := func(q float64) float64 {
+			return float64(rtts[int(q*float64(len(rtts)-1))]) / float64(time.Millisecond)
+		}
+		st.P50, st.P95 = ms(0.5), ms(0.95)
+	}
+	return st
+}
+
+// probeUpstreams asks every upstream for the root NS set, so a resolver is judged
+// even while no client asks it anything.
+func probeUpstreams() {
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeNS)
+	for _, u := range upstreams {
+		cli := u.client(false)
+		r, rtt, err := cli.Exchange(q, u.addr)
+		cli.put()
+		u.record(r, rtt, err)
+		if err != nil {
+			log.Debugf("probe %s: %s", u.addr, err)
+		}
+	}
+}
+
+func pollingUpstreams() {
+	go func() {
+		for {
+			probeUpstreams()
+			time.Sleep(upstreamProbeInterval)
+		}
+	}()
+}
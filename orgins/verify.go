@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+)
+
+// verifyPolicy is what verifyChain lets through beyond what crypto/x509
+// does. The zero value is strict.
+type verifyPolicy struct {
+	// a leaf without SANs is checked against its CommonName, as browsers
+	// stopped doing years ago; only for ancient internal hosts
+	cnFallback bool
+	// an expired intermediate the upstream still sends is ignored when
+	// another path, e.g. through a cross-sign, verifies without it; strict
+	// rejects the chain. A policy for SCTs would go here too
+	expiredIntermediate bool
+}
+
+var upstreamPolicy = verifyPolicy{cnFallback: verifyCNFallback, expiredIntermediate: verifyExpiredIntermediate}
+
+// Outcomes of verifyChain, naming the policy that decided, for the log.
+const (
+	chainVerified       = "verified"
+	chainCNFallback     = "cn-fallback"
+	chainSkippedExpired = "expired-intermediate-skipped"
+
+	chainUnparsable     = "unparsable"
+	chainNoSANs         = "no-sans"
+	chainNameConstraint = "name-constraint"
+	chainExpiredInterim = "expired-intermediate"
+	chainExpired        = "expired"
+	chainUnknownRoot    = "unknown-authority"
+	chainHostname       = "hostname-mismatch"
+	chainInvalid        = "invalid"
+)
+
+// chainError is a chain verifyChain rejected, and the policy it failed.
+type chainError struct {
+	policy string
+	err    error
+}
+
+func (e *chainError) Error() string { return e.policy + ": " + e.err.Error() }
+func (e *chainError) Unwrap() error { return e.err }
+
+// verifyChain verifies the certificates an upstream sent, leaf first,
+// for host against roots. It returns the policy that allowed the chain,
+// or a *chainError naming the one that rejected it.
+func verifyChain(rawCerts [][]byte, host string, roots *x509.CertPool, policy verifyPolicy) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", &chainError{chainUnparsable, errors.New("no certificates")}
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, asn1Data := range rawCerts {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			return "", &chainError{chainUnparsable, err}
+		}
+		certs[i] = cert
+	}
+	leaf := certs[0]
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	now := time.Now()
+	var expired []*x509.Certificate
+	for _, cert := range certs[1:] {
+		if now.After(cert.NotAfter) {
+			expired = append(expired, cert)
+		}
+		opts.Intermediates.AddCert(cert)
+	}
+
+	allowed := chainVerified
+	if !hasSANs(leaf) {
+		if !policy.cnFallback || !matchHostname(leaf.Subject.CommonName, host) {
+			return "", &chainError{chainNoSANs, errors.New("leaf has no SANs, only CommonName " + leaf.Subject.CommonName)}
+		}
+		opts.DNSName = "" // checked above, x509 no longer looks at the CN
+		allowed = chainCNFallback
+	}
+
+	if _, err := leaf.Verify(opts); err != nil {
+		return "", &chainError{chainFailure(err), err}
+	}
+	if len(expired) > 0 {
+		// the path that verified went around them, x509 takes no expired
+		if !policy.expiredIntermediate {
+			return "", &chainError{chainExpiredInterim, errors.New("sent expired intermediate " + expired[0].Subject.String())}
+		}
+		if allowed == chainVerified {
+			allowed = chainSkippedExpired
+		}
+	}
+	return allowed, nil
+}
+
+// chainFailure names the policy behind an x509 verification error.
+func chainFailure(err error) string {
+	var cerr x509.UnknownAuthorityError
+	var herr x509.HostnameError
+	var ierr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &cerr):
+		return chainUnknownRoot
+	case errors.As(err, &herr):
+		return chainHostname
+	case errors.As(err, &ierr) && ierr.Reason == x509.CANotAuthorizedForThisName:
+		return chainNameConstraint
+	case errors.As(err, &ierr) && ierr.Reason == x509.Expired:
+		return chainExpired
+	}
+	return chainInvalid
+}
+
+func hasSANs(cert *x509.Certificate) bool {
+	return len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 || len(cert.EmailAddresses) > 0 || len(cert.URIs) > 0
+}
+
+// matchHostname matches host against pattern, a name or *.wildcard for one
+// label, as for SANs.
+func matchHostname(pattern, host string) bool {
+	pattern, host = strings.ToLower(strings.TrimSuffix(pattern, ".")), strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "" {
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(host, '.')
+		return i > 0 && host[i:] == pattern[1:]
+	}
+	return pattern == host
+}
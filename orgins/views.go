@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// view is the rule set a group of clients sees, picked by source address
+// or by the address of ours they connect to:
+//
+//	guest cidr=192.168.20.0/24 mode=direct
+//	kids cidr=192.168.30.0/24,fd00:30::/64 sources=CONF_DOMS.ini,CONF_KIDS.ini
+//	work local=10.0.0.2 sources=CONF_WORK.ini
+//	home local=10.0.0.3 sources=CONF_DOMS.ini sightings=off
+//	default sources=CONF_DOMS.ini
+//
+// The first view whose cidr and local both match, those it has, wins;
+// unmatched clients get the default view, which uses the rule sources of
+// the settings unless the views file says otherwise. A view with local
+// answers with the address it was asked on, so its clients come back to the
+// same one; UDP DNS can only tell that with -dns-listen bound to each
+// address rather than a wildcard.
+type view struct {
+	name    string
+	nets    []*net.IPNet
+	locals  []net.IP
+	sources []string
+	direct  bool // mode=direct: nothing is proxied or blocked
+	// sightings=off: names its clients ask for aren't kept in sightings
+	noSightings bool
+
+	table map[string]*rule
+	dump  []*rule // every parsed rule in merge order, for the admin API
+	epoch int64   // configEpoch the view was built in
+
+	// counters looked up once, like the global ones
+	decisions [numDecisions]*int64
+	tlsConns  *int64
+}
+
+// viewSet is what a rule load publishes as a whole: the views in match
+// order, the default view last, and whether any has a resolve-only rule, so
+// ClientHellos need peeking.
+type viewSet struct {
+	views       []*view
+	passthrough bool
+}
+
+var viewsCur atomic.Value // *viewSet
+
+func init() {
+	viewsCur.Store(&viewSet{views: []*view{newView("default", nil, ruleSources, false)}})
+}
+
+// currentViews is the snapshot handlers read, once per request.
+func currentViews() *viewSet {
+	return viewsCur.Load().(*viewSet)
+}
+
+func newView(name string, nets []*net.IPNet, sources []string, direct bool) *view {
+	v := &view{name: name, nets: nets, sources: sources, direct: direct}
+	for i, d := range decisionNames {
+		v.decisions[i] = metricCounter(metricName("view_dns_decisions_total", "view", name, "decision", d))
+	}
+	v.tlsConns = metricCounter(metricName("view_tls_conns_total", "view", name))
+	return v
+}
+
+// viewFor returns the view of a client at addr connected to local, the
+// default one if none matches, e.g. for addresses without an IP.
+func viewFor(addr, local net.Addr) *view {
+	vs := currentViews().views
+	ip, lip := addrIP(addr), addrIP(local)
+	for _, v := range vs[:len(vs)-1] {
+		if v.matches(ip, lip) {
+			return v
+		}
+	}
+	return vs[len(vs)-1]
+}
+
+func (v *view) matches(ip, local net.IP) bool {
+	if len(v.locals) > 0 && !containsIP(v.locals, local) {
+		return false
+	}
+	if len(v.nets) == 0 {
+		return len(v.locals) > 0
+	}
+	for _, n := range v.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// spoofTo is what spoofed answers to clients of v asking on local point
+// at: the address asked for views picked by it, spoofIPv4 and spoofIPv6
+// otherwise and for the other family.
+func (v *view) spoofTo(local net.Addr) (ip4, ip6 net.IP) {
+	ip4, ip6 = spoofIPv4, spoofIPv6
+	if ip := addrIP(local); len(v.locals) > 0 && containsIP(v.locals, ip) {
+		if ip.To4() != nil {
+			ip4 = ip.To4()
+		} else {
+			ip6 = ip
+		}
+	}
+	return
+}
+
+func viewByName(name string) *view {
+	for _, v := range currentViews().views {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// match returns the rule for domain or its closest listed parent, or with
+// matchCnames for the name its CNAME chain led to, nil for direct views
+// and for names a noaaaa or plain-dns rule says are forwarded.
+func (v *view) match(domain string) *rule {
+	if r := v.matchAny(domain); r != nil && !r.forwarded() {
+		return r
+	}
+	return nil
+}
+
+// forwardedFor returns the noaaaa or plain-dns rule of v for domain, nil if
+// it has none.
+func (v *view) forwardedFor(domain string) *rule {
+	if r := v.matchAny(domain); r != nil && r.forwarded() {
+		return r
+	}
+	return nil
+}
+
+// matchAny is match with the noaaaa and plain-dns rules too.
+func (v *view) matchAny(domain string) *rule {
+	if v.direct || domain == "" {
+		return nil
+	}
+	if r := matchRule(v.table, domain); r != nil || !matchCnames {
+		return r
+	}
+	if target := aliasTarget(domain); target != "" {
+		return matchRule(v.table, target)
+	}
+	return nil
+}
+
+// loadViews reads viewsFile. A missing file just means everyone gets the
+// default view.
+func loadViews() []*view {
+	def := newView("default", nil, currentSettings().sources, false)
+	var ret []*view
+	fil, err := os.Open(viewsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return []*view{def}
+	}
+	defer func() {
+		if err := fil.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(fil)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, opts := fields[0], parseOpts(fields[1:])
+		if seen[name] {
+			log.Errorf("duplicate view %s", name)
+			continue
+		}
+		seen[name] = true
+
+		sources := currentSettings().sources
+		if s := opts["sources"]; s != "" {
+			sources = strings.Split(s, ",")
+		}
+		var direct bool
+		switch opts["mode"] {
+		case "", "proxy":
+		case "direct":
+			direct = true
+		default:
+			log.Errorf("view %s: mode is proxy or direct, not %s", name, opts["mode"])
+			continue
+		}
+		if s := opts["sightings"]; s != "" && s != "on" && s != "off" {
+			log.Errorf("view %s: sightings is on or off, not %s", name, s)
+			continue
+		}
+
+		if name == "default" {
+			if opts["cidr"] != "" || opts["local"] != "" {
+				log.Errorf("view default takes no cidr or local")
+			}
+			def = newView(name, nil, sources, direct)
+			def.noSightings = opts["sightings"] == "off"
+			continue
+		}
+		var nets []*net.IPNet
+		var locals []net.IP
+		if opts["cidr"] != "" {
+			for _, c := range strings.Split(opts["cidr"], ",") {
+				_, n, err := net.ParseCIDR(c)
+				if err != nil {
+					log.Errorf("view %s: bad cidr %s", name, c)
+					continue
+				}
+				nets = append(nets, n)
+			}
+		}
+		if opts["local"] != "" {
+			for _, a := range strings.Split(opts["local"], ",") {
+				ip := net.ParseIP(a)
+				if ip == nil || ip.IsUnspecified() {
+					log.Errorf("view %s: bad local address %s", name, a)
+					continue
+				}
+				locals = append(locals, ip)
+			}
+		}
+		// one that lost all of either would match more clients than meant
+		if len(nets) == 0 && len(locals) == 0 || opts["cidr"] != "" && len(nets) == 0 || opts["local"] != "" && len(locals) == 0 {
+			log.Errorf("view %s matches no clients", name)
+			continue
+		}
+		v := newView(name, nets, sources, direct)
+		v.locals = locals
+		v.noSightings = opts["sightings"] == "off"
+		ret = append(ret, v)
+	}
+	return append(ret, def)
+}
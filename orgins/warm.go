@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// leafUsed is when the leaf of a cn was last handed out, so the most recent
+// ones can be minted again ahead of time after a CA reload.
+var leafUsed sync.Map // cn -> time.Time
+
+// warmStatus is the /status view of the current or last warm-up.
+type warmStatus struct {
+	Running bool       `json:"running"`
+	Total   int64      `json:"total"`
+	Done    int64      `json:"done"`
+	Failed  int64      `json:"failed"`
+	Started *time.Time `json:"started,omitempty"`
+}
+
+var (
+	warmLock    sync.Mutex
+	warmCur     warmStatus
+	warmPending bool // asked for again while running
+)
+
+// leafCN is the name a leaf for host is minted for: its registrable domain
+// or its parent, covered with a wildcard. Single labels and public suffixes
+// get a leaf of their own.
+func leafCN(host string) (string, error) {
+	if !validHostname(host) {
+		return "", errors.New("invalid hostname " + host)
+	}
+	secondary, _ := registrable(host)
+	if host == secondary {
+		return secondary, nil
+	}
+	return host[strings.IndexByte(host, '.')+1:], nil
+}
+
+// leafName is leafCN of host and the generation of the suffix list it was
+// derived with, read before so that it's never newer than the list.
+func leafName(host string) (string, uint64, error) {
+	gen := atomic.LoadUint64(&suffixGen)
+	cn, err := leafCN(host)
+	return cn, gen, err
+}
+
+// derivedCN reports whether leafCN gives cn for some name with the current
+// suffix list: cn itself, or a name one label below.
+func derivedCN(cn string) bool {
+	if own, err := leafCN(cn); err == nil && own == cn {
+		return true
+	}
+	below, err := leafCN("x." + cn)
+	return err == nil && below == cn
+}
+
+// retireLeaves drops the leaves cached for cns derived with a suffix list
+// other than that of generation gen, and the cns the list no longer
+// derives from the ones warmed up. Leaves are minted again as they're
+// asked for.
+func retireLeaves(gen uint64) {
+	n := 0
+	cacheCert.Range(func(k, _ interface{}) bool {
+		if k.(leafKey).gen != gen {
+			cacheCert.Delete(k)
+			n++
+		}
+		return true
+	})
+	leafUsed.Range(func(k, _ interface{}) bool {
+		if !derivedCN(k.(string)) {
+			leafUsed.Delete(k)
+		}
+		return true
+	})
+	if n > 0 {
+		metricAdd("leaves_retired_total", int64(n))
+		log.Infof("public suffix list changed, %d cached leaves retired", n)
+	}
+}
+
+// warmCandidates are the cns of rules with the warm option and of the
+// warmRecent most recently used leaves, without the ones already cached,
+// all derived with the suffix list of generation gen.
+func warmCandidates(gen uint64) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	add := func(cn string) {
+		if seen[cn] {
+			return
+		}
+		seen[cn] = true
+		if _, ok := cacheCert.Load(leafKey{cn: cn, gen: gen}); !ok {
+			ret = append(ret, cn)
+		}
+	}
+	for _, v := range currentViews().views {
+		for domain, r := range v.table {
+			if !r.warm || r.block || r.resolveOnly || r.forwarded() {
+				continue
+			}
+			if cn, err := leafCN(domain); err == nil {
+				add(cn)
+			}
+		}
+	}
+
+	type used struct {
+		cn string
+		at time.Time
+	}
+	var recent []used
+	leafUsed.Range(func(k, v interface{}) bool {
+		recent = append(recent, used{k.(string), v.(time.Time)})
+		return true
+	})
+	sort.Slice(recent, func(i, j int) bool { return recent[i].at.After(recent[j].at) })
+	if len(recent) > warmRecent {
+		recent = recent[:warmRecent]
+	}
+	for _, u := range recent {
+		add(u.cn)
+	}
+	return ret
+}
+
+// warmLeaves mints the leaves of warmCandidates in the background with
+// warmWorkers at a time. Called after config and CA reloads; a call while
+// one runs makes it run once more afterwards.
+func warmLeaves() {
+	if !warmUp || !enableTLS {
+		return
+	}
+	warmLock.Lock()
+	if warmCur.Running {
+		warmPending = true
+		warmLock.Unlock()
+		return
+	}
+	warmCur.Running = true
+	warmLock.Unlock()
+
+	go func() {
+		for {
+			runWarm()
+			markReady("warm")
+			warmLock.Lock()
+			if !warmPending {
+				warmCur.Running = false
+				warmLock.Unlock()
+				return
+			}
+			warmPending = false
+			warmLock.Unlock()
+		}
+	}()
+}
+
+func runWarm() {
+	gen := atomic.LoadUint64(&suffixGen)
+	cns := warmCandidates(gen)
+	now := time.Now()
+	warmLock.Lock()
+	warmCur.Total, warmCur.Done, warmCur.Failed, warmCur.Started = int64(len(cns)), 0, 0, &now
+	warmLock.Unlock()
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cn := range work {
+				_, err := cachedLeaf(cn, gen, false, "warm-up")
+				warmLock.Lock()
+				if err != nil {
+					warmCur.Failed++
+				} else {
+					warmCur.Done++
+				}
+				warmLock.Unlock()
+			}
+		}()
+	}
+	for _, cn := range cns {
+		work <- cn
+	}
+	close(work)
+	wg.Wait()
+	metricAdd("leaves_warmed_total", int64(len(cns)))
+	if len(cns) > 0 {
+		log.Infof("warmed %d leaves in %s", len(cns), time.Since(now).Round(time.Millisecond))
+	}
+}
+
+func warmProgress() *warmStatus {
+	if !warmUp {
+		return nil
+	}
+	warmLock.Lock()
+	defer warmLock.Unlock()
+	st := warmCur
+	return &st
+}